@@ -0,0 +1,5 @@
+// Package apiv1 holds the gRPC API served by `pg_container serve`, generated
+// from pg_container.proto.
+package apiv1
+
+//go:generate protoc --proto_path=../.. --go_out=../.. --go_opt=paths=source_relative --go-grpc_out=../.. --go-grpc_opt=paths=source_relative api/v1/pg_container.proto
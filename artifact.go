@@ -0,0 +1,599 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/bgrcs/pg_container/pgcontainer"
+	"github.com/distribution/reference"
+	"github.com/docker/docker/api/types/registry"
+	"github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// dumpArtifactType is the artifact type of the manifests of dumps pushed
+// with promote --attach-dump.
+const dumpArtifactType = "application/vnd.pg-container.dump.v1"
+
+// dumpMediaTypes are the media types of the dump in such a manifest, by
+// format.
+var dumpMediaTypes = map[string]string{
+	pgcontainer.FormatPlain:  "application/vnd.pg-container.dump.sql",
+	pgcontainer.FormatCustom: "application/vnd.pg-container.dump.pgdump",
+}
+
+// manifestMediaTypes are the manifests an image reference may resolve to.
+var manifestMediaTypes = []string{
+	ocispec.MediaTypeImageManifest,
+	ocispec.MediaTypeImageIndex,
+	"application/vnd.docker.distribution.manifest.v2+json",
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+}
+
+// maxManifestSize bounds the manifests read from a registry.
+const maxManifestSize = 4 << 20
+
+// pushDumpArtifact pushes dump as an OCI artifact whose subject is the image
+// ref, already pushed, so registries list it among the referrers of the
+// image. The dump is a blob addressed by its digest: images made from the
+// same dump share it in the repository, and it is uploaded once. It returns
+// the descriptor of the artifact manifest and whether the dump was already
+// in the repository.
+func pushDumpArtifact(ctx context.Context, ref string, auth registry.AuthConfig, dump io.Reader) (ocispec.Descriptor, bool, error) {
+	client, target, err := newRegistryClient(ref, auth, "pull,push")
+	if err != nil {
+		return ocispec.Descriptor{}, false, err
+	}
+
+	spooled, layer, err := spoolDump(dump)
+	if err != nil {
+		return ocispec.Descriptor{}, false, err
+	}
+	defer os.Remove(spooled.Name())
+	defer spooled.Close()
+
+	subject, err := client.resolve(ctx, target)
+	if err != nil {
+		return ocispec.Descriptor{}, false, err
+	}
+
+	if _, err := client.pushBlob(ctx, ocispec.DescriptorEmptyJSON, bytes.NewReader(ocispec.DescriptorEmptyJSON.Data)); err != nil {
+		return ocispec.Descriptor{}, false, err
+	}
+
+	existed, err := client.pushBlob(ctx, layer, spooled)
+	if err != nil {
+		return ocispec.Descriptor{}, false, err
+	}
+
+	annotations := map[string]string{ocispec.AnnotationCreated: time.Now().UTC().Format(time.RFC3339)}
+
+	config := ocispec.DescriptorEmptyJSON
+	config.Data = nil
+
+	manifest, err := json.Marshal(ocispec.Manifest{
+		Versioned:    specs.Versioned{SchemaVersion: 2},
+		MediaType:    ocispec.MediaTypeImageManifest,
+		ArtifactType: dumpArtifactType,
+		Config:       config,
+		Layers:       []ocispec.Descriptor{layer},
+		Subject:      &subject,
+		Annotations:  annotations,
+	})
+	if err != nil {
+		return ocispec.Descriptor{}, false, err
+	}
+
+	artifact := ocispec.Descriptor{
+		MediaType:    ocispec.MediaTypeImageManifest,
+		ArtifactType: dumpArtifactType,
+		Digest:       digest.FromBytes(manifest),
+		Size:         int64(len(manifest)),
+		Annotations:  annotations,
+	}
+
+	subjectIndexed, err := client.pushManifest(ctx, artifact.Digest.String(), artifact.MediaType, manifest)
+	if err != nil {
+		return ocispec.Descriptor{}, false, err
+	}
+
+	// A registry without the referrers API does not index the subject; the
+	// artifact is then listed in the fallback tag named after its digest.
+	if !subjectIndexed {
+		if err := client.addReferrer(ctx, subject.Digest, artifact); err != nil {
+			return ocispec.Descriptor{}, false, err
+		}
+	}
+
+	return artifact, existed, nil
+}
+
+// fetchDumpArtifact opens the dump of the latest artifact pushed for the
+// image ref by pushDumpArtifact, reading it from the registry without
+// pulling the image.
+func fetchDumpArtifact(ctx context.Context, ref string, auth registry.AuthConfig) (io.ReadCloser, error) {
+	client, target, err := newRegistryClient(ref, auth, "pull")
+	if err != nil {
+		return nil, err
+	}
+
+	subject, err := client.resolve(ctx, target)
+	if err != nil {
+		return nil, err
+	}
+
+	referrers, err := client.referrers(ctx, subject.Digest)
+	if err != nil {
+		return nil, err
+	}
+
+	referrers = slices.DeleteFunc(referrers, func(d ocispec.Descriptor) bool {
+		return d.ArtifactType != dumpArtifactType
+	})
+	if len(referrers) == 0 {
+		return nil, fmt.Errorf("No dump is attached to %s; push one with promote --push --attach-dump", ref)
+	}
+
+	latest := slices.MaxFunc(referrers, func(a, b ocispec.Descriptor) int {
+		return strings.Compare(a.Annotations[ocispec.AnnotationCreated], b.Annotations[ocispec.AnnotationCreated])
+	})
+
+	data, _, err := client.fetchManifest(ctx, latest.Digest.String(), ocispec.MediaTypeImageManifest)
+	if err != nil {
+		return nil, err
+	}
+
+	var manifest ocispec.Manifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("Failed to parse the dump manifest %s: %w", latest.Digest, err)
+	}
+	if len(manifest.Layers) != 1 {
+		return nil, fmt.Errorf("The dump manifest %s has %d layers, expected 1", latest.Digest, len(manifest.Layers))
+	}
+
+	return client.fetchBlob(ctx, manifest.Layers[0])
+}
+
+// spoolDump copies dump to a temporary file, which the upload can read again
+// after a retry, and describes it.
+func spoolDump(dump io.Reader) (*os.File, ocispec.Descriptor, error) {
+	file, err := os.CreateTemp("", "pg_container-dump-*")
+	if err != nil {
+		return nil, ocispec.Descriptor{}, err
+	}
+
+	fail := func(err error) (*os.File, ocispec.Descriptor, error) {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, ocispec.Descriptor{}, fmt.Errorf("Failed to read the dump: %w", err)
+	}
+
+	digester := digest.Canonical.Digester()
+	size, err := io.Copy(io.MultiWriter(file, digester.Hash()), dump)
+	if err != nil {
+		return fail(err)
+	}
+
+	header := make([]byte, 5)
+	if _, err := file.ReadAt(header, 0); err != nil && !errors.Is(err, io.EOF) {
+		return fail(err)
+	}
+
+	format := pgcontainer.FormatPlain
+	if string(header) == "PGDMP" {
+		format = pgcontainer.FormatCustom
+	}
+
+	return file, ocispec.Descriptor{
+		MediaType:   dumpMediaTypes[format],
+		Digest:      digester.Digest(),
+		Size:        size,
+		Annotations: map[string]string{ocispec.AnnotationTitle: pgcontainer.DumpFileName(format)},
+	}, nil
+}
+
+// registryClient talks to the distribution API of the registry of one
+// repository, for what the daemon does not do: pushing and fetching
+// artifacts other than images.
+type registryClient struct {
+	base       string
+	repository string
+	auth       registry.AuthConfig
+
+	// actions are those requested for a bearer token, pull or pull,push.
+	actions string
+	token   string
+	basic   bool
+}
+
+// newRegistryClient returns a client for the repository of ref, and the tag
+// or digest ref names.
+func newRegistryClient(ref string, auth registry.AuthConfig, actions string) (*registryClient, string, error) {
+	named, err := reference.ParseNormalizedNamed(ref)
+	if err != nil {
+		return nil, "", fmt.Errorf("Invalid image reference %s: %w", ref, err)
+	}
+	named = reference.TagNameOnly(named)
+
+	var target string
+	if digested, ok := named.(reference.Digested); ok {
+		target = digested.Digest().String()
+	} else if tagged, ok := named.(reference.Tagged); ok {
+		target = tagged.Tag()
+	}
+
+	host := reference.Domain(named)
+	if host == "docker.io" {
+		host = "registry-1.docker.io"
+	}
+
+	// Like the daemon, talk plain HTTP to a registry on the loopback only.
+	scheme := "https"
+	hostname := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		hostname = h
+	}
+	if ip := net.ParseIP(hostname); hostname == "localhost" || (ip != nil && ip.IsLoopback()) {
+		scheme = "http"
+	}
+
+	return &registryClient{
+		base:       scheme + "://" + host,
+		repository: reference.Path(named),
+		auth:       auth,
+		actions:    actions,
+	}, target, nil
+}
+
+func (c *registryClient) url(path string) string {
+	return c.base + "/v2/" + c.repository + path
+}
+
+// do sends a request, authenticating and sending it again when the registry
+// asks for it. body is read from the start on each attempt.
+func (c *registryClient) do(ctx context.Context, method string, target string, header http.Header, body io.ReadSeeker) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		var reader io.Reader
+		var length int64
+		if body != nil {
+			var err error
+			if length, err = body.Seek(0, io.SeekEnd); err != nil {
+				return nil, err
+			}
+			if _, err := body.Seek(0, io.SeekStart); err != nil {
+				return nil, err
+			}
+			// The transport closes a body that is a Closer, which the
+			// next attempt still needs.
+			reader = io.NopCloser(body)
+		}
+
+		req, err := http.NewRequestWithContext(ctx, method, target, reader)
+		if err != nil {
+			return nil, err
+		}
+		req.ContentLength = length
+		for name, values := range header {
+			req.Header[name] = values
+		}
+
+		switch {
+		case c.token != "":
+			req.Header.Set("Authorization", "Bearer "+c.token)
+		case c.basic:
+			req.SetBasicAuth(c.auth.Username, c.auth.Password)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.StatusCode != http.StatusUnauthorized || attempt > 0 {
+			return resp, nil
+		}
+
+		challenge := resp.Header.Get("WWW-Authenticate")
+		resp.Body.Close()
+
+		if err := c.login(ctx, challenge); err != nil {
+			return nil, err
+		}
+	}
+}
+
+var challengeParam = regexp.MustCompile(`(\w+)="([^"]*)"`)
+
+// login answers the authentication challenge of the registry, with basic
+// authentication or a bearer token from the token service it names.
+func (c *registryClient) login(ctx context.Context, challenge string) error {
+	scheme, rest, _ := strings.Cut(challenge, " ")
+
+	switch strings.ToLower(scheme) {
+	case "basic":
+		if c.auth.Username == "" {
+			return fmt.Errorf("%s requires credentials, pass --registry-username and --registry-password", c.base)
+		}
+		c.basic = true
+		return nil
+
+	case "bearer":
+		params := map[string]string{}
+		for _, match := range challengeParam.FindAllStringSubmatch(rest, -1) {
+			params[match[1]] = match[2]
+		}
+
+		query := url.Values{"scope": {"repository:" + c.repository + ":" + c.actions}}
+		if params["service"] != "" {
+			query.Set("service", params["service"])
+		}
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, params["realm"]+"?"+query.Encode(), nil)
+		if err != nil {
+			return fmt.Errorf("Invalid authentication challenge from %s: %w", c.base, err)
+		}
+		if c.auth.Username != "" {
+			req.SetBasicAuth(c.auth.Username, c.auth.Password)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return fmt.Errorf("Failed to authenticate to %s: %w", c.base, err)
+		}
+		defer resp.Body.Close()
+
+		if err := expectStatus(resp, http.StatusOK); err != nil {
+			return fmt.Errorf("Failed to authenticate to %s: %w", c.base, err)
+		}
+
+		var token struct {
+			Token       string `json:"token"`
+			AccessToken string `json:"access_token"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+			return fmt.Errorf("Failed to authenticate to %s: %w", c.base, err)
+		}
+
+		c.token = cmp.Or(token.Token, token.AccessToken)
+		return nil
+	}
+
+	return fmt.Errorf("Unsupported authentication %q requested by %s", scheme, c.base)
+}
+
+// resolve describes the manifest target, a tag or digest, refers to.
+func (c *registryClient) resolve(ctx context.Context, target string) (ocispec.Descriptor, error) {
+	data, mediaType, err := c.fetchManifest(ctx, target, manifestMediaTypes...)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+
+	return ocispec.Descriptor{MediaType: mediaType, Digest: digest.FromBytes(data), Size: int64(len(data))}, nil
+}
+
+func (c *registryClient) fetchManifest(ctx context.Context, target string, mediaTypes ...string) ([]byte, string, error) {
+	resp, err := c.do(ctx, http.MethodGet, c.url("/manifests/"+target), http.Header{"Accept": {strings.Join(mediaTypes, ", ")}}, nil)
+	if err != nil {
+		return nil, "", fmt.Errorf("Failed to fetch the manifest %s:%s: %w", c.repository, target, err)
+	}
+	defer resp.Body.Close()
+
+	if err := expectStatus(resp, http.StatusOK); err != nil {
+		return nil, "", fmt.Errorf("Failed to fetch the manifest %s:%s: %w", c.repository, target, err)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxManifestSize))
+	if err != nil {
+		return nil, "", fmt.Errorf("Failed to fetch the manifest %s:%s: %w", c.repository, target, err)
+	}
+
+	mediaType, _, _ := strings.Cut(resp.Header.Get("Content-Type"), ";")
+
+	return data, mediaType, nil
+}
+
+func (c *registryClient) pushManifest(ctx context.Context, target string, mediaType string, data []byte) (subjectIndexed bool, err error) {
+	resp, err := c.do(ctx, http.MethodPut, c.url("/manifests/"+target), http.Header{"Content-Type": {mediaType}}, bytes.NewReader(data))
+	if err != nil {
+		return false, fmt.Errorf("Failed to push the manifest %s:%s: %w", c.repository, target, err)
+	}
+	defer resp.Body.Close()
+
+	if err := expectStatus(resp, http.StatusCreated); err != nil {
+		return false, fmt.Errorf("Failed to push the manifest %s:%s: %w", c.repository, target, err)
+	}
+
+	return resp.Header.Get("OCI-Subject") != "", nil
+}
+
+// pushBlob uploads content as the blob desc, unless the repository has it
+// already, which it reports.
+func (c *registryClient) pushBlob(ctx context.Context, desc ocispec.Descriptor, content io.ReadSeeker) (bool, error) {
+	resp, err := c.do(ctx, http.MethodHead, c.url("/blobs/"+desc.Digest.String()), nil, nil)
+	if err != nil {
+		return false, fmt.Errorf("Failed to check for the blob %s: %w", desc.Digest, err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK {
+		return true, nil
+	}
+
+	resp, err = c.do(ctx, http.MethodPost, c.url("/blobs/uploads/"), nil, nil)
+	if err != nil {
+		return false, fmt.Errorf("Failed to start the upload of %s: %w", desc.Digest, err)
+	}
+	resp.Body.Close()
+
+	if err := expectStatus(resp, http.StatusAccepted); err != nil {
+		return false, fmt.Errorf("Failed to start the upload of %s: %w", desc.Digest, err)
+	}
+
+	location, err := resp.Request.URL.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		return false, fmt.Errorf("Invalid upload location from %s: %w", c.base, err)
+	}
+	query := location.Query()
+	query.Set("digest", desc.Digest.String())
+	location.RawQuery = query.Encode()
+
+	resp, err = c.do(ctx, http.MethodPut, location.String(), http.Header{"Content-Type": {"application/octet-stream"}}, content)
+	if err != nil {
+		return false, fmt.Errorf("Failed to upload %s: %w", desc.Digest, err)
+	}
+	defer resp.Body.Close()
+
+	if err := expectStatus(resp, http.StatusCreated); err != nil {
+		return false, fmt.Errorf("Failed to upload %s: %w", desc.Digest, err)
+	}
+
+	return false, nil
+}
+
+// fetchBlob streams the blob desc, failing at the end if it does not match
+// its digest.
+func (c *registryClient) fetchBlob(ctx context.Context, desc ocispec.Descriptor) (io.ReadCloser, error) {
+	resp, err := c.do(ctx, http.MethodGet, c.url("/blobs/"+desc.Digest.String()), nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to fetch the blob %s: %w", desc.Digest, err)
+	}
+
+	if err := expectStatus(resp, http.StatusOK); err != nil {
+		resp.Body.Close()
+		return nil, fmt.Errorf("Failed to fetch the blob %s: %w", desc.Digest, err)
+	}
+
+	return &verifiedBlob{ReadCloser: resp.Body, verifier: desc.Digest.Verifier(), expected: desc.Digest}, nil
+}
+
+// referrers lists the manifests whose subject is the manifest with digest
+// subject, from the referrers API or else its fallback tag.
+func (c *registryClient) referrers(ctx context.Context, subject digest.Digest) ([]ocispec.Descriptor, error) {
+	resp, err := c.do(ctx, http.MethodGet, c.url("/referrers/"+subject.String()), http.Header{"Accept": {ocispec.MediaTypeImageIndex}}, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to list the referrers of %s: %w", subject, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		index, err := c.referrersTag(ctx, subject)
+		return index.Manifests, err
+	}
+
+	if err := expectStatus(resp, http.StatusOK); err != nil {
+		return nil, fmt.Errorf("Failed to list the referrers of %s: %w", subject, err)
+	}
+
+	var index ocispec.Index
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxManifestSize)).Decode(&index); err != nil {
+		return nil, fmt.Errorf("Failed to list the referrers of %s: %w", subject, err)
+	}
+
+	return index.Manifests, nil
+}
+
+// referrersTag is the index of the fallback tag listing the referrers of
+// subject, empty when there is none.
+func (c *registryClient) referrersTag(ctx context.Context, subject digest.Digest) (ocispec.Index, error) {
+	index := ocispec.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageIndex,
+		Manifests: []ocispec.Descriptor{},
+	}
+
+	resp, err := c.do(ctx, http.MethodGet, c.url("/manifests/"+referrersTagName(subject)), http.Header{"Accept": {ocispec.MediaTypeImageIndex}}, nil)
+	if err != nil {
+		return index, fmt.Errorf("Failed to list the referrers of %s: %w", subject, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return index, nil
+	}
+
+	if err := expectStatus(resp, http.StatusOK); err != nil {
+		return index, fmt.Errorf("Failed to list the referrers of %s: %w", subject, err)
+	}
+
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxManifestSize)).Decode(&index); err != nil {
+		return index, fmt.Errorf("Failed to list the referrers of %s: %w", subject, err)
+	}
+
+	return index, nil
+}
+
+// addReferrer adds artifact to the fallback tag listing the referrers of
+// subject.
+func (c *registryClient) addReferrer(ctx context.Context, subject digest.Digest, artifact ocispec.Descriptor) error {
+	index, err := c.referrersTag(ctx, subject)
+	if err != nil {
+		return err
+	}
+
+	if slices.ContainsFunc(index.Manifests, func(d ocispec.Descriptor) bool { return d.Digest == artifact.Digest }) {
+		return nil
+	}
+	index.Manifests = append(index.Manifests, artifact)
+
+	data, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.pushManifest(ctx, referrersTagName(subject), ocispec.MediaTypeImageIndex, data)
+	return err
+}
+
+// referrersTagName is the fallback tag of the referrers of subject, as
+// defined by the distribution spec: sha256-<hex>.
+func referrersTagName(subject digest.Digest) string {
+	return subject.Algorithm().String() + "-" + subject.Encoded()
+}
+
+// expectStatus fails unless resp has one of statuses, with what the registry
+// said about it.
+func expectStatus(resp *http.Response, statuses ...int) error {
+	if slices.Contains(statuses, resp.StatusCode) {
+		return nil
+	}
+
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if message := strings.TrimSpace(string(body)); message != "" {
+		return fmt.Errorf("unexpected response %s: %s", resp.Status, message)
+	}
+
+	return fmt.Errorf("unexpected response %s", resp.Status)
+}
+
+// verifiedBlob fails the read at the end of a blob that does not match its
+// digest.
+type verifiedBlob struct {
+	io.ReadCloser
+	verifier digest.Verifier
+	expected digest.Digest
+}
+
+func (b *verifiedBlob) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.verifier.Write(p[:n])
+
+	if errors.Is(err, io.EOF) && !b.verifier.Verified() {
+		return n, fmt.Errorf("The blob %s does not match its digest", b.expected)
+	}
+
+	return n, err
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/stdcopy"
+	cli "github.com/urfave/cli/v3"
+)
+
+// Tools of --from-backrest and --from-walg.
+const (
+	backupToolBackrest = "pgbackrest"
+	backupToolWalg     = "wal-g"
+)
+
+// walgVersion is the WAL-G release installed in the helper containers, the
+// official postgres images shipping pgBackRest's packages but not WAL-G.
+const walgVersion = "v3.0.5"
+
+// backupRepository is where --from-backrest and --from-walg restore from.
+type backupRepository struct {
+	Tool string
+
+	// Config is the content of the config file of the tool, which is passed
+	// to the helper containers on stdin and removed before the commit.
+	Config []byte
+
+	// Stanza is the pgBackRest stanza, found in the repository when empty.
+	Stanza string
+}
+
+func (r *backupRepository) String() string {
+	if r.Tool == backupToolBackrest {
+		return "pgBackRest stanza " + cmp.Or(r.Stanza, "(the only one in the repository)")
+	}
+	return "WAL-G"
+}
+
+// parseBackupRepository reads --from-backrest or --from-walg, nil when
+// neither is given. Both copy the cluster like --physical, so they reject the
+// same flags.
+func parseBackupRepository(cmd *cli.Command) (*backupRepository, error) {
+	backrest, walg := cmd.String("from-backrest"), cmd.String("from-walg")
+
+	if backrest == "" && walg == "" {
+		if cmd.IsSet("stanza") {
+			return nil, fmt.Errorf("--stanza needs --from-backrest")
+		}
+		return nil, nil
+	}
+
+	if backrest != "" && walg != "" {
+		return nil, fmt.Errorf("--from-backrest and --from-walg cannot be used together")
+	}
+
+	flag, repository := "--from-backrest", &backupRepository{Tool: backupToolBackrest, Stanza: cmd.String("stanza")}
+	path := backrest
+	if walg != "" {
+		if cmd.IsSet("stanza") {
+			return nil, fmt.Errorf("--stanza needs --from-backrest")
+		}
+		flag, repository = "--from-walg", &backupRepository{Tool: backupToolWalg}
+		path = walg
+	}
+
+	if cmd.Bool("physical") {
+		return nil, fmt.Errorf("%s cannot be used with --physical", flag)
+	}
+
+	for _, name := range physicalConflicts {
+		if cmd.IsSet(name) {
+			return nil, fmt.Errorf("--%s cannot be used with %s, which restores a copy of the data directory instead of a dump", name, flag)
+		}
+	}
+
+	if cmd.IsSet("max-rate") {
+		return nil, fmt.Errorf("--max-rate cannot be used with %s, which reads the backup repository rather than the source", flag)
+	}
+
+	if cmd.String("runtime") != runtimeDocker {
+		return nil, fmt.Errorf("%s needs --runtime %s", flag, runtimeDocker)
+	}
+
+	var err error
+	repository.Config, err = os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read the %s config: %w", repository.Tool, err)
+	}
+
+	return repository, nil
+}
+
+// installScript installs the tool in an official postgres image, with its
+// output on stderr so stdout is left to the tool itself, and writes the config
+// read from stdin to where the commands of restoreScript look for it.
+func (r *backupRepository) installScript() string {
+	if r.Tool == backupToolBackrest {
+		return `set -e
+mkdir -p /etc/pgbackrest
+cat > /etc/pgbackrest/pgbackrest.conf
+chown postgres:postgres /etc/pgbackrest/pgbackrest.conf
+chmod 600 /etc/pgbackrest/pgbackrest.conf
+apt-get update >&2
+apt-get install -y --no-install-recommends pgbackrest >&2
+`
+	}
+
+	return `set -e
+mkdir -p /etc/wal-g
+cat > /etc/wal-g/config.json
+chown postgres:postgres /etc/wal-g/config.json
+chmod 600 /etc/wal-g/config.json
+apt-get update >&2
+apt-get install -y --no-install-recommends ca-certificates curl >&2
+arch=$(uname -m)
+[ "$arch" = x86_64 ] && arch=amd64
+mkdir -p /tmp/wal-g
+curl -fsSL "https://github.com/wal-g/wal-g/releases/download/` + walgVersion + `/wal-g-pg-ubuntu-20.04-$arch.tar.gz" | tar -xz -C /tmp/wal-g
+install /tmp/wal-g/wal-g* /usr/local/bin/wal-g
+rm -rf /tmp/wal-g
+`
+}
+
+// infoScript prints the backups in the repository as JSON.
+func (r *backupRepository) infoScript() string {
+	if r.Tool == backupToolBackrest {
+		return r.installScript() + `gosu postgres pgbackrest --log-level-file=off --log-level-console=warn info --output=json
+`
+	}
+
+	return r.installScript() + `gosu postgres wal-g --config /etc/wal-g/config.json backup-list --detail --json
+`
+}
+
+// restoreScript restores the latest backup into /data and recovers it up to
+// the end of that backup, fetching the WAL it needs from the repository,
+// before the config goes away with the rest of the tool's state.
+func (r *backupRepository) restoreScript(stanza string) string {
+	var restore string
+
+	if r.Tool == backupToolBackrest {
+		restore = `gosu postgres pgbackrest --stanza="$STANZA" --pg1-path=/data --log-level-file=off --log-level-console=info \
+	--type=immediate --target-action=promote \
+	--recovery-option="restore_command=pgbackrest --stanza=$STANZA --pg1-path=/data --log-level-file=off archive-get %f \"%p\"" \
+	restore
+`
+	} else {
+		restore = `gosu postgres wal-g --config /etc/wal-g/config.json backup-fetch /data LATEST
+case "$PG_MAJOR" in
+9.*|10|11) recovery=/data/recovery.conf ;;
+*) recovery=/data/postgresql.auto.conf; gosu postgres touch /data/recovery.signal ;;
+esac
+printf "restore_command = 'wal-g --config /etc/wal-g/config.json wal-fetch \"%%f\" \"%%p\"'\nrecovery_target = 'immediate'\nrecovery_target_action = 'promote'\n" >> "$recovery"
+chown postgres:postgres "$recovery"
+`
+	}
+
+	return "STANZA=" + shellQuote(stanza) + "\n" + r.installScript() + `mkdir -p /data
+chown postgres:postgres /data
+chmod 700 /data
+` + restore + standaloneScript + `rm -rf /etc/pgbackrest /etc/wal-g /tmp/pgbackrest
+`
+}
+
+// restoreBackup restores the latest backup of the repository into a helper
+// container, as takeBasebackup copies the live cluster. The source is never
+// connected to: the major version comes from the repository, read by a first
+// helper, and the WAL for the recovery from its archive. The repository must
+// be reachable from a container on the host network, as an object store or
+// over SFTP; a repository on a local path is not mounted in.
+func restoreBackup(ctx context.Context, apiClient *client.Client, repository *backupRepository, options backupOptions) (*basebackup, error) {
+	if err := pullImage(ctx, apiClient, "postgres"); err != nil {
+		return nil, err
+	}
+
+	logger.Info("🔎 Looking up the latest backup", "repository", repository.String())
+
+	probe, err := runClusterHelper(ctx, apiClient, "postgres", repository.Tool, repository.infoScript(), string(repository.Config), options)
+	if err != nil {
+		return nil, connectionError(fmt.Errorf("Failed to read the backup repository: %w", err))
+	}
+
+	info, err := helperStdout(ctx, apiClient, probe.ID)
+	probe.Remove()
+	if err != nil {
+		return nil, err
+	}
+
+	stanza, version, err := latestBackup(repository, info)
+	if err != nil {
+		return nil, err
+	}
+
+	baseImage := basebackupImage(version)
+	if err := pullImage(ctx, apiClient, baseImage); err != nil {
+		return nil, err
+	}
+
+	logger.Info("📦 Restoring the latest backup", "tool", repository.Tool, "image", baseImage)
+
+	return runClusterHelper(ctx, apiClient, baseImage, repository.Tool, repository.restoreScript(stanza), string(repository.Config), options)
+}
+
+// helperStdout returns what a stopped helper container printed on stdout.
+func helperStdout(ctx context.Context, apiClient *client.Client, containerID string) ([]byte, error) {
+	reader, err := apiClient.ContainerLogs(ctx, containerID, container.LogsOptions{ShowStdout: true})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read the output of the helper container: %w", err)
+	}
+	defer reader.Close()
+
+	var stdout, stderr bytes.Buffer
+	if _, err := stdcopy.StdCopy(&stdout, &stderr, reader); err != nil {
+		return nil, fmt.Errorf("Failed to read the output of the helper container: %w", err)
+	}
+
+	return stdout.Bytes(), nil
+}
+
+// latestBackup returns the stanza and the server_version_num of the latest
+// backup listed in info.
+func latestBackup(repository *backupRepository, info []byte) (string, int, error) {
+	if repository.Tool == backupToolWalg {
+		var backups []struct {
+			Name      string `json:"backup_name"`
+			PgVersion int    `json:"pg_version"`
+		}
+		if err := json.Unmarshal(info, &backups); err != nil {
+			return "", 0, fmt.Errorf("Failed to parse the WAL-G backup list: %w", err)
+		}
+		if len(backups) == 0 {
+			return "", 0, fmt.Errorf("No backups in the WAL-G repository")
+		}
+
+		latest := backups[len(backups)-1]
+		logger.Debug("Latest WAL-G backup", "backup", latest.Name, "pg_version", latest.PgVersion)
+
+		return "", latest.PgVersion, nil
+	}
+
+	var stanzas []struct {
+		Name string `json:"name"`
+		DB   []struct {
+			ID      int    `json:"id"`
+			Version string `json:"version"`
+		} `json:"db"`
+		Backup []struct {
+			Label    string `json:"label"`
+			Database struct {
+				ID int `json:"id"`
+			} `json:"database"`
+		} `json:"backup"`
+	}
+	if err := json.Unmarshal(info, &stanzas); err != nil {
+		return "", 0, fmt.Errorf("Failed to parse the pgBackRest info: %w", err)
+	}
+
+	var names []string
+	for _, stanza := range stanzas {
+		names = append(names, stanza.Name)
+	}
+
+	if repository.Stanza == "" && len(stanzas) != 1 {
+		return "", 0, fmt.Errorf("The pgBackRest repository has stanzas %s; pick one with --stanza", strings.Join(names, ", "))
+	}
+
+	for _, stanza := range stanzas {
+		if repository.Stanza != "" && stanza.Name != repository.Stanza {
+			continue
+		}
+
+		if len(stanza.Backup) == 0 {
+			return "", 0, fmt.Errorf("No backups in pgBackRest stanza %s", stanza.Name)
+		}
+
+		latest := stanza.Backup[len(stanza.Backup)-1]
+		for _, db := range stanza.DB {
+			if db.ID != latest.Database.ID {
+				continue
+			}
+
+			logger.Debug("Latest pgBackRest backup", "stanza", stanza.Name, "backup", latest.Label, "version", db.Version)
+
+			major, minor, _ := strings.Cut(db.Version, ".")
+			majorNum, err := strconv.Atoi(major)
+			if err != nil {
+				return "", 0, fmt.Errorf("Unexpected PostgreSQL version %q in pgBackRest stanza %s", db.Version, stanza.Name)
+			}
+			minorNum, _ := strconv.Atoi(minor)
+
+			if majorNum >= 10 {
+				return stanza.Name, majorNum * 10000, nil
+			}
+			return stanza.Name, majorNum*10000 + minorNum*100, nil
+		}
+
+		return "", 0, fmt.Errorf("pgBackRest stanza %s lists no database for backup %s", stanza.Name, latest.Label)
+	}
+
+	return "", 0, fmt.Errorf("No stanza %s in the pgBackRest repository, which has %s", repository.Stanza, strings.Join(names, ", "))
+}
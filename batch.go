@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+
+	"github.com/docker/go-units"
+	"golang.org/x/sync/errgroup"
+)
+
+// backupAll snapshots each database, options.BatchJobs of them at a time and
+// otherwise in turn. By default the first failure stops the batch, letting
+// the runs in progress finish; with keepGoing the remaining databases are
+// still processed. Either way a summary table follows a batch of more than
+// one, and the batch fails if any database did.
+func backupAll(ctx context.Context, connectionURLs []string, options backupOptions, keepGoing bool) error {
+	if len(connectionURLs) == 1 {
+		_, err := processBackup(ctx, connectionURLs[0], options)
+		return err
+	}
+
+	records := make([]*runRecord, len(connectionURLs))
+	errs := make([]error, len(connectionURLs))
+	var stopped atomic.Bool
+
+	var group errgroup.Group
+	group.SetLimit(max(options.BatchJobs, 1))
+
+	for i, connectionURL := range connectionURLs {
+		if stopped.Load() {
+			break
+		}
+
+		group.Go(func() error {
+			// A run may have failed while this one waited for its turn.
+			if stopped.Load() {
+				return nil
+			}
+
+			logger.Info(fmt.Sprintf("> Database %d of %d", i+1, len(connectionURLs)), "url", redactURL(connectionURL))
+
+			run, err := processBackup(ctx, connectionURL, options)
+			records[i], errs[i] = run, err
+
+			if err != nil {
+				if !keepGoing || ctx.Err() != nil {
+					stopped.Store(true)
+					return nil
+				}
+
+				logger.Error(err.Error(), "database", run.Database)
+			}
+			return nil
+		})
+	}
+	group.Wait()
+
+	var runs []*runRecord
+	var firstErr error
+	failed := 0
+
+	for i, run := range records {
+		if run == nil {
+			continue
+		}
+		runs = append(runs, run)
+
+		if errs[i] != nil {
+			failed++
+			if firstErr == nil {
+				firstErr = errs[i]
+			}
+		}
+	}
+
+	if !options.JSONOutput && !quiet() {
+		printBatchSummary(runs, len(connectionURLs))
+	}
+
+	if failed == 0 {
+		return nil
+	}
+
+	if !keepGoing {
+		return firstErr
+	}
+
+	// The exit code is that of the first failure, so a batch fails the same
+	// way its first failing run would have on its own.
+	return &phaseError{
+		code: exitCode(firstErr),
+		err:  fmt.Errorf("%d of %d databases failed", failed, len(connectionURLs)),
+	}
+}
+
+// shareJobs divides the --jobs of a run between the databases it snapshots:
+// up to that many run at a time, and each dumps and restores with an equal
+// share, which the dump and then the restore use in turn. Without --jobs the
+// databases run one at a time with their own --dump-jobs and --restore-jobs.
+func shareJobs(options backupOptions, databases int) backupOptions {
+	if options.Jobs == 0 {
+		return options
+	}
+
+	options.BatchJobs = min(options.Jobs, databases)
+	share := max(options.Jobs/options.BatchJobs, 1)
+	options.DumpJobs, options.RestoreJobs = share, share
+
+	return options
+}
+
+// batchOptions adjusts the options for a batch of several databases, whose
+// containers cannot share a name, a port or a .env file.
+func batchOptions(options backupOptions, portSet bool) (backupOptions, error) {
+	if options.ContainerName != "" {
+		return options, fmt.Errorf("--name cannot be used with several databases")
+	}
+
+	if options.Dotenv != "" {
+		return options, fmt.Errorf("--dotenv cannot be used with several databases")
+	}
+
+	if options.ImageName != "" {
+		return options, fmt.Errorf("--image-name cannot be used with several databases")
+	}
+
+	if options.CreateContainer {
+		if !portSet {
+			options.HostPort = autoPort
+		} else if options.HostPort != autoPort && !options.PortFallback {
+			return options, fmt.Errorf("--port %s cannot be shared by several databases; use --port auto or --port-fallback", options.HostPort)
+		}
+	}
+
+	return options, nil
+}
+
+func printBatchSummary(runs []*runRecord, total int) {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+
+	fmt.Fprintln(tw, "DATABASE\tRESULT\tIMAGE\tDUMP\tDURATION\tERROR")
+
+	for _, run := range runs {
+		// Only the first line of the error fits the table; the full message
+		// was logged when the run failed.
+		message, _, _ := strings.Cut(run.Error, "\n")
+
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n",
+			run.Database,
+			run.Result,
+			run.Image,
+			units.HumanSize(float64(run.DumpSize)),
+			run.duration().Round(time.Second),
+			message,
+		)
+	}
+
+	if skipped := total - len(runs); skipped > 0 {
+		fmt.Fprintf(tw, "(%d more skipped after the failure; pass --keep-going to continue past failures)\n", skipped)
+	}
+
+	tw.Flush()
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"text/tabwriter"
+	"time"
+
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/api/types/registry"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/jsonmessage"
+	"github.com/docker/go-units"
+	cli "github.com/urfave/cli/v3"
+)
+
+var benchCommand = &cli.Command{
+	Name:          "bench",
+	Usage:         "Measure how fast snapshot images are pulled and start accepting connections",
+	ShellComplete: completeImages(0),
+	UsageText: `pg_container bench [image...] [--runs n] [--pull]
+
+Starts a throwaway container from each image --runs times and reports the
+time until it accepts connections, with the minimum, median and maximum over
+the runs. The restore ran when the image was built; its duration is taken
+from the history of the run that built it, when there is one.
+
+With --pull the local copy of the image is removed before each run and
+pulled again, reporting the time the pull took and the bytes downloaded.
+The image has to be in a registry for that, e.g. pushed with promote --push.
+
+With --output json the runs are printed as a JSON document instead.
+
+Example:
+	pg_container bench db-2025-01-18-1200:latest db-custom-2025-01-18-1300:latest --runs 10`,
+	Flags: []cli.Flag{
+		&cli.IntFlag{
+			Name:  "runs",
+			Usage: "Containers started from each image",
+			Value: 5,
+		},
+		&cli.BoolFlag{
+			Name:  "pull",
+			Usage: "Remove the local copy of the image and pull it again before each run",
+		},
+		&cli.StringFlag{
+			Name:    "registry-username",
+			Usage:   "Username used to authenticate the pull",
+			Sources: cli.EnvVars("PG_CONTAINER_REGISTRY_USERNAME"),
+		},
+		&cli.StringFlag{
+			Name:    "registry-password",
+			Usage:   "Password used to authenticate the pull",
+			Sources: cli.EnvVars("PG_CONTAINER_REGISTRY_PASSWORD"),
+		},
+		&cli.DurationFlag{
+			Name:  "start-timeout",
+			Usage: "How long to wait for each container to accept connections",
+			Value: defaultStartTimeout,
+		},
+	},
+	Action: func(ctx context.Context, cmd *cli.Command) error {
+		if cmd.NArg() == 0 {
+			return cli.ShowSubcommandHelp(cmd)
+		}
+
+		runs := int(cmd.Int("runs"))
+		if runs < 1 {
+			return fmt.Errorf("Invalid --runs %d: expected at least 1", runs)
+		}
+
+		apiClient, err := newDockerClient(ctx)
+		if err != nil {
+			return err
+		}
+		defer apiClient.Close()
+
+		var encodedAuth string
+		if cmd.Bool("pull") {
+			encodedAuth, err = registry.EncodeAuthConfig(registry.AuthConfig{
+				Username: cmd.String("registry-username"),
+				Password: cmd.String("registry-password"),
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		var results []*benchResult
+		for _, imageName := range cmd.Args().Slice() {
+			result, err := benchImage(ctx, apiClient, imageName, runs, cmd.Bool("pull"), encodedAuth, cmd.Duration("start-timeout"))
+			if err != nil {
+				return err
+			}
+			results = append(results, result)
+		}
+
+		if cmd.String("output") == "json" {
+			encoder := json.NewEncoder(os.Stdout)
+			encoder.SetIndent("", "  ")
+			return encoder.Encode(results)
+		}
+
+		printBenchResults(results)
+
+		return nil
+	},
+}
+
+// benchResult holds the measurements of one image.
+type benchResult struct {
+	Image     string        `json:"image"`
+	ImageSize int64         `json:"image_size"`
+	Restore   time.Duration `json:"restore,omitempty"`
+	Runs      []benchRun    `json:"runs"`
+}
+
+// benchRun is a single container started by bench, after a pull with --pull.
+type benchRun struct {
+	Pull       time.Duration `json:"pull,omitempty"`
+	Downloaded int64         `json:"downloaded,omitempty"`
+	Ready      time.Duration `json:"ready"`
+}
+
+func benchImage(ctx context.Context, apiClient *client.Client, imageName string, runs int, pull bool, encodedAuth string, timeout time.Duration) (*benchResult, error) {
+	if pull {
+		// Check before removing anything that the image can be pulled back.
+		if _, err := apiClient.DistributionInspect(ctx, imageName, encodedAuth); err != nil {
+			return nil, fmt.Errorf("--pull needs %s in a registry it can be pulled from: %w", imageName, err)
+		}
+	}
+
+	result := &benchResult{Image: imageName, Restore: restoreDuration(imageName)}
+
+	logger.Info("> ⏱️  Benchmarking "+imageName, "runs", runs)
+
+	for i := range runs {
+		var run benchRun
+
+		if pull {
+			if _, err := apiClient.ImageRemove(ctx, imageName, image.RemoveOptions{PruneChildren: true}); err != nil && !client.IsErrNotFound(err) {
+				return nil, fmt.Errorf("Failed to remove %s before pulling it: %w", imageName, err)
+			}
+
+			start := time.Now()
+			downloaded, err := pullImageMeasured(ctx, apiClient, imageName, encodedAuth)
+			if err != nil {
+				return nil, err
+			}
+			run.Pull = time.Since(start)
+			run.Downloaded = downloaded
+		}
+
+		start := time.Now()
+		snapshotContainer, err := startEphemeralContainer(ctx, apiClient, imageName, timeout)
+		if err != nil {
+			return nil, err
+		}
+		run.Ready = time.Since(start)
+
+		if err := snapshotContainer.Remove(); err != nil {
+			logger.Warn("Failed to remove the benchmark container", "container", snapshotContainer.ID[:12], "error", err)
+		}
+
+		logger.Info(fmt.Sprintf("Run %d/%d: ready after %s", i+1, runs, run.Ready.Round(time.Millisecond)))
+		result.Runs = append(result.Runs, run)
+	}
+
+	if inspect, _, err := apiClient.ImageInspectWithRaw(ctx, imageName); err == nil {
+		result.ImageSize = inspect.Size
+	}
+
+	return result, nil
+}
+
+// pullImageMeasured pulls ref and returns the bytes downloaded, the sum of
+// the compressed sizes of the layers that were not present already.
+func pullImageMeasured(ctx context.Context, apiClient *client.Client, ref string, encodedAuth string) (int64, error) {
+	reader, err := apiClient.ImagePull(ctx, ref, image.PullOptions{RegistryAuth: encodedAuth})
+	if err != nil {
+		return 0, fmt.Errorf("Failed to pull %s: %w", ref, err)
+	}
+	defer reader.Close()
+
+	layers := map[string]int64{}
+
+	decoder := json.NewDecoder(reader)
+	for {
+		var message jsonmessage.JSONMessage
+		if err := decoder.Decode(&message); errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return 0, fmt.Errorf("Failed to pull %s: %w", ref, err)
+		}
+
+		if message.Error != nil {
+			return 0, fmt.Errorf("Failed to pull %s: %w", ref, message.Error)
+		}
+
+		if message.Status == "Downloading" && message.Progress != nil {
+			layers[message.ID] = max(layers[message.ID], message.Progress.Total)
+		}
+	}
+
+	var downloaded int64
+	for _, size := range layers {
+		downloaded += size
+	}
+
+	return downloaded, nil
+}
+
+// restoreDuration is how long the build of imageName took according to the
+// history, which for a logical snapshot is mostly the restore, or 0 when the
+// image was not built here.
+func restoreDuration(imageName string) time.Duration {
+	records, err := readHistory()
+	if err != nil {
+		return 0
+	}
+
+	for _, r := range slices.Backward(records) {
+		if r.Image != imageName || r.Result != "success" {
+			continue
+		}
+
+		for _, phase := range r.Phases {
+			if phase.Name == "build" {
+				return phase.Duration
+			}
+		}
+	}
+
+	return 0
+}
+
+func printBenchResults(results []*benchResult) {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "IMAGE\tSIZE\tRESTORE\tPULL (MIN/MEDIAN/MAX)\tDOWNLOADED\tREADY (MIN/MEDIAN/MAX)")
+
+	for _, result := range results {
+		restore := "-"
+		if result.Restore > 0 {
+			restore = result.Restore.Round(time.Second).String()
+		}
+
+		var pulls, readies []time.Duration
+		var downloaded int64
+		for _, run := range result.Runs {
+			pulls = append(pulls, run.Pull)
+			readies = append(readies, run.Ready)
+			downloaded = max(downloaded, run.Downloaded)
+		}
+
+		pull, download := "-", "-"
+		if downloaded > 0 {
+			pull = durationSpread(pulls)
+			download = units.HumanSize(float64(downloaded))
+		}
+
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n",
+			result.Image,
+			units.HumanSize(float64(result.ImageSize)),
+			restore,
+			pull,
+			download,
+			durationSpread(readies),
+		)
+	}
+
+	tw.Flush()
+}
+
+// durationSpread formats the minimum, median and maximum of durations.
+func durationSpread(durations []time.Duration) string {
+	sorted := slices.Clone(durations)
+	slices.Sort(sorted)
+
+	round := func(d time.Duration) string {
+		return d.Round(10 * time.Millisecond).String()
+	}
+
+	return round(sorted[0]) + " / " + round(sorted[len(sorted)/2]) + " / " + round(sorted[len(sorted)-1])
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	ciGitHub = "github"
+	ciGitLab = "gitlab"
+)
+
+// ciReporter adapts a run's output to the CI system given with --ci. Section
+// markers go to stderr along with the progress output; both runners pick them
+// up from either stream.
+type ciReporter struct {
+	provider string
+	// dotenv is the dotenv artifact GitLab jobs pass their results in.
+	dotenv    string
+	openPhase string
+}
+
+func validateCI(provider string) error {
+	switch provider {
+	case "", ciGitHub, ciGitLab:
+		return nil
+	default:
+		return fmt.Errorf("Invalid --ci %q: expected %s or %s", provider, ciGitHub, ciGitLab)
+	}
+}
+
+// startPhase folds the output of a phase into a collapsible section.
+func (c *ciReporter) startPhase(name string) {
+	if c == nil {
+		return
+	}
+
+	c.endPhase()
+
+	switch c.provider {
+	case ciGitHub:
+		fmt.Fprintf(os.Stderr, "::group::%s\n", name)
+	case ciGitLab:
+		fmt.Fprintf(os.Stderr, "\x1b[0Ksection_start:%d:%s[collapsed=true]\r\x1b[0K%s\n", time.Now().Unix(), gitLabSection(name), name)
+	default:
+		return
+	}
+
+	c.openPhase = name
+}
+
+func (c *ciReporter) endPhase() {
+	if c == nil || c.openPhase == "" {
+		return
+	}
+
+	switch c.provider {
+	case ciGitHub:
+		fmt.Fprintln(os.Stderr, "::endgroup::")
+	case ciGitLab:
+		fmt.Fprintf(os.Stderr, "\x1b[0Ksection_end:%d:%s\r\x1b[0K\n", time.Now().Unix(), gitLabSection(c.openPhase))
+	}
+
+	c.openPhase = ""
+}
+
+// fail closes the open section and, on GitHub, annotates the job with the
+// error the run failed with.
+func (c *ciReporter) fail(err error) {
+	if c == nil {
+		return
+	}
+
+	c.endPhase()
+
+	if c.provider == ciGitHub {
+		fmt.Fprintf(os.Stderr, "::error title=pg_container::%s\n", escapeWorkflowCommand(err.Error()))
+	}
+}
+
+// publish hands the results of a successful run to later steps or jobs.
+func (c *ciReporter) publish(run *runRecord) error {
+	if c == nil {
+		return nil
+	}
+
+	switch c.provider {
+	case ciGitHub:
+		return publishGitHubOutputs(run)
+	case ciGitLab:
+		return publishGitLabDotenv(c.dotenv, run)
+	}
+
+	return nil
+}
+
+func publishGitHubOutputs(run *runRecord) error {
+	path := os.Getenv("GITHUB_OUTPUT")
+	if path == "" {
+		logger.Warn("GITHUB_OUTPUT is not set, so the step outputs are not written")
+		return nil
+	}
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("Failed to open GITHUB_OUTPUT: %w", err)
+	}
+	defer f.Close()
+
+	for _, output := range ciOutputs(run) {
+		if _, err := fmt.Fprintf(f, "%s=%s\n", output.name, output.value); err != nil {
+			return fmt.Errorf("Failed to write GITHUB_OUTPUT: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// publishGitLabDotenv writes the results for artifacts:reports:dotenv, which
+// makes them variables of the jobs that need this one.
+func publishGitLabDotenv(path string, run *runRecord) error {
+	for _, output := range ciOutputs(run) {
+		if err := writeDotenv(path, output.variable, output.value); err != nil {
+			return err
+		}
+	}
+
+	logger.Info("📝 Wrote the results for downstream jobs", "file", path)
+
+	return nil
+}
+
+type ciOutput struct {
+	// name is the GitHub step output, variable the GitLab dotenv variable.
+	name     string
+	variable string
+	value    string
+}
+
+// ciOutputs are the results passed on to later CI steps; values that do not
+// apply to the run are left out.
+func ciOutputs(run *runRecord) []ciOutput {
+	var outputs []ciOutput
+
+	for _, output := range []ciOutput{
+		{"image", "IMAGE_TAG", run.Image},
+		{"digest", "IMAGE_DIGEST", run.ImageID},
+		{"container", "CONTAINER_NAME", run.Container},
+		{"connection_url", "DATABASE_URL", run.ConnectionURL},
+	} {
+		if output.value != "" {
+			outputs = append(outputs, output)
+		}
+	}
+
+	return outputs
+}
+
+func escapeWorkflowCommand(s string) string {
+	return strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A").Replace(s)
+}
+
+// gitLabSection makes a phase name usable as a section name, which only
+// allows letters, digits, dots, dashes and underscores.
+func gitLabSection(name string) string {
+	return "pg_container_" + strings.ReplaceAll(name, " ", "_")
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	citusFail    = "fail"
+	citusFlatten = "flatten"
+)
+
+// citusExtensions are left out of a flattened dump: neither they nor the
+// columnar access method can be created on the postgres image.
+var citusExtensions = []string{"citus", "citus_columnar"}
+
+// citusSource describes the Citus installation of a source database.
+type citusSource struct {
+	DistributedTables int
+	ReferenceTables   int
+}
+
+// checkCitus looks for Citus in the source database before anything is
+// dumped. A dump of a Citus coordinator creates the extension and records
+// the shards of its workers, so it fails to restore on a single node. With
+// --citus fail, the default, the run stops and explains how to go on; with
+// --citus flatten the dump leaves the extensions out and the distributed and
+// reference tables restore as regular tables, their rows read through the
+// coordinator. It returns nil when the source has no Citus.
+func checkCitus(ctx context.Context, connectionURL string, options backupOptions) (*citusSource, error) {
+	if options.FromBackup != nil {
+		return nil, nil
+	}
+
+	conn, err := pgx.Connect(ctx, connectionURL)
+	if err != nil {
+		return nil, connectionError(fmt.Errorf("Failed to connect to the source database: %w", err))
+	}
+	defer conn.Close(ctx)
+
+	var installed bool
+	if err := conn.QueryRow(ctx, "SELECT EXISTS (SELECT FROM pg_extension WHERE extname = 'citus')").Scan(&installed); err != nil {
+		return nil, fmt.Errorf("Failed to look for Citus in the source database: %w", err)
+	}
+	if !installed {
+		return nil, nil
+	}
+
+	var source citusSource
+	err = conn.QueryRow(ctx, `
+		SELECT count(*) FILTER (WHERE partmethod <> 'n'),
+		       count(*) FILTER (WHERE partmethod = 'n' AND repmodel = 't')
+		FROM pg_dist_partition`).Scan(&source.DistributedTables, &source.ReferenceTables)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to list the Citus tables of the source database: %w", err)
+	}
+
+	if options.Physical {
+		return nil, fmt.Errorf("The source is a Citus coordinator with %s; a --physical copy holds none of the rows on the workers. Take a logical snapshot with --citus %s instead",
+			source, citusFlatten)
+	}
+
+	if options.Citus != citusFlatten {
+		return nil, fmt.Errorf("The source is a Citus coordinator with %s; its dump would not restore without Citus and its workers. Pass --citus %s to snapshot the tables as regular ones of a single node",
+			source, citusFlatten)
+	}
+
+	return &source, nil
+}
+
+func (s citusSource) String() string {
+	return fmt.Sprintf("%d distributed and %d reference tables", s.DistributedTables, s.ReferenceTables)
+}
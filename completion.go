@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/client"
+	cli "github.com/urfave/cli/v3"
+)
+
+var completionCommand = &cli.Command{
+	Name:      "completion",
+	Usage:     "Print a shell completion script",
+	ArgsUsage: "bash|zsh|fish",
+	UsageText: `pg_container completion [bash|zsh|fish]
+
+The scripts complete subcommands and flags, and the names of the snapshot
+containers and images on the Docker daemon where a command takes one.
+
+Examples:
+	source <(pg_container completion bash)
+	pg_container completion zsh > "${fpath[1]}/_pg_container"
+	pg_container completion fish > ~/.config/fish/completions/pg_container.fish`,
+	Action: func(ctx context.Context, cmd *cli.Command) error {
+		if cmd.NArg() != 1 {
+			return cli.ShowSubcommandHelp(cmd)
+		}
+
+		name := cmd.Root().Name
+
+		switch shell := cmd.Args().First(); shell {
+		case "bash":
+			fmt.Printf(bashCompletion, name)
+		case "zsh":
+			fmt.Printf(zshCompletion, name)
+		case "fish":
+			script, err := cmd.Root().ToFishCompletion()
+			if err != nil {
+				return err
+			}
+			fmt.Print(script)
+			fmt.Printf(fishNameCompletion, name, strings.Join(nameCompletingCommands(), " "))
+		default:
+			return fmt.Errorf("Unsupported shell %q: expected bash, zsh or fish", shell)
+		}
+
+		return nil
+	},
+}
+
+// The bash and zsh scripts ask the binary for the candidates on every
+// completion, via the --generate-shell-completion flag of the CLI library.
+const bashCompletion = `# bash completion for %[1]s
+
+__%[1]s_complete() {
+  local cur prev words cword
+  if declare -F _init_completion >/dev/null 2>&1; then
+    _init_completion -n "=:" || return
+  else
+    COMPREPLY=()
+    _get_comp_words_by_ref -n "=:" cur prev words cword
+  fi
+
+  local request=("${words[@]:0:$cword}")
+  if [[ "$cur" == -* ]]; then
+    request+=("$cur")
+  fi
+
+  local IFS=$'\n'
+  COMPREPLY=($(compgen -W "$("${request[@]}" --generate-shell-completion 2>/dev/null)" -- "$cur"))
+
+  # Image names contain colons, which bash splits words on.
+  if declare -F __ltrim_colon_completions >/dev/null 2>&1; then
+    __ltrim_colon_completions "$cur"
+  fi
+}
+
+complete -o bashdefault -o default -F __%[1]s_complete %[1]s
+`
+
+const zshCompletion = `#compdef %[1]s
+
+_%[1]s() {
+  local -a candidates
+  local current=${words[-1]}
+
+  if [[ "$current" == -* ]]; then
+    candidates=("${(@f)$(${words[@]:0:#words[@]-1} ${current} --generate-shell-completion 2>/dev/null)}")
+  else
+    candidates=("${(@f)$(${words[@]:0:#words[@]-1} --generate-shell-completion 2>/dev/null)}")
+  fi
+
+  if [[ -n "${candidates[1]}" ]]; then
+    _describe 'values' candidates
+  else
+    _files
+  fi
+}
+
+if [ "$funcstack[1]" = "_%[1]s" ]; then
+  _%[1]s "$@"
+else
+  compdef _%[1]s %[1]s
+fi
+`
+
+// fishNameCompletion adds the container and image names to the static
+// script the CLI library generates for fish.
+const fishNameCompletion = `
+function __%[1]s_names
+    set -l args (commandline -opc)
+    $args --generate-shell-completion 2>/dev/null
+end
+
+complete -c %[1]s -n '__fish_seen_subcommand_from %[2]s' -f -a '(__%[1]s_names)'
+`
+
+// nameCompletingCommands lists the subcommands completing container or image
+// names, which the static fish script cannot know about.
+func nameCompletingCommands() []string {
+	var names []string
+	for _, command := range []*cli.Command{psqlCommand, refreshCommand, startCommand, stopCommand, diffCommand, driftCommand, extractCommand, helmCommand, promoteCommand, upCommand, verifyCommand} {
+		names = append(names, command.Name)
+	}
+	return names
+}
+
+// completeContainers completes the first n arguments, or every argument when
+// n is 0, with the names of the snapshot containers.
+func completeContainers(n int) cli.ShellCompleteFunc {
+	return completeNames(n, func(ctx context.Context, apiClient *client.Client) ([]string, error) {
+		containers, err := listManagedContainers(ctx, apiClient)
+		if err != nil {
+			return nil, err
+		}
+
+		names := make([]string, len(containers))
+		for i, c := range containers {
+			names[i] = containerName(c)
+		}
+		return names, nil
+	})
+}
+
+// completeImages completes the first n arguments, or every argument when n
+// is 0, with the names of the snapshot images.
+func completeImages(n int) cli.ShellCompleteFunc {
+	return completeNames(n, func(ctx context.Context, apiClient *client.Client) ([]string, error) {
+		images, err := listManagedImages(ctx, apiClient, "")
+		if err != nil {
+			return nil, err
+		}
+
+		var names []string
+		for _, image := range images {
+			names = append(names, image.RepoTags...)
+		}
+		return names, nil
+	})
+}
+
+// completeNames prints the candidates for a name argument, or the matching
+// flags when the word being completed starts with a dash. Completion must stay quiet and quick, so errors
+// and a slow daemon just leave the candidates out.
+func completeNames(n int, list func(context.Context, *client.Client) ([]string, error)) cli.ShellCompleteFunc {
+	return func(ctx context.Context, cmd *cli.Command) {
+		// The flag itself is the last argument, the word being completed
+		// the one before it.
+		if current := os.Args[len(os.Args)-2]; strings.HasPrefix(current, "-") {
+			for _, flag := range cmd.VisibleFlags() {
+				for _, name := range flag.Names() {
+					if len(name) > 1 && strings.HasPrefix("--"+name, current) {
+						fmt.Fprintln(cmd.Root().Writer, "--"+name)
+					}
+				}
+			}
+			return
+		}
+
+		if n > 0 && cmd.NArg() >= n {
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+		defer cancel()
+
+		apiClient, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+		if err != nil {
+			return
+		}
+		defer apiClient.Close()
+
+		names, err := list(ctx, apiClient)
+		if err != nil {
+			return
+		}
+
+		for _, name := range names {
+			fmt.Fprintln(cmd.Root().Writer, name)
+		}
+	}
+}
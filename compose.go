@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+type composeService struct {
+	Image       string              `yaml:"image"`
+	Ports       []string            `yaml:"ports,omitempty"`
+	Environment []string            `yaml:"environment,omitempty"`
+	Command     string              `yaml:"command,omitempty"`
+	Volumes     []string            `yaml:"volumes,omitempty"`
+	Labels      map[string]string   `yaml:"labels,omitempty"`
+	Restart     string              `yaml:"restart,omitempty"`
+	ShmSize     string              `yaml:"shm_size,omitempty"`
+	Healthcheck *composeHealthcheck `yaml:"healthcheck,omitempty"`
+}
+
+type composeHealthcheck struct {
+	Test     []string `yaml:"test"`
+	Interval string   `yaml:"interval"`
+	Timeout  string   `yaml:"timeout"`
+	Retries  int      `yaml:"retries"`
+}
+
+// newComposeService describes the snapshot as a compose service with the
+// same port, environment and healthcheck a created container would get.
+func newComposeService(imageName string, options backupOptions) composeService {
+	service := composeService{
+		Image:   imageName,
+		Labels:  options.Labels,
+		ShmSize: options.ShmSize,
+	}
+
+	// Compose picks a free port itself when the host port is left out.
+	hostPort := options.HostPort
+	if hostPort == autoPort {
+		hostPort = ""
+	}
+	service.Ports = []string{options.BindAddress + ":" + hostPort + ":" + options.ContainerPort}
+
+	service.Environment = append(service.Environment, options.Env...)
+	if options.ContainerPort != defaultContainerPort {
+		service.Environment = append(service.Environment, "PGPORT="+options.ContainerPort)
+	}
+
+	if options.Restart != "" && options.Restart != "no" {
+		service.Restart = options.Restart
+	}
+
+	if health := healthcheck(options); health.Test[0] != "NONE" {
+		service.Healthcheck = &composeHealthcheck{
+			Test:     health.Test,
+			Interval: health.Interval.String(),
+			Timeout:  health.Timeout.String(),
+			Retries:  health.Retries,
+		}
+	}
+
+	return service
+}
+
+var composeServiceNameInvalid = regexp.MustCompile(`[^a-z0-9_-]+`)
+
+// composeServiceName is the service key for a database; compose only
+// accepts lower-case letters, digits, dashes and underscores.
+func composeServiceName(databaseName string) string {
+	name := composeServiceNameInvalid.ReplaceAllString(strings.ToLower(databaseName), "-")
+	if name == "" || name == "-" {
+		return "postgres"
+	}
+
+	return name
+}
+
+// writeComposeService adds the service to a compose file, or replaces the
+// service of the same name. The rest of the file, comments included, is kept
+// as it is; a missing file is created.
+func writeComposeService(path string, name string, service composeService) error {
+	content, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	var document yaml.Node
+	if len(bytes.TrimSpace(content)) > 0 {
+		if err := yaml.Unmarshal(content, &document); err != nil {
+			return fmt.Errorf("Failed to parse %s: %w", path, err)
+		}
+	}
+
+	if document.Kind == 0 {
+		document = yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{{Kind: yaml.MappingNode}}}
+	}
+
+	root := document.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return fmt.Errorf("Failed to update %s: expected a mapping at the top level", path)
+	}
+
+	var serviceNode yaml.Node
+	if err := serviceNode.Encode(service); err != nil {
+		return err
+	}
+
+	setMappingValue(mappingChild(root, "services"), name, &serviceNode)
+
+	var output bytes.Buffer
+	encoder := yaml.NewEncoder(&output)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(&document); err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(path, output.Bytes(), 0644); err != nil {
+		return fmt.Errorf("Failed to write %s: %w", path, err)
+	}
+
+	return nil
+}
+
+// mappingChild returns the mapping stored under key, adding an empty one when
+// the key is missing.
+func mappingChild(mapping *yaml.Node, key string) *yaml.Node {
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key && mapping.Content[i+1].Kind == yaml.MappingNode {
+			return mapping.Content[i+1]
+		}
+	}
+
+	child := &yaml.Node{Kind: yaml.MappingNode}
+	setMappingValue(mapping, key, child)
+
+	return child
+}
+
+func setMappingValue(mapping *yaml.Node, key string, value *yaml.Node) {
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			mapping.Content[i+1] = value
+			return
+		}
+	}
+
+	mapping.Content = append(mapping.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: key}, value)
+}
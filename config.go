@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+
+	cli "github.com/urfave/cli/v3"
+	"gopkg.in/yaml.v3"
+)
+
+// configFileName is looked up in the current directory, then in the
+// pg_container directory of $XDG_CONFIG_HOME (~/.config by default).
+const configFileName = "pg_container.yaml"
+
+// configFile is the content of pg_container.yaml. Each profile sets flags by
+// their long name, plus source for the connection URL(s) to snapshot:
+//
+//	profiles:
+//	  staging:
+//	    source: postgres://app@staging-db:5432/app
+//	    format: custom
+//	    image-name: app-staging
+//	    start: true
+//	    name: app-staging
+//	    replace: true
+//	    port: 5433
+//	    label:
+//	      team: qa
+//
+// Lists and maps are for the flags that can be repeated, a map entry being
+// passed as key=value.
+type configFile struct {
+	Profiles map[string]map[string]any `yaml:"profiles"`
+}
+
+// projectConfigName is looked up in the current directory and its parents,
+// up to the root of the repository, for the defaults of a project.
+const projectConfigName = ".pg_container.yaml"
+
+// configFlags are not settable from a profile, since they pick the profile.
+var configFlags = []string{"config", "profile", "no-project-config"}
+
+// pathFlags name files, which a profile or project config gives relative to
+// its own directory rather than to wherever pg_container runs.
+var pathFlags = []string{"init-sql", "smoke-test", "post-start-sql", "hooks-file"}
+
+type profileSourcesKey struct{}
+
+// profileSources returns the connection URLs of the profile applied by
+// applyProfile, which are used when none are given on the command line.
+func profileSources(ctx context.Context) []string {
+	sources, _ := ctx.Value(profileSourcesKey{}).([]string)
+	return sources
+}
+
+// findConfigFile returns the config file to read, or "" if there is none.
+func findConfigFile(path string) (string, error) {
+	if path != "" {
+		return path, nil
+	}
+
+	candidates := []string{configFileName}
+	if configDir, err := os.UserConfigDir(); err == nil {
+		candidates = append(candidates, filepath.Join(configDir, "pg_container", configFileName))
+	}
+
+	for _, candidate := range candidates {
+		if _, err := os.Stat(candidate); err == nil {
+			return candidate, nil
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return "", err
+		}
+	}
+
+	return "", nil
+}
+
+// applyProfile sets the root flags from the --profile section of the config
+// file. Flags given on the command line win over the profile, whose paths are
+// relative to the config file.
+func applyProfile(ctx context.Context, cmd *cli.Command) (context.Context, error) {
+	name := cmd.String("profile")
+	if name == "" {
+		return ctx, nil
+	}
+
+	path, err := findConfigFile(cmd.String("config"))
+	if err != nil {
+		return ctx, err
+	}
+	if path == "" {
+		return ctx, fmt.Errorf("--profile %s needs a %s in the current directory or the user config directory, or --config", name, configFileName)
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return ctx, err
+	}
+
+	var config configFile
+	if err := yaml.Unmarshal(content, &config); err != nil {
+		return ctx, fmt.Errorf("Failed to parse %s: %w", path, err)
+	}
+
+	profile, ok := config.Profiles[name]
+	if !ok {
+		return ctx, fmt.Errorf("No profile %q in %s", name, path)
+	}
+
+	where := fmt.Sprintf("profile %s of %s", name, path)
+	if err := resolvePaths(profile, path, where); err != nil {
+		return ctx, err
+	}
+
+	sources, err := setFlags(cmd, profile, where)
+	if err != nil {
+		return ctx, err
+	}
+
+	return context.WithValue(ctx, profileSourcesKey{}, sources), nil
+}
+
+// findProjectConfig returns the project config of the current directory, or
+// "" if there is none. The search stops at the root of the repository, the
+// first directory holding .git, so a config outside the repository is never
+// picked up.
+func findProjectConfig() (string, error) {
+	dir, err := os.Getwd()
+	if err != nil {
+		return "", err
+	}
+
+	for {
+		path := filepath.Join(dir, projectConfigName)
+		if _, err := os.Stat(path); err == nil {
+			return path, nil
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return "", err
+		}
+
+		if _, err := os.Stat(filepath.Join(dir, ".git")); err == nil {
+			return "", nil
+		}
+
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", nil
+		}
+		dir = parent
+	}
+}
+
+// applyProjectConfig sets the root flags from the project config, as a
+// profile does. It comes last: the command line, the environment and the
+// profile all win over it, and its source is only used when none of them
+// names a database.
+//
+//	image-prefix: registry.example.com/app/
+//	name: app-db
+//	port: 5433
+//	init-sql:
+//	  - db/seed-users.sql
+func applyProjectConfig(ctx context.Context, cmd *cli.Command) (context.Context, error) {
+	if cmd.Bool("no-project-config") {
+		return ctx, nil
+	}
+
+	path, err := findProjectConfig()
+	if err != nil || path == "" {
+		return ctx, err
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return ctx, err
+	}
+
+	var values map[string]any
+	if err := yaml.Unmarshal(content, &values); err != nil {
+		return ctx, fmt.Errorf("Failed to parse %s: %w", path, err)
+	}
+
+	if err := resolvePaths(values, path, path); err != nil {
+		return ctx, err
+	}
+
+	sources, err := setFlags(cmd, values, path)
+	if err != nil {
+		return ctx, err
+	}
+
+	if len(sources) == 0 || len(profileSources(ctx)) > 0 {
+		return ctx, nil
+	}
+
+	return context.WithValue(ctx, profileSourcesKey{}, sources), nil
+}
+
+// resolvePaths makes the relative paths of the pathFlags in values, read from
+// the config file path, relative to its directory instead. where names the
+// section in errors.
+func resolvePaths(values map[string]any, path string, where string) error {
+	for _, key := range pathFlags {
+		value, ok := values[key]
+		if !ok {
+			continue
+		}
+
+		paths, err := flagValues(value)
+		if err != nil {
+			return fmt.Errorf("Invalid %s in %s: %w", key, where, err)
+		}
+
+		resolved := make([]any, len(paths))
+		for i, file := range paths {
+			if !filepath.IsAbs(file) {
+				file = filepath.Join(filepath.Dir(path), file)
+			}
+			resolved[i] = file
+		}
+		values[key] = resolved
+	}
+
+	return nil
+}
+
+// setFlags sets every root flag named in values that was not given on the
+// command line, and returns the connection URLs under source. where names
+// the section in errors.
+func setFlags(cmd *cli.Command, values map[string]any, where string) ([]string, error) {
+	root := cmd.Root()
+
+	var sources []string
+
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		items, err := flagValues(values[key])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid %s in %s: %w", key, where, err)
+		}
+
+		if key == "source" {
+			sources = items
+			continue
+		}
+
+		if !slices.ContainsFunc(root.Flags, func(flag cli.Flag) bool { return slices.Contains(flag.Names(), key) }) || slices.Contains(configFlags, key) {
+			return nil, fmt.Errorf("Unknown option %q in %s", key, where)
+		}
+
+		if root.IsSet(key) {
+			continue
+		}
+
+		for _, item := range items {
+			if err := root.Set(key, item); err != nil {
+				return nil, fmt.Errorf("Invalid %s in %s: %w", key, where, err)
+			}
+		}
+	}
+
+	return sources, nil
+}
+
+// flagValues turns a YAML value into the flag values it stands for.
+func flagValues(value any) ([]string, error) {
+	switch value := value.(type) {
+	case nil:
+		return nil, nil
+	case []any:
+		var items []string
+		for _, item := range value {
+			if _, ok := item.([]any); ok {
+				return nil, fmt.Errorf("expected a value, not a nested list")
+			}
+			if _, ok := item.(map[string]any); ok {
+				return nil, fmt.Errorf("expected a value, not a map")
+			}
+			items = append(items, fmt.Sprint(item))
+		}
+		return items, nil
+	case map[string]any:
+		var items []string
+		for key, item := range value {
+			items = append(items, key+"="+fmt.Sprint(item))
+		}
+		sort.Strings(items)
+		return items, nil
+	default:
+		return []string{strings.TrimSpace(fmt.Sprint(value))}, nil
+	}
+}
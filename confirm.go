@@ -0,0 +1,26 @@
+package main
+
+import "fmt"
+
+// confirmRemoval asks before removing what, which the user may still need,
+// unless yes (--yes) says to go ahead. Without a terminal to ask on it
+// refuses, so a script or CI job only removes things it was told to.
+func confirmRemoval(what string, yes bool) error {
+	if yes {
+		return nil
+	}
+
+	if !stdinIsTerminal() {
+		return fmt.Errorf("Refusing to remove %s without confirmation; pass --yes when there is no terminal to confirm on", what)
+	}
+
+	confirmed, err := newPrompter().confirm("Remove "+what+"?", false)
+	if err != nil {
+		return err
+	}
+	if !confirmed {
+		return fmt.Errorf("Not removing %s", what)
+	}
+
+	return nil
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"context"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	apiv1 "github.com/bgrcs/pg_container/api/v1"
+	"github.com/docker/go-units"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// source is a database the server snapshots on a schedule or when asked to
+// from the dashboard. Only the redacted URL is ever shown.
+type source struct {
+	connectionURL string
+	database      string
+	redacted      string
+}
+
+// schedule queues a build of every source each interval. A source whose
+// previous build is still queued or running is skipped until the next tick.
+type schedule struct {
+	sources  []source
+	interval time.Duration
+
+	mu   sync.Mutex
+	next time.Time
+}
+
+func newSchedule(connectionURLs []string, interval time.Duration) (*schedule, error) {
+	s := &schedule{interval: interval}
+
+	for _, connectionURL := range connectionURLs {
+		connectionURL, err := normalizeConnectionURL(connectionURL)
+		if err != nil {
+			return nil, err
+		}
+
+		database, err := extractDatabaseName(connectionURL)
+		if err != nil {
+			return nil, err
+		}
+
+		s.sources = append(s.sources, source{connectionURL: connectionURL, database: database, redacted: redactURL(connectionURL)})
+	}
+
+	return s, nil
+}
+
+func (s *schedule) run(ctx context.Context, server *jobServer) {
+	if s.interval <= 0 || len(s.sources) == 0 {
+		return
+	}
+
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		s.mu.Lock()
+		s.next = time.Now().Add(s.interval)
+		s.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		for _, source := range s.sources {
+			if server.pending(source.connectionURL) {
+				continue
+			}
+			if _, err := server.submit(source.connectionURL, server.defaults); err != nil {
+				logger.Warn("Failed to queue the scheduled build", "database", source.database, "error", status.Convert(err).Message())
+			}
+		}
+	}
+}
+
+func (s *schedule) nextRun() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.next
+}
+
+// dashboard is the web UI of the server: the sources with their last run and
+// a button queueing a fresh snapshot, the jobs of the server and the snapshot
+// images on the Docker daemon. The page reloads itself while open.
+type dashboard struct {
+	server   *jobServer
+	schedule *schedule
+}
+
+func (d *dashboard) routes(mux *http.ServeMux) {
+	mux.HandleFunc("GET /{$}", d.index)
+	mux.HandleFunc("POST /refresh", d.refresh)
+	mux.HandleFunc("GET /jobs/{id}/log", d.log)
+}
+
+type dashboardSource struct {
+	Index    int
+	Database string
+	URL      string
+	LastRun  *runRecord
+	Pending  bool
+}
+
+type dashboardImage struct {
+	Reference string
+	Database  string
+	Size      string
+	Created   time.Time
+}
+
+type dashboardPage struct {
+	Sources  []dashboardSource
+	NextRun  time.Time
+	Interval time.Duration
+	Jobs     []*apiv1.Job
+	Images   []dashboardImage
+	Errors   []string
+}
+
+func (d *dashboard) index(w http.ResponseWriter, r *http.Request) {
+	page := dashboardPage{
+		NextRun:  d.schedule.nextRun(),
+		Interval: d.schedule.interval,
+		Jobs:     d.server.list(),
+	}
+
+	records, err := readHistory()
+	if err != nil {
+		page.Errors = append(page.Errors, err.Error())
+	}
+
+	for i, source := range d.schedule.sources {
+		entry := dashboardSource{Index: i, Database: source.database, URL: source.redacted, Pending: d.server.pending(source.connectionURL)}
+		for j := len(records) - 1; j >= 0; j-- {
+			if records[j].Database == source.database {
+				entry.LastRun = &records[j]
+				break
+			}
+		}
+		page.Sources = append(page.Sources, entry)
+	}
+
+	images, err := listManagedImages(r.Context(), d.server.apiClient, "")
+	if err != nil {
+		page.Errors = append(page.Errors, err.Error())
+	}
+	for _, image := range images {
+		for _, reference := range image.RepoTags {
+			page.Images = append(page.Images, dashboardImage{
+				Reference: reference,
+				Database:  image.Labels[databaseLabel],
+				Size:      units.HumanSize(float64(image.Size)),
+				Created:   time.Unix(image.Created, 0),
+			})
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := dashboardTemplate.Execute(w, page); err != nil {
+		logger.Warn("Failed to render the dashboard", "error", err)
+	}
+}
+
+// refresh queues a build of one of the sources. The form posts the index of
+// the source rather than its URL, so the page never carries credentials and
+// only configured databases can be snapshotted.
+func (d *dashboard) refresh(w http.ResponseWriter, r *http.Request) {
+	// Refuse forms posted from other sites while the dashboard is open.
+	if origin := r.Header.Get("Origin"); origin != "" && origin != "http://"+r.Host && origin != "https://"+r.Host {
+		http.Error(w, "Cross-origin request refused", http.StatusForbidden)
+		return
+	}
+
+	index, err := strconv.Atoi(r.FormValue("source"))
+	if err != nil || index < 0 || index >= len(d.schedule.sources) {
+		http.Error(w, "Unknown source", http.StatusBadRequest)
+		return
+	}
+
+	source := d.schedule.sources[index]
+	if !d.server.pending(source.connectionURL) {
+		if _, err := d.server.submit(source.connectionURL, d.server.defaults); err != nil {
+			code := http.StatusInternalServerError
+			if status.Code(err) == codes.ResourceExhausted {
+				code = http.StatusServiceUnavailable
+			}
+			http.Error(w, status.Convert(err).Message(), code)
+			return
+		}
+	}
+
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+func (d *dashboard) log(w http.ResponseWriter, r *http.Request) {
+	j, err := d.server.lookup(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, status.Convert(err).Message(), http.StatusNotFound)
+		return
+	}
+
+	d.server.mu.Lock()
+	lines := j.logs
+	d.server.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	for _, line := range lines {
+		w.Write([]byte(line.GetTime().AsTime().Local().Format(time.TimeOnly) + " " + line.GetMessage() + "\n"))
+	}
+}
+
+var dashboardTemplate = template.Must(template.New("dashboard").Funcs(template.FuncMap{
+	"time": func(t time.Time) string {
+		if t.IsZero() {
+			return ""
+		}
+		return t.Local().Format(time.DateTime)
+	},
+	"timestamp": func(t *timestamppb.Timestamp) string {
+		if t == nil {
+			return ""
+		}
+		return t.AsTime().Local().Format(time.DateTime)
+	},
+	"state": func(state apiv1.JobState) string {
+		return strings.ToLower(strings.TrimPrefix(state.String(), "JOB_STATE_"))
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="10">
+<title>pg_container</title>
+<style>
+body { font-family: system-ui, sans-serif; margin: 2em; color: #222; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { text-align: left; padding: 0.3em 1em 0.3em 0; border-bottom: 1px solid #ddd; vertical-align: top; }
+code { font-size: 0.9em; }
+.success, .succeeded { color: #1a7f37; } .failed { color: #cf222e; } .running, .queued { color: #9a6700; }
+.error { color: #cf222e; white-space: pre-wrap; }
+</style>
+</head>
+<body>
+<h1>pg_container</h1>
+{{range .Errors}}<p class="error">{{.}}</p>{{end}}
+
+<h2>Databases</h2>
+{{if .Sources}}
+{{if .Interval}}<p>Snapshotted every {{.Interval}}, next at {{time .NextRun}}.</p>{{end}}
+<table>
+<tr><th>Database</th><th>Source</th><th>Last run</th><th>Image</th><th></th></tr>
+{{range .Sources}}
+<tr>
+<td>{{.Database}}</td>
+<td><code>{{.URL}}</code></td>
+<td>{{with .LastRun}}<span class="{{.Result}}">{{.Result}}</span> {{time .Time}}{{if .Error}}<div class="error">{{.Error}}</div>{{end}}{{end}}</td>
+<td>{{with .LastRun}}<code>{{.Image}}</code>{{end}}</td>
+<td>{{if .Pending}}building…{{else}}<form method="post" action="/refresh"><input type="hidden" name="source" value="{{.Index}}"><button>Refresh</button></form>{{end}}</td>
+</tr>
+{{end}}
+</table>
+{{else}}
+<p>No databases configured; start the server with --source to refresh them from here.</p>
+{{end}}
+
+<h2>Jobs</h2>
+{{if .Jobs}}
+<table>
+<tr><th>Job</th><th>Database</th><th>State</th><th>Queued</th><th>Finished</th><th>Image</th><th>Container</th></tr>
+{{range .Jobs}}
+<tr>
+<td><a href="/jobs/{{.Id}}/log"><code>{{.Id}}</code></a></td>
+<td>{{.Database}}</td>
+<td><span class="{{state .State}}">{{state .State}}</span>{{if .Error}}<div class="error">{{.Error}}</div>{{end}}</td>
+<td>{{timestamp .CreatedAt}}</td>
+<td>{{timestamp .FinishedAt}}</td>
+<td><code>{{.Image}}</code></td>
+<td><code>{{.Container}}</code></td>
+</tr>
+{{end}}
+</table>
+{{else}}
+<p>No jobs yet.</p>
+{{end}}
+
+<h2>Images</h2>
+{{if .Images}}
+<table>
+<tr><th>Image</th><th>Database</th><th>Size</th><th>Created</th></tr>
+{{range .Images}}
+<tr><td><code>{{.Reference}}</code></td><td>{{.Database}}</td><td>{{.Size}}</td><td>{{time .Created}}</td></tr>
+{{end}}
+</table>
+{{else}}
+<p>No snapshot images.</p>
+{{end}}
+</body>
+</html>
+`))
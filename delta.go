@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/bgrcs/pg_container/pgcontainer"
+	"github.com/docker/docker/client"
+	cli "github.com/urfave/cli/v3"
+)
+
+// validateBase rejects the flags --base cannot honour. The delta is applied
+// to the data of the base, so the rows of the changed tables would be loaded
+// without what --init-sql does to them, and the delta is dumped as it is, so
+// without the rewrites of --exclude-column-data and --convert-encoding.
+func validateBase(cmd *cli.Command) error {
+	if cmd.String("base") == "" {
+		return nil
+	}
+
+	if cmd.IsSet("init-sql") {
+		return fmt.Errorf("--init-sql cannot be used with --base, which would load the rows of changed tables without it")
+	}
+
+	for _, name := range []string{"exclude-column-data", "convert-encoding"} {
+		if cmd.IsSet(name) {
+			return fmt.Errorf("--%s cannot be used with --base, which would dump the rows of changed tables without it", name)
+		}
+	}
+
+	if cmd.String("format") != pgcontainer.FormatPlain {
+		return fmt.Errorf("--base needs --format %s", pgcontainer.FormatPlain)
+	}
+
+	if cmd.String("runtime") != runtimeDocker {
+		return fmt.Errorf("--base needs --runtime %s", runtimeDocker)
+	}
+
+	return nil
+}
+
+// dumpDelta dumps what changed since the --base image. A base without
+// checksums, or with a different schema, gets a full dump, whose image then
+// records checksums for the next run.
+func dumpDelta(ctx context.Context, apiClient *client.Client, connectionURL string, databaseName string, options backupOptions) (*pgcontainer.Delta, error) {
+	base, err := baseChecksums(ctx, apiClient, options.Base, databaseName)
+	if err != nil {
+		return nil, err
+	}
+
+	var delta *pgcontainer.Delta
+	_, err = runDump(ctx, options, func(ctx context.Context, dump pgcontainer.DumpOptions) (*pgcontainer.Archive, error) {
+		dumped, err := pgcontainer.DumpDelta(ctx, connectionURL, base, dump)
+		if err != nil {
+			return nil, err
+		}
+		delta = dumped
+		return delta.Archive, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case base == nil:
+		logger.Info("🧮 The base image has no checksums, dumping in full; later runs can use this image as --base", "base", options.Base)
+	case delta.Full:
+		logger.Info("🧮 The schema changed since the base image, dumping in full", "base", options.Base)
+	default:
+		logger.Info(fmt.Sprintf("🧮 %d of %d tables changed since the base image", len(delta.Changed), len(delta.Checksums.Tables)), "base", options.Base)
+		for _, table := range delta.Changed {
+			logger.Debug("Changed since the base image", "table", table)
+		}
+	}
+
+	return delta, nil
+}
+
+// baseChecksums reads the checksums recorded on the base image, or nil when
+// it has none.
+func baseChecksums(ctx context.Context, apiClient *client.Client, base string, databaseName string) (*pgcontainer.Checksums, error) {
+	inspect, _, err := apiClient.ImageInspectWithRaw(ctx, base)
+	if err != nil {
+		return nil, fmt.Errorf("Base image %s not found: %w", base, err)
+	}
+
+	if inspect.Config == nil || inspect.Config.Labels[pgcontainer.ChecksumsLabel] == "" {
+		return nil, nil
+	}
+
+	if database := inspect.Config.Labels[databaseLabel]; database != databaseName {
+		return nil, fmt.Errorf("Base image %s is a snapshot of %s, not of %s", base, database, databaseName)
+	}
+
+	var checksums pgcontainer.Checksums
+	if err := json.Unmarshal([]byte(inspect.Config.Labels[pgcontainer.ChecksumsLabel]), &checksums); err != nil {
+		return nil, fmt.Errorf("Invalid checksums on the base image %s: %w", base, err)
+	}
+
+	return &checksums, nil
+}
+
+// addChecksumsLabel records checksums on the image, for a later run to use
+// it as --base.
+func addChecksumsLabel(labels map[string]string, checksums *pgcontainer.Checksums) error {
+	encoded, err := json.Marshal(checksums)
+	if err != nil {
+		return err
+	}
+
+	labels[pgcontainer.ChecksumsLabel] = string(encoded)
+
+	return nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// devcontainerBaseImage runs the editor side of a generated devcontainer.
+const devcontainerBaseImage = "mcr.microsoft.com/devcontainers/base:ubuntu"
+
+// writeDevcontainer adds the snapshot as a service to the docker-compose.yml
+// of a devcontainer setup in dir. A devcontainer.json is only created when
+// there is none: an existing one may carry comments that rewriting it would
+// drop, so the settings to add are returned in that case instead.
+func writeDevcontainer(dir string, databaseName string, imageName string, options backupOptions) (string, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+
+	name := composeServiceName(databaseName)
+
+	// Other services reach the database on the compose network, nothing needs
+	// to be published on the host.
+	service := newComposeService(imageName, options)
+	service.Ports = nil
+
+	composePath := filepath.Join(dir, "docker-compose.yml")
+	if err := writeComposeService(composePath, name, service); err != nil {
+		return "", err
+	}
+
+	settings := map[string]any{
+		"containerEnv": map[string]string{
+			"DATABASE_URL": fmt.Sprintf("postgres://postgres:postgres@%s:%s/%s", name, options.ContainerPort, databaseName),
+		},
+	}
+
+	configPath := filepath.Join(dir, "devcontainer.json")
+	if _, err := os.Stat(configPath); err == nil {
+		snippet, err := json.MarshalIndent(settings, "", "  ")
+		return string(snippet), err
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return "", err
+	}
+
+	if err := writeComposeService(composePath, "app", composeService{
+		Image:   devcontainerBaseImage,
+		Command: "sleep infinity",
+		Volumes: []string{"../..:/workspaces:cached"},
+	}); err != nil {
+		return "", err
+	}
+
+	settings["name"] = databaseName
+	settings["dockerComposeFile"] = []string{"docker-compose.yml"}
+	settings["service"] = "app"
+	settings["runServices"] = []string{"app", name}
+	settings["workspaceFolder"] = "/workspaces/${localWorkspaceFolderBasename}"
+
+	content, err := json.MarshalIndent(settings, "", "  ")
+	if err != nil {
+		return "", err
+	}
+
+	if err := os.WriteFile(configPath, append(content, '\n'), 0644); err != nil {
+		return "", fmt.Errorf("Failed to write %s: %w", configPath, err)
+	}
+
+	return "", nil
+}
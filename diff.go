@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/docker/docker/client"
+	cli "github.com/urfave/cli/v3"
+)
+
+var diffCommand = &cli.Command{
+	Name:          "diff",
+	Usage:         "Compare the schema and row counts of two snapshot images",
+	ShellComplete: completeImages(2),
+	UsageText: `pg_container diff [imageA] [imageB]
+
+Example:
+	pg_container diff db-2025-01-11-1200:latest db-2025-01-18-1200:latest`,
+	Action: func(ctx context.Context, cmd *cli.Command) error {
+		if cmd.NArg() != 2 {
+			return cli.ShowSubcommandHelp(cmd)
+		}
+
+		apiClient, err := newDockerClient(ctx)
+		if err != nil {
+			return err
+		}
+		defer apiClient.Close()
+
+		before, err := summarizeImage(ctx, apiClient, cmd.Args().Get(0))
+		if err != nil {
+			return err
+		}
+
+		after, err := summarizeImage(ctx, apiClient, cmd.Args().Get(1))
+		if err != nil {
+			return err
+		}
+
+		printSchemaDiff(os.Stdout, before, after)
+		printRowCountDiff(os.Stdout, before, after)
+
+		return nil
+	},
+}
+
+func summarizeImage(ctx context.Context, apiClient *client.Client, imageName string) (*dumpSummary, error) {
+	dump, err := openImageDump(ctx, apiClient, imageName)
+	if err != nil {
+		return nil, err
+	}
+	defer dump.Close()
+
+	summary, err := parseDump(dump)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse dump from image %s: %w", imageName, err)
+	}
+
+	return summary, nil
+}
+
+// printSchemaDiff prints the schema changes from before to after and returns
+// how many there are.
+func printSchemaDiff(w io.Writer, before, after *dumpSummary) int {
+	fmt.Fprintln(w, "Schema differences:")
+
+	changes := 0
+
+	for _, key := range sortedKeys(before.Objects, after.Objects) {
+		_, inBefore := before.Objects[key]
+		_, inAfter := after.Objects[key]
+
+		switch {
+		case inBefore && !inAfter:
+			fmt.Fprintf(w, "  - %s\n", key)
+			changes++
+		case !inBefore && inAfter:
+			fmt.Fprintf(w, "  + %s\n", key)
+			changes++
+		}
+	}
+
+	for _, name := range sortedKeys(before.Tables, after.Tables) {
+		oldTable, inBefore := before.Tables[name]
+		newTable, inAfter := after.Tables[name]
+		if !inBefore || !inAfter {
+			continue
+		}
+
+		for _, line := range columnChanges(oldTable.Columns, newTable.Columns) {
+			fmt.Fprintf(w, "  ~ %s: %s\n", name, line)
+			changes++
+		}
+	}
+
+	if changes == 0 {
+		fmt.Fprintln(w, "  (none)")
+	}
+
+	return changes
+}
+
+func columnChanges(before, after []column) []string {
+	oldColumns := map[string]string{}
+	for _, c := range before {
+		oldColumns[c.Name] = c.Definition
+	}
+
+	newColumns := map[string]string{}
+	for _, c := range after {
+		newColumns[c.Name] = c.Definition
+	}
+
+	var changes []string
+
+	for _, c := range before {
+		if _, ok := newColumns[c.Name]; !ok {
+			changes = append(changes, fmt.Sprintf("- column %s %s", c.Name, c.Definition))
+		}
+	}
+
+	for _, c := range after {
+		previous, ok := oldColumns[c.Name]
+		switch {
+		case !ok:
+			changes = append(changes, fmt.Sprintf("+ column %s %s", c.Name, c.Definition))
+		case previous != c.Definition:
+			changes = append(changes, fmt.Sprintf("~ column %s %s -> %s", c.Name, previous, c.Definition))
+		}
+	}
+
+	return changes
+}
+
+func printRowCountDiff(w io.Writer, before, after *dumpSummary) {
+	fmt.Fprintln(w, "\nRow counts:")
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	defer tw.Flush()
+
+	for _, name := range sortedKeys(before.Tables, after.Tables) {
+		oldTable, inBefore := before.Tables[name]
+		newTable, inAfter := after.Tables[name]
+
+		switch {
+		case !inBefore:
+			fmt.Fprintf(tw, "  %s\t-\t%d\t(new)\n", name, newTable.Rows)
+		case !inAfter:
+			fmt.Fprintf(tw, "  %s\t%d\t-\t(removed)\n", name, oldTable.Rows)
+		default:
+			fmt.Fprintf(tw, "  %s\t%d\t%d\t(%+d)\n", name, oldTable.Rows, newTable.Rows, newTable.Rows-oldTable.Rows)
+		}
+	}
+}
+
+func sortedKeys[V any](maps ...map[string]V) []string {
+	seen := map[string]struct{}{}
+	var keys []string
+
+	for _, m := range maps {
+		for key := range m {
+			if _, ok := seen[key]; !ok {
+				seen[key] = struct{}{}
+				keys = append(keys, key)
+			}
+		}
+	}
+
+	sort.Strings(keys)
+
+	return keys
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+)
+
+// localPortRange are the ports probed on localhost: the default one and
+// those a second or third local server is usually moved to.
+var localPortRange = []int{5432, 5433, 5434, 5435}
+
+// localPostgres is a server found on this machine, offered by the wizard as
+// the source.
+type localPostgres struct {
+	// Source says where it was found, e.g. "listening" or "container shop-db,
+	// postgres:16".
+	Source   string
+	Host     string
+	Port     string
+	User     string
+	Database string
+	Password string
+}
+
+func (s localPostgres) String() string {
+	return net.JoinHostPort(s.Host, s.Port) + " (" + s.Source + ")"
+}
+
+// detectLocalPostgres looks for servers to snapshot: the one the PG*
+// environment points at, running containers publishing the postgres port,
+// and whatever listens on the usual ports of localhost. It gives up on each
+// quickly and never fails, offering only what it found.
+func detectLocalPostgres(ctx context.Context) []localPostgres {
+	var found []localPostgres
+	seen := map[string]bool{}
+
+	add := func(server localPostgres) {
+		key := net.JoinHostPort(server.Host, server.Port)
+		if !seen[key] {
+			seen[key] = true
+			found = append(found, server)
+		}
+	}
+
+	if host, port := os.Getenv("PGHOST"), os.Getenv("PGPORT"); (host != "" || port != "") && !strings.HasPrefix(host, "/") {
+		add(localPostgres{
+			Source:   "PGHOST and PGPORT",
+			Host:     localHost(host),
+			Port:     cmp.Or(port, "5432"),
+			User:     os.Getenv("PGUSER"),
+			Database: os.Getenv("PGDATABASE"),
+		})
+	}
+
+	for _, server := range detectPostgresContainers(ctx) {
+		add(server)
+	}
+
+	for _, port := range localPortRange {
+		address := net.JoinHostPort("localhost", strconv.Itoa(port))
+		if seen[address] {
+			continue
+		}
+
+		conn, err := net.DialTimeout("tcp", address, 300*time.Millisecond)
+		if err != nil {
+			continue
+		}
+		conn.Close()
+
+		add(localPostgres{Source: "listening", Host: "localhost", Port: strconv.Itoa(port)})
+	}
+
+	return found
+}
+
+// detectPostgresContainers returns the running containers of a local Docker
+// daemon that publish the postgres port, with the user, database and
+// password the postgres image was started with. Snapshot containers of the
+// tool are left out.
+func detectPostgresContainers(ctx context.Context) []localPostgres {
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+
+	apiClient, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return nil
+	}
+	defer apiClient.Close()
+
+	// The ports of a remote daemon are published on another machine.
+	if !localDaemon(apiClient) {
+		return nil
+	}
+
+	containers, err := apiClient.ContainerList(ctx, container.ListOptions{})
+	if err != nil {
+		return nil
+	}
+
+	var found []localPostgres
+	for _, c := range containers {
+		if c.Labels[managedLabel] == "true" {
+			continue
+		}
+
+		for _, port := range c.Ports {
+			if port.PrivatePort != 5432 || port.PublicPort == 0 || port.Type != "tcp" {
+				continue
+			}
+
+			server := localPostgres{
+				Source: "container " + containerName(c) + ", " + c.Image,
+				Host:   localHost(port.IP),
+				Port:   strconv.Itoa(int(port.PublicPort)),
+			}
+
+			if inspect, err := apiClient.ContainerInspect(ctx, c.ID); err == nil && inspect.Config != nil {
+				env := map[string]string{}
+				for _, variable := range inspect.Config.Env {
+					name, value, _ := strings.Cut(variable, "=")
+					env[name] = value
+				}
+				server.User = cmp.Or(env["POSTGRES_USER"], "postgres")
+				server.Database = cmp.Or(env["POSTGRES_DB"], server.User)
+				server.Password = env["POSTGRES_PASSWORD"]
+			}
+
+			found = append(found, server)
+			break
+		}
+	}
+
+	return found
+}
+
+// localHost names the addresses of this machine, and those a port is
+// published on to all of them, localhost.
+func localHost(host string) string {
+	switch host {
+	case "", "0.0.0.0", "::", "127.0.0.1", "::1":
+		return "localhost"
+	}
+
+	return host
+}
+
+// chooseLocalPostgres offers the servers found, returning the one picked or
+// nil to enter the connection details instead.
+func chooseLocalPostgres(p *prompter, found []localPostgres) (*localPostgres, error) {
+	fmt.Fprintln(p.out, "Found these PostgreSQL servers:")
+	for i, server := range found {
+		fmt.Fprintf(p.out, "  %d) %s\n", i+1, server)
+	}
+
+	for {
+		answer, err := p.ask(fmt.Sprintf("Snapshot one of them? (1-%d, empty to enter the details)", len(found)), "")
+		if err != nil || answer == "" {
+			return nil, err
+		}
+
+		if n, err := strconv.Atoi(answer); err == nil && n >= 1 && n <= len(found) {
+			return &found[n-1], nil
+		}
+	}
+}
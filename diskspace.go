@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/bgrcs/pg_container/pgcontainer"
+	"github.com/docker/docker/client"
+	"github.com/docker/go-units"
+	"github.com/jackc/pgx/v5"
+)
+
+// checkDiskSpace fails early when the temp directory or the Docker data root
+// clearly cannot hold the run, instead of letting the build die with ENOSPC
+// after a long dump. The estimate is based on the size of the source
+// database: the dump spooled to the temp directory takes up to about that
+// much, which leaves room for the copy a rewrite of it makes since the
+// indexes are not dumped, and the build context, the restored data in the
+// builder stage and its copy in the final image each take about that much,
+// plus the dump itself when it is kept in the image. A --physical copy takes
+// the size of the whole cluster twice, in the helper container and in the
+// committed image. Checks that cannot be made, such as on a remote daemon or
+// for a restore from a backup repository, whose size is not known up front,
+// are skipped.
+func checkDiskSpace(ctx context.Context, apiClient *client.Client, connectionURL string, options backupOptions) error {
+	if options.FromBackup != nil {
+		return requireSpace("the temp directory", os.TempDir(), uint64(pgcontainer.PgDumpSize))
+	}
+
+	databaseSize, err := sourceDatabaseSize(ctx, connectionURL, options.Physical)
+	if err != nil {
+		logger.Debug("Skipping the disk space check for the dump and the Docker data root", "error", err)
+		return requireSpace("the temp directory", os.TempDir(), uint64(pgcontainer.PgDumpSize))
+	}
+
+	tempSize := uint64(pgcontainer.PgDumpSize)
+	if !options.Physical {
+		tempSize += uint64(databaseSize)
+	}
+	if err := requireSpace("the temp directory", os.TempDir(), tempSize); err != nil {
+		return err
+	}
+
+	if !strings.HasPrefix(apiClient.DaemonHost(), "unix://") {
+		return nil
+	}
+
+	info, err := apiClient.Info(ctx)
+	if err != nil || info.DockerRootDir == "" {
+		return nil
+	}
+
+	copies := uint64(3)
+	if options.IncludeDump {
+		copies++
+	}
+	if options.Physical {
+		copies = 2
+	}
+
+	return requireSpace("the Docker data root", info.DockerRootDir, copies*uint64(databaseSize))
+}
+
+func requireSpace(description, path string, required uint64) error {
+	available, err := freeSpace(path)
+	if err != nil {
+		// Not on this machine, e.g. inside the VM of Docker Desktop.
+		return nil
+	}
+
+	if available < required {
+		return fmt.Errorf("Not enough disk space in %s (%s): about %s needed, %s available; free up space or pass --no-disk-check",
+			description, path, units.HumanSize(float64(required)), units.HumanSize(float64(available)))
+	}
+
+	return nil
+}
+
+// sourceDatabaseSize is the size of the database, or with wholeCluster of all
+// the databases on the server.
+func sourceDatabaseSize(ctx context.Context, connectionURL string, wholeCluster bool) (int64, error) {
+	conn, err := pgx.Connect(ctx, connectionURL)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close(ctx)
+
+	query := "SELECT pg_database_size(current_database())"
+	if wholeCluster {
+		query = "SELECT sum(pg_database_size(oid))::bigint FROM pg_database"
+	}
+
+	var size int64
+	err = conn.QueryRow(ctx, query).Scan(&size)
+
+	return size, err
+}
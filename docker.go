@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+
+	"github.com/docker/docker/client"
+)
+
+// newDockerClient connects to the daemon from the environment, negotiating
+// the API version so older daemons work, and pings it before any work starts
+// so an unreachable daemon is reported with a hint instead of surfacing from
+// the middle of a run.
+func newDockerClient(ctx context.Context) (*client.Client, error) {
+	apiClient, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return nil, connectionError(fmt.Errorf("Invalid Docker configuration: %w", err))
+	}
+
+	if _, err := apiClient.Ping(ctx); err != nil {
+		apiClient.Close()
+
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		return nil, connectionError(fmt.Errorf("Cannot reach the Docker daemon at %s: %w\n%s", apiClient.DaemonHost(), err, dockerHint(apiClient.DaemonHost(), err)))
+	}
+
+	return apiClient, nil
+}
+
+// localDaemon reports whether the daemon is reached through a local socket
+// rather than over the network, e.g. a tcp:// or ssh:// DOCKER_HOST.
+func localDaemon(apiClient *client.Client) bool {
+	host := apiClient.DaemonHost()
+	return strings.HasPrefix(host, "unix://") || strings.HasPrefix(host, "npipe://")
+}
+
+// dockerHint explains the usual reasons the daemon cannot be reached.
+func dockerHint(host string, err error) string {
+	socket, isSocket := strings.CutPrefix(host, "unix://")
+
+	switch {
+	case errors.Is(err, syscall.EACCES) || strings.Contains(err.Error(), "permission denied"):
+		return fmt.Sprintf("Your user may not access %s. Add it to the docker group (sudo usermod -aG docker $USER) and log in again, or use rootless Docker.", socket)
+	case isSocket && !exists(socket):
+		for _, candidate := range alternativeSockets() {
+			if exists(candidate) {
+				return fmt.Sprintf("%s does not exist, but %s does. Point DOCKER_HOST at it: export DOCKER_HOST=unix://%s", socket, candidate, candidate)
+			}
+		}
+
+		if runtime.GOOS == "darwin" || runtime.GOOS == "windows" {
+			return "Docker Desktop does not appear to be running; start it and try again."
+		}
+
+		return fmt.Sprintf("%s does not exist. Is Docker installed and running? (sudo systemctl start docker)", socket)
+	case runtime.GOOS == "darwin" || runtime.GOOS == "windows":
+		return "Is Docker Desktop running? Start it and try again."
+	default:
+		return "Is the Docker daemon running? (sudo systemctl start docker) For a remote daemon, check DOCKER_HOST and DOCKER_CONTEXT."
+	}
+}
+
+// alternativeSockets are where rootless Docker, Docker Desktop and Colima
+// put their sockets, which the default DOCKER_HOST does not cover.
+func alternativeSockets() []string {
+	var sockets []string
+
+	if runtimeDir := os.Getenv("XDG_RUNTIME_DIR"); runtimeDir != "" {
+		sockets = append(sockets, filepath.Join(runtimeDir, "docker.sock"))
+	}
+
+	if home, err := os.UserHomeDir(); err == nil {
+		sockets = append(sockets,
+			filepath.Join(home, ".docker", "run", "docker.sock"),
+			filepath.Join(home, ".docker", "desktop", "docker.sock"),
+			filepath.Join(home, ".colima", "default", "docker.sock"),
+		)
+	}
+
+	return sockets
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var timezonePattern = regexp.MustCompile(`^[A-Za-z0-9_+\-/]+$`)
+
+// validateTimezone only checks the shape of the name, since it ends up in the
+// Dockerfile; whether Postgres knows the zone is checked when it starts.
+func validateTimezone(timezone string) error {
+	if timezone != "" && !timezonePattern.MatchString(timezone) {
+		return fmt.Errorf("Invalid --timezone %q: expected an IANA zone name such as Europe/Berlin or UTC", timezone)
+	}
+
+	return nil
+}
+
+var memoryPattern = regexp.MustCompile(`^[0-9]+(kB|MB|GB|TB)?$`)
+
+func validateMaintenanceWorkMem(value string) error {
+	if !memoryPattern.MatchString(value) {
+		return fmt.Errorf("Invalid --restore-maintenance-work-mem %q: expected a Postgres memory size such as 512MB or 2GB", value)
+	}
+
+	return nil
+}
+
+var tablespacePattern = regexp.MustCompile(`^[a-z_][a-z0-9_]*$`)
+
+// parseTablespaceMap parses the old=new values of --tablespace-map. The new
+// tablespaces are created by the restore, in a directory named after them, so
+// they are held to plain lowercase names; pg_ is reserved for the system.
+func parseTablespaceMap(values []string) (map[string]string, error) {
+	mapping, err := parseKeyValues("tablespace-map", values)
+	if err != nil {
+		return nil, err
+	}
+
+	for source, target := range mapping {
+		if target != "pg_default" && (!tablespacePattern.MatchString(target) || strings.HasPrefix(target, "pg_")) {
+			return nil, fmt.Errorf("Invalid --tablespace-map %s=%s: expected pg_default or a lowercase name such as fast_disk", source, target)
+		}
+	}
+
+	return mapping, nil
+}
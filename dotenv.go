@@ -0,0 +1,43 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// writeDotenv sets key=value in a .env file, replacing an existing assignment
+// of the key and leaving every other line untouched.
+func writeDotenv(path string, key string, value string) error {
+	content, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	assignment := key + "=" + value
+	replaced := false
+
+	var lines []string
+	if len(content) > 0 {
+		lines = strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")
+	}
+
+	for i, line := range lines {
+		trimmed := strings.TrimPrefix(strings.TrimSpace(line), "export ")
+		if strings.HasPrefix(trimmed, key+"=") {
+			lines[i] = assignment
+			replaced = true
+		}
+	}
+
+	if !replaced {
+		lines = append(lines, assignment)
+	}
+
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0600); err != nil {
+		return fmt.Errorf("Failed to write %s: %w", path, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/bgrcs/pg_container/pgcontainer"
+	"github.com/docker/go-units"
+	"github.com/jackc/pgx/v5"
+)
+
+// runPlan is everything --dry-run resolves before it would start dumping.
+type runPlan struct {
+	Source        string   `json:"source"`
+	Database      string   `json:"database"`
+	ServerVersion string   `json:"server_version"`
+	DatabaseSize  int64    `json:"database_size"`
+	PgDumpVersion string   `json:"pg_dump_version"`
+	PgDumpArgs    []string `json:"pg_dump_args"`
+	Physical      bool     `json:"physical"`
+	Backup        string   `json:"backup,omitempty"`
+	BaseImage     string   `json:"base_image"`
+	Image         string   `json:"image"`
+	IncludeDump   bool     `json:"include_dump"`
+	Container     string   `json:"container,omitempty"`
+	Port          string   `json:"port,omitempty"`
+	Bind          string   `json:"bind,omitempty"`
+	Network       string   `json:"network,omitempty"`
+	Start         bool     `json:"start"`
+	Warnings      []string `json:"warnings,omitempty"`
+}
+
+func planBackup(ctx context.Context, connectionURL string, options backupOptions) (*runPlan, error) {
+	databaseName, err := extractDatabaseName(connectionURL)
+	if err != nil {
+		return nil, err
+	}
+
+	plan := &runPlan{
+		Source:      redactURL(connectionURL),
+		Database:    databaseName,
+		PgDumpArgs:  dumpOptions(options).Args(),
+		BaseImage:   pgcontainer.DefaultBaseImage,
+		Image:       pgcontainer.ImageName(imageBaseName(options, databaseName), time.Now()),
+		IncludeDump: options.IncludeDump,
+		Start:       options.StartContainer,
+	}
+
+	if options.FromBackup != nil {
+		// Planning does not read the repository, which takes a container.
+		plan.Physical = true
+		plan.PgDumpArgs = nil
+		plan.Backup = options.FromBackup.String()
+		plan.BaseImage = "postgres (the major version of the latest backup)"
+	} else if err := planSource(ctx, plan, connectionURL, options); err != nil {
+		return nil, err
+	} else {
+		size := plan.DatabaseSize
+		if len(options.Schemas) > 0 && !options.Physical {
+			if size, err = estimateDumpSize(ctx, connectionURL, options); err != nil {
+				return nil, fmt.Errorf("Failed to query the source database: %w", err)
+			}
+		}
+
+		if warning, err := dumpSizeVerdict(size, options); err != nil {
+			plan.Warnings = append(plan.Warnings, "the run would stop: "+err.Error())
+		} else if warning != "" {
+			plan.Warnings = append(plan.Warnings, warning)
+		}
+
+		if citus, err := checkCitus(ctx, connectionURL, options); err != nil {
+			plan.Warnings = append(plan.Warnings, "the run would stop: "+err.Error())
+		} else if citus != nil {
+			options.FlattenCitus = true
+			plan.PgDumpArgs = dumpOptions(options).Args()
+			plan.Warnings = append(plan.Warnings, "the "+citus.String()+" of Citus would be flattened into regular tables")
+		}
+	}
+
+	if options.CreateContainer {
+		apiClient, err := newDockerClient(ctx)
+		if err != nil {
+			return nil, err
+		}
+		defer apiClient.Close()
+
+		if err := validateBindAddress(options.BindAddress); err != nil {
+			return nil, err
+		}
+
+		if err := validateContainerOptions(options); err != nil {
+			return nil, err
+		}
+
+		name := options.ContainerName
+		if name == "" {
+			name = defaultContainerName(databaseName)
+		}
+
+		plan.Container, err = resolveContainerName(ctx, apiClient, name, options.Replace, options.AutoSuffix)
+		if err != nil {
+			return nil, err
+		}
+
+		plan.Port, err = reserveHostPort(ctx, apiClient, options.BindAddress, options.HostPort, options.PortFallback, replacing(options))
+		if err != nil {
+			return nil, err
+		}
+
+		plan.Bind = options.BindAddress
+		plan.Network = options.Network
+	}
+
+	return plan, nil
+}
+
+// planSource fills in what the plan takes from the source database.
+func planSource(ctx context.Context, plan *runPlan, connectionURL string, options backupOptions) error {
+	conn, err := pgx.Connect(ctx, connectionURL)
+	if err != nil {
+		return fmt.Errorf("Failed to connect to the source database: %w", err)
+	}
+	defer conn.Close(ctx)
+
+	if err := conn.QueryRow(ctx, "SELECT current_setting('server_version'), pg_database_size(current_database())").Scan(&plan.ServerVersion, &plan.DatabaseSize); err != nil {
+		return fmt.Errorf("Failed to query the source database: %w", err)
+	}
+
+	if options.Physical {
+		var versionNum int
+		if err := conn.QueryRow(ctx, "SELECT current_setting('server_version_num')::int, sum(pg_database_size(oid))::bigint FROM pg_database").Scan(&versionNum, &plan.DatabaseSize); err != nil {
+			return fmt.Errorf("Failed to query the source database: %w", err)
+		}
+
+		plan.Physical = true
+		plan.PgDumpArgs = nil
+		plan.BaseImage = basebackupImage(versionNum)
+	} else {
+		if version, err := pgcontainer.PgDumpVersion(ctx); err == nil {
+			plan.PgDumpVersion = version
+		} else {
+			plan.Warnings = append(plan.Warnings, "the embedded pg_dump cannot run on this machine")
+		}
+
+		timescale, versionNum, err := pgcontainer.SourceTimescale(ctx, conn)
+		if err != nil {
+			return fmt.Errorf("Failed to query the source database: %w", err)
+		}
+		if timescale != "" {
+			plan.BaseImage = pgcontainer.TimescaleImage(timescale, versionNum)
+		}
+	}
+
+	return nil
+}
+
+func printPlan(ctx context.Context, connectionURL string, options backupOptions, format string) error {
+	plan, err := planBackup(ctx, connectionURL, options)
+	if err != nil {
+		return err
+	}
+
+	if format == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(plan)
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+
+	fmt.Fprintf(tw, "Source:\t%s\n", plan.Source)
+	if plan.Backup != "" {
+		fmt.Fprintf(tw, "Database:\t%s\n", plan.Database)
+	} else {
+		fmt.Fprintf(tw, "Database:\t%s (%s, PostgreSQL %s)\n", plan.Database, units.HumanSize(float64(plan.DatabaseSize)), plan.ServerVersion)
+	}
+	if plan.Backup != "" {
+		fmt.Fprintf(tw, "Copy:\trestore of the latest backup in %s\n", plan.Backup)
+	} else if plan.Physical {
+		fmt.Fprintf(tw, "Copy:\tpg_basebackup of the whole cluster (%s)\n", units.HumanSize(float64(plan.DatabaseSize)))
+	} else {
+		fmt.Fprintf(tw, "pg_dump:\t%s %s\n", plan.PgDumpVersion, strings.Join(plan.PgDumpArgs, " "))
+	}
+	fmt.Fprintf(tw, "Base image:\t%s\n", plan.BaseImage)
+	fmt.Fprintf(tw, "Image:\t%s\n", plan.Image)
+
+	if plan.Container != "" {
+		fmt.Fprintf(tw, "Container:\t%s\n", plan.Container)
+		fmt.Fprintf(tw, "Published on:\t%s:%s\n", plan.Bind, plan.Port)
+		if plan.Network != "" {
+			fmt.Fprintf(tw, "Network:\t%s\n", plan.Network)
+		}
+		fmt.Fprintf(tw, "Start:\t%t\n", plan.Start)
+	}
+
+	for _, warning := range plan.Warnings {
+		fmt.Fprintf(tw, "Warning:\t%s\n", warning)
+	}
+
+	return tw.Flush()
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/docker/go-units"
+	"github.com/jackc/pgx/v5"
+)
+
+// parseDumpSize parses the size of --max-dump-size or --warn-dump-size, e.g.
+// 50GB. An empty value means no threshold.
+func parseDumpSize(flag string, value string) (int64, error) {
+	if value == "" {
+		return 0, nil
+	}
+
+	size, err := units.FromHumanSize(value)
+	if err != nil || size <= 0 {
+		return 0, fmt.Errorf("Invalid --%s %q: expected a size such as 50GB", flag, value)
+	}
+
+	return size, nil
+}
+
+// checkDumpSize estimates the size of the snapshot before anything is dumped
+// and fails when it exceeds --max-dump-size, or warns when it exceeds
+// --warn-dump-size. A restore from a backup repository, whose size is not
+// known up front, is not checked.
+func checkDumpSize(ctx context.Context, connectionURL string, options backupOptions) error {
+	if (options.MaxDumpSize == 0 && options.WarnDumpSize == 0) || options.FromBackup != nil {
+		return nil
+	}
+
+	size, err := estimateDumpSize(ctx, connectionURL, options)
+	if err != nil {
+		return connectionError(fmt.Errorf("Failed to estimate the size of the source database: %w", err))
+	}
+
+	warning, err := dumpSizeVerdict(size, options)
+	if err != nil {
+		return err
+	}
+	if warning != "" {
+		logger.Warn(warning)
+	}
+
+	return nil
+}
+
+// dumpSizeVerdict compares an estimated size against the thresholds and
+// returns the error of one over --max-dump-size or the warning of one over
+// --warn-dump-size.
+func dumpSizeVerdict(size int64, options backupOptions) (string, error) {
+	human := units.HumanSize(float64(size))
+
+	if options.MaxDumpSize > 0 && size > options.MaxDumpSize {
+		return "", fmt.Errorf("The source is about %s, over --max-dump-size %s; narrow it down with --schema or raise the limit",
+			human, units.HumanSize(float64(options.MaxDumpSize)))
+	}
+
+	if options.WarnDumpSize > 0 && size > options.WarnDumpSize {
+		return fmt.Sprintf("The source is about %s, over --warn-dump-size %s; the snapshot will take a while and a lot of disk space",
+			human, units.HumanSize(float64(options.WarnDumpSize))), nil
+	}
+
+	return "", nil
+}
+
+// estimateDumpSize is the size on disk of what the run copies: the whole
+// cluster for --physical, the relations of the --schema schemas, or else the
+// database. Indexes count as well, since the restore rebuilds them.
+func estimateDumpSize(ctx context.Context, connectionURL string, options backupOptions) (int64, error) {
+	if options.Physical || len(options.Schemas) == 0 {
+		return sourceDatabaseSize(ctx, connectionURL, options.Physical)
+	}
+
+	conn, err := pgx.Connect(ctx, connectionURL)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close(ctx)
+
+	var size int64
+	err = conn.QueryRow(ctx, `SELECT coalesce(sum(pg_total_relation_size(c.oid)), 0)::bigint
+		FROM pg_class c JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE n.nspname = ANY($1) AND c.relkind IN ('r', 'm', 'p')`, options.Schemas).Scan(&size)
+
+	return size, err
+}
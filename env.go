@@ -0,0 +1,53 @@
+package main
+
+import (
+	"strings"
+
+	cli "github.com/urfave/cli/v3"
+)
+
+// envPrefix starts the environment variables that set flags.
+const envPrefix = "PG_CONTAINER_"
+
+// bindEnvVars gives every flag of cmd and its subcommands that does not have
+// an environment variable yet one named after it: PG_CONTAINER_FORMAT for
+// --format of the root command, which the subcommands inherit, and
+// PG_CONTAINER_METRICS_LISTEN for --listen of metrics, since subcommands
+// reuse names such as --output with other meanings. Flags on the command line
+// win over the environment, which wins over a --profile.
+func bindEnvVars(cmd *cli.Command, prefix string) {
+	for _, flag := range cmd.Flags {
+		name := prefix + envName(flag.Names()[0])
+
+		switch flag := flag.(type) {
+		case *cli.StringFlag:
+			if len(flag.Sources.EnvKeys()) == 0 {
+				flag.Sources = cli.EnvVars(name)
+			}
+		case *cli.BoolFlag:
+			if len(flag.Sources.EnvKeys()) == 0 {
+				flag.Sources = cli.EnvVars(name)
+			}
+		case *cli.IntFlag:
+			if len(flag.Sources.EnvKeys()) == 0 {
+				flag.Sources = cli.EnvVars(name)
+			}
+		case *cli.DurationFlag:
+			if len(flag.Sources.EnvKeys()) == 0 {
+				flag.Sources = cli.EnvVars(name)
+			}
+		case *cli.StringSliceFlag:
+			if len(flag.Sources.EnvKeys()) == 0 {
+				flag.Sources = cli.EnvVars(name)
+			}
+		}
+	}
+
+	for _, subcommand := range cmd.Commands {
+		bindEnvVars(subcommand, envPrefix+envName(subcommand.Name)+"_")
+	}
+}
+
+func envName(name string) string {
+	return strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+	"github.com/docker/go-connections/nat"
+)
+
+// ephemeralContainer is a throwaway container started from a snapshot image
+// for commands that need to query it, such as verify.
+type ephemeralContainer struct {
+	ID           string
+	Port         string
+	DatabaseName string
+
+	apiClient *client.Client
+}
+
+// URL is the connection string of the ephemeral container's database.
+func (e *ephemeralContainer) URL() string {
+	return connectionString(e.DatabaseName, "127.0.0.1", e.Port)
+}
+
+func (e *ephemeralContainer) Remove() error {
+	return e.apiClient.ContainerRemove(context.Background(), e.ID, container.RemoveOptions{Force: true})
+}
+
+// startEphemeralContainer starts imageName on a free loopback port and waits
+// until it accepts connections. The caller must Remove it.
+func startEphemeralContainer(ctx context.Context, apiClient *client.Client, imageName string, timeout time.Duration) (*ephemeralContainer, error) {
+	inspect, _, err := apiClient.ImageInspectWithRaw(ctx, imageName)
+	if err != nil {
+		return nil, fmt.Errorf("Image %s not found: %w", imageName, err)
+	}
+
+	databaseName := "postgres"
+	if inspect.Config != nil && inspect.Config.Labels[databaseLabel] != "" {
+		databaseName = inspect.Config.Labels[databaseLabel]
+	}
+
+	port, err := freePort("127.0.0.1")
+	if err != nil {
+		return nil, err
+	}
+
+	containerConfig := &container.Config{
+		Image: imageName,
+		Labels: map[string]string{
+			managedLabel:   "true",
+			temporaryLabel: "true",
+			databaseLabel:  databaseName,
+		},
+		ExposedPorts: nat.PortSet{"5432/tcp": struct{}{}},
+	}
+	hostConfig := &container.HostConfig{
+		PortBindings: nat.PortMap{
+			"5432/tcp": []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: port}},
+		},
+	}
+
+	created, err := apiClient.ContainerCreate(ctx, containerConfig, hostConfig, nil, nil, "")
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create a container from %s: %w", imageName, err)
+	}
+
+	e := &ephemeralContainer{ID: created.ID, Port: port, DatabaseName: databaseName, apiClient: apiClient}
+
+	if err := startContainer(ctx, apiClient, created.ID, timeout, nil); err != nil {
+		e.Remove()
+		return nil, err
+	}
+
+	return e, nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/docker/docker/client"
+)
+
+// Exit codes, so scripts can branch on which part of a run failed. They are
+// listed in the help output as well.
+const (
+	exitFailure    = 1 // invalid arguments or anything not covered below
+	exitConnection = 2 // the source database or the Docker daemon could not be reached
+	exitDump       = 3 // pg_dump failed
+	exitBuild      = 4 // building the image or restoring the dump into it failed
+	exitContainer  = 5 // creating, starting or checking the container failed
+
+	// exitInterrupted follows the shell convention of 128 + SIGINT.
+	exitInterrupted = 130
+)
+
+const exitCodesHelp = `Exit codes:
+	1	invalid arguments or other failure
+	2	the source database or the Docker daemon could not be reached
+	3	pg_dump failed
+	4	building the image or restoring the dump failed
+	5	creating, starting or checking the container failed
+	130	interrupted by Ctrl-C or SIGTERM`
+
+// phaseError attributes a failure to the phase of the run it happened in,
+// which decides the exit code.
+type phaseError struct {
+	code int
+	err  error
+}
+
+func (e *phaseError) Error() string {
+	return e.err.Error()
+}
+
+func (e *phaseError) Unwrap() error {
+	return e.err
+}
+
+func connectionError(err error) error {
+	return &phaseError{code: exitConnection, err: err}
+}
+
+// dumpError reports a failed pg_dump. pg_dump exits the same way whether it
+// could not connect or failed halfway, so its output decides which it was.
+func dumpError(err error, output string) error {
+	if strings.Contains(output, "connection to server") || strings.Contains(output, "could not connect") {
+		return connectionError(err)
+	}
+
+	return &phaseError{code: exitDump, err: err}
+}
+
+func buildError(err error) error {
+	return &phaseError{code: exitBuild, err: err}
+}
+
+func containerError(err error) error {
+	return &phaseError{code: exitContainer, err: err}
+}
+
+// exitCode maps an error returned by a command to the process exit code. An
+// unreachable Docker daemon counts as a connection error whichever phase ran
+// into it.
+func exitCode(err error) int {
+	if errors.Is(err, context.Canceled) {
+		return exitInterrupted
+	}
+
+	if client.IsErrConnectionFailed(err) {
+		return exitConnection
+	}
+
+	var phaseErr *phaseError
+	if errors.As(err, &phaseErr) {
+		return phaseErr.code
+	}
+
+	return exitFailure
+}
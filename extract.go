@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/docker/docker/api/types/registry"
+	cli "github.com/urfave/cli/v3"
+)
+
+var extractCommand = &cli.Command{
+	Name:          "extract",
+	Usage:         "Copy the dump out of an existing snapshot image",
+	ShellComplete: completeImages(1),
+	UsageText: `pg_container extract [image] -o [file]
+
+With --from-registry the image is a reference in a registry, and the dump is
+fetched from the artifact pushed with promote --push --attach-dump, without
+pulling the image.
+
+Example:
+	pg_container extract db-2025-01-18-1200:latest -o dump.sql
+	pg_container extract registry.example.com/db:staging --from-registry -o dump.sql`,
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:    "output",
+			Aliases: []string{"o"},
+			Usage:   "File to write the dump to, or - for stdout",
+			Value:   "-",
+		},
+		&cli.BoolFlag{
+			Name:  "from-registry",
+			Usage: "Fetch the dump attached to the image in its registry instead of reading a local image",
+		},
+		&cli.StringFlag{
+			Name:    "registry-username",
+			Usage:   "Username used to authenticate to the registry",
+			Sources: cli.EnvVars("PG_CONTAINER_REGISTRY_USERNAME"),
+		},
+		&cli.StringFlag{
+			Name:    "registry-password",
+			Usage:   "Password used to authenticate to the registry",
+			Sources: cli.EnvVars("PG_CONTAINER_REGISTRY_PASSWORD"),
+		},
+	},
+	Action: func(ctx context.Context, cmd *cli.Command) error {
+		imageName := cmd.Args().Get(0)
+		if imageName == "" {
+			return cli.ShowSubcommandHelp(cmd)
+		}
+
+		dump, err := openDump(ctx, cmd, imageName)
+		if err != nil {
+			return err
+		}
+		defer dump.Close()
+
+		output := cmd.String("output")
+		if output == "-" {
+			_, err = io.Copy(os.Stdout, dump)
+			return err
+		}
+
+		file, err := os.Create(output)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		written, err := io.Copy(file, dump)
+		if err != nil {
+			return fmt.Errorf("Failed to write dump to %s: %w", output, err)
+		}
+
+		logger.Info(fmt.Sprintf("✅ Extracted %d bytes", written), "file", output)
+
+		return file.Close()
+	},
+}
+
+// openDump opens the dump of imageName, a local image or with
+// --from-registry one in a registry.
+func openDump(ctx context.Context, cmd *cli.Command, imageName string) (io.ReadCloser, error) {
+	if cmd.Bool("from-registry") {
+		return fetchDumpArtifact(ctx, imageName, registry.AuthConfig{
+			Username: cmd.String("registry-username"),
+			Password: cmd.String("registry-password"),
+		})
+	}
+
+	apiClient, err := newDockerClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	dump, err := openImageDump(ctx, apiClient, imageName)
+	if err != nil {
+		apiClient.Close()
+		return nil, err
+	}
+
+	return &imageDump{Reader: dump, close: func() error {
+		defer apiClient.Close()
+		return dump.Close()
+	}}, nil
+}
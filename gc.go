@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/bgrcs/pg_container/pgcontainer"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/client"
+	cli "github.com/urfave/cli/v3"
+)
+
+func newRunID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+
+	return hex.EncodeToString(b)
+}
+
+// runResources tracks what a single run created so it can be undone when the
+// run fails part way through.
+type runResources struct {
+	runID      string
+	apiClient  *client.Client
+	nerdctl    *pgcontainer.Nerdctl
+	images     []string
+	containers []string
+	networks   []string
+}
+
+func (r *runResources) addImage(name string) {
+	r.images = append(r.images, name)
+}
+
+func (r *runResources) addContainer(name string) {
+	r.containers = append(r.containers, name)
+}
+
+func (r *runResources) addNetwork(name string) {
+	r.networks = append(r.networks, name)
+}
+
+// rollback removes everything the run created, including the dangling
+// builder-stage images that carry the run label but were never tagged.
+func (r *runResources) rollback() {
+	if r.nerdctl != nil {
+		r.rollbackNerdctl()
+		return
+	}
+
+	if r.apiClient == nil {
+		return
+	}
+
+	ctx := context.Background()
+
+	logger.Info("> 🧹 Rolling back resources from failed run")
+
+	for _, name := range r.containers {
+		if err := r.apiClient.ContainerRemove(ctx, name, container.RemoveOptions{Force: true}); err != nil {
+			logger.Warn("Failed to remove container", "container", name, "error", err)
+		}
+	}
+
+	for _, name := range r.networks {
+		if err := r.apiClient.NetworkRemove(ctx, name); err != nil {
+			logger.Warn("Failed to remove network", "network", name, "error", err)
+		}
+	}
+
+	for _, name := range r.images {
+		if _, err := r.apiClient.ImageRemove(ctx, name, image.RemoveOptions{Force: true, PruneChildren: true}); err != nil {
+			logger.Warn("Failed to remove image", "image", name, "error", err)
+		}
+	}
+
+	removeImages(ctx, r.apiClient, filters.NewArgs(
+		filters.Arg("label", runLabel+"="+r.runID),
+	), false)
+}
+
+// rollbackNerdctl is rollback for --runtime nerdctl, where the build leaves no
+// intermediate images behind.
+func (r *runResources) rollbackNerdctl() {
+	if len(r.containers) == 0 && len(r.images) == 0 {
+		return
+	}
+
+	ctx := context.Background()
+
+	logger.Info("> 🧹 Rolling back resources from failed run")
+
+	for _, name := range r.containers {
+		if err := r.nerdctl.RemoveContainer(ctx, name); err != nil {
+			logger.Warn("Failed to remove container", "container", name, "error", err)
+		}
+	}
+
+	for _, name := range r.images {
+		if err := r.nerdctl.RemoveImage(ctx, name); err != nil {
+			logger.Warn("Failed to remove image", "image", name, "error", err)
+		}
+	}
+}
+
+// removeImages deletes every image matching the filters and returns how many
+// were (or with dryRun, would be) removed.
+func removeImages(ctx context.Context, apiClient *client.Client, imageFilters filters.Args, dryRun bool) int {
+	images, err := apiClient.ImageList(ctx, image.ListOptions{All: true, Filters: imageFilters})
+	if err != nil {
+		logger.Warn("Failed to list images", "error", err)
+		return 0
+	}
+
+	removed := 0
+
+	for _, summary := range images {
+		if dryRun {
+			fmt.Printf("Would remove image %s\n", summary.ID)
+			removed++
+			continue
+		}
+
+		if _, err := apiClient.ImageRemove(ctx, summary.ID, image.RemoveOptions{Force: true, PruneChildren: true}); err != nil {
+			logger.Warn("Failed to remove image", "image", summary.ID, "error", err)
+			continue
+		}
+		removed++
+	}
+
+	return removed
+}
+
+var gcCommand = &cli.Command{
+	Name:  "gc",
+	Usage: "Remove leftovers from failed or interrupted runs",
+	UsageText: `pg_container gc [--containers] [--dry-run] [--yes]
+
+What would be removed is listed and confirmed first, unless --yes is given;
+without a terminal to confirm on, --yes is required. Temporary containers are
+only removed once they stopped, as a running one may belong to a run still in
+progress in another shell or batch; one left running by a killed run can be
+removed with docker rm -f.
+
+Example:
+	pg_container gc --dry-run`,
+	Flags: []cli.Flag{
+		&cli.BoolFlag{
+			Name:  "containers",
+			Usage: "Also remove stopped snapshot containers",
+		},
+		&cli.BoolFlag{
+			Name:  "dry-run",
+			Usage: "Only list what would be removed",
+		},
+	},
+	Action: func(ctx context.Context, cmd *cli.Command) error {
+		apiClient, err := newDockerClient(ctx)
+		if err != nil {
+			return err
+		}
+		defer apiClient.Close()
+
+		dryRun, withContainers := cmd.Bool("dry-run"), cmd.Bool("containers")
+
+		// List what would go first and ask, unless that is all that was asked.
+		if !dryRun && !cmd.Bool("yes") {
+			containers, images := collectGarbage(ctx, apiClient, withContainers, true)
+			if containers+images == 0 {
+				logger.Info("✅ Nothing to clean up")
+				return nil
+			}
+
+			if err := confirmRemoval(fmt.Sprintf("these %d containers and %d images", containers, images), false); err != nil {
+				return err
+			}
+		}
+
+		removedContainers, removedImages := collectGarbage(ctx, apiClient, withContainers, dryRun)
+
+		logger.Info(fmt.Sprintf("✅ Cleaned up %d containers and %d images", removedContainers, removedImages))
+
+		return nil
+	},
+}
+
+// stoppedStatuses are the states of containers no run is using.
+var stoppedStatuses = []string{"created", "exited", "dead"}
+
+// collectGarbage removes the leftovers of runs, and with withContainers the
+// stopped snapshot containers, returning how many containers and images were
+// (or with dryRun, would be) removed. Running temporary containers are left
+// alone, as they may be restoring or committing for a run in progress.
+func collectGarbage(ctx context.Context, apiClient *client.Client, withContainers bool, dryRun bool) (int, int) {
+	removedContainers := 0
+
+	label := temporaryLabel + "=true"
+	if withContainers {
+		label = managedLabel + "=true"
+	}
+	for _, status := range stoppedStatuses {
+		removedContainers += removeContainers(ctx, apiClient, filters.NewArgs(
+			filters.Arg("label", label),
+			filters.Arg("status", status),
+		), dryRun)
+	}
+
+	removedImages := removeImages(ctx, apiClient, filters.NewArgs(
+		filters.Arg("label", managedLabel+"=true"),
+		filters.Arg("dangling", "true"),
+	), dryRun)
+
+	return removedContainers, removedImages
+}
+
+func removeContainers(ctx context.Context, apiClient *client.Client, containerFilters filters.Args, dryRun bool) int {
+	containers, err := apiClient.ContainerList(ctx, container.ListOptions{All: true, Filters: containerFilters})
+	if err != nil {
+		logger.Warn("Failed to list containers", "error", err)
+		return 0
+	}
+
+	removed := 0
+
+	for _, c := range containers {
+		name := c.ID
+		if len(c.Names) > 0 {
+			name = c.Names[0]
+		}
+
+		if dryRun {
+			fmt.Printf("Would remove container %s\n", name)
+			removed++
+			continue
+		}
+
+		if err := apiClient.ContainerRemove(ctx, c.ID, container.RemoveOptions{Force: true}); err != nil {
+			logger.Warn("Failed to remove container", "container", name, "error", err)
+			continue
+		}
+		removed++
+	}
+
+	return removed
+}
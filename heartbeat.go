@@ -0,0 +1,42 @@
+package main
+
+import (
+	"time"
+)
+
+const defaultHeartbeatInterval = time.Minute
+
+// startHeartbeat logs a line every interval until the returned function is
+// called, so CI systems that kill jobs without output do not give up on a long
+// dump or build. progress, if not nil, adds a detail such as the bytes dumped
+// so far. An interval of 0 disables the heartbeat.
+func startHeartbeat(interval time.Duration, phase string, progress func() string) func() {
+	if interval <= 0 {
+		return func() {}
+	}
+
+	start := time.Now()
+	done := make(chan struct{})
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				args := []any{"phase", phase, "elapsed", time.Since(start).Round(time.Second)}
+				if progress != nil {
+					args = append(args, "progress", progress())
+				}
+				logger.Info("⏳ Still working", args...)
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+	}
+}
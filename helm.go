@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"embed"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	cli "github.com/urfave/cli/v3"
+	"gopkg.in/yaml.v3"
+)
+
+// helmTemplates are the chart's templates, copied as they are. Only
+// Chart.yaml and values.yaml depend on the image.
+//
+//go:embed all:helm
+var helmTemplates embed.FS
+
+var helmCommand = &cli.Command{
+	Name:          "helm",
+	Usage:         "Scaffold a Helm chart running a snapshot image",
+	ShellComplete: completeImages(1),
+	UsageText: `pg_container helm [image] [-o dir]
+
+Example:
+	pg_container helm registry.example.com/db:staging --storage 20Gi -o charts/db`,
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:    "output",
+			Aliases: []string{"o"},
+			Usage:   "Directory to write the chart to (default: the chart name)",
+		},
+		&cli.StringFlag{
+			Name:  "name",
+			Usage: "Name of the chart (default: the database name)",
+		},
+		&cli.StringFlag{
+			Name:  "database",
+			Usage: "Database in the image, read from its labels when omitted",
+		},
+		&cli.StringFlag{
+			Name:  "storage",
+			Usage: "Keep PGDATA in a persistent volume claim of this size, e.g. 20Gi; without it changes are lost when the pod restarts",
+		},
+		&cli.StringFlag{
+			Name:  "storage-class",
+			Usage: "Storage class of the volume claim",
+		},
+		&cli.StringFlag{
+			Name:  "memory",
+			Usage: "Memory limit of the pod, e.g. 2g",
+		},
+		&cli.StringFlag{
+			Name:  "cpus",
+			Usage: "CPU limit of the pod, e.g. 1.5",
+		},
+	},
+	Action: func(ctx context.Context, cmd *cli.Command) error {
+		imageName := cmd.Args().Get(0)
+		if imageName == "" {
+			return cli.ShowSubcommandHelp(cmd)
+		}
+
+		databaseName := cmd.String("database")
+		if databaseName == "" {
+			apiClient, err := newDockerClient(ctx)
+			if err != nil {
+				return err
+			}
+			defer apiClient.Close()
+
+			inspect, _, err := apiClient.ImageInspectWithRaw(ctx, imageName)
+			if err != nil {
+				return fmt.Errorf("Image %s not found, pass --database if it only exists in a registry: %w", imageName, err)
+			}
+			if inspect.Config != nil {
+				databaseName = inspect.Config.Labels[databaseLabel]
+			}
+			if databaseName == "" {
+				return fmt.Errorf("%s does not record its database; pass --database", imageName)
+			}
+		}
+
+		name := cmd.String("name")
+		if name == "" {
+			name = k8sName(databaseName)
+		}
+
+		dir := cmd.String("output")
+		if dir == "" {
+			dir = name
+		}
+
+		values := helmValues{Database: databaseName}
+		values.Image.Repository = imageRepository(imageName)
+		values.Image.Tag = strings.TrimPrefix(imageName[len(values.Image.Repository):], ":")
+		if values.Image.Tag == "" {
+			values.Image.Tag = "latest"
+		}
+		values.Image.PullPolicy = "IfNotPresent"
+		values.Service.Type = "ClusterIP"
+		values.Service.Port = 5432
+		values.Storage.Enabled = cmd.String("storage") != ""
+		values.Storage.Size = cmd.String("storage")
+		if values.Storage.Size == "" {
+			values.Storage.Size = "10Gi"
+		}
+		values.Storage.StorageClassName = cmd.String("storage-class")
+		values.Resources = map[string]map[string]string{}
+		if memory := cmd.String("memory"); memory != "" {
+			values.limit("memory", k8sQuantity(memory))
+		}
+		if cpus := cmd.String("cpus"); cpus != "" {
+			values.limit("cpu", cpus)
+		}
+
+		if err := writeHelmChart(dir, name, values); err != nil {
+			return err
+		}
+
+		logger.Info("⎈ Wrote Helm chart", "chart", name, "dir", dir)
+		logger.Info("Install it with: helm install " + name + " " + dir)
+
+		return nil
+	},
+}
+
+type helmValues struct {
+	Image struct {
+		Repository string `yaml:"repository"`
+		Tag        string `yaml:"tag"`
+		PullPolicy string `yaml:"pullPolicy"`
+	} `yaml:"image"`
+	Database string `yaml:"database"`
+	Service  struct {
+		Type string `yaml:"type"`
+		Port int    `yaml:"port"`
+	} `yaml:"service"`
+	Storage struct {
+		Enabled          bool   `yaml:"enabled"`
+		Size             string `yaml:"size"`
+		StorageClassName string `yaml:"storageClassName"`
+	} `yaml:"storage"`
+	Resources map[string]map[string]string `yaml:"resources"`
+}
+
+func (v *helmValues) limit(resource, value string) {
+	if v.Resources["limits"] == nil {
+		v.Resources["limits"] = map[string]string{}
+	}
+	v.Resources["limits"][resource] = value
+}
+
+func writeHelmChart(dir string, name string, values helmValues) error {
+	chart := map[string]any{
+		"apiVersion":  "v2",
+		"name":        name,
+		"description": "Snapshot of the " + values.Database + " database made by pg_container",
+		"type":        "application",
+		"version":     "0.1.0",
+		"appVersion":  values.Image.Tag,
+	}
+
+	for file, content := range map[string]any{"Chart.yaml": chart, "values.yaml": values} {
+		var output bytes.Buffer
+		encoder := yaml.NewEncoder(&output)
+		encoder.SetIndent(2)
+		if err := encoder.Encode(content); err != nil {
+			return err
+		}
+
+		if err := writeChartFile(filepath.Join(dir, file), output.Bytes()); err != nil {
+			return err
+		}
+	}
+
+	return fs.WalkDir(helmTemplates, "helm", func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+
+		content, err := helmTemplates.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		return writeChartFile(filepath.Join(dir, strings.TrimPrefix(path, "helm/")), content)
+	})
+}
+
+func writeChartFile(path string, content []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(path, content, 0644); err != nil {
+		return fmt.Errorf("Failed to write %s: %w", path, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
+
+	"github.com/bgrcs/pg_container/pgcontainer"
+	"github.com/docker/go-units"
+	cli "github.com/urfave/cli/v3"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type phaseTiming struct {
+	Name     string        `json:"name"`
+	Duration time.Duration `json:"duration"`
+	Seconds  float64       `json:"seconds"`
+}
+
+// runRecord is one line of the history file, describing a single invocation.
+// It is also what --output json prints at the end of a run.
+type runRecord struct {
+	Time          time.Time             `json:"time"`
+	RunID         string                `json:"run_id"`
+	Database      string                `json:"database"`
+	Image         string                `json:"image,omitempty"`
+	ImageID       string                `json:"image_id,omitempty"`
+	Container     string                `json:"container,omitempty"`
+	ContainerID   string                `json:"container_id,omitempty"`
+	Port          string                `json:"port,omitempty"`
+	ConnectionURL string                `json:"connection_url,omitempty"`
+	DumpSize      int64                 `json:"dump_size"`
+	ImageSize     int64                 `json:"image_size"`
+	Phases        []phaseTiming         `json:"phases"`
+	Warnings      []pgcontainer.Warning `json:"warnings,omitempty"`
+	Changes       []pgcontainer.Change  `json:"changes,omitempty"`
+	Result        string                `json:"result"`
+	Error         string                `json:"error,omitempty"`
+
+	ci *ciReporter
+
+	// span covers the whole run and phaseSpan the phase in progress, with
+	// spanCtx carrying span as the parent of the phases.
+	spanCtx   context.Context
+	span      trace.Span
+	phaseSpan trace.Span
+}
+
+// startSpan starts the span of the run and returns the context to continue
+// the run with, so the Docker API calls are traced beneath it.
+func (r *runRecord) startSpan(ctx context.Context) context.Context {
+	r.spanCtx, r.span = tracer.Start(ctx, "pg_container", trace.WithAttributes(attribute.String("pg_container.run_id", r.RunID)))
+	return r.spanCtx
+}
+
+// track starts timing a phase and returns the function that stops it.
+func (r *runRecord) track(phase string) func() {
+	start := time.Now()
+	r.ci.startPhase(phase)
+	if r.spanCtx != nil {
+		_, r.phaseSpan = tracer.Start(r.spanCtx, phase)
+	}
+
+	return func() {
+		r.ci.endPhase()
+		if r.phaseSpan != nil {
+			r.phaseSpan.End()
+			r.phaseSpan = nil
+		}
+		elapsed := time.Since(start)
+		r.Phases = append(r.Phases, phaseTiming{Name: phase, Duration: elapsed, Seconds: elapsed.Seconds()})
+	}
+}
+
+func (r *runRecord) duration() time.Duration {
+	var total time.Duration
+	for _, phase := range r.Phases {
+		total += phase.Duration
+	}
+
+	return total
+}
+
+// finish writes the record to the history file, with the error the run
+// failed with if any, and ends its spans.
+func (r *runRecord) finish(err error) {
+	if r.phaseSpan != nil {
+		endSpan(r.phaseSpan, err)
+	}
+	if r.span != nil {
+		r.span.SetAttributes(
+			attribute.String("pg_container.database", r.Database),
+			attribute.String("pg_container.image", r.Image),
+			attribute.Int64("pg_container.dump_size", r.DumpSize),
+			attribute.Int64("pg_container.image_size", r.ImageSize),
+		)
+		endSpan(r.span, err)
+	}
+
+	if err != nil {
+		r.Result = "failed"
+		r.Error = err.Error()
+	} else {
+		r.Result = "success"
+	}
+
+	if err := appendHistory(r); err != nil {
+		logger.Warn("Failed to record run history", "error", err)
+	}
+}
+
+func historyPath() (string, error) {
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(configDir, "pg_container", "history.jsonl"), nil
+}
+
+func appendHistory(r *runRecord) error {
+	path, err := historyPath()
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	line, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+
+	return file.Close()
+}
+
+func readHistory() ([]runRecord, error) {
+	path, err := historyPath()
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var records []runRecord
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var r runRecord
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			continue
+		}
+		records = append(records, r)
+	}
+
+	return records, scanner.Err()
+}
+
+var historyCommand = &cli.Command{
+	Name:  "history",
+	Usage: "Show previous runs with their durations and sizes",
+	UsageText: `pg_container history [--database name] [--limit n]
+
+Example:
+	pg_container history --database db`,
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "database",
+			Usage: "Only show runs for this database",
+		},
+		&cli.IntFlag{
+			Name:  "limit",
+			Usage: "Number of most recent runs to show",
+			Value: 20,
+		},
+	},
+	Action: func(ctx context.Context, cmd *cli.Command) error {
+		records, err := readHistory()
+		if err != nil {
+			return err
+		}
+
+		database := cmd.String("database")
+
+		var shown []runRecord
+		lastDumpSize := map[string]int64{}
+		var growth []string
+
+		for _, r := range records {
+			if database != "" && r.Database != database {
+				continue
+			}
+
+			change := ""
+			if previous := lastDumpSize[r.Database]; previous > 0 && r.DumpSize > 0 {
+				change = fmt.Sprintf("%+.0f%%", float64(r.DumpSize-previous)/float64(previous)*100)
+			}
+			if r.Result == "success" {
+				lastDumpSize[r.Database] = r.DumpSize
+			}
+
+			shown = append(shown, r)
+			growth = append(growth, change)
+		}
+
+		if limit := int(cmd.Int("limit")); limit > 0 && len(shown) > limit {
+			growth = growth[len(shown)-limit:]
+			shown = shown[len(shown)-limit:]
+		}
+
+		if len(shown) == 0 {
+			fmt.Println("No runs recorded yet")
+			return nil
+		}
+
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "TIME\tDATABASE\tRESULT\tDUMP\tCHANGE\tIMAGE\tDURATION\tPHASES")
+
+		for i, r := range shown {
+			phases := ""
+			for _, phase := range r.Phases {
+				phases += fmt.Sprintf("%s=%s ", phase.Name, phase.Duration.Round(time.Second))
+			}
+
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+				r.Time.Local().Format("2006-01-02 15:04"),
+				r.Database,
+				r.Result,
+				units.HumanSize(float64(r.DumpSize)),
+				growth[i],
+				units.HumanSize(float64(r.ImageSize)),
+				r.duration().Round(time.Second),
+				phases,
+			)
+		}
+
+		return tw.Flush()
+	},
+}
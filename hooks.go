@@ -0,0 +1,187 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+	"gopkg.in/yaml.v3"
+)
+
+// runPostStartSQL copies a SQL file into the container and runs it with psql,
+// stopping at the first error.
+func runPostStartSQL(ctx context.Context, apiClient *client.Client, containerName string, databaseName string, sqlPath string) error {
+	sql, err := os.ReadFile(sqlPath)
+	if err != nil {
+		return err
+	}
+
+	exitCode, output, err := psqlInContainer(ctx, apiClient, containerName, databaseName, "post-start.sql", sql)
+	if err != nil {
+		return err
+	}
+
+	postStartLog := newLogWriter(slog.LevelInfo, "psql")
+	postStartLog.Write([]byte(output))
+	postStartLog.Flush()
+
+	if exitCode != 0 {
+		return fmt.Errorf("%s failed with exit code %d", filepath.Base(sqlPath), exitCode)
+	}
+
+	return nil
+}
+
+// psqlInContainer copies sql into the container as /tmp/name and runs it
+// with psql, stopping at the first error. It returns the exit code and the
+// output of psql.
+func psqlInContainer(ctx context.Context, apiClient *client.Client, containerName string, databaseName string, name string, sql []byte) (int, string, error) {
+	var archive bytes.Buffer
+	tw := tar.NewWriter(&archive)
+
+	if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(sql))}); err != nil {
+		return -1, "", err
+	}
+	if _, err := tw.Write(sql); err != nil {
+		return -1, "", err
+	}
+	if err := tw.Close(); err != nil {
+		return -1, "", err
+	}
+
+	if err := apiClient.CopyToContainer(ctx, containerName, "/tmp", &archive, container.CopyToContainerOptions{}); err != nil {
+		return -1, "", fmt.Errorf("Failed to copy %s into the container: %w", name, err)
+	}
+
+	return execInContainer(ctx, apiClient, containerName, []string{
+		"psql", "-U", "postgres", "-d", databaseName, "-v", "ON_ERROR_STOP=1", "-f", "/tmp/" + name,
+	})
+}
+
+// Events of a run that --hook commands can be attached to.
+const (
+	hookPreDump   = "pre-dump"
+	hookPostDump  = "post-dump"
+	hookPreBuild  = "pre-build"
+	hookPostBuild = "post-build"
+	hookPostStart = "post-start"
+)
+
+var hookEvents = []string{hookPreDump, hookPostDump, hookPreBuild, hookPostBuild, hookPostStart}
+
+// lifecycleHooks maps an event to the shell commands run on it, in order.
+type lifecycleHooks map[string][]string
+
+// parseHooks reads the hooks of a --hooks-file and --hook event=command
+// values, which run after those of the file. The file maps events to a
+// command or a list of them:
+//
+//	pre-dump: ./scripts/check-replica-lag.sh
+//	post-build:
+//	  - ./scripts/warm-cache.sh
+//	  - curl -fsS -X POST https://ci.example.com/hooks/snapshot
+func parseHooks(file string, values []string) (lifecycleHooks, error) {
+	hooks := lifecycleHooks{}
+
+	if file != "" {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+
+		var events map[string]any
+		if err := yaml.Unmarshal(content, &events); err != nil {
+			return nil, fmt.Errorf("Failed to parse %s: %w", file, err)
+		}
+
+		for event, commands := range events {
+			if !slices.Contains(hookEvents, event) {
+				return nil, fmt.Errorf("Unknown hook event %q in %s: expected one of %s", event, file, strings.Join(hookEvents, ", "))
+			}
+
+			switch commands := commands.(type) {
+			case string:
+				hooks[event] = append(hooks[event], commands)
+			case []any:
+				for _, command := range commands {
+					command, ok := command.(string)
+					if !ok {
+						return nil, fmt.Errorf("Invalid %s hook in %s: expected a command", event, file)
+					}
+					hooks[event] = append(hooks[event], command)
+				}
+			default:
+				return nil, fmt.Errorf("Invalid %s hook in %s: expected a command or a list of commands", event, file)
+			}
+		}
+	}
+
+	for _, value := range values {
+		event, command, ok := strings.Cut(value, "=")
+		if !ok || command == "" {
+			return nil, fmt.Errorf("Invalid --hook %q: expected event=command", value)
+		}
+		if !slices.Contains(hookEvents, event) {
+			return nil, fmt.Errorf("Invalid --hook %q: the event must be one of %s", value, strings.Join(hookEvents, ", "))
+		}
+
+		hooks[event] = append(hooks[event], command)
+	}
+
+	return hooks, nil
+}
+
+// run runs the commands of an event on the host, with what the run has
+// produced so far in their environment. The first failing command fails the
+// run.
+func (h lifecycleHooks) run(ctx context.Context, event string, run *runRecord) error {
+	for _, command := range h[event] {
+		logger.Info("🪝 Running "+event+" hook", "command", command)
+
+		cmd := exec.CommandContext(ctx, "sh", "-c", command)
+		cmd.Stdout = os.Stderr
+		cmd.Stderr = os.Stderr
+		cmd.Env = append(os.Environ(), hookEnv(event, run)...)
+
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("The %s hook %q failed: %w", event, command, err)
+		}
+	}
+
+	return nil
+}
+
+// hookEnv describes the run to a hook. Variables for results the run has not
+// reached yet are left out.
+func hookEnv(event string, run *runRecord) []string {
+	env := []string{
+		"PG_CONTAINER_EVENT=" + event,
+		"PG_CONTAINER_RUN_ID=" + run.RunID,
+		"PG_CONTAINER_DATABASE=" + run.Database,
+	}
+
+	if run.DumpSize > 0 {
+		env = append(env, "PG_CONTAINER_DUMP_SIZE="+strconv.FormatInt(run.DumpSize, 10))
+	}
+	if run.Image != "" {
+		env = append(env, "PG_CONTAINER_IMAGE="+run.Image, "PG_CONTAINER_IMAGE_ID="+run.ImageID)
+	}
+	if run.Container != "" {
+		env = append(env, "PG_CONTAINER_CONTAINER_NAME="+run.Container)
+	}
+	if run.ConnectionURL != "" {
+		env = append(env, "DATABASE_URL="+run.ConnectionURL)
+	}
+
+	return env
+}
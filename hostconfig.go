@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/go-units"
+)
+
+// parseRestartPolicy accepts the same values as docker run --restart,
+// including on-failure:N.
+func parseRestartPolicy(value string) (container.RestartPolicy, error) {
+	name, retries, hasRetries := strings.Cut(value, ":")
+
+	policy := container.RestartPolicy{Name: container.RestartPolicyMode(name)}
+	if name == "" {
+		policy.Name = container.RestartPolicyDisabled
+	}
+
+	if hasRetries {
+		count, err := strconv.Atoi(retries)
+		if err != nil {
+			return policy, fmt.Errorf("Invalid restart policy %q: retry count must be a number", value)
+		}
+		policy.MaximumRetryCount = count
+	}
+
+	if err := container.ValidateRestartPolicy(policy); err != nil {
+		return policy, fmt.Errorf("Invalid restart policy %q: %w", value, err)
+	}
+
+	return policy, nil
+}
+
+// applyResourceLimits sets --memory, --cpus and --shm-size on hostConfig.
+// Sizes take the usual docker suffixes such as 512m or 2g.
+func applyResourceLimits(hostConfig *container.HostConfig, options backupOptions) error {
+	if options.Memory != "" {
+		memory, err := units.RAMInBytes(options.Memory)
+		if err != nil {
+			return fmt.Errorf("Invalid --memory %q: %w", options.Memory, err)
+		}
+		hostConfig.Memory = memory
+	}
+
+	if options.CPUs != "" {
+		cpus, err := strconv.ParseFloat(options.CPUs, 64)
+		if err != nil || cpus <= 0 {
+			return fmt.Errorf("Invalid --cpus %q: expected a positive number such as 1.5", options.CPUs)
+		}
+		hostConfig.NanoCPUs = int64(cpus * 1e9)
+	}
+
+	if options.ShmSize != "" {
+		shmSize, err := units.RAMInBytes(options.ShmSize)
+		if err != nil {
+			return fmt.Errorf("Invalid --shm-size %q: %w", options.ShmSize, err)
+		}
+		hostConfig.ShmSize = shmSize
+	}
+
+	return nil
+}
+
+// healthcheck makes docker report the container healthy once Postgres accepts
+// connections, which is what compose's service_healthy condition waits for.
+func healthcheck(options backupOptions) *container.HealthConfig {
+	if options.HealthInterval <= 0 {
+		return &container.HealthConfig{Test: []string{"NONE"}}
+	}
+
+	return &container.HealthConfig{
+		Test:     []string{"CMD", "pg_isready", "-U", "postgres", "-h", "127.0.0.1", "-p", options.ContainerPort},
+		Interval: options.HealthInterval,
+		Timeout:  options.HealthInterval,
+		Retries:  options.HealthRetries,
+	}
+}
+
+// parseEnv validates --env values. Like docker run, a bare KEY passes the
+// variable through from the current environment.
+func parseEnv(values []string) ([]string, error) {
+	var env []string
+
+	for _, value := range values {
+		key, _, hasValue := strings.Cut(value, "=")
+		if key == "" {
+			return nil, fmt.Errorf("Invalid --env %q: expected KEY=VALUE", value)
+		}
+
+		if !hasValue {
+			hostValue, ok := os.LookupEnv(key)
+			if !ok {
+				continue
+			}
+			value = key + "=" + hostValue
+		}
+
+		env = append(env, value)
+	}
+
+	return env, nil
+}
+
+func validateContainerOptions(options backupOptions) error {
+	if n, err := strconv.Atoi(options.ContainerPort); err != nil || n < 1 || n > 65535 {
+		return fmt.Errorf("Invalid --container-port %q: expected a number between 1 and 65535", options.ContainerPort)
+	}
+
+	policy, err := parseRestartPolicy(options.Restart)
+	if err != nil {
+		return err
+	}
+
+	if err := applyResourceLimits(&container.HostConfig{}, options); err != nil {
+		return err
+	}
+
+	if options.TmpfsPGData && options.Restart != "no" && options.Restart != "" {
+		logger.Warn("--tmpfs-pgdata discards all changes whenever the container restarts")
+	}
+
+	if options.TmpfsPGData && options.Volume != "" {
+		return fmt.Errorf("--tmpfs-pgdata and --volume cannot be used together")
+	}
+
+	if options.AutoRemove && policy.Name != container.RestartPolicyDisabled {
+		return fmt.Errorf("--rm cannot be combined with --restart %s", options.Restart)
+	}
+
+	return nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/bgrcs/pg_container/pgcontainer"
+)
+
+func initScripts(options backupOptions) []pgcontainer.InitScript {
+	scripts := slices.Clone(options.InitSQL)
+
+	if options.ReadonlyUser != "" {
+		scripts = append(scripts, pgcontainer.InitScript{
+			Name: "50-readonly-user.sql",
+			SQL:  readonlyUserSQL(options.ReadonlyUser, options.ReadonlyPassword),
+		})
+	}
+
+	return scripts
+}
+
+// readInitSQL reads the --init-sql files. They are numbered to run in the
+// given order, and before the read-only role is created so it is granted
+// SELECT on the tables they create too.
+func readInitSQL(paths []string) ([]pgcontainer.InitScript, error) {
+	var scripts []pgcontainer.InitScript
+
+	for i, path := range paths {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read --init-sql: %w", err)
+		}
+
+		scripts = append(scripts, pgcontainer.InitScript{
+			Name: fmt.Sprintf("40-init-%02d.sql", i+1),
+			SQL:  string(content),
+		})
+	}
+
+	return scripts, nil
+}
+
+// readonlyUserSQL creates a login role that can read every table, view and
+// sequence in the restored schemas.
+func readonlyUserSQL(name string, password string) string {
+	var sql strings.Builder
+
+	fmt.Fprintf(&sql, "CREATE ROLE %s LOGIN PASSWORD %s;\n", quoteIdent(name), quoteLiteral(password))
+	fmt.Fprintf(&sql, "SELECT format('GRANT CONNECT ON DATABASE %%I TO %%I', current_database(), %s) \\gexec\n", quoteLiteral(name))
+
+	for _, statement := range []string{
+		"GRANT USAGE ON SCHEMA %I TO %I",
+		"GRANT SELECT ON ALL TABLES IN SCHEMA %I TO %I",
+		"GRANT SELECT ON ALL SEQUENCES IN SCHEMA %I TO %I",
+	} {
+		fmt.Fprintf(&sql,
+			"SELECT format('%s', nspname, %s) FROM pg_namespace WHERE nspname NOT LIKE 'pg\\_%%' AND nspname <> 'information_schema' \\gexec\n",
+			statement, quoteLiteral(name),
+		)
+	}
+
+	return sql.String()
+}
+
+// parseReadonlyUser splits a --readonly-user value of name[:password],
+// generating a password when none is given.
+func parseReadonlyUser(value string) (string, string, error) {
+	name, password, _ := strings.Cut(value, ":")
+	if name == "" {
+		return "", "", fmt.Errorf("Invalid --readonly-user %q: expected name[:password]", value)
+	}
+
+	if password == "" {
+		password = newRunID()
+	}
+
+	return name, password, nil
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// k8sManifests describes how to run a snapshot in a cluster. The manifests
+// are plain maps rather than the client-go types, which would pull in the
+// whole Kubernetes API for a handful of fields.
+type k8sManifests struct {
+	Name        string
+	Image       string
+	Database    string
+	Options     backupOptions
+	SourceURL   string
+	Schedule    string
+	RefreshWith string
+}
+
+type yamlMap = map[string]any
+
+func (m k8sManifests) labels() yamlMap {
+	return yamlMap{
+		"app.kubernetes.io/name":       m.Name,
+		"app.kubernetes.io/managed-by": "pg_container",
+	}
+}
+
+func (m k8sManifests) metadata() yamlMap {
+	return yamlMap{"name": m.Name, "labels": m.labels()}
+}
+
+func (m k8sManifests) deployment() yamlMap {
+	container := yamlMap{
+		"name":  "postgres",
+		"image": m.Image,
+		"ports": []yamlMap{{"name": "postgres", "containerPort": 5432}},
+		"readinessProbe": yamlMap{
+			"exec":          yamlMap{"command": []string{"pg_isready", "-U", "postgres", "-h", "127.0.0.1"}},
+			"periodSeconds": 5,
+		},
+	}
+
+	var env []yamlMap
+	for _, value := range m.Options.Env {
+		name, value, _ := strings.Cut(value, "=")
+		env = append(env, yamlMap{"name": name, "value": value})
+	}
+	if len(env) > 0 {
+		container["env"] = env
+	}
+
+	limits := yamlMap{}
+	if m.Options.Memory != "" {
+		limits["memory"] = k8sQuantity(m.Options.Memory)
+	}
+	if m.Options.CPUs != "" {
+		limits["cpu"] = m.Options.CPUs
+	}
+	if len(limits) > 0 {
+		container["resources"] = yamlMap{"limits": limits}
+	}
+
+	pod := yamlMap{"containers": []yamlMap{container}}
+
+	// Same reason as --shm-size: the 64m default is too small for parallel
+	// queries.
+	if m.Options.ShmSize != "" {
+		container["volumeMounts"] = []yamlMap{{"name": "shm", "mountPath": "/dev/shm"}}
+		pod["volumes"] = []yamlMap{{
+			"name":     "shm",
+			"emptyDir": yamlMap{"medium": "Memory", "sizeLimit": k8sQuantity(m.Options.ShmSize)},
+		}}
+	}
+
+	return yamlMap{
+		"apiVersion": "apps/v1",
+		"kind":       "Deployment",
+		"metadata":   m.metadata(),
+		"spec": yamlMap{
+			"replicas": 1,
+			"selector": yamlMap{"matchLabels": m.labels()},
+			// The data lives in the image, so there is nothing to hand over
+			// between an old and a new pod.
+			"strategy": yamlMap{"type": "Recreate"},
+			"template": yamlMap{
+				"metadata": yamlMap{"labels": m.labels()},
+				"spec":     pod,
+			},
+		},
+	}
+}
+
+func (m k8sManifests) service() yamlMap {
+	return yamlMap{
+		"apiVersion": "v1",
+		"kind":       "Service",
+		"metadata":   m.metadata(),
+		"spec": yamlMap{
+			"selector": m.labels(),
+			"ports":    []yamlMap{{"name": "postgres", "port": 5432, "targetPort": "postgres"}},
+		},
+	}
+}
+
+func (m k8sManifests) secret() yamlMap {
+	data := yamlMap{
+		"DATABASE_URL": fmt.Sprintf("postgres://postgres:postgres@%s:5432/%s", m.Name, m.Database),
+	}
+	if m.Schedule != "" {
+		data["SOURCE_URL"] = m.SourceURL
+	}
+
+	return yamlMap{
+		"apiVersion": "v1",
+		"kind":       "Secret",
+		"metadata":   m.metadata(),
+		"type":       "Opaque",
+		"stringData": data,
+	}
+}
+
+// cronJob reruns pg_container against the source on a schedule. The image
+// passed with --k8s-refresh-image has to bring pg_container and access to a
+// Docker daemon.
+func (m k8sManifests) cronJob() yamlMap {
+	return yamlMap{
+		"apiVersion": "batch/v1",
+		"kind":       "CronJob",
+		"metadata":   yamlMap{"name": m.Name + "-refresh", "labels": m.labels()},
+		"spec": yamlMap{
+			"schedule":          m.Schedule,
+			"concurrencyPolicy": "Forbid",
+			"jobTemplate": yamlMap{"spec": yamlMap{"template": yamlMap{"spec": yamlMap{
+				"restartPolicy": "Never",
+				"containers": []yamlMap{{
+					"name":  "refresh",
+					"image": m.RefreshWith,
+					"args":  []string{"$(SOURCE_URL)"},
+					"env": []yamlMap{{
+						"name": "SOURCE_URL",
+						"valueFrom": yamlMap{"secretKeyRef": yamlMap{
+							"name": m.Name,
+							"key":  "SOURCE_URL",
+						}},
+					}},
+				}},
+			}}}},
+		},
+	}
+}
+
+// k8sQuantity turns docker sizes such as 2g or 512m into the binary suffixes
+// Kubernetes expects, where a plain m would mean milli.
+func k8sQuantity(size string) string {
+	lower := strings.ToLower(size)
+	for _, suffix := range []string{"k", "m", "g", "t"} {
+		for _, unit := range []string{suffix + "b", suffix} {
+			if number, ok := strings.CutSuffix(lower, unit); ok {
+				return number + strings.ToUpper(suffix) + "i"
+			}
+		}
+	}
+
+	return size
+}
+
+type k8sObject struct {
+	file   string
+	object yamlMap
+	mode   os.FileMode
+}
+
+// k8sName turns a database name into a valid object name, which allows
+// neither upper case nor underscores.
+func k8sName(databaseName string) string {
+	name := strings.Trim(strings.ReplaceAll(composeServiceName(databaseName), "_", "-"), "-")
+	if name == "" {
+		return "postgres"
+	}
+
+	return name
+}
+
+// writeK8sManifests writes one file per object into dir and returns their
+// paths. The secret holds connection URLs and is only readable by the owner.
+func writeK8sManifests(dir string, m k8sManifests) ([]string, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	objects := []k8sObject{
+		{"deployment.yaml", m.deployment(), 0644},
+		{"service.yaml", m.service(), 0644},
+		{"secret.yaml", m.secret(), 0600},
+	}
+	if m.Schedule != "" {
+		objects = append(objects, k8sObject{"cronjob.yaml", m.cronJob(), 0644})
+	}
+
+	var written []string
+	for _, o := range objects {
+		var content bytes.Buffer
+		encoder := yaml.NewEncoder(&content)
+		encoder.SetIndent(2)
+		if err := encoder.Encode(o.object); err != nil {
+			return nil, err
+		}
+
+		path := filepath.Join(dir, o.file)
+		if err := os.WriteFile(path, content.Bytes(), o.mode); err != nil {
+			return nil, fmt.Errorf("Failed to write %s: %w", path, err)
+		}
+		written = append(written, path)
+	}
+
+	return written, nil
+}
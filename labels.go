@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+const (
+	// databaseLabel is set on every image we build so later commands can find
+	// the database a snapshot was taken from without parsing the image name.
+	databaseLabel = "pg_container.database"
+
+	// managedLabel marks every image and container created by the tool.
+	managedLabel = "pg_container.managed"
+
+	// runLabel ties an artifact to the invocation that created it, so a failed
+	// run can find and remove what it left behind.
+	runLabel = "pg_container.run"
+
+	// sourceLabel records the connection URL a snapshot was taken from, with
+	// the password removed, so refresh can dump the same source again.
+	sourceLabel = "pg_container.source"
+
+	// temporaryLabel marks containers that only exist for the duration of a
+	// command, such as the ones used to read a dump out of an image.
+	temporaryLabel = "pg_container.temporary"
+
+	// citusLabel, timezoneLabel and readonlyUserLabel record the --citus,
+	// --timezone and --readonly-user a snapshot was built with, so refresh
+	// builds the next one the same way. The password of the read-only user is
+	// not recorded; refresh generates a new one unless it is passed again.
+	citusLabel        = "pg_container.citus"
+	timezoneLabel     = "pg_container.timezone"
+	readonlyUserLabel = "pg_container.readonly-user"
+
+	// replicaLabel marks the logical replica of a database kept by replica,
+	// with the name of the database. The replica is not a snapshot, so it
+	// carries no managedLabel and gc leaves it alone.
+	replicaLabel = "pg_container.replica"
+)
+
+func managedLabels(runID string, databaseName string, connectionURL string) map[string]string {
+	return map[string]string{
+		managedLabel:  "true",
+		runLabel:      runID,
+		databaseLabel: databaseName,
+		sourceLabel:   redactURL(connectionURL),
+	}
+}
+
+// snapshotLabels are managedLabels plus the labels recording the options
+// refresh needs to build the snapshot again.
+func snapshotLabels(runID string, databaseName string, connectionURL string, options backupOptions) map[string]string {
+	labels := managedLabels(runID, databaseName, connectionURL)
+
+	if options.Citus != "" && options.Citus != citusFail {
+		labels[citusLabel] = options.Citus
+	}
+	if options.Timezone != "" {
+		labels[timezoneLabel] = options.Timezone
+	}
+	if options.ReadonlyUser != "" {
+		labels[readonlyUserLabel] = options.ReadonlyUser
+	}
+
+	return labels
+}
+
+// redactURL drops the password from a connection URL.
+func redactURL(connectionURL string) string {
+	u, err := url.Parse(connectionURL)
+	if err != nil {
+		return ""
+	}
+
+	if u.User != nil {
+		u.User = url.User(u.User.Username())
+	}
+
+	return u.String()
+}
+
+// isToolLabel reports whether a label is one of the tool's own rather than
+// one passed with --label.
+func isToolLabel(key string) bool {
+	return strings.HasPrefix(key, "pg_container.")
+}
+
+// mergeLabels adds user supplied labels to the tool's own, which always win so
+// the lifecycle commands keep recognizing the artifacts.
+func mergeLabels(labels map[string]string, custom map[string]string) map[string]string {
+	merged := map[string]string{}
+
+	for key, value := range custom {
+		merged[key] = value
+	}
+
+	for key, value := range labels {
+		merged[key] = value
+	}
+
+	return merged
+}
+
+// parseKeyValues parses repeated KEY=VALUE flag values.
+func parseKeyValues(flagName string, values []string) (map[string]string, error) {
+	parsed := map[string]string{}
+
+	for _, value := range values {
+		key, v, ok := strings.Cut(value, "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("Invalid --%s %q: expected KEY=VALUE", flagName, value)
+		}
+		parsed[key] = v
+	}
+
+	return parsed, nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+	cli "github.com/urfave/cli/v3"
+)
+
+var startCommand = &cli.Command{
+	Name:          "start",
+	Usage:         "Start snapshot containers and wait until they accept connections",
+	ShellComplete: completeContainers(0),
+	UsageText: `pg_container start [container...] [--all]
+
+Example:
+	pg_container start postgres-db-staging`,
+	Flags: []cli.Flag{
+		&cli.BoolFlag{
+			Name:  "all",
+			Usage: "Start every stopped snapshot container",
+		},
+		&cli.DurationFlag{
+			Name:  "timeout",
+			Usage: "How long to wait for each container to accept connections",
+			Value: defaultStartTimeout,
+		},
+	},
+	Action: func(ctx context.Context, cmd *cli.Command) error {
+		return forEachManagedContainer(ctx, cmd, func(apiClient *client.Client, c types.Container) error {
+			if c.State == "running" {
+				logger.Info("Container is already running", "container", containerName(c))
+				return nil
+			}
+
+			if err := startContainer(ctx, apiClient, c.ID, cmd.Duration("timeout"), nil); err != nil {
+				return containerError(err)
+			}
+
+			logger.Info("✅ Started", "container", containerName(c))
+
+			if host, port, ok := publishedPort(ctx, apiClient, c.ID); ok {
+				printReady(c.Labels[databaseLabel], host, port)
+			}
+
+			return nil
+		})
+	},
+}
+
+var stopCommand = &cli.Command{
+	Name:          "stop",
+	Usage:         "Stop snapshot containers",
+	ShellComplete: completeContainers(0),
+	UsageText: `pg_container stop [container...] [--all]
+
+Example:
+	pg_container stop --all`,
+	Flags: []cli.Flag{
+		&cli.BoolFlag{
+			Name:  "all",
+			Usage: "Stop every running snapshot container",
+		},
+	},
+	Action: func(ctx context.Context, cmd *cli.Command) error {
+		return forEachManagedContainer(ctx, cmd, func(apiClient *client.Client, c types.Container) error {
+			if c.State != "running" {
+				logger.Info("Container is not running", "container", containerName(c))
+				return nil
+			}
+
+			if err := apiClient.ContainerStop(ctx, c.ID, container.StopOptions{}); err != nil {
+				return containerError(fmt.Errorf("Failed to stop %s: %w", containerName(c), err))
+			}
+
+			logger.Info("✅ Stopped", "container", containerName(c))
+
+			return nil
+		})
+	},
+}
+
+// forEachManagedContainer applies fn to the containers named on the command
+// line, or to all snapshot containers with --all. Unmanaged containers are
+// never touched, even when named explicitly.
+func forEachManagedContainer(ctx context.Context, cmd *cli.Command, fn func(*client.Client, types.Container) error) error {
+	if cmd.NArg() == 0 && !cmd.Bool("all") {
+		return cli.ShowSubcommandHelp(cmd)
+	}
+
+	apiClient, err := newDockerClient(ctx)
+	if err != nil {
+		return err
+	}
+	defer apiClient.Close()
+
+	var targets []types.Container
+
+	if cmd.Bool("all") {
+		targets, err = listManagedContainers(ctx, apiClient)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, name := range cmd.Args().Slice() {
+		c, err := findManagedContainer(ctx, apiClient, name)
+		if err != nil {
+			return err
+		}
+		targets = append(targets, c)
+	}
+
+	for _, c := range targets {
+		if err := fn(apiClient, c); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
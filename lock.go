@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// acquireRunLock makes sure only one run per database is in progress, so two
+// runs do not pick the same container name or replace each other's container.
+// It fails right away instead of waiting; the returned function releases the
+// lock.
+func acquireRunLock(databaseName string) (func(), error) {
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return nil, err
+	}
+
+	dir := filepath.Join(cacheDir, "pg_container", "locks")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	path := filepath.Join(dir, databaseName+".lock")
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open lock file %s: %w", path, err)
+	}
+
+	locked, err := tryLock(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("Failed to lock %s: %w", path, err)
+	}
+
+	if !locked {
+		holder, _ := os.ReadFile(path)
+		f.Close()
+
+		if pid := strings.TrimSpace(string(holder)); pid != "" {
+			return nil, fmt.Errorf("Another run for database %s is in progress (pid %s); wait for it to finish or pass --no-lock", databaseName, pid)
+		}
+		return nil, fmt.Errorf("Another run for database %s is in progress; wait for it to finish or pass --no-lock", databaseName)
+	}
+
+	f.Truncate(0)
+	f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+
+	return func() {
+		f.Truncate(0)
+		f.Close()
+	}, nil
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// tryLock is a no-op where flock is not available.
+func tryLock(f *os.File) (bool, error) {
+	return true, nil
+}
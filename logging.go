@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/moby/term"
+)
+
+// logger receives all progress output. It writes to stderr so that stdout only
+// carries results: the artifact name with --quiet, tables of the inspection
+// commands, or the --output json document.
+var logger = slog.New(newTextHandler(os.Stderr, slog.LevelInfo))
+
+// plainOutput leaves emoji and ANSI escapes out of the output, so CI logs and
+// log aggregators get plain text. setupLogging turns it on for --no-emoji,
+// when NO_COLOR is set, and when stderr is not a terminal.
+var plainOutput bool
+
+// setupLogging configures logger from --verbose, --quiet, --no-emoji and
+// --log-format. --verbose additionally shows the pg_dump, docker build and
+// container log streams; --quiet leaves only warnings and errors.
+func setupLogging(verbose, quiet, noEmoji bool, format string) error {
+	if verbose && quiet {
+		return fmt.Errorf("--verbose and --quiet cannot be used together")
+	}
+
+	level := slog.LevelInfo
+	if verbose {
+		level = slog.LevelDebug
+	}
+	if quiet {
+		level = slog.LevelWarn
+	}
+
+	_, stderrIsTerminal := term.GetFdInfo(os.Stderr)
+	plainOutput = noEmoji || os.Getenv("NO_COLOR") != "" || !stderrIsTerminal
+
+	switch format {
+	case "text":
+		logger = slog.New(newTextHandler(os.Stderr, level))
+	case "json":
+		logger = slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: level, ReplaceAttr: plainMessage}))
+	default:
+		return fmt.Errorf("Invalid --log-format %q: expected text or json", format)
+	}
+
+	// Route anything still using the log package through the same handler.
+	slog.SetDefault(logger)
+
+	return nil
+}
+
+// ansiEscape matches the escape sequences that color or move the cursor.
+var ansiEscape = regexp.MustCompile(`\x1b\[[0-9;?]*[ -/]*[@-~]`)
+
+// display returns s as it is to be printed: in plain output without ANSI
+// escapes, and without emoji along with the spaces after them, so that
+// "✅ Done" becomes "Done".
+func display(s string) string {
+	if !plainOutput {
+		return s
+	}
+
+	s = ansiEscape.ReplaceAllString(s, "")
+
+	var out strings.Builder
+	afterEmoji := false
+	for _, r := range s {
+		switch {
+		case isEmoji(r):
+			afterEmoji = true
+			continue
+		case r == ' ' && afterEmoji:
+			continue
+		}
+		afterEmoji = false
+		out.WriteRune(r)
+	}
+
+	return strings.TrimRight(out.String(), " ")
+}
+
+// isEmoji reports whether r is a pictograph or one of the joiners, variation
+// selectors and skin tones emoji are made up of.
+func isEmoji(r rune) bool {
+	return unicode.Is(unicode.So, r) || r == '\u200d' || (r >= 0xfe00 && r <= 0xfe0f) || (r >= 0x1f3fb && r <= 0x1f3ff)
+}
+
+// plainMessage is the ReplaceAttr of the JSON handler, which passes the
+// message of each record through display.
+func plainMessage(groups []string, attr slog.Attr) slog.Attr {
+	if len(groups) == 0 && attr.Key == slog.MessageKey {
+		attr.Value = slog.StringValue(display(attr.Value.String()))
+	}
+
+	return attr
+}
+
+// quiet reports whether informational output is switched off, in which case
+// commands print just the name of what they produced on stdout.
+func quiet() bool {
+	return !logger.Enabled(context.Background(), slog.LevelInfo)
+}
+
+// textHandler prints the message followed by its attributes as key=value,
+// without the timestamp and level columns of slog.TextHandler. Warnings and
+// errors are marked so they stand out in the progress output, with words in
+// plain output, and lines of a logWriter stream are prefixed with the
+// stream's name.
+type textHandler struct {
+	mu     *sync.Mutex
+	w      io.Writer
+	level  slog.Leveler
+	prefix string
+	attrs  []slog.Attr
+}
+
+func newTextHandler(w io.Writer, level slog.Leveler) *textHandler {
+	return &textHandler{mu: &sync.Mutex{}, w: w, level: level}
+}
+
+func (h *textHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+func (h *textHandler) Handle(_ context.Context, record slog.Record) error {
+	var line strings.Builder
+
+	switch {
+	case record.Level >= slog.LevelError && plainOutput:
+		line.WriteString("ERROR: ")
+	case record.Level >= slog.LevelError:
+		line.WriteString("❌ ")
+	case record.Level >= slog.LevelWarn && plainOutput:
+		line.WriteString("WARNING: ")
+	case record.Level >= slog.LevelWarn:
+		line.WriteString("⚠️  ")
+	}
+
+	var source string
+	record.Attrs(func(attr slog.Attr) bool {
+		if attr.Key == sourceKey {
+			source = attr.Value.String()
+		}
+		return true
+	})
+	if source != "" {
+		line.WriteString(source + ": ")
+	}
+	line.WriteString(display(record.Message))
+
+	writeAttr := func(attr slog.Attr) bool {
+		if !attr.Equal(slog.Attr{}) && attr.Key != sourceKey {
+			fmt.Fprintf(&line, " %s%s=%s", h.prefix, attr.Key, attr.Value.Resolve())
+		}
+		return true
+	}
+
+	for _, attr := range h.attrs {
+		writeAttr(attr)
+	}
+	record.Attrs(writeAttr)
+	line.WriteByte('\n')
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	_, err := io.WriteString(h.w, line.String())
+	return err
+}
+
+func (h *textHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	clone := *h
+	clone.attrs = append(append([]slog.Attr{}, h.attrs...), attrs...)
+	return &clone
+}
+
+func (h *textHandler) WithGroup(name string) slog.Handler {
+	clone := *h
+	clone.prefix = h.prefix + name + "."
+	return &clone
+}
+
+const sourceKey = "source"
+
+// logWriter turns an output stream into log records, one per line, tagged with
+// the stream it came from.
+type logWriter struct {
+	level   slog.Level
+	source  string
+	pending []byte
+}
+
+func newLogWriter(level slog.Level, source string) *logWriter {
+	return &logWriter{level: level, source: source}
+}
+
+func (w *logWriter) Write(p []byte) (int, error) {
+	w.pending = append(w.pending, p...)
+
+	for {
+		i := bytes.IndexByte(w.pending, '\n')
+		if i < 0 {
+			break
+		}
+
+		w.log(w.pending[:i])
+		w.pending = w.pending[i+1:]
+	}
+
+	return len(p), nil
+}
+
+// Flush logs a trailing line that did not end in a newline.
+func (w *logWriter) Flush() {
+	if len(w.pending) > 0 {
+		w.log(w.pending)
+		w.pending = nil
+	}
+}
+
+func (w *logWriter) log(line []byte) {
+	text := strings.TrimRight(string(line), "\r")
+	if strings.TrimSpace(text) == "" {
+		return
+	}
+
+	logger.Log(context.Background(), w.level, text, sourceKey, w.source)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/client"
+)
+
+// listManagedContainers returns the snapshot containers created by the tool,
+// newest first. Throwaway containers used internally are left out.
+func listManagedContainers(ctx context.Context, apiClient *client.Client) ([]types.Container, error) {
+	containers, err := apiClient.ContainerList(ctx, container.ListOptions{
+		All:     true,
+		Filters: filters.NewArgs(filters.Arg("label", managedLabel+"=true")),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to list containers: %w", err)
+	}
+
+	var managed []types.Container
+	for _, c := range containers {
+		if c.Labels[temporaryLabel] != "true" {
+			managed = append(managed, c)
+		}
+	}
+
+	sort.Slice(managed, func(i, j int) bool {
+		return managed[i].Created > managed[j].Created
+	})
+
+	return managed, nil
+}
+
+// listManagedImages returns the snapshot images built by the tool, newest
+// first, optionally only those of one database.
+func listManagedImages(ctx context.Context, apiClient *client.Client, database string) ([]image.Summary, error) {
+	imageFilters := filters.NewArgs(filters.Arg("label", managedLabel+"=true"), filters.Arg("dangling", "false"))
+	if database != "" {
+		imageFilters.Add("label", databaseLabel+"="+database)
+	}
+
+	images, err := apiClient.ImageList(ctx, image.ListOptions{Filters: imageFilters})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to list images: %w", err)
+	}
+
+	sort.Slice(images, func(i, j int) bool {
+		return images[i].Created > images[j].Created
+	})
+
+	return images, nil
+}
+
+// findManagedContainer looks up a tool-managed container by name, or picks
+// the most recently created running one (falling back to any) when name is
+// empty.
+func findManagedContainer(ctx context.Context, apiClient *client.Client, name string) (types.Container, error) {
+	containers, err := listManagedContainers(ctx, apiClient)
+	if err != nil {
+		return types.Container{}, err
+	}
+
+	if name != "" {
+		for _, c := range containers {
+			if containerName(c) == name || strings.HasPrefix(c.ID, name) {
+				return c, nil
+			}
+		}
+
+		return types.Container{}, fmt.Errorf("No pg_container managed container named %s", name)
+	}
+
+	for _, c := range containers {
+		if c.State == "running" {
+			return c, nil
+		}
+	}
+
+	if len(containers) > 0 {
+		return containers[0], nil
+	}
+
+	return types.Container{}, fmt.Errorf("No pg_container managed containers found; create one with -c")
+}
+
+func containerName(c types.Container) string {
+	if len(c.Names) > 0 {
+		return strings.TrimPrefix(c.Names[0], "/")
+	}
+
+	return c.ID[:12]
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/docker/go-units"
+)
+
+// parseMaxRate turns a --max-rate such as 50MB/s, or just 50MB, into bytes
+// per second. An empty value means no limit.
+func parseMaxRate(value string) (int64, error) {
+	if value == "" {
+		return 0, nil
+	}
+
+	rate, err := units.FromHumanSize(strings.TrimSuffix(strings.TrimSpace(value), "/s"))
+	if err != nil || rate <= 0 {
+		return 0, fmt.Errorf("Invalid --max-rate %q: expected a size per second such as 50MB/s", value)
+	}
+
+	return rate, nil
+}
+
+// basebackupMaxRate is the --max-rate argument of pg_basebackup for a limit
+// in bytes per second. pg_basebackup takes kilobytes and accepts 32kB/s to
+// 1GB/s, so the limit is clamped to that range.
+func basebackupMaxRate(bytesPerSecond int64) string {
+	if bytesPerSecond <= 0 {
+		return ""
+	}
+
+	return fmt.Sprintf("%dk", min(max(bytesPerSecond/1024, 32), 1024*1024))
+}
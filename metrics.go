@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	cli "github.com/urfave/cli/v3"
+)
+
+// durationBuckets are the upper bounds, in seconds, of the phase duration
+// histograms; snapshot jobs take anywhere from seconds to hours.
+var durationBuckets = []float64{1, 5, 15, 30, 60, 120, 300, 600, 1800, 3600, 7200}
+
+var metricsCommand = &cli.Command{
+	Name:  "metrics",
+	Usage: "Serve Prometheus metrics about the recorded runs",
+	UsageText: `pg_container metrics [--listen address] [--output file]
+
+The metrics are computed from the run history on every scrape, so they cover
+runs started by cron, CI or by hand alike. Failures per database are
+pg_container_runs_total{result="failed"}.
+
+Examples:
+	pg_container metrics --listen :9187
+	pg_container metrics --output /var/lib/node_exporter/textfile/pg_container.prom`,
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "listen",
+			Usage: "Address to serve /metrics on",
+			Value: "127.0.0.1:9187",
+		},
+		&cli.StringFlag{
+			Name:    "output",
+			Aliases: []string{"o"},
+			Usage:   "Write the metrics to this file once instead of serving them, e.g. for the node_exporter textfile collector",
+		},
+	},
+	Action: func(ctx context.Context, cmd *cli.Command) error {
+		if output := cmd.String("output"); output != "" {
+			return writeMetricsFile(output)
+		}
+
+		return serveMetrics(ctx, cmd.String("listen"))
+	},
+}
+
+func serveMetrics(ctx context.Context, address string) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return fmt.Errorf("Failed to listen on %s: %w", address, err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", handleMetrics)
+
+	logger.Info("📈 Serving metrics on http://" + listener.Addr().String() + "/metrics")
+
+	return serveHTTP(ctx, listener, mux)
+}
+
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	records, err := readHistory()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	writeMetrics(w, records)
+}
+
+// serveHTTP serves handler on listener until ctx is done.
+func serveHTTP(ctx context.Context, listener net.Listener, handler http.Handler) error {
+	server := &http.Server{Handler: handler, ReadHeaderTimeout: 10 * time.Second}
+
+	go func() {
+		<-ctx.Done()
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+
+	if err := server.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+
+	return nil
+}
+
+// writeMetricsFile replaces the file in one rename, so a collector reading it
+// never sees half of it.
+func writeMetricsFile(path string) error {
+	records, err := readHistory()
+	if err != nil {
+		return err
+	}
+
+	temp := path + ".tmp"
+	f, err := os.Create(temp)
+	if err != nil {
+		return err
+	}
+
+	writeMetrics(f, records)
+
+	if err := f.Close(); err != nil {
+		os.Remove(temp)
+		return err
+	}
+
+	return os.Rename(temp, path)
+}
+
+type histogram struct {
+	buckets []uint64
+	sum     float64
+	count   uint64
+}
+
+func (h *histogram) observe(value float64) {
+	if h.buckets == nil {
+		h.buckets = make([]uint64, len(durationBuckets))
+	}
+
+	for i, bound := range durationBuckets {
+		if value <= bound {
+			h.buckets[i]++
+		}
+	}
+	h.sum += value
+	h.count++
+}
+
+type databaseMetrics struct {
+	runs          map[string]uint64
+	phases        map[string]*histogram
+	lastDumpBytes int64
+	lastImageSize int64
+	lastSuccess   time.Time
+}
+
+// writeMetrics renders the history in the Prometheus text format. Databases
+// and phases are sorted so consecutive scrapes are easy to compare.
+func writeMetrics(w io.Writer, records []runRecord) {
+	databases := map[string]*databaseMetrics{}
+
+	for _, r := range records {
+		m := databases[r.Database]
+		if m == nil {
+			m = &databaseMetrics{runs: map[string]uint64{}, phases: map[string]*histogram{}}
+			databases[r.Database] = m
+		}
+
+		m.runs[r.Result]++
+
+		for _, phase := range r.Phases {
+			if m.phases[phase.Name] == nil {
+				m.phases[phase.Name] = &histogram{}
+			}
+			m.phases[phase.Name].observe(phase.Duration.Seconds())
+		}
+
+		if r.Result == "success" {
+			m.lastDumpBytes = r.DumpSize
+			m.lastImageSize = r.ImageSize
+			m.lastSuccess = r.Time
+		}
+	}
+
+	names := make([]string, 0, len(databases))
+	for name := range databases {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	fmt.Fprintln(w, "# HELP pg_container_runs_total Runs by database and result.")
+	fmt.Fprintln(w, "# TYPE pg_container_runs_total counter")
+	for _, name := range names {
+		for _, result := range []string{"success", "failed"} {
+			fmt.Fprintf(w, "pg_container_runs_total{database=%s,result=%q} %d\n", metricLabel(name), result, databases[name].runs[result])
+		}
+	}
+
+	fmt.Fprintln(w, "# HELP pg_container_phase_duration_seconds Duration of the completed phases of a run: dump, build, smoke-test, container, start and post-start.")
+	fmt.Fprintln(w, "# TYPE pg_container_phase_duration_seconds histogram")
+	for _, name := range names {
+		m := databases[name]
+
+		phases := make([]string, 0, len(m.phases))
+		for phase := range m.phases {
+			phases = append(phases, phase)
+		}
+		slices.Sort(phases)
+
+		for _, phase := range phases {
+			h := m.phases[phase]
+			labels := fmt.Sprintf("database=%s,phase=%q", metricLabel(name), phase)
+
+			for i, bound := range durationBuckets {
+				fmt.Fprintf(w, "pg_container_phase_duration_seconds_bucket{%s,le=\"%g\"} %d\n", labels, bound, h.buckets[i])
+			}
+			fmt.Fprintf(w, "pg_container_phase_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", labels, h.count)
+			fmt.Fprintf(w, "pg_container_phase_duration_seconds_sum{%s} %g\n", labels, h.sum)
+			fmt.Fprintf(w, "pg_container_phase_duration_seconds_count{%s} %d\n", labels, h.count)
+		}
+	}
+
+	gauges := []struct {
+		name  string
+		help  string
+		value func(*databaseMetrics) float64
+	}{
+		{"pg_container_last_dump_bytes", "Size of the dump of the last successful run.", func(m *databaseMetrics) float64 { return float64(m.lastDumpBytes) }},
+		{"pg_container_last_image_size_bytes", "Size of the image built by the last successful run.", func(m *databaseMetrics) float64 { return float64(m.lastImageSize) }},
+		{"pg_container_last_success_timestamp_seconds", "Time of the last successful run, to alert on stale snapshots.", func(m *databaseMetrics) float64 { return float64(m.lastSuccess.Unix()) }},
+	}
+
+	for _, gauge := range gauges {
+		fmt.Fprintf(w, "# HELP %s %s\n", gauge.name, gauge.help)
+		fmt.Fprintf(w, "# TYPE %s gauge\n", gauge.name)
+		for _, name := range names {
+			if m := databases[name]; !m.lastSuccess.IsZero() {
+				fmt.Fprintf(w, "%s{database=%s} %g\n", gauge.name, metricLabel(name), gauge.value(m))
+			}
+		}
+	}
+}
+
+// metricLabel quotes a label value; the format only knows the backslash,
+// double quote and newline escapes.
+func metricLabel(value string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value) + `"`
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/errdefs"
+)
+
+// imageBaseName is the image name before the build time is appended.
+func imageBaseName(options backupOptions, databaseName string) string {
+	return options.ImagePrefix + cmp.Or(options.ImageName, databaseName)
+}
+
+func defaultContainerName(databaseName string) string {
+	return "postgres-" + databaseName + "-" + strconv.FormatInt(time.Now().Unix(), 10)
+}
+
+func containerExists(ctx context.Context, apiClient *client.Client, name string) (bool, error) {
+	_, err := apiClient.ContainerInspect(ctx, name)
+	if errdefs.IsNotFound(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// resolveContainerName decides what the new container will be called when a
+// container with the requested name already exists: with replace the name is
+// kept (the old container is removed right before creating the new one), with
+// autoSuffix the first free name-N is used, and otherwise it is an error.
+func resolveContainerName(ctx context.Context, apiClient *client.Client, name string, replace bool, autoSuffix bool) (string, error) {
+	if replace && autoSuffix {
+		return "", fmt.Errorf("--replace and --auto-suffix cannot be used together")
+	}
+
+	exists, err := containerExists(ctx, apiClient, name)
+	if err != nil {
+		return "", err
+	}
+
+	if !exists || replace {
+		return name, nil
+	}
+
+	if !autoSuffix {
+		return "", fmt.Errorf("A container named %s already exists; pass --replace to remove it or --auto-suffix to pick another name", name)
+	}
+
+	for i := 2; ; i++ {
+		candidate := name + "-" + strconv.Itoa(i)
+
+		exists, err := containerExists(ctx, apiClient, candidate)
+		if err != nil {
+			return "", err
+		}
+
+		if !exists {
+			return candidate, nil
+		}
+	}
+}
+
+// confirmReplace asks before --replace removes the existing container name,
+// which is done up front rather than once the image is built.
+func confirmReplace(ctx context.Context, apiClient *client.Client, name string) error {
+	exists, err := containerExists(ctx, apiClient, name)
+	if err != nil || !exists {
+		return err
+	}
+
+	return confirmRemoval("the existing container "+name, false)
+}
+
+// replaceContainer stops and removes an existing container so its name can be
+// reused. A container started with --rm is removed by the daemon once
+// stopped, which only has to be waited for.
+func replaceContainer(ctx context.Context, apiClient *client.Client, name string) error {
+	exists, err := containerExists(ctx, apiClient, name)
+	if err != nil || !exists {
+		return err
+	}
+
+	logger.Info("♻️  Replacing existing container", "container", name)
+
+	if err := apiClient.ContainerStop(ctx, name, container.StopOptions{}); err != nil && !errdefs.IsNotFound(err) {
+		return fmt.Errorf("Failed to stop container %s: %w", name, err)
+	}
+
+	err = apiClient.ContainerRemove(ctx, name, container.RemoveOptions{})
+	switch {
+	case err == nil, errdefs.IsNotFound(err):
+		return nil
+	case errdefs.IsConflict(err) && strings.Contains(err.Error(), "already in progress"):
+		return waitRemoved(ctx, apiClient, name)
+	default:
+		return fmt.Errorf("Failed to remove container %s: %w", name, err)
+	}
+}
+
+// waitRemoved waits for the daemon to finish removing the container name.
+func waitRemoved(ctx context.Context, apiClient *client.Client, name string) error {
+	waitCh, errCh := apiClient.ContainerWait(ctx, name, container.WaitConditionRemoved)
+	select {
+	case <-waitCh:
+		return nil
+	case err := <-errCh:
+		if errdefs.IsNotFound(err) {
+			return nil
+		}
+		return fmt.Errorf("Failed to wait for the removal of container %s: %w", name, err)
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/errdefs"
+)
+
+// ensureNetwork creates a bridge network with the given name unless one
+// already exists, and reports whether it had to be created.
+func ensureNetwork(ctx context.Context, apiClient *client.Client, name string) (bool, error) {
+	_, err := apiClient.NetworkInspect(ctx, name, network.InspectOptions{})
+	if err == nil {
+		return false, nil
+	} else if !errdefs.IsNotFound(err) {
+		return false, fmt.Errorf("Failed to inspect network %s: %w", name, err)
+	}
+
+	_, err = apiClient.NetworkCreate(ctx, name, network.CreateOptions{
+		Driver: "bridge",
+		Labels: map[string]string{managedLabel: "true"},
+	})
+	if err != nil {
+		return false, fmt.Errorf("Failed to create network %s: %w", name, err)
+	}
+
+	logger.Info("🌐 Created network", "network", name)
+
+	return true, nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/docker/go-units"
+)
+
+// notifyTimeout bounds each notification, so an unreachable endpoint does
+// not hold up a finished run.
+const notifyTimeout = 10 * time.Second
+
+// notify posts the outcome of a run. A generic webhook gets the same document
+// as --output json, Slack a formatted message. Failing to notify only warns,
+// since the run itself is done by then.
+func notify(run *runRecord, options backupOptions) {
+	if options.NotifyURL != "" {
+		if err := postJSON(options.NotifyURL, run); err != nil {
+			logger.Warn("Failed to send the notification", "error", err)
+		}
+	}
+
+	if options.SlackWebhook != "" {
+		if err := postJSON(options.SlackWebhook, map[string]string{"text": slackMessage(run)}); err != nil {
+			logger.Warn("Failed to notify Slack", "error", err)
+		}
+	}
+}
+
+func slackMessage(run *runRecord) string {
+	var message strings.Builder
+
+	if run.Result == "success" {
+		fmt.Fprintf(&message, ":white_check_mark: Snapshot of *%s* built in %s\n", run.Database, run.duration().Round(time.Second))
+		fmt.Fprintf(&message, "Image: `%s` (%s, dump %s)", run.Image, units.HumanSize(float64(run.ImageSize)), units.HumanSize(float64(run.DumpSize)))
+		if run.Container != "" {
+			fmt.Fprintf(&message, "\nContainer: `%s`", run.Container)
+		}
+		if len(run.Warnings) > 0 {
+			fmt.Fprintf(&message, "\n%d pg_dump warnings", len(run.Warnings))
+		}
+	} else {
+		database := run.Database
+		if database == "" {
+			database = "the database"
+		}
+		fmt.Fprintf(&message, ":x: Snapshot of *%s* failed after %s\n```%s```", database, run.duration().Round(time.Second), run.Error)
+	}
+
+	return message.String()
+}
+
+// postJSON sends body to endpoint. The URL is left out of errors because
+// webhook URLs carry their credentials.
+func postJSON(endpoint string, body any) error {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("Invalid URL")
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return fmt.Errorf("Request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("Unexpected response %s", resp.Status)
+	}
+
+	return nil
+}
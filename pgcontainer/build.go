@@ -0,0 +1,437 @@
+package pgcontainer
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	_ "embed"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"strconv"
+	"text/template"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/jsonmessage"
+	"github.com/klauspost/compress/zstd"
+)
+
+//go:embed Dockerfile
+var dockerfile []byte
+
+//go:embed pg_container-clone
+var cloneScript []byte
+
+// dockerfileTemplate is the embedded Dockerfile, which is a text/template so
+// build options can add or drop whole instructions.
+var dockerfileTemplate = template.Must(template.New("Dockerfile").Parse(string(dockerfile)))
+
+// DefaultMaintenanceWorkMem is the maintenance_work_mem of a fast restore.
+const DefaultMaintenanceWorkMem = "1GB"
+
+// BuildOptions configures BuildImage.
+type BuildOptions struct {
+	// Database is the name of the database the dump is restored into.
+	Database string
+
+	// Name is the image name, which gets the build time appended as in
+	// ImageName. It defaults to Database.
+	Name string
+
+	// Labels are set on the image. RunID is recorded as the
+	// pg_container.run label of the intermediate build stage as well, so
+	// an interrupted build can be cleaned up.
+	Labels map[string]string
+	RunID  string
+
+	// StopOnError fails the build on the first statement of the dump that
+	// errors, instead of leaving a partially restored database behind.
+	StopOnError bool
+
+	// IncludeDump keeps a copy of the dump in the final image next to the
+	// restored PGDATA.
+	IncludeDump bool
+
+	// RestoreJobs is the number of parallel pg_restore jobs for a custom
+	// format dump; 0 uses every CPU of the build.
+	RestoreJobs int
+
+	// Analyze collects planner statistics right after the restore, so the
+	// first queries against the snapshot are not planned blind. Vacuum runs a
+	// VACUUM (ANALYZE) instead, which also sets the visibility map.
+	Analyze bool
+	Vacuum  bool
+
+	// InitScripts run against the restored database, in name order, once
+	// the dump has been loaded.
+	InitScripts []InitScript
+
+	// FastRestore starts the build-time server with fsync, full page writes
+	// and synchronous commit off and a large maintenance_work_mem. These are
+	// passed on the pg_ctl command line only, so the image keeps the defaults.
+	FastRestore        bool
+	MaintenanceWorkMem string
+
+	// Timezone sets TZ and the server's timezone settings in the final image.
+	Timezone string
+
+	// CompressContext sends a plain dump zstd-compressed in the build context
+	// and decompresses it in the build, since a text dump shrinks severalfold
+	// and the context goes over the wire to a remote daemon. A custom dump is
+	// compressed by pg_dump already and is sent as is.
+	CompressContext bool
+
+	// Template marks the restored database as a template, which CREATE
+	// DATABASE ... TEMPLATE copies in a fraction of the time of a restore,
+	// e.g. once per test. The image gets PG_CONTAINER_TEMPLATE set to the
+	// database and a pg_container-clone command creating such copies.
+	Template bool
+
+	// Sequences sets the sequences of the restored database once the dump is
+	// loaded: SequencesPreserve, the default, keeps the values of the source,
+	// SequencesReset restarts them, and SequencesBump moves them
+	// SequenceOffset past the source's values, so rows seeded into the
+	// snapshot never collide with ids taken in production.
+	Sequences      string
+	SequenceOffset int64
+
+	// Output, if set, receives the build log while the image builds.
+	Output io.Writer
+}
+
+// InitScript is a SQL file run against the restored database during the
+// build.
+type InitScript struct {
+	Name string
+	SQL  string
+}
+
+// BuildError is returned when the daemon fails the build. Output is the build
+// log, whose last lines are where a failed restore reports its error.
+type BuildError struct {
+	Err    error
+	Output string
+}
+
+func (e *BuildError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *BuildError) Unwrap() error {
+	return e.Err
+}
+
+// contextFile is a file of the build context, either content or, for the
+// dump, the file at path, which is streamed from disk.
+type contextFile struct {
+	name    string
+	content []byte
+	path    string
+}
+
+type dockerfileOptions struct {
+	DumpFile           string
+	Compressed         bool
+	CustomFormat       bool
+	StopOnError        bool
+	IncludeDump        bool
+	Analyze            bool
+	Vacuum             bool
+	InitScripts        bool
+	FastRestore        bool
+	MaintenanceWorkMem string
+	Timezone           string
+	Template           bool
+
+	// BaseImage is the image of both stages, and Timescale the version of
+	// the timescaledb extension to restore with, see Archive.Timescale.
+	BaseImage string
+	Timescale string
+
+	// AnalyzePartitionsFile is run between the sections of a custom format
+	// restore, see analyzePartitions.
+	AnalyzePartitionsFile string
+
+	// RefreshMatviewsFile, if set, is run by pg_container-refresh-matviews
+	// on start, see Archive.RefreshMatviews.
+	RefreshMatviewsFile string
+
+	// SequencesFile, if set, is run after the restore, see sequencesSQL.
+	SequencesFile string
+}
+
+// sequencesFileName is the SequencesFile of options, empty when they keep
+// the values of the sequences.
+func (options BuildOptions) sequencesFileName() string {
+	if sequencesSQL(options.Sequences, options.SequenceOffset) == nil {
+		return ""
+	}
+
+	return sequencesFile
+}
+
+// BuildImage builds an image with archive restored into options.Database and
+// returns its tag.
+func BuildImage(ctx context.Context, apiClient *client.Client, archive *Archive, options BuildOptions) (string, error) {
+	options = options.withDefaults()
+
+	files, err := buildFiles(archive, options)
+	if err != nil {
+		return "", err
+	}
+
+	buildContext := tarStream(files)
+	defer buildContext.Close()
+
+	tag := ImageName(options.Name, time.Now())
+	buildArgs := map[string]*string{}
+	for name, value := range options.buildArgs() {
+		buildArgs[name] = &value
+	}
+
+	buildResponse, err := apiClient.ImageBuild(ctx, buildContext, types.ImageBuildOptions{
+		Tags:        []string{tag},
+		Dockerfile:  "Dockerfile",
+		Remove:      true,
+		ForceRemove: true,
+		BuildArgs:   buildArgs,
+		Labels:      options.Labels,
+	})
+	if err != nil {
+		return "", fmt.Errorf("Failed to build image: %w", err)
+	}
+
+	if buildResponse.Body == nil {
+		return "", fmt.Errorf("Failed to build image: the Docker daemon returned no output")
+	}
+	defer buildResponse.Body.Close()
+
+	var buildOutput bytes.Buffer
+	output := io.Writer(&buildOutput)
+	if options.Output != nil {
+		output = io.MultiWriter(&buildOutput, options.Output)
+	}
+
+	if err := jsonmessage.DisplayJSONMessagesStream(buildResponse.Body, output, 0, false, nil); err != nil {
+		return "", &BuildError{Err: fmt.Errorf("Failed to build image: %w", err), Output: buildOutput.String()}
+	}
+
+	return tag, nil
+}
+
+func (options BuildOptions) withDefaults() BuildOptions {
+	if options.Name == "" {
+		options.Name = options.Database
+	}
+	if options.MaintenanceWorkMem == "" {
+		options.MaintenanceWorkMem = DefaultMaintenanceWorkMem
+	}
+	return options
+}
+
+func (options BuildOptions) buildArgs() map[string]string {
+	return map[string]string{
+		"DB_NAME":      options.Database,
+		"RUN_ID":       options.RunID,
+		"RESTORE_JOBS": strconv.Itoa(options.RestoreJobs),
+	}
+}
+
+// buildFiles renders the Dockerfile and returns it with the rest of the build
+// context.
+func buildFiles(archive *Archive, options BuildOptions) ([]contextFile, error) {
+	dumpFile := DumpFileName(archive.Format)
+	dump := contextFile{name: dumpFile, path: archive.Path}
+	compressed := compressContext(archive, options)
+	if compressed {
+		path, err := compressDump(archive)
+		if err != nil {
+			return nil, err
+		}
+		dump = contextFile{name: dumpFile + ".zst", path: path}
+	}
+
+	var rendered bytes.Buffer
+	err := dockerfileTemplate.Execute(&rendered, dockerfileOptions{
+		DumpFile:           dumpFile,
+		Compressed:         compressed,
+		CustomFormat:       archive.Format == FormatCustom,
+		StopOnError:        options.StopOnError,
+		IncludeDump:        options.IncludeDump,
+		Analyze:            options.Analyze,
+		Vacuum:             options.Vacuum,
+		InitScripts:        len(options.InitScripts) > 0,
+		FastRestore:        options.FastRestore,
+		MaintenanceWorkMem: options.MaintenanceWorkMem,
+		Timezone:           options.Timezone,
+		Template:           options.Template,
+
+		BaseImage:             baseImage(archive),
+		Timescale:             archive.Timescale,
+		AnalyzePartitionsFile: analyzePartitionsFile,
+		SequencesFile:         options.sequencesFileName(),
+		RefreshMatviewsFile:   archive.refreshMatviewsFileName(),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to render Dockerfile: %w", err)
+	}
+
+	files := []contextFile{
+		dump,
+		{name: "Dockerfile", content: rendered.Bytes()},
+	}
+	for _, script := range options.InitScripts {
+		files = append(files, contextFile{name: "init/" + script.Name, content: []byte(script.SQL)})
+	}
+	if options.Template {
+		files = append(files, contextFile{name: "pg_container-clone", content: cloneScript})
+	}
+	if archive.Format == FormatCustom {
+		files = append(files, contextFile{name: analyzePartitionsFile, content: []byte(analyzePartitions)})
+	}
+	if len(archive.RefreshMatviews) > 0 {
+		files = append(files,
+			contextFile{name: refreshMatviewsFile, content: archive.RefreshMatviews},
+			contextFile{name: "pg_container-refresh-matviews", content: refreshMatviewsScript})
+	}
+	if sequences := sequencesSQL(options.Sequences, options.SequenceOffset); sequences != nil {
+		files = append(files, contextFile{name: sequencesFile, content: sequences})
+	}
+
+	return files, nil
+}
+
+// tarStream returns the files as a tar, written as the reader is consumed
+// rather than into a buffer first, which would hold the dump a second time.
+// Closing the reader stops the writing.
+func tarStream(files []contextFile) io.ReadCloser {
+	reader, writer := io.Pipe()
+
+	go func() {
+		writer.CloseWithError(writeTar(writer, files))
+	}()
+
+	return reader
+}
+
+func writeTar(w io.Writer, files []contextFile) error {
+	tw := tar.NewWriter(w)
+
+	for _, file := range files {
+		if err := writeTarFile(tw, file); err != nil {
+			return err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("Failed to finish the tar: %w", err)
+	}
+
+	return nil
+}
+
+// writeTarFile adds file to tw, copying a file on disk in small chunks.
+func writeTarFile(tw *tar.Writer, file contextFile) error {
+	if file.path == "" {
+		if err := tw.WriteHeader(&tar.Header{Name: file.name, Mode: 0644, Size: int64(len(file.content))}); err != nil {
+			return fmt.Errorf("Failed to write tar header: %w", err)
+		}
+		if _, err := tw.Write(file.content); err != nil {
+			return fmt.Errorf("Failed to write %s to tar: %w", file.name, err)
+		}
+		return nil
+	}
+
+	f, err := os.Open(file.path)
+	if err != nil {
+		return fmt.Errorf("Failed to read %s: %w", file.name, err)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("Failed to read %s: %w", file.name, err)
+	}
+
+	if err := tw.WriteHeader(&tar.Header{Name: file.name, Mode: 0644, Size: info.Size()}); err != nil {
+		return fmt.Errorf("Failed to write tar header: %w", err)
+	}
+	if _, err := io.Copy(tw, f); err != nil {
+		return fmt.Errorf("Failed to write %s to tar: %w", file.name, err)
+	}
+
+	return nil
+}
+
+// writeTo writes file to path, for a build context on disk.
+func (file contextFile) writeTo(path string) error {
+	if file.path == "" {
+		return os.WriteFile(path, file.content, 0644)
+	}
+
+	in, err := os.Open(file.path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+
+	return out.Close()
+}
+
+// compressContext tells whether the dump of archive goes into the build
+// context compressed. A custom format dump is compressed already, and the
+// Alpine based Timescale images have no zstd to decompress it with.
+func compressContext(archive *Archive, options BuildOptions) bool {
+	return options.CompressContext && archive.Format != FormatCustom && archive.Timescale == ""
+}
+
+// compressDump compresses the dump of archive with zstd, which the postgres
+// images ship for the compressed init scripts of their entrypoint, into a file
+// next to it and returns its path. The dump is streamed through the encoder,
+// so neither it nor the compressed copy is held in memory, and the tar header
+// gets the size of the finished file.
+func compressDump(archive *Archive) (string, error) {
+	in, err := os.Open(archive.Path)
+	if err != nil {
+		return "", fmt.Errorf("Failed to compress the dump: %w", err)
+	}
+	defer in.Close()
+
+	path := archive.Path + ".zst"
+	out, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return "", fmt.Errorf("Failed to compress the dump: %w", err)
+	}
+	defer out.Close()
+
+	encoder, err := zstd.NewWriter(out, zstd.WithEncoderConcurrency(runtime.NumCPU()))
+	if err != nil {
+		return "", fmt.Errorf("Failed to compress the dump: %w", err)
+	}
+
+	if _, err := io.Copy(encoder, in); err != nil {
+		encoder.Close()
+		return "", fmt.Errorf("Failed to compress the dump: %w", err)
+	}
+	if err := encoder.Close(); err != nil {
+		return "", fmt.Errorf("Failed to compress the dump: %w", err)
+	}
+	if err := out.Close(); err != nil {
+		return "", fmt.Errorf("Failed to compress the dump: %w", err)
+	}
+
+	return path, nil
+}
@@ -0,0 +1,221 @@
+package pgcontainer
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// excludedColumn is a column whose data a plain dump leaves out: nulled, or
+// emptied when it is NOT NULL.
+type excludedColumn struct {
+	Schema, Table, Column string
+
+	// Value is what every row of the column gets in the COPY, `\N` or empty.
+	Value string
+}
+
+// parseColumnPatterns splits the values of DumpOptions.ExcludeColumnData
+// into the schemas, tables and columns of the columns they name, the schema
+// empty when it is left out, and the types.
+func parseColumnPatterns(patterns []string) (schemas, tables, columns, types []string, err error) {
+	for _, pattern := range patterns {
+		parts := strings.Split(pattern, ".")
+		switch {
+		case len(parts) == 1 && pattern != "":
+			types = append(types, pattern)
+		case len(parts) == 2 && parts[0] != "" && parts[1] != "":
+			schemas, tables, columns = append(schemas, ""), append(tables, parts[0]), append(columns, parts[1])
+		case len(parts) == 3 && parts[0] != "" && parts[1] != "" && parts[2] != "":
+			schemas, tables, columns = append(schemas, parts[0]), append(tables, parts[1]), append(columns, parts[2])
+		default:
+			return nil, nil, nil, nil, fmt.Errorf("Invalid column %q: expected [schema.]table.column or a type such as bytea", pattern)
+		}
+	}
+
+	return schemas, tables, columns, types, nil
+}
+
+// minGeneratedServerVersion is the first release with generated columns,
+// whose values are not dumped.
+const minGeneratedServerVersion = 120000
+
+// listExcludedColumns returns the columns of the ordinary tables of schemas,
+// or of all schemas when there are none, that patterns name, by themselves,
+// the partitioned table they belong to, or their type. A NOT NULL column can
+// only be emptied, which fails for types other than strings and bytea.
+// serverVersion is the server_version_num of the source: the partitions are
+// found through pg_inherits, which every release with partitioning has, and
+// generated columns are only left out from the release that has them.
+func listExcludedColumns(ctx context.Context, conn *pgx.Conn, patterns []string, schemas []string, serverVersion int) ([]excludedColumn, error) {
+	patternSchemas, patternTables, patternColumns, types, err := parseColumnPatterns(patterns)
+	if err != nil {
+		return nil, err
+	}
+
+	generated := ""
+	if serverVersion >= minGeneratedServerVersion {
+		generated = "AND a.attgenerated = ''"
+	}
+
+	rows, err := conn.Query(ctx, `
+		WITH RECURSIVE ancestors(relid, ancestor) AS (
+			SELECT oid, oid FROM pg_class WHERE relkind = 'r'
+			UNION ALL
+			SELECT a.relid, i.inhparent
+			FROM ancestors a
+			JOIN pg_inherits i ON i.inhrelid = a.ancestor
+			JOIN pg_class p ON p.oid = i.inhparent AND p.relkind = 'p'
+		)
+		SELECT n.nspname, c.relname, a.attname, a.attnotnull,
+		       t.typcategory = 'S' OR t.oid = 'bytea'::regtype,
+		       format_type(a.atttypid, a.atttypmod)
+		FROM pg_attribute a
+		JOIN pg_class c ON c.oid = a.attrelid
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		JOIN pg_type t ON t.oid = a.atttypid
+		WHERE c.relkind = 'r' AND a.attnum > 0 AND NOT a.attisdropped `+generated+`
+		  AND (coalesce(cardinality($5::text[]), 0) = 0 OR n.nspname = ANY($5))
+		  AND (a.atttypid = ANY($4::regtype[])
+		       OR EXISTS (
+		           SELECT FROM ancestors r
+		           JOIN pg_class rc ON rc.oid = r.ancestor
+		           JOIN pg_namespace rn ON rn.oid = rc.relnamespace
+		           JOIN unnest($1::text[], $2::text[], $3::text[]) AS p(s, t, c)
+		             ON (p.s = '' OR p.s = rn.nspname) AND p.t = rc.relname AND p.c = a.attname
+		           WHERE r.relid = c.oid))
+		ORDER BY n.nspname, c.relname, a.attnum`, patternSchemas, patternTables, patternColumns, types, schemas)
+	if err != nil {
+		return nil, err
+	}
+
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (excludedColumn, error) {
+		var column excludedColumn
+		var notNull, emptiable bool
+		var typ string
+		if err := row.Scan(&column.Schema, &column.Table, &column.Column, &notNull, &emptiable, &typ); err != nil {
+			return column, err
+		}
+
+		switch {
+		case !notNull:
+			column.Value = `\N`
+		case !emptiable:
+			return column, fmt.Errorf("Cannot leave out the data of %s.%s.%s: it is NOT NULL and of type %s, which has no empty value", column.Schema, column.Table, column.Column, typ)
+		}
+
+		return column, nil
+	})
+}
+
+// action is what the Change of the column says happened to it.
+func (c excludedColumn) action() string {
+	if c.Value == "" {
+		return "emptied"
+	}
+
+	return "nulled"
+}
+
+// columnRewrite replaces the values of the excluded columns in the COPY
+// blocks of a plain dump, which pg_dump writes a row per line with the
+// fields separated by tabs; tabs and newlines within values are escaped.
+type columnRewrite struct {
+	byTable map[[2]string]map[string]string
+
+	// values are those of the block being copied, by field, nil outside of
+	// blocks with excluded columns.
+	values map[int]string
+}
+
+func newColumnRewrite(excluded []excludedColumn) *columnRewrite {
+	byTable := map[[2]string]map[string]string{}
+	for _, column := range excluded {
+		table := [2]string{column.Schema, column.Table}
+		if byTable[table] == nil {
+			byTable[table] = map[string]string{}
+		}
+		byTable[table][column.Column] = column.Value
+	}
+
+	return &columnRewrite{byTable: byTable}
+}
+
+func (c *columnRewrite) rewrite(entry tocEntry) []byte {
+	if !entry.Rows {
+		// A piece ends with the COPY line of the rows that follow it, if any.
+		c.values = nil
+		text := bytes.TrimSuffix(entry.Text, []byte("\n"))
+		line := text[bytes.LastIndexByte(text, '\n')+1:]
+		if bytes.HasPrefix(line, []byte("COPY ")) && bytes.HasSuffix(line, []byte(" FROM stdin;")) {
+			c.values = copyColumns(string(line), c.byTable)
+		}
+
+		return entry.Text
+	}
+
+	if c.values == nil {
+		return entry.Text
+	}
+
+	fields := bytes.Split(bytes.TrimSuffix(entry.Text, []byte("\n")), []byte("\t"))
+	for i, value := range c.values {
+		if i < len(fields) {
+			fields[i] = []byte(value)
+		}
+	}
+
+	return append(bytes.Join(fields, []byte("\t")), '\n')
+}
+
+// copyColumns returns the replacement values of a COPY block by the index of
+// their field, nil when none of the block's columns are excluded.
+func copyColumns(line string, byTable map[[2]string]map[string]string) map[int]string {
+	line = strings.TrimPrefix(line, "COPY ")
+	name, columns, ok := strings.Cut(line, " (")
+	if !ok {
+		return nil
+	}
+	columns, _, _ = strings.Cut(columns, ") FROM stdin;")
+
+	qualified := splitIdentifiers(name, '.')
+	if len(qualified) != 2 {
+		return nil
+	}
+	excluded := byTable[[2]string{qualified[0], qualified[1]}]
+	if excluded == nil {
+		return nil
+	}
+
+	values := map[int]string{}
+	for i, column := range splitIdentifiers(columns, ',') {
+		if value, ok := excluded[strings.TrimSpace(column)]; ok {
+			values[i] = value
+		}
+	}
+
+	return values
+}
+
+// splitIdentifiers splits a list of identifiers, each quoted or not, at sep,
+// and unquotes them.
+func splitIdentifiers(list string, sep byte) []string {
+	var identifiers []string
+	quoted := false
+	start := 0
+
+	for i := 0; i <= len(list); i++ {
+		switch {
+		case i == len(list) || (list[i] == sep && !quoted):
+			identifiers = append(identifiers, unquoteIdent(strings.TrimSpace(list[start:i])))
+			start = i + 1
+		case list[i] == '"':
+			quoted = !quoted
+		}
+	}
+
+	return identifiers
+}
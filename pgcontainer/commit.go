@@ -0,0 +1,216 @@
+package pgcontainer
+
+import (
+	"bytes"
+	"context"
+	_ "embed"
+	"fmt"
+	"io"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/jsonmessage"
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/docker/go-connections/nat"
+)
+
+//go:embed restore.sh
+var restoreScript []byte
+
+// restoreScriptTemplate is the builder stage of the Dockerfile as a shell
+// script, rendered from the same options.
+var restoreScriptTemplate = template.Must(template.New("restore.sh").Parse(string(restoreScript)))
+
+// commitShmSize is the /dev/shm of the restore container, which the 64MB of
+// a build step are often too little for with parallel workers.
+const commitShmSize = 1 << 30
+
+// CommitImage is an alternative to BuildImage that restores the dump in a
+// temporary container of the postgres image and commits the stopped
+// container as the image. The restore is not bound by the limits of a build
+// step: it gets a larger /dev/shm, its output streams as it happens rather
+// than per step, and the image has a single layer on top of postgres instead
+// of a copy of PGDATA made from the builder stage.
+func CommitImage(ctx context.Context, apiClient *client.Client, archive *Archive, options BuildOptions) (string, error) {
+	options = options.withDefaults()
+
+	var script bytes.Buffer
+	err := restoreScriptTemplate.Execute(&script, dockerfileOptions{
+		DumpFile:           DumpFileName(archive.Format),
+		Compressed:         compressContext(archive, options),
+		CustomFormat:       archive.Format == FormatCustom,
+		StopOnError:        options.StopOnError,
+		IncludeDump:        options.IncludeDump,
+		Analyze:            options.Analyze,
+		Vacuum:             options.Vacuum,
+		InitScripts:        len(options.InitScripts) > 0,
+		FastRestore:        options.FastRestore,
+		MaintenanceWorkMem: options.MaintenanceWorkMem,
+		Timezone:           options.Timezone,
+		Template:           options.Template,
+
+		Timescale:             archive.Timescale,
+		AnalyzePartitionsFile: analyzePartitionsFile,
+		SequencesFile:         options.sequencesFileName(),
+		RefreshMatviewsFile:   archive.refreshMatviewsFileName(),
+	})
+	if err != nil {
+		return "", fmt.Errorf("Failed to render the restore script: %w", err)
+	}
+
+	base := baseImage(archive)
+	if err := pullBaseImage(ctx, apiClient, base, options.Output); err != nil {
+		return "", err
+	}
+
+	commitEnv := []string{"PGDATA=/data"}
+	if options.Timezone != "" {
+		commitEnv = append(commitEnv, "TZ="+options.Timezone)
+	}
+	if options.Template {
+		commitEnv = append(commitEnv, "PG_CONTAINER_TEMPLATE="+options.Database)
+	}
+	commitCmd := []string{"postgres", "-c", "config_file=/data/postgresql.conf"}
+	if len(archive.RefreshMatviews) > 0 {
+		commitEnv = append(commitEnv, "PG_CONTAINER_DATABASE="+options.Database)
+		commitCmd = RefreshMatviewsCommand
+	}
+
+	return commitRestore(ctx, apiClient, base, script.String(), archive, &container.Config{
+		User:         "postgres",
+		Env:          commitEnv,
+		Entrypoint:   []string{"docker-entrypoint.sh"},
+		Cmd:          commitCmd,
+		ExposedPorts: nat.PortSet{nat.Port(DefaultContainerPort + "/tcp"): struct{}{}},
+	}, "restore of "+options.Database, options)
+}
+
+// commitRestore runs script in a temporary container of image, as root and
+// with the files of the build context in /tmp, and commits the stopped
+// container as the image with config and the labels of options.
+func commitRestore(ctx context.Context, apiClient *client.Client, image string, script string, archive *Archive, config *container.Config, comment string, options BuildOptions) (string, error) {
+	// The build arguments are set in the script rather than the environment,
+	// which the commit would carry over into the image.
+	var args strings.Builder
+	for _, name := range sortedKeys(options.buildArgs()) {
+		args.WriteString(name + "='" + strings.ReplaceAll(options.buildArgs()[name], "'", `'\''`) + "'\n")
+	}
+
+	created, err := apiClient.ContainerCreate(ctx, &container.Config{
+		Image:      image,
+		User:       "root",
+		Entrypoint: []string{"sh", "-c", args.String() + script},
+		Env:        []string{"PGDATA=/data"},
+		Labels: map[string]string{
+			"pg_container.managed":   "true",
+			"pg_container.run":       options.RunID,
+			"pg_container.temporary": "true",
+		},
+	}, &container.HostConfig{
+		ShmSize: commitShmSize,
+	}, nil, nil, "")
+	if err != nil {
+		return "", fmt.Errorf("Failed to create the restore container: %w", err)
+	}
+	defer apiClient.ContainerRemove(context.WithoutCancel(ctx), created.ID, container.RemoveOptions{Force: true, RemoveVolumes: true})
+
+	files, err := buildFiles(archive, options)
+	if err != nil {
+		return "", err
+	}
+
+	var restoreFiles []contextFile
+	for _, file := range files {
+		if file.name != "Dockerfile" {
+			restoreFiles = append(restoreFiles, file)
+		}
+	}
+
+	content := tarStream(restoreFiles)
+	defer content.Close()
+
+	if err := apiClient.CopyToContainer(ctx, created.ID, "/tmp", content, container.CopyToContainerOptions{}); err != nil {
+		return "", fmt.Errorf("Failed to copy the dump into the restore container: %w", err)
+	}
+
+	var restoreOutput bytes.Buffer
+	output := io.Writer(&restoreOutput)
+	if options.Output != nil {
+		output = io.MultiWriter(&restoreOutput, options.Output)
+	}
+
+	waitCh, errCh := apiClient.ContainerWait(ctx, created.ID, container.WaitConditionNextExit)
+
+	if err := apiClient.ContainerStart(ctx, created.ID, container.StartOptions{}); err != nil {
+		return "", fmt.Errorf("Failed to start the restore container: %w", err)
+	}
+
+	logs, err := apiClient.ContainerLogs(ctx, created.ID, container.LogsOptions{ShowStdout: true, ShowStderr: true, Follow: true})
+	if err == nil {
+		stdcopy.StdCopy(output, output, logs)
+		logs.Close()
+	}
+
+	select {
+	case <-ctx.Done():
+		return "", ctx.Err()
+	case err := <-errCh:
+		return "", fmt.Errorf("Failed to wait for the restore container: %w", err)
+	case status := <-waitCh:
+		if status.StatusCode != 0 {
+			return "", &BuildError{
+				Err:    fmt.Errorf("Failed to restore the dump: exit code %d", status.StatusCode),
+				Output: restoreOutput.String(),
+			}
+		}
+	}
+
+	tag := ImageName(options.Name, time.Now())
+
+	// The daemon adds the labels of the container to those of the image, so
+	// the temporary one is overridden for containers of the image to not
+	// inherit it.
+	config.Labels = map[string]string{"pg_container.temporary": "false"}
+	for name, value := range options.Labels {
+		config.Labels[name] = value
+	}
+
+	_, err = apiClient.ContainerCommit(ctx, created.ID, container.CommitOptions{
+		Reference: tag,
+		Comment:   comment,
+		Config:    config,
+	})
+	if err != nil {
+		return "", fmt.Errorf("Failed to commit the image: %w", err)
+	}
+
+	return tag, nil
+}
+
+// pullBaseImage pulls the base image unless it is present, which docker
+// build does by itself for the FROM of the Dockerfile.
+func pullBaseImage(ctx context.Context, apiClient *client.Client, base string, output io.Writer) error {
+	if _, _, err := apiClient.ImageInspectWithRaw(ctx, base); err == nil {
+		return nil
+	}
+
+	reader, err := apiClient.ImagePull(ctx, base, image.PullOptions{})
+	if err != nil {
+		return fmt.Errorf("Failed to pull %s: %w", base, err)
+	}
+	defer reader.Close()
+
+	if output == nil {
+		output = io.Discard
+	}
+
+	if err := jsonmessage.DisplayJSONMessagesStream(reader, output, 0, false, nil); err != nil {
+		return fmt.Errorf("Failed to pull %s: %w", base, err)
+	}
+
+	return nil
+}
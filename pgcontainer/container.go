@@ -0,0 +1,194 @@
+package pgcontainer
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/client"
+	"github.com/docker/go-connections/nat"
+)
+
+// ContainerOptions configures CreateContainer.
+type ContainerOptions struct {
+	// Name is the name of the container.
+	Name string
+
+	// Database is an extra network alias of the container on Network.
+	Database string
+
+	Env    []string
+	Labels map[string]string
+
+	// BindAddress and HostPort are where the Postgres port is published; an
+	// empty HostPort lets Docker pick a free one. ContainerPort is the port
+	// the server listens on inside the container, DefaultContainerPort if
+	// empty.
+	BindAddress   string
+	HostPort      string
+	ContainerPort string
+
+	// Network attaches the container to an existing network, reachable as
+	// Name and as Database.
+	Network string
+
+	RestartPolicy container.RestartPolicy
+	AutoRemove    bool
+
+	// Memory and ShmSize are in bytes, NanoCPUs in billionths of a CPU.
+	Memory   int64
+	NanoCPUs int64
+	ShmSize  int64
+
+	// Healthcheck, if set, is the health check of the container.
+	Healthcheck *container.HealthConfig
+
+	// TmpfsPGData moves PGDATA onto a tmpfs, Volume onto a named volume or,
+	// when the value looks like a path, a host directory.
+	TmpfsPGData bool
+	Volume      string
+}
+
+// CreateContainer creates, but does not start, a container running image and
+// returns its name.
+func CreateContainer(ctx context.Context, apiClient *client.Client, image string, options ContainerOptions) (string, error) {
+	containerConfig, hostConfig, networkingConfig, err := containerConfigs(image, options)
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := apiClient.ContainerCreate(ctx, containerConfig, hostConfig, networkingConfig, nil, options.Name); err != nil {
+		return "", fmt.Errorf("Failed to create container %s: %w", options.Name, err)
+	}
+
+	return options.Name, nil
+}
+
+// containerConfigs turns options into the configuration of a container
+// running image.
+func containerConfigs(image string, options ContainerOptions) (*container.Config, *container.HostConfig, *network.NetworkingConfig, error) {
+	if options.ContainerPort == "" {
+		options.ContainerPort = DefaultContainerPort
+	}
+
+	containerPort := nat.Port(options.ContainerPort + "/tcp")
+
+	env := options.Env
+	if options.ContainerPort != DefaultContainerPort {
+		// The server, pg_isready and psql all pick the port up from PGPORT.
+		env = append(env, "PGPORT="+options.ContainerPort)
+	}
+
+	containerConfig := &container.Config{
+		Image:       image,
+		Env:         env,
+		Labels:      options.Labels,
+		Healthcheck: options.Healthcheck,
+		ExposedPorts: nat.PortSet{
+			containerPort: struct{}{},
+		},
+	}
+	hostConfig := &container.HostConfig{
+		PortBindings: nat.PortMap{
+			containerPort: []nat.PortBinding{
+				{
+					HostIP:   options.BindAddress,
+					HostPort: options.HostPort,
+				},
+			},
+		},
+		RestartPolicy: options.RestartPolicy,
+		AutoRemove:    options.AutoRemove,
+		Resources: container.Resources{
+			Memory:   options.Memory,
+			NanoCPUs: options.NanoCPUs,
+		},
+		ShmSize: options.ShmSize,
+	}
+
+	if options.TmpfsPGData {
+		applyTmpfsPGData(containerConfig, hostConfig)
+	}
+
+	if options.Volume != "" {
+		if err := applyVolumePGData(containerConfig, hostConfig, options.Volume); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+
+	var networkingConfig *network.NetworkingConfig
+	if options.Network != "" {
+		hostConfig.NetworkMode = container.NetworkMode(options.Network)
+		networkingConfig = &network.NetworkingConfig{
+			EndpointsConfig: map[string]*network.EndpointSettings{
+				options.Network: {
+					Aliases: []string{options.Database},
+				},
+			},
+		}
+	}
+
+	return containerConfig, hostConfig, networkingConfig, nil
+}
+
+// PGDATA can be moved out of the image onto a tmpfs or a volume. Mounting
+// straight over /data would hide the restored database, so the mount goes
+// elsewhere and the prebaked data directory is copied into it on start unless
+// it already holds a cluster.
+const (
+	TmpfsMountPoint  = "/run/pgdata"
+	VolumeMountPoint = "/pgdata"
+)
+
+func applyPGDataMount(containerConfig *container.Config, mountPoint string) {
+	dataDir := mountPoint + "/data"
+
+	containerConfig.Env = append(containerConfig.Env, "PGDATA="+dataDir)
+	containerConfig.Cmd = []string{"sh", "-c", fmt.Sprintf(
+		`if [ -s %[1]s/PG_VERSION ]; then echo "pg_container: existing data found in %[1]s, skipping restore"; `+
+			`else mkdir -p -m 700 %[1]s && cp -a /data/. %[1]s/; fi && `+
+			`(! command -v pg_container-refresh-matviews >/dev/null || exec pg_container-refresh-matviews) & `+
+			`exec postgres -c config_file=%[1]s/postgresql.conf`,
+		dataDir,
+	)}
+}
+
+func applyTmpfsPGData(containerConfig *container.Config, hostConfig *container.HostConfig) {
+	hostConfig.Tmpfs = map[string]string{TmpfsMountPoint: "rw,mode=1777"}
+	applyPGDataMount(containerConfig, TmpfsMountPoint)
+}
+
+// applyVolumePGData mounts a named volume, or a host directory when the value
+// looks like a path. A host directory must be writable by the postgres user
+// of the image (uid 999).
+func applyVolumePGData(containerConfig *container.Config, hostConfig *container.HostConfig, volume string) error {
+	m := mount.Mount{
+		Type:   mount.TypeVolume,
+		Source: volume,
+		Target: VolumeMountPoint,
+	}
+
+	if strings.ContainsAny(volume, `/\`) || strings.HasPrefix(volume, ".") {
+		path, err := filepath.Abs(volume)
+		if err != nil {
+			return err
+		}
+
+		if err := os.MkdirAll(path, 0777); err != nil {
+			return fmt.Errorf("Failed to create volume directory %s: %w", path, err)
+		}
+
+		m.Type = mount.TypeBind
+		m.Source = path
+	}
+
+	hostConfig.Mounts = append(hostConfig.Mounts, m)
+	applyPGDataMount(containerConfig, VolumeMountPoint)
+
+	return nil
+}
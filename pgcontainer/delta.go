@@ -0,0 +1,260 @@
+package pgcontainer
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	_ "embed"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"slices"
+	"text/template"
+
+	"github.com/docker/docker/client"
+	"github.com/jackc/pgx/v5"
+)
+
+// Checksums identify the contents of a snapshot, so a later one can tell
+// which tables changed since. They are recorded on the image, see
+// ChecksumsLabel.
+type Checksums struct {
+	// Schema is the SHA-256 of the schema-only dump.
+	Schema string `json:"schema"`
+
+	// Tables maps the quoted, schema-qualified name of every table to the
+	// number of its rows and the sum of a hash of each row, which does not
+	// depend on the order the rows are read in.
+	Tables map[string]string `json:"tables"`
+}
+
+// ChecksumsLabel is the image label holding the Checksums of its data as
+// JSON.
+const ChecksumsLabel = "pg_container.checksums"
+
+// Delta is the output of DumpDelta.
+type Delta struct {
+	// Archive is the full dump, or with Full unset a plain SQL script
+	// turning the data of the base into the current data.
+	Archive *Archive
+
+	// Full is set when there was no base to compare with or its schema
+	// differs, so Archive is a full dump.
+	Full bool
+
+	// Changed are the tables whose rows differ from the base.
+	Changed []string
+
+	// Checksums are those of the current data.
+	Checksums *Checksums
+}
+
+// DumpDelta dumps only what changed since a snapshot with the checksums
+// base: the rows of the tables whose checksums differ, and the values of all
+// sequences. The script replaces the rows of those tables and rewrites them
+// with VACUUM FULL, so a container applying it on top of the base image
+// changes the files of those tables only and can be committed as a small
+// layer, see CommitDelta. The checksums and the dump are taken from the same
+// snapshot.
+//
+// Without a base, or when the schema differs from that of base, the whole
+// database is dumped as by Dump, and Full is set. Otherwise the rows are
+// dumped as they are: options.ExcludeColumnData and options.ConvertEncoding
+// only apply to a full dump, so the caller rejects them with a base.
+//
+// Computing the checksums reads every table once, which is still less work
+// than dumping and restoring the unchanged ones. The caller closes the
+// Archive to remove the dump.
+func DumpDelta(ctx context.Context, connectionURL string, base *Checksums, options DumpOptions) (delta *Delta, err error) {
+	dir, pgDumpPath, release, err := installPgDump()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to install pg_dump: %w", err)
+	}
+	defer release()
+	defer func() {
+		if err != nil {
+			os.RemoveAll(dir)
+		}
+	}()
+
+	conn, err := pgx.Connect(ctx, connectionURL)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to connect to the source database: %w", err)
+	}
+	defer conn.Close(context.WithoutCancel(ctx))
+
+	tx, err := conn.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.RepeatableRead, AccessMode: pgx.ReadOnly})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to start the snapshot transaction: %w", err)
+	}
+	defer tx.Rollback(context.WithoutCancel(ctx))
+
+	if err := tx.QueryRow(ctx, "SELECT pg_export_snapshot()").Scan(&options.Snapshot); err != nil {
+		return nil, fmt.Errorf("Failed to export a snapshot: %w", err)
+	}
+
+	schemaOptions := DumpOptions{
+		Format:        FormatPlain,
+		SchemaOnly:    true,
+		NoOwnership:   options.NoOwnership,
+		NoReplication: options.NoReplication,
+		Schemas:       options.Schemas,
+		Snapshot:      options.Snapshot,
+
+		ExcludeExtensions:   options.ExcludeExtensions,
+		NoTableAccessMethod: options.NoTableAccessMethod,
+	}
+
+	var schema bytes.Buffer
+	if _, err := runPgDump(ctx, pgDumpPath, connectionURL, schemaOptions.Args(), &schema, nil); err != nil {
+		return nil, err
+	}
+
+	schemaSum := sha256.Sum256(schema.Bytes())
+	delta = &Delta{Checksums: &Checksums{Schema: hex.EncodeToString(schemaSum[:]), Tables: map[string]string{}}}
+
+	tables, err := listDumpedTables(ctx, tx, options.Schemas, "'r'")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, table := range tables {
+		var sum string
+		err := tx.QueryRow(ctx, "SELECT count(*) || ':' || coalesce(sum(('x' || left(md5(t::text), 16))::bit(64)::bigint::numeric), 0) FROM ONLY "+table+" t").Scan(&sum)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to checksum %s: %w", table, err)
+		}
+		delta.Checksums.Tables[table] = sum
+
+		if base != nil && base.Tables[table] != sum {
+			delta.Changed = append(delta.Changed, table)
+		}
+	}
+
+	if base == nil || base.Schema != delta.Checksums.Schema {
+		delta.Full, delta.Changed = true, nil
+		delta.Archive, err = dump(ctx, dir, pgDumpPath, connectionURL, options)
+		return delta, err
+	}
+
+	sequences, err := listDumpedTables(ctx, tx, options.Schemas, "'S'")
+	if err != nil {
+		return nil, err
+	}
+
+	archive, script, err := newArchive(dir, FormatPlain)
+	if err != nil {
+		return nil, err
+	}
+	defer script.Close()
+
+	var header bytes.Buffer
+	header.WriteString("SET session_replication_role = replica;\n")
+	for _, table := range delta.Changed {
+		fmt.Fprintf(&header, "DELETE FROM ONLY %s;\n", table)
+	}
+	header.WriteString("\n")
+	if _, err := script.Write(header.Bytes()); err != nil {
+		return nil, fmt.Errorf("Failed to write the delta: %w", err)
+	}
+
+	if patterns := slices.Concat(delta.Changed, sequences); len(patterns) > 0 {
+		args := []string{"--data-only", "--snapshot=" + options.Snapshot}
+		for _, pattern := range patterns {
+			args = append(args, "--table="+pattern)
+		}
+		if options.Verbose {
+			args = append(args, "--verbose")
+		}
+
+		stderr, err := runPgDump(ctx, pgDumpPath, connectionURL, args, throttle(ctx, &progressWriter{w: script, progress: options.Progress}, newLimiter(options.MaxRate)), options.Stderr)
+		if err != nil {
+			return nil, err
+		}
+
+		archive.Warnings = parseWarnings(stderr)
+	}
+
+	var footer bytes.Buffer
+	footer.WriteString("\nSET session_replication_role = DEFAULT;\n")
+	for _, table := range delta.Changed {
+		fmt.Fprintf(&footer, "VACUUM FULL %s;\n", table)
+	}
+	if _, err := script.Write(footer.Bytes()); err != nil {
+		return nil, fmt.Errorf("Failed to write the delta: %w", err)
+	}
+	if err := script.Close(); err != nil {
+		return nil, fmt.Errorf("Failed to write the delta: %w", err)
+	}
+
+	delta.Archive = archive
+
+	return delta, nil
+}
+
+// listDumpedTables returns the quoted, schema-qualified names of the
+// relations of the given kinds in schemas, or in all schemas but the system
+// ones, leaving out those of extensions. The names are quoted so they can be
+// passed to pg_dump as patterns matching only themselves.
+func listDumpedTables(ctx context.Context, tx pgx.Tx, schemas []string, kinds string) ([]string, error) {
+	rows, err := tx.Query(ctx, `
+		SELECT format('"%s"."%s"', replace(n.nspname, '"', '""'), replace(c.relname, '"', '""'))
+		FROM pg_class c
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE c.relkind IN (`+kinds+`)
+		  AND (coalesce(cardinality($1::text[]), 0) = 0 OR n.nspname = ANY($1))
+		  AND n.nspname NOT IN ('pg_catalog', 'information_schema')
+		  AND n.nspname NOT LIKE 'pg\_%'
+		  AND NOT EXISTS (SELECT FROM pg_depend d WHERE d.classid = 'pg_class'::regclass AND d.objid = c.oid AND d.deptype = 'e')
+		ORDER BY 1`, schemas)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to list tables: %w", err)
+	}
+
+	return pgx.CollectRows(rows, pgx.RowTo[string])
+}
+
+//go:embed delta.sh
+var deltaScript []byte
+
+// deltaScriptTemplate applies a delta on top of the data of the base image,
+// rendered from the options of the restore script.
+var deltaScriptTemplate = template.Must(template.New("delta.sh").Parse(string(deltaScript)))
+
+// CommitDelta applies archive, a delta from DumpDelta, to the data of the
+// base image in a temporary container of it, and commits the container as
+// the image. Only the files of the changed tables, the catalogs and the WAL
+// differ from the base, so the image is the layers of the base, shared with
+// it on disk and in the registry, plus a small one on top. The image keeps
+// the settings of the base; the dump kept in the base is removed, since it no
+// longer matches the data.
+func CommitDelta(ctx context.Context, apiClient *client.Client, base string, archive *Archive, options BuildOptions) (string, error) {
+	options = options.withDefaults()
+
+	inspect, _, err := apiClient.ImageInspectWithRaw(ctx, base)
+	if err != nil {
+		return "", fmt.Errorf("Failed to inspect the base image %s: %w", base, err)
+	}
+	if inspect.Config == nil {
+		return "", fmt.Errorf("The base image %s has no configuration", base)
+	}
+
+	var script bytes.Buffer
+	err = deltaScriptTemplate.Execute(&script, dockerfileOptions{
+		DumpFile:           DumpFileName(FormatPlain),
+		Compressed:         options.CompressContext,
+		StopOnError:        options.StopOnError,
+		Analyze:            options.Analyze || options.Vacuum,
+		FastRestore:        options.FastRestore,
+		MaintenanceWorkMem: options.MaintenanceWorkMem,
+		SequencesFile:      options.sequencesFileName(),
+	})
+	if err != nil {
+		return "", fmt.Errorf("Failed to render the delta script: %w", err)
+	}
+
+	config := *inspect.Config
+	config.Labels = nil
+
+	return commitRestore(ctx, apiClient, inspect.ID, script.String(), archive, &config, "delta of "+options.Database+" on "+base, options)
+}
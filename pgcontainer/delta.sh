@@ -0,0 +1,17 @@
+set -e
+
+{{- if .Compressed}}
+zstd -d -q --rm /tmp/{{.DumpFile}}.zst -o /tmp/{{.DumpFile}}
+{{- end}}
+gosu postgres pg_ctl -D ${PGDATA} -o "-c listen_addresses=''{{if .FastRestore}} -c fsync=off -c full_page_writes=off -c synchronous_commit=off -c max_wal_size=4GB -c maintenance_work_mem={{.MaintenanceWorkMem}}{{end}}" -w -t 86400 start
+gosu postgres psql -U postgres -d ${DB_NAME}{{if .StopOnError}} -v ON_ERROR_STOP=1{{end}} -f /tmp/{{.DumpFile}}
+{{- if .SequencesFile}}
+gosu postgres psql -U postgres -d ${DB_NAME} -v ON_ERROR_STOP=1 -f /tmp/{{.SequencesFile}}
+{{- end}}
+{{- if .Analyze}}
+gosu postgres psql -U postgres -d ${DB_NAME} -c "ANALYZE;"
+{{- end}}
+gosu postgres pg_ctl -D ${PGDATA} -m fast -w -t 86400 stop
+
+rm -f /dump.sql /dump.pgdump
+rm -rf /tmp/*
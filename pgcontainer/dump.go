@@ -0,0 +1,632 @@
+package pgcontainer
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	_ "embed"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/time/rate"
+)
+
+//go:embed pg_dump
+var pgDump []byte
+
+// pgDumpChecksum is the SHA-256 of the embedded pg_dump binary.
+var pgDumpChecksum = sha256.Sum256(pgDump)
+
+// PgDumpSize is the size of the embedded pg_dump binary, which is written to
+// the temp directory for every dump.
+var PgDumpSize = int64(len(pgDump))
+
+// DumpOptions configures Dump. The zero value makes a plain dump of the whole
+// database.
+type DumpOptions struct {
+	// Format is FormatPlain or FormatCustom; empty means plain.
+	Format string
+
+	// SchemaOnly leaves out the data.
+	SchemaOnly bool
+
+	// NoOwnership leaves out ownership and privileges, for restoring into a
+	// server that lacks the roles of the source.
+	NoOwnership bool
+
+	// NoReplication leaves out publications and subscriptions, which a
+	// snapshot has no use for and which would connect to the source once
+	// enabled. They are listed in Archive.Changes.
+	NoReplication bool
+
+	// EventTriggers is what a plain dump does with event triggers, which
+	// would fire on the DDL run against the container: EventTriggersKeep or
+	// empty dumps them as they are, EventTriggersSkip leaves them out and
+	// EventTriggersDefer creates them disabled, for whoever needs them to
+	// enable them.
+	EventTriggers string
+
+	// ExcludeExtensions leaves these extensions out, with the rows of their
+	// configuration tables.
+	ExcludeExtensions []string
+
+	// NoTableAccessMethod creates every table with the default access
+	// method of the restore, for tables using one from an excluded
+	// extension.
+	NoTableAccessMethod bool
+
+	// ForeignData is what a plain dump does with foreign servers, their user
+	// mappings, which hold credentials, and foreign tables, none of which
+	// can reach their remote in a container: ForeignDataKeep or empty dumps
+	// them as they are, ForeignDataStrip leaves them out, and ForeignDataStub
+	// leaves out the servers and user mappings and moves the foreign tables
+	// to an empty file_fdw server, so views on them still restore.
+	ForeignData string
+
+	// RefreshMatviews is when a plain dump populates its materialized views:
+	// RefreshMatviewsBlocking or empty refreshes them during the restore, as
+	// pg_dump has it, RefreshMatviewsNone leaves them empty until someone
+	// refreshes them, and RefreshMatviewsConcurrently moves the refreshes to
+	// Archive.RefreshMatviews, run in the background of the container's first
+	// start, so neither the build nor the start waits for large views.
+	RefreshMatviews string
+
+	// ConvertEncoding, if set to EncodingUTF8, dumps in UTF8 whatever the
+	// encoding of the source, which the server converts from, so a LATIN1 or
+	// other legacy database restores into the UTF8 one of the image. A
+	// SQL_ASCII database holds bytes the server cannot convert: those that
+	// are not valid UTF8 are replaced in a plain dump, and the objects that
+	// had them listed in Archive.Changes.
+	ConvertEncoding string
+
+	// ExcludeColumnData leaves the values of columns out of a plain dump while
+	// keeping the rows, for attachments and other payloads the snapshot has no
+	// use for. Each is a column as [schema.]table.column, a partitioned table
+	// standing for its partitions, or a type such as bytea for every column of
+	// it. The values become NULL, or empty in a NOT NULL column, which only
+	// strings and bytea have. The columns are listed in Archive.Changes. The
+	// values are still read from the source and spooled with the rest of the
+	// dump, and only replaced by the rewrite that follows, so the option makes
+	// the image smaller but neither the dump faster nor the load on the
+	// source lighter.
+	ExcludeColumnData []string
+
+	// TablespaceMap maps the tablespaces of the source, which a container
+	// lacks, to the ones a plain dump creates their objects in instead,
+	// pg_default or a tablespace the restore creates under PGDATA. Objects
+	// of tablespaces it does not name go to pg_default, as do all of a
+	// custom format dump, which is made with --no-tablespaces. Either way
+	// the tablespaces are listed in Archive.Changes.
+	TablespaceMap map[string]string
+
+	// Schemas limits the dump to these schemas. Objects elsewhere that they
+	// depend on, extensions included, are not dumped.
+	Schemas []string
+
+	// Jobs is how many processes dump the data at once: a pg_dump for each of
+	// several Schemas, and connections copying ranges of the pages of each
+	// table of at least SplitTableSize, which is split into Jobs ranges. 0 or
+	// 1 dumps the data in one pg_dump. Only a plain dump with data is split
+	// up: the definitions are dumped once, in dependency order, before all
+	// the data, and the indexes, constraints and triggers once after it,
+	// every process reading the same snapshot.
+	Jobs int
+
+	// SplitTableSize is the size in bytes from which the rows of a table are
+	// copied in ranges of its pages by Jobs connections instead of by
+	// pg_dump; 0 never splits a table. Scanning a range of pages needs
+	// PostgreSQL 14 or later, older servers are dumped without splitting.
+	SplitTableSize int64
+
+	// MaxRate caps the bytes per second read from pg_dump, shared by all its
+	// processes; 0 means no limit. pg_dump blocks on the full pipe and stops
+	// reading from the server in turn, so the source sees the same rate.
+	MaxRate int64
+
+	// Snapshot, if set, is a snapshot exported by a transaction of the
+	// caller, which pg_dump then reads the database as of. The transaction has
+	// to stay open until Dump returns.
+	Snapshot string
+
+	// Verbose passes --verbose, so Stderr receives every object as pg_dump
+	// works through it.
+	Verbose bool
+
+	// Stderr, if set, receives pg_dump's stderr while it runs.
+	Stderr io.Writer
+
+	// Progress, if set, is called with the number of bytes dumped so far
+	// whenever pg_dump has written more. It is called from the goroutine
+	// copying the output, so it must be safe to call concurrently with the
+	// caller's own code.
+	Progress func(written int64)
+}
+
+// Archive is the output of a successful pg_dump.
+type Archive struct {
+	// Format is the format the dump was made in.
+	Format string
+
+	// Path is the file the dump is spooled to, in a private directory of the
+	// run, so the dump is never held in memory. Close removes it.
+	Path string
+	dir  string
+
+	// Warnings are what pg_dump warned about while still succeeding.
+	Warnings []Warning
+
+	// Timescale is the version of the timescaledb extension in the source
+	// database, empty without it, and ServerVersion the server_version_num
+	// of the source. A dump with hypertables is restored on TimescaleImage,
+	// between timescaledb_pre_restore and timescaledb_post_restore.
+	Timescale     string
+	ServerVersion int
+
+	// RefreshMatviews are the REFRESH MATERIALIZED VIEW statements taken out
+	// of the dump for DumpOptions.RefreshMatviews, run when the container starts.
+	RefreshMatviews []byte
+
+	// Changes are the objects left out or altered by the rewrites of
+	// DumpOptions.
+	Changes []Change
+
+	// excludedColumns are the columns of DumpOptions.ExcludeColumnData.
+	excludedColumns []excludedColumn
+}
+
+// dumpFileName is the file of the run directory an Archive is spooled to.
+const dumpFileName = "dump"
+
+// newArchive returns an Archive of format spooled to a new file of dir, and
+// the file, open for writing.
+func newArchive(dir string, format string) (*Archive, *os.File, error) {
+	path := filepath.Join(dir, dumpFileName)
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to create the dump file: %w", err)
+	}
+
+	return &Archive{Format: format, Path: path, dir: dir}, file, nil
+}
+
+// Size is the size of the dump in bytes.
+func (a *Archive) Size() int64 {
+	info, err := os.Stat(a.Path)
+	if err != nil {
+		return 0
+	}
+
+	return info.Size()
+}
+
+// ReadAll reads the whole dump into memory, for the small dumps of the
+// schema only.
+func (a *Archive) ReadAll() ([]byte, error) {
+	return os.ReadFile(a.Path)
+}
+
+// Close removes the dump and the run directory it was spooled to.
+func (a *Archive) Close() error {
+	if a.dir == "" {
+		return nil
+	}
+
+	return os.RemoveAll(a.dir)
+}
+
+// transform replaces the dump with what pass writes while reading it, going
+// through a new file of the run directory so neither is held in memory.
+func (a *Archive) transform(pass func(r io.Reader, w io.Writer) error) error {
+	in, err := os.Open(a.Path)
+	if err != nil {
+		return fmt.Errorf("Failed to rewrite the dump: %w", err)
+	}
+	defer in.Close()
+
+	out, err := os.CreateTemp(a.dir, dumpFileName+"-*")
+	if err != nil {
+		return fmt.Errorf("Failed to rewrite the dump: %w", err)
+	}
+	defer os.Remove(out.Name())
+
+	buffered := bufio.NewWriterSize(out, 1<<20)
+	if err := pass(bufio.NewReaderSize(in, 1<<20), buffered); err != nil {
+		out.Close()
+		return fmt.Errorf("Failed to rewrite the dump: %w", err)
+	}
+	if err := buffered.Flush(); err != nil {
+		out.Close()
+		return fmt.Errorf("Failed to rewrite the dump: %w", err)
+	}
+	if err := out.Close(); err != nil {
+		return fmt.Errorf("Failed to rewrite the dump: %w", err)
+	}
+
+	if err := os.Rename(out.Name(), a.Path); err != nil {
+		return fmt.Errorf("Failed to rewrite the dump: %w", err)
+	}
+
+	return nil
+}
+
+// Warning is a warning pg_dump printed while still succeeding, such as an
+// object it skipped.
+type Warning struct {
+	Kind    string `json:"kind"`
+	Message string `json:"message"`
+}
+
+// DumpError is returned when pg_dump exits with an error. Stderr is what it
+// printed, which usually says whether it could not connect or failed halfway.
+type DumpError struct {
+	Err    error
+	Stderr string
+}
+
+func (e *DumpError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *DumpError) Unwrap() error {
+	return e.Err
+}
+
+// Dump runs the embedded pg_dump against connectionURL. Cancelling ctx kills
+// pg_dump and returns the context's error. The caller closes the Archive to
+// remove the dump.
+func Dump(ctx context.Context, connectionURL string, options DumpOptions) (*Archive, error) {
+	dir, pgDumpPath, release, err := installPgDump()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to install pg_dump: %w", err)
+	}
+	defer release()
+
+	archive, err := dump(ctx, dir, pgDumpPath, connectionURL, options)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+
+	return archive, nil
+}
+
+// dump is Dump with pg_dump installed at pgDumpPath, spooling to dir.
+func dump(ctx context.Context, dir string, pgDumpPath string, connectionURL string, options DumpOptions) (*Archive, error) {
+	if options.Format == "" {
+		options.Format = FormatPlain
+	}
+
+	archive, err := dumpArchive(ctx, dir, pgDumpPath, connectionURL, options)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := inspectSource(ctx, connectionURL, archive, options); err != nil {
+		return nil, err
+	}
+
+	if err := rewriteArchive(archive, options); err != nil {
+		return nil, err
+	}
+
+	return archive, nil
+}
+
+// dumpArchive runs the pg_dump, or the processes of a parallel dump.
+func dumpArchive(ctx context.Context, dir string, pgDumpPath string, connectionURL string, options DumpOptions) (*Archive, error) {
+
+	limiter := newLimiter(options.MaxRate)
+
+	if options.Format == FormatPlain && !options.SchemaOnly {
+		if archive, err := dumpParallel(ctx, dir, pgDumpPath, connectionURL, options, limiter); !errors.Is(err, errNotSplit) {
+			return archive, err
+		}
+	}
+
+	archive, file, err := newArchive(dir, options.Format)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	output := throttle(ctx, &progressWriter{w: file, progress: options.Progress}, limiter)
+
+	stderr, err := runPgDump(ctx, pgDumpPath, connectionURL, options.Args(), output, options.Stderr)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := file.Close(); err != nil {
+		return nil, fmt.Errorf("Failed to write the dump: %w", err)
+	}
+
+	archive.Warnings = parseWarnings(stderr)
+
+	return archive, nil
+}
+
+// runPgDump runs pg_dump with args, its output going to stdout, and returns
+// what it printed on stderr.
+func runPgDump(ctx context.Context, pgDumpPath string, connectionURL string, args []string, stdout io.Writer, stderrOutput io.Writer) (string, error) {
+	var stderr bytes.Buffer
+
+	cmd := pgDumpCommand(ctx, pgDumpPath, append([]string{connectionURL}, args...)...)
+	cmd.Stdout = stdout
+	cmd.Stderr = &stderr
+	if stderrOutput != nil {
+		cmd.Stderr = io.MultiWriter(&stderr, stderrOutput)
+	}
+
+	if err := cmd.Start(); err != nil {
+		return "", fmt.Errorf("Failed to run pg_dump: %w", err)
+	}
+
+	if err := cmd.Wait(); err != nil {
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+
+		return "", &DumpError{Err: fmt.Errorf("pg_dump failed: %w", err), Stderr: stderr.String()}
+	}
+
+	return stderr.String(), nil
+}
+
+// Args are the arguments Dump passes to pg_dump after the connection URL.
+func (o DumpOptions) Args() []string {
+	var args []string
+
+	if o.Format == FormatCustom {
+		args = append(args, "--format=custom", "--no-tablespaces")
+	}
+
+	if o.SchemaOnly {
+		args = append(args, "--schema-only")
+	}
+
+	for _, schema := range o.Schemas {
+		args = append(args, "--schema="+schema)
+	}
+
+	for _, extension := range o.ExcludeExtensions {
+		args = append(args, "--exclude-extension="+extension)
+	}
+
+	if o.NoTableAccessMethod {
+		args = append(args, "--no-table-access-method")
+	}
+
+	if o.ConvertEncoding != "" {
+		args = append(args, "--encoding="+o.ConvertEncoding)
+	}
+
+	if o.NoOwnership {
+		args = append(args, "--no-owner", "--no-privileges")
+	}
+
+	if o.NoReplication {
+		args = append(args, "--no-publications", "--no-subscriptions")
+	}
+
+	if o.Snapshot != "" {
+		args = append(args, "--snapshot="+o.Snapshot)
+	}
+
+	if o.Verbose {
+		args = append(args, "--verbose")
+	}
+
+	return args
+}
+
+// PgDumpVersion reports the version of the embedded pg_dump, and fails when
+// the binary cannot run on this machine.
+func PgDumpVersion(ctx context.Context) (string, error) {
+	dir, pgDumpPath, release, err := installPgDump()
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(dir)
+	defer release()
+
+	output, err := pgDumpCommand(ctx, pgDumpPath, "--version").Output()
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(output)), nil
+}
+
+// installPgDump writes the embedded pg_dump binary into a new private
+// directory of the run and returns the directory, which the dump is spooled
+// to as well, the path pg_dump is run by, and a function to call once it no
+// longer is. Every run gets its own directory, created 0700 and holding a
+// file created with O_EXCL, so concurrent runs cannot race on the file and
+// other users cannot plant a binary in its place.
+//
+// The binary is reopened read-only through the descriptor it was written
+// with, checked against the embedded checksum from that descriptor, and run
+// as /proc/self/fd/N of it, so what runs is what was checked even if the
+// path is swapped in between. Where /proc is missing it is run by its path,
+// and only the private directory keeps it from being swapped.
+func installPgDump() (string, string, func(), error) {
+	dir, err := os.MkdirTemp("", "pg_container-")
+	if err != nil {
+		return "", "", nil, err
+	}
+
+	fail := func(err error) (string, string, func(), error) {
+		os.RemoveAll(dir)
+		return "", "", nil, err
+	}
+
+	path := filepath.Join(dir, "pg_dump")
+
+	written, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0700)
+	if err != nil {
+		return fail(err)
+	}
+	if _, err := written.Write(pgDump); err != nil {
+		written.Close()
+		return fail(err)
+	}
+
+	// A file open for writing cannot be run, so the checked and run
+	// descriptor is a read-only one of the same file.
+	pgDumpPath := path
+	binary, err := os.Open(fmt.Sprintf("/proc/self/fd/%d", written.Fd()))
+	if err != nil {
+		binary, err = os.Open(path)
+	}
+	written.Close()
+	if err != nil {
+		return fail(err)
+	}
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, binary); err != nil {
+		binary.Close()
+		return fail(err)
+	}
+	if !bytes.Equal(hash.Sum(nil), pgDumpChecksum[:]) {
+		binary.Close()
+		return fail(fmt.Errorf("Checksum mismatch for %s, refusing to run it", path))
+	}
+
+	if fdPath := fmt.Sprintf("/proc/self/fd/%d", binary.Fd()); fileExists(fdPath) {
+		pgDumpPath = fdPath
+	}
+
+	return dir, pgDumpPath, func() { binary.Close() }, nil
+}
+
+// fileExists reports whether path can be stat'ed.
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// pgDumpCommand runs the pg_dump at pgDumpPath, named pg_dump in its argv[0]
+// whatever the path, since it prefixes its messages with that name.
+func pgDumpCommand(ctx context.Context, pgDumpPath string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, pgDumpPath, args...)
+	cmd.Args[0] = "pg_dump"
+	return cmd
+}
+
+// warningKinds classify warnings by the first pattern they contain.
+var warningKinds = []struct {
+	kind     string
+	patterns []string
+}{
+	{"permission", []string{"permission denied", "must be owner", "must be superuser"}},
+	{"version", []string{"server version", "version mismatch"}},
+	{"skipped", []string{"skipping", "could not find", "no matching", "not dumped", "will not be dumped"}},
+	{"dependency", []string{"circular", "dependency", "foreign key"}},
+}
+
+// parseWarnings picks the warnings out of pg_dump's stderr.
+func parseWarnings(stderr string) []Warning {
+	var warnings []Warning
+
+	for _, line := range strings.Split(stderr, "\n") {
+		message, ok := strings.CutPrefix(strings.TrimSpace(line), "pg_dump: ")
+		if !ok {
+			continue
+		}
+
+		// Older versions print WARNING: instead of warning:.
+		const prefix = "warning: "
+		if len(message) <= len(prefix) || !strings.EqualFold(message[:len(prefix)], prefix) {
+			continue
+		}
+		message = message[len(prefix):]
+
+		warning := Warning{Kind: "other", Message: message}
+	classify:
+		for _, kind := range warningKinds {
+			for _, pattern := range kind.patterns {
+				if strings.Contains(strings.ToLower(message), pattern) {
+					warning.Kind = kind.kind
+					break classify
+				}
+			}
+		}
+
+		warnings = append(warnings, warning)
+	}
+
+	return warnings
+}
+
+// progressWriter reports the running total of the bytes written through it.
+type progressWriter struct {
+	w        io.Writer
+	n        int64
+	progress func(int64)
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	n, err := p.w.Write(b)
+	p.n += int64(n)
+	if p.progress != nil {
+		p.progress(p.n)
+	}
+	return n, err
+}
+
+// newLimiter returns a limiter for bytesPerSecond, or nil when there is no
+// limit. Its burst is at most a second's worth, so the rate holds from the
+// start.
+func newLimiter(bytesPerSecond int64) *rate.Limiter {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+
+	return rate.NewLimiter(rate.Limit(bytesPerSecond), int(min(bytesPerSecond, 256<<10)))
+}
+
+// throttle returns w with its writes held back to the rate of limiter, or w
+// itself when limiter is nil.
+func throttle(ctx context.Context, w io.Writer, limiter *rate.Limiter) io.Writer {
+	if limiter == nil {
+		return w
+	}
+
+	return &throttledWriter{ctx: ctx, w: w, limiter: limiter}
+}
+
+// throttledWriter writes in chunks of at most the burst of limiter, each one
+// once the limiter allows it.
+type throttledWriter struct {
+	ctx     context.Context
+	w       io.Writer
+	limiter *rate.Limiter
+}
+
+func (t *throttledWriter) Write(b []byte) (int, error) {
+	var written int
+
+	for len(b) > 0 {
+		chunk := b[:min(len(b), t.limiter.Burst())]
+		if err := t.limiter.WaitN(t.ctx, len(chunk)); err != nil {
+			return written, err
+		}
+
+		n, err := t.w.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		b = b[n:]
+	}
+
+	return written, nil
+}
@@ -0,0 +1,65 @@
+package pgcontainer
+
+import (
+	"bytes"
+	"fmt"
+	"unicode/utf8"
+)
+
+// EncodingUTF8 is the encoding DumpOptions.ConvertEncoding converts to.
+const EncodingUTF8 = "UTF8"
+
+// encodingRewrite replaces the bytes of a plain dump that are not valid
+// UTF8 with U+FFFD, counting how many each object had over all the pieces
+// it is passed in.
+type encodingRewrite struct {
+	objects []string
+	invalid map[string]int
+}
+
+func newEncodingRewrite() *encodingRewrite {
+	return &encodingRewrite{invalid: map[string]int{}}
+}
+
+func (e *encodingRewrite) rewrite(entry tocEntry) []byte {
+	if utf8.Valid(entry.Text) {
+		return entry.Text
+	}
+
+	var out bytes.Buffer
+	out.Grow(len(entry.Text))
+
+	invalid := 0
+	for text := entry.Text; len(text) > 0; {
+		r, size := utf8.DecodeRune(text)
+		if r == utf8.RuneError && size == 1 {
+			invalid++
+			out.WriteRune(utf8.RuneError)
+		} else {
+			out.Write(text[:size])
+		}
+		text = text[size:]
+	}
+
+	object := entry.object()
+	if e.invalid[object] == 0 {
+		e.objects = append(e.objects, object)
+	}
+	e.invalid[object] += invalid
+
+	return out.Bytes()
+}
+
+// changes records the objects that had bytes replaced, in dump order.
+func (e *encodingRewrite) changes() []Change {
+	var changes []Change
+	for _, object := range e.objects {
+		changes = append(changes, Change{
+			Kind:   "convert-encoding",
+			Object: object,
+			Action: fmt.Sprintf("had %d bytes that are not UTF8 replaced with U+FFFD", e.invalid[object]),
+		})
+	}
+
+	return changes
+}
@@ -0,0 +1,47 @@
+package pgcontainer
+
+import (
+	"strings"
+)
+
+// What a dump does with event triggers, see DumpOptions.EventTriggers.
+const (
+	EventTriggersKeep  = "keep"
+	EventTriggersSkip  = "skip"
+	EventTriggersDefer = "defer"
+)
+
+// eventTriggerRewrite skips or disables the event triggers of a plain dump,
+// recording what it did.
+type eventTriggerRewrite struct {
+	mode    string
+	changes []Change
+}
+
+func (t *eventTriggerRewrite) rewrite(entry tocEntry) []byte {
+	if entry.Type != "EVENT TRIGGER" {
+		if strings.HasPrefix(entry.Name, "EVENT TRIGGER ") && t.mode == EventTriggersSkip {
+			// The comment or security label of a skipped trigger.
+			return nil
+		}
+
+		return entry.Text
+	}
+
+	if t.mode == EventTriggersSkip {
+		t.changes = append(t.changes, Change{Kind: "event-triggers", Object: entry.object(), Action: "skipped"})
+		return nil
+	}
+
+	// pg_dump names the trigger in CREATE EVENT TRIGGER quoted as needed,
+	// unlike in the heading.
+	for _, line := range strings.Split(string(entry.Text), "\n") {
+		if rest, ok := strings.CutPrefix(line, "CREATE EVENT TRIGGER "); ok {
+			name, _, _ := strings.Cut(rest, " ON ")
+			t.changes = append(t.changes, Change{Kind: "event-triggers", Object: entry.object(), Action: "created disabled"})
+			return append(entry.Text, "ALTER EVENT TRIGGER "+name+" DISABLE;\n\n"...)
+		}
+	}
+
+	return entry.Text
+}
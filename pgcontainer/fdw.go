@@ -0,0 +1,123 @@
+package pgcontainer
+
+import (
+	"bytes"
+	"strings"
+)
+
+// What a dump does with foreign servers, their user mappings and foreign
+// tables, see DumpOptions.ForeignData.
+const (
+	ForeignDataKeep  = "keep"
+	ForeignDataStrip = "strip"
+	ForeignDataStub  = "stub"
+)
+
+// foreignDataStub creates the server stubbed foreign tables are moved to.
+// file_fdw ships with the postgres image, and a table reading /dev/null is
+// empty, so views on the tables still restore and return no rows. The dump
+// empties the search_path, so the extension is given a schema.
+const foreignDataStub = `CREATE EXTENSION IF NOT EXISTS file_fdw WITH SCHEMA pg_catalog;
+CREATE SERVER pg_container_stub FOREIGN DATA WRAPPER file_fdw;
+
+`
+
+// foreignDataRewrite strips or stubs the foreign data of a plain dump,
+// entry by entry, recording what it did.
+type foreignDataRewrite struct {
+	mode    string
+	changes []Change
+
+	// tables are the stripped foreign tables, by schema-qualified name, whose
+	// comments and privileges go with them.
+	tables  map[string]bool
+	stubbed bool
+}
+
+func newForeignDataRewrite(mode string) *foreignDataRewrite {
+	return &foreignDataRewrite{mode: mode, tables: map[string]bool{}}
+}
+
+func (f *foreignDataRewrite) rewrite(entry tocEntry) []byte {
+	switch {
+	case entry.Type == "SERVER" || entry.Type == "USER MAPPING":
+		f.record(entry, "stripped")
+		return nil
+
+	case strings.HasPrefix(entry.Name, "SERVER "):
+		// The comment, privileges or security label of a server.
+		return nil
+
+	case entry.Type == "FOREIGN TABLE" && f.mode == ForeignDataStrip:
+		f.record(entry, "stripped")
+		f.tables[entry.Schema+"."+entry.Name] = true
+		return nil
+
+	case entry.Type == "FOREIGN TABLE":
+		f.record(entry, "stubbed")
+		text := stubForeignTable(entry.Text)
+		if !f.stubbed {
+			f.stubbed = true
+			text = append([]byte(foreignDataStub), text...)
+		}
+		return text
+
+	case f.attachedToStripped(entry):
+		return nil
+	}
+
+	return entry.Text
+}
+
+// attachedToStripped tells whether entry is the comment, privileges or
+// security label of a stripped foreign table or one of its columns.
+func (f *foreignDataRewrite) attachedToStripped(entry tocEntry) bool {
+	name := entry.Name
+	for _, prefix := range []string{"FOREIGN TABLE ", "TABLE ", "COLUMN "} {
+		if rest, ok := strings.CutPrefix(name, prefix); ok {
+			name = rest
+			break
+		}
+	}
+
+	if strings.HasPrefix(entry.Name, "COLUMN ") {
+		if i := strings.LastIndex(name, "."); i >= 0 {
+			name = name[:i]
+		}
+	}
+
+	return name != entry.Name && f.tables[entry.Schema+"."+name]
+}
+
+func (f *foreignDataRewrite) record(entry tocEntry, action string) {
+	f.changes = append(f.changes, Change{Kind: "fdw", Object: entry.object(), Action: action})
+}
+
+// stubForeignTable moves the CREATE FOREIGN TABLE of an entry to the stub
+// server, replacing its options, which belong to the original wrapper, and
+// leaving out the per-column options pg_dump sets with ALTER FOREIGN TABLE.
+func stubForeignTable(text []byte) []byte {
+	var out bytes.Buffer
+	skipping := false
+
+	for _, line := range strings.SplitAfter(string(text), "\n") {
+		trimmed := strings.TrimRight(line, "\n")
+
+		switch {
+		case skipping:
+			skipping = trimmed != ");"
+
+		case strings.HasPrefix(trimmed, "SERVER "):
+			out.WriteString("SERVER pg_container_stub\nOPTIONS (\n    filename '/dev/null'\n);\n")
+			skipping = !strings.HasSuffix(trimmed, ";")
+
+		case strings.HasPrefix(trimmed, "ALTER FOREIGN TABLE ") && strings.HasSuffix(trimmed, " OPTIONS ("):
+			skipping = true
+
+		default:
+			out.WriteString(line)
+		}
+	}
+
+	return out.Bytes()
+}
@@ -0,0 +1,59 @@
+package pgcontainer
+
+import (
+	"bytes"
+	_ "embed"
+)
+
+// When a dump populates its materialized views, see
+// DumpOptions.RefreshMatviews.
+const (
+	RefreshMatviewsBlocking     = "blocking"
+	RefreshMatviewsConcurrently = "concurrently"
+	RefreshMatviewsNone         = "none"
+)
+
+//go:embed pg_container-refresh-matviews
+var refreshMatviewsScript []byte
+
+// refreshMatviewsFile is the file of the build context holding
+// Archive.RefreshMatviews.
+const refreshMatviewsFile = "refresh-matviews.sql"
+
+// RefreshMatviewsCommand is the command of an image whose materialized views
+// are refreshed on start: the refresh in the background, then the server.
+var RefreshMatviewsCommand = []string{"sh", "-c", "pg_container-refresh-matviews & exec postgres -c config_file=/data/postgresql.conf"}
+
+// matviewRewrite takes the REFRESH MATERIALIZED VIEW of each view out of a
+// plain dump, so the restore creates the views empty, keeping the statements
+// in dump order, which refreshes views before those built on them.
+type matviewRewrite struct {
+	mode      string
+	refreshes bytes.Buffer
+	changes   []Change
+}
+
+func (m *matviewRewrite) rewrite(entry tocEntry) []byte {
+	if entry.Type != "MATERIALIZED VIEW DATA" {
+		return entry.Text
+	}
+
+	action := "left unpopulated"
+	if m.mode == RefreshMatviewsConcurrently {
+		action = "refreshed on the first start"
+		m.refreshes.Write(entry.Text)
+	}
+	m.changes = append(m.changes, Change{Kind: "refresh-matviews", Object: "MATERIALIZED VIEW " + entry.Schema + "." + entry.Name, Action: action})
+
+	return nil
+}
+
+// refreshMatviewsFileName is the RefreshMatviewsFile of archive, empty when
+// it refreshes no views on start.
+func (a *Archive) refreshMatviewsFileName() string {
+	if len(a.RefreshMatviews) == 0 {
+		return ""
+	}
+
+	return refreshMatviewsFile
+}
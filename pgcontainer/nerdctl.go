@@ -0,0 +1,286 @@
+package pgcontainer
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/mount"
+)
+
+// Nerdctl builds images and runs containers through the nerdctl command line
+// of containerd instead of the Docker API, for hosts without dockerd such as
+// Lima, colima with the containerd runtime or k3s nodes. Building needs
+// buildkitd next to containerd, as nerdctl build itself does.
+type Nerdctl struct {
+	// Binary is the nerdctl executable, "nerdctl" if empty.
+	Binary string
+
+	// Namespace is the containerd namespace of the images and containers,
+	// such as k8s.io for images the kubelet of a k3s node can use. Empty
+	// leaves it to nerdctl, which defaults to "default".
+	Namespace string
+}
+
+func (n *Nerdctl) command(ctx context.Context, args ...string) *exec.Cmd {
+	if n.Namespace != "" {
+		args = append([]string{"--namespace", n.Namespace}, args...)
+	}
+
+	return exec.CommandContext(ctx, cmp.Or(n.Binary, "nerdctl"), args...)
+}
+
+// run runs nerdctl and returns its standard output, with whatever it printed
+// on standard error in the error.
+func (n *Nerdctl) run(ctx context.Context, args ...string) (string, error) {
+	var stdout, stderr bytes.Buffer
+
+	cmd := n.command(ctx, args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		if message := strings.TrimSpace(stderr.String()); message != "" {
+			return "", fmt.Errorf("nerdctl %s: %w: %s", args[0], err, message)
+		}
+		return "", fmt.Errorf("nerdctl %s: %w", args[0], err)
+	}
+
+	return strings.TrimSpace(stdout.String()), nil
+}
+
+// Version returns the version of the nerdctl client, failing when it cannot
+// be run.
+func (n *Nerdctl) Version(ctx context.Context) (string, error) {
+	return n.run(ctx, "version", "--format", "{{.Client.Version}}")
+}
+
+// BuildImage is BuildImage for containerd.
+func (n *Nerdctl) BuildImage(ctx context.Context, archive *Archive, options BuildOptions) (string, error) {
+	options = options.withDefaults()
+
+	files, err := buildFiles(archive, options)
+	if err != nil {
+		return "", err
+	}
+
+	// nerdctl build takes a directory rather than a tar stream.
+	dir, err := os.MkdirTemp("", "pg_container-build-")
+	if err != nil {
+		return "", fmt.Errorf("Failed to create the build context: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, file := range files {
+		path := filepath.Join(dir, filepath.FromSlash(file.name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return "", fmt.Errorf("Failed to create the build context: %w", err)
+		}
+		if err := file.writeTo(path); err != nil {
+			return "", fmt.Errorf("Failed to write %s to the build context: %w", file.name, err)
+		}
+	}
+
+	tag := ImageName(options.Name, time.Now())
+
+	args := []string{"build", "--tag", tag, "--progress", "plain"}
+	for _, name := range sortedKeys(options.buildArgs()) {
+		args = append(args, "--build-arg", name+"="+options.buildArgs()[name])
+	}
+	for _, name := range sortedKeys(options.Labels) {
+		args = append(args, "--label", name+"="+options.Labels[name])
+	}
+	args = append(args, dir)
+
+	var buildOutput bytes.Buffer
+	output := io.Writer(&buildOutput)
+	if options.Output != nil {
+		output = io.MultiWriter(&buildOutput, options.Output)
+	}
+
+	cmd := n.command(ctx, args...)
+	cmd.Stdout = output
+	cmd.Stderr = output
+
+	if err := cmd.Run(); err != nil {
+		return "", &BuildError{Err: fmt.Errorf("Failed to build image: %w", err), Output: buildOutput.String()}
+	}
+
+	return tag, nil
+}
+
+// CreateContainer is CreateContainer for containerd. The container gets no
+// health check, which nerdctl releases before 2.1 do not support, and no
+// network alias, so on a network it is only reachable by its name.
+func (n *Nerdctl) CreateContainer(ctx context.Context, image string, options ContainerOptions) (string, error) {
+	containerConfig, hostConfig, _, err := containerConfigs(image, options)
+	if err != nil {
+		return "", err
+	}
+
+	args := []string{"create", "--name", options.Name}
+
+	for _, env := range containerConfig.Env {
+		args = append(args, "--env", env)
+	}
+	for _, name := range sortedKeys(containerConfig.Labels) {
+		args = append(args, "--label", name+"="+containerConfig.Labels[name])
+	}
+
+	for port, bindings := range hostConfig.PortBindings {
+		for _, binding := range bindings {
+			publish := port.Port()
+			if binding.HostPort != "" {
+				publish = binding.HostPort + ":" + publish
+			}
+			if binding.HostIP != "" {
+				publish = binding.HostIP + ":" + publish
+			}
+			args = append(args, "--publish", publish)
+		}
+	}
+
+	if policy := hostConfig.RestartPolicy; policy.Name != "" && policy.Name != container.RestartPolicyDisabled {
+		restart := string(policy.Name)
+		if policy.MaximumRetryCount > 0 {
+			restart += ":" + strconv.Itoa(policy.MaximumRetryCount)
+		}
+		args = append(args, "--restart", restart)
+	}
+	if hostConfig.AutoRemove {
+		args = append(args, "--rm")
+	}
+
+	if hostConfig.Memory > 0 {
+		args = append(args, "--memory", strconv.FormatInt(hostConfig.Memory, 10))
+	}
+	if hostConfig.NanoCPUs > 0 {
+		args = append(args, "--cpus", strconv.FormatFloat(float64(hostConfig.NanoCPUs)/1e9, 'f', -1, 64))
+	}
+	if hostConfig.ShmSize > 0 {
+		args = append(args, "--shm-size", strconv.FormatInt(hostConfig.ShmSize, 10))
+	}
+
+	for path, tmpfsOptions := range hostConfig.Tmpfs {
+		args = append(args, "--tmpfs", path+":"+tmpfsOptions)
+	}
+	for _, m := range hostConfig.Mounts {
+		volume := m.Source + ":" + m.Target
+		if m.Type == mount.TypeVolume {
+			// Unlike dockerd, nerdctl does not create named volumes on use.
+			if _, err := n.run(ctx, "volume", "inspect", m.Source); err != nil {
+				if _, err := n.run(ctx, "volume", "create", m.Source); err != nil {
+					return "", fmt.Errorf("Failed to create volume %s: %w", m.Source, err)
+				}
+			}
+		}
+		args = append(args, "--volume", volume)
+	}
+
+	if hostConfig.NetworkMode != "" {
+		args = append(args, "--network", string(hostConfig.NetworkMode))
+	}
+
+	args = append(args, image)
+	args = append(args, containerConfig.Cmd...)
+
+	if _, err := n.run(ctx, args...); err != nil {
+		return "", fmt.Errorf("Failed to create container %s: %w", options.Name, err)
+	}
+
+	return options.Name, nil
+}
+
+// StartContainer starts a container created by CreateContainer.
+func (n *Nerdctl) StartContainer(ctx context.Context, name string) error {
+	if _, err := n.run(ctx, "start", name); err != nil {
+		return fmt.Errorf("Failed to start container %s: %w", name, err)
+	}
+	return nil
+}
+
+// Running reports whether the container is running, and its exit code when
+// it is not.
+func (n *Nerdctl) Running(ctx context.Context, name string) (bool, int, error) {
+	state, err := n.run(ctx, "inspect", "--format", "{{.State.Running}} {{.State.ExitCode}}", name)
+	if err != nil {
+		return false, 0, err
+	}
+
+	running, exitCode, _ := strings.Cut(state, " ")
+	code, _ := strconv.Atoi(exitCode)
+
+	return running == "true", code, nil
+}
+
+// Exec runs a command in a running container and returns its exit code and
+// combined output.
+func (n *Nerdctl) Exec(ctx context.Context, name string, command []string, stdin io.Reader) (int, string, error) {
+	args := []string{"exec"}
+	if stdin != nil {
+		args = append(args, "--interactive")
+	}
+	args = append(append(args, name), command...)
+
+	var output bytes.Buffer
+	cmd := n.command(ctx, args...)
+	cmd.Stdin = stdin
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode(), output.String(), nil
+	}
+
+	return 0, output.String(), err
+}
+
+// Exists reports whether a container of that name exists.
+func (n *Nerdctl) Exists(ctx context.Context, name string) (bool, error) {
+	names, err := n.run(ctx, "container", "ls", "--all", "--format", "{{.Names}}")
+	if err != nil {
+		return false, err
+	}
+
+	for _, existing := range strings.Fields(names) {
+		if existing == name {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// RemoveContainer removes a container, stopping it first if need be.
+func (n *Nerdctl) RemoveContainer(ctx context.Context, name string) error {
+	_, err := n.run(ctx, "rm", "--force", name)
+	return err
+}
+
+// RemoveImage removes an image by tag.
+func (n *Nerdctl) RemoveImage(ctx context.Context, name string) error {
+	_, err := n.run(ctx, "rmi", "--force", name)
+	return err
+}
+
+func sortedKeys(values map[string]string) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,411 @@
+package pgcontainer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+
+	"github.com/jackc/pgx/v5"
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/time/rate"
+)
+
+// errNotSplit means the dump is not split up by dumpParallel, because there
+// is nothing to spread over several processes or because the server could
+// not export a snapshot for them to share. Dump then falls back to a single
+// pg_dump, which also reports a connection failure in its own words.
+var errNotSplit = errors.New("dump not split")
+
+// minSplitServerVersion is the first release scanning a range of ctids
+// without reading the whole table, which splitting a table relies on.
+const minSplitServerVersion = 140000
+
+// dumpPart is a piece of a parallel dump: the output of a pg_dump, or the
+// rows of a range of pages of a split table.
+type dumpPart struct {
+	pgDumpArgs []string
+	copy       *tableRange
+
+	// path is the file the part is spooled to until the parts are joined.
+	path   string
+	stderr string
+}
+
+// splitTable is a table of at least DumpOptions.SplitTableSize, whose rows
+// are copied in ranges of pages rather than by pg_dump.
+type splitTable struct {
+	// Name is the quoted, schema-qualified name, Columns the quoted columns
+	// the rows are copied with, leaving out generated ones.
+	Name    string
+	Columns string
+	Pages   int64
+}
+
+// tableRange is the pages [From, To) of a split table; To is 0 for the last
+// range, which takes the pages added since the size was read as well.
+type tableRange struct {
+	table    splitTable
+	From, To int64
+}
+
+// dumpParallel dumps with several processes at once: each of options.Schemas
+// in its own pg_dump, and each table of at least options.SplitTableSize in
+// ranges of its pages copied over their own connections. The dump is split
+// into pg_dump's sections so the result restores like a single dump: the
+// pre-data section of all the schemas has the definitions in dependency
+// order, the data sections and the copied ranges depend on nothing but those
+// definitions, and the post-data section, with the foreign keys, comes last.
+// All processes read options.Snapshot, or a snapshot exported from a
+// transaction held open until they are done, so the data is as consistent as
+// from one pg_dump. They share limiter, so options.MaxRate caps their sum.
+// Each part is spooled to its own file of dir, and the files are joined in
+// order into the dump.
+//
+// A database with partitioned tables is split into sections even with a
+// single job, so analyzePartitions can run between the data and the
+// post-data: pg_dump already creates the parents before their partitions and
+// loads each partition directly, but the foreign keys to the parents would
+// otherwise be validated without statistics.
+func dumpParallel(ctx context.Context, dir string, pgDumpPath string, connectionURL string, options DumpOptions, limiter *rate.Limiter) (*Archive, error) {
+	conn, err := pgx.Connect(ctx, connectionURL)
+	if err != nil {
+		return nil, errNotSplit
+	}
+	defer conn.Close(context.WithoutCancel(ctx))
+
+	tx, err := conn.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.RepeatableRead, AccessMode: pgx.ReadOnly})
+	if err != nil {
+		return nil, errNotSplit
+	}
+	defer tx.Rollback(context.WithoutCancel(ctx))
+
+	snapshot := options.Snapshot
+	if snapshot != "" {
+		if _, err := tx.Exec(ctx, "SET TRANSACTION SNAPSHOT '"+snapshot+"'"); err != nil {
+			return nil, errNotSplit
+		}
+	} else if err := tx.QueryRow(ctx, "SELECT pg_export_snapshot()").Scan(&snapshot); err != nil {
+		return nil, errNotSplit
+	}
+
+	// The copied ranges are spliced into the script of pg_dump, which
+	// declares its encoding, the database's unless converted. The names of
+	// the split tables are read in it too, as they go into the script and
+	// the queries of copyRange.
+	encoding := options.ConvertEncoding
+	if encoding == "" {
+		if err := tx.QueryRow(ctx, "SELECT pg_encoding_to_char(encoding) FROM pg_database WHERE datname = current_database()").Scan(&encoding); err != nil {
+			return nil, errNotSplit
+		}
+	}
+	if err := setDumpSettings(ctx, tx, encoding); err != nil {
+		return nil, errNotSplit
+	}
+
+	var tables []splitTable
+	if options.SplitTableSize > 0 && options.Jobs > 1 {
+		tables, err = findSplitTables(ctx, tx, options)
+		if err != nil {
+			return nil, errNotSplit
+		}
+	}
+
+	partitioned, err := countPartitioned(ctx, tx, options.Schemas)
+	if err != nil {
+		return nil, errNotSplit
+	}
+
+	parallel := options.Jobs > 1 && (len(options.Schemas) > 1 || len(tables) > 0)
+	if !parallel && partitioned == 0 {
+		return nil, errNotSplit
+	}
+
+	section := func(name string, schemas []string) *dumpPart {
+		sectionOptions := options
+		sectionOptions.Schemas = schemas
+		sectionOptions.Snapshot = snapshot
+
+		args := append(sectionOptions.Args(), "--section="+name)
+		if name == "data" {
+			for _, table := range tables {
+				args = append(args, "--exclude-table-data="+table.Name)
+			}
+		}
+
+		return &dumpPart{pgDumpArgs: args}
+	}
+
+	parts := []*dumpPart{section("pre-data", options.Schemas)}
+	if len(options.Schemas) > 1 && options.Jobs > 1 {
+		for _, schema := range options.Schemas {
+			parts = append(parts, section("data", []string{schema}))
+		}
+	} else {
+		parts = append(parts, section("data", options.Schemas))
+	}
+	for _, table := range tables {
+		for _, r := range table.ranges(options.Jobs) {
+			parts = append(parts, &dumpPart{copy: &r})
+		}
+	}
+	postData := section("post-data", options.Schemas)
+	parts = append(parts, postData)
+
+	var stderr io.Writer
+	if options.Stderr != nil {
+		stderr = &syncWriter{w: options.Stderr}
+	}
+
+	var written atomic.Int64
+
+	group, groupCtx := errgroup.WithContext(ctx)
+	group.SetLimit(max(options.Jobs, 1))
+
+	for i, p := range parts {
+		p.path = filepath.Join(dir, fmt.Sprintf("part-%d", i))
+	}
+	defer func() {
+		for _, p := range parts {
+			os.Remove(p.path)
+		}
+	}()
+
+	for _, p := range parts {
+		group.Go(func() error {
+			file, err := os.OpenFile(p.path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+			if err != nil {
+				return fmt.Errorf("Failed to create a part of the dump: %w", err)
+			}
+			defer file.Close()
+
+			output := throttle(groupCtx, &sharedProgressWriter{w: file, total: &written, progress: options.Progress}, limiter)
+
+			if p.copy != nil {
+				if options.Verbose && stderr != nil {
+					fmt.Fprintf(stderr, "pg_container: copying pages %d to %s of table %s\n", p.copy.From, p.copy.end(), p.copy.table.Name)
+				}
+				if err := copyRange(groupCtx, connectionURL, snapshot, encoding, *p.copy, output); err != nil {
+					return err
+				}
+			} else if p.stderr, err = runPgDump(groupCtx, pgDumpPath, connectionURL, p.pgDumpArgs, output, stderr); err != nil {
+				return err
+			}
+
+			return file.Close()
+		})
+	}
+
+	if err := group.Wait(); err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+
+	archive, file, err := newArchive(dir, options.Format)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	for _, p := range parts {
+		if p == postData && partitioned > 0 {
+			if _, err := io.WriteString(file, analyzePartitions); err != nil {
+				return nil, fmt.Errorf("Failed to write the dump: %w", err)
+			}
+		}
+		if err := appendFile(file, p.path); err != nil {
+			return nil, err
+		}
+		archive.Warnings = append(archive.Warnings, parseWarnings(p.stderr)...)
+	}
+
+	if err := file.Close(); err != nil {
+		return nil, fmt.Errorf("Failed to write the dump: %w", err)
+	}
+
+	return archive, nil
+}
+
+// appendFile copies the file at path to the end of w and removes it.
+func appendFile(w io.Writer, path string) error {
+	part, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("Failed to join the parts of the dump: %w", err)
+	}
+	defer os.Remove(path)
+	defer part.Close()
+
+	if _, err := io.Copy(w, part); err != nil {
+		return fmt.Errorf("Failed to join the parts of the dump: %w", err)
+	}
+
+	return nil
+}
+
+// findSplitTables returns the ordinary tables of options.Schemas, or of all
+// schemas but the system ones, of at least options.SplitTableSize. Tables of
+// extensions are left to pg_dump, which knows which of their rows belong in
+// the dump. None are split on a server too old to scan a range of ctids.
+func findSplitTables(ctx context.Context, tx pgx.Tx, options DumpOptions) ([]splitTable, error) {
+	var version int
+	if err := tx.QueryRow(ctx, "SELECT current_setting('server_version_num')::int").Scan(&version); err != nil {
+		return nil, err
+	}
+	if version < minSplitServerVersion {
+		return nil, nil
+	}
+
+	rows, err := tx.Query(ctx, `
+		SELECT name, columns, pages FROM (
+			SELECT
+				format('"%s"."%s"', replace(n.nspname, '"', '""'), replace(c.relname, '"', '""')) AS name,
+				(SELECT string_agg(quote_ident(a.attname), ', ' ORDER BY a.attnum)
+				 FROM pg_attribute a
+				 WHERE a.attrelid = c.oid AND a.attnum > 0 AND NOT a.attisdropped AND a.attgenerated = '') AS columns,
+				pg_relation_size(c.oid) / current_setting('block_size')::bigint AS pages
+			FROM pg_class c
+			JOIN pg_namespace n ON n.oid = c.relnamespace
+			WHERE c.relkind = 'r'
+			  AND pg_relation_size(c.oid) >= $1
+			  AND (coalesce(cardinality($2::text[]), 0) = 0 OR n.nspname = ANY($2))
+			  AND NOT EXISTS (SELECT FROM pg_depend d WHERE d.classid = 'pg_class'::regclass AND d.objid = c.oid AND d.deptype = 'e')
+			  AND n.nspname NOT IN ('pg_catalog', 'information_schema')
+			  AND n.nspname NOT LIKE 'pg\_%'
+		) t
+		WHERE columns IS NOT NULL
+		ORDER BY name`, options.SplitTableSize, options.Schemas)
+	if err != nil {
+		return nil, err
+	}
+
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (splitTable, error) {
+		var table splitTable
+		err := row.Scan(&table.Name, &table.Columns, &table.Pages)
+		return table, err
+	})
+}
+
+// ranges splits the pages of the table into n ranges of about the same size.
+func (t splitTable) ranges(n int) []tableRange {
+	n = int(max(min(int64(n), t.Pages), 1))
+
+	ranges := make([]tableRange, n)
+	for i := range ranges {
+		ranges[i] = tableRange{table: t, From: t.Pages * int64(i) / int64(n), To: t.Pages * int64(i+1) / int64(n)}
+	}
+	ranges[n-1].To = 0
+
+	return ranges
+}
+
+func (r tableRange) end() string {
+	if r.To == 0 {
+		return "the end"
+	}
+
+	return fmt.Sprint(r.To - 1)
+}
+
+// copyRange writes the rows of r to w as a COPY ... FROM stdin block of a
+// plain dump, read over a connection of its own from snapshot. The rows are
+// formatted as pg_dump formats them, in encoding and with the settings it
+// sets, whatever the defaults of the server and pgx.
+func copyRange(ctx context.Context, connectionURL string, snapshot string, encoding string, r tableRange, w io.Writer) error {
+	conn, err := pgx.Connect(ctx, connectionURL)
+	if err != nil {
+		return fmt.Errorf("Failed to connect to copy %s: %w", r.table.Name, err)
+	}
+	defer conn.Close(context.WithoutCancel(ctx))
+
+	tx, err := conn.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.RepeatableRead, AccessMode: pgx.ReadOnly})
+	if err != nil {
+		return fmt.Errorf("Failed to copy %s: %w", r.table.Name, err)
+	}
+	defer tx.Rollback(context.WithoutCancel(ctx))
+
+	if _, err := tx.Exec(ctx, "SET TRANSACTION SNAPSHOT '"+snapshot+"'"); err != nil {
+		return fmt.Errorf("Failed to copy %s: %w", r.table.Name, err)
+	}
+
+	// Like pg_dump, fail rather than copy only the rows a policy lets through.
+	if _, err := tx.Exec(ctx, "SET LOCAL row_security = off"); err != nil {
+		return fmt.Errorf("Failed to copy %s: %w", r.table.Name, err)
+	}
+
+	if err := setDumpSettings(ctx, tx, encoding); err != nil {
+		return fmt.Errorf("Failed to copy %s: %w", r.table.Name, err)
+	}
+
+	condition := fmt.Sprintf("ctid >= '(%d,0)'::tid", r.From)
+	if r.To > 0 {
+		condition += fmt.Sprintf(" AND ctid < '(%d,0)'::tid", r.To)
+	}
+
+	if _, err := fmt.Fprintf(w, "COPY %s (%s) FROM stdin;\n", r.table.Name, r.table.Columns); err != nil {
+		return err
+	}
+
+	query := fmt.Sprintf("COPY (SELECT %s FROM ONLY %s WHERE %s) TO STDOUT", r.table.Columns, r.table.Name, condition)
+	if _, err := conn.PgConn().CopyTo(ctx, w, query); err != nil {
+		return fmt.Errorf("Failed to copy %s: %w", r.table.Name, err)
+	}
+
+	_, err = io.WriteString(w, "\\.\n\n")
+	return err
+}
+
+// setDumpSettings sets for the rest of tx what pg_dump sets on its
+// connection before reading data: the client encoding of the dump, and the
+// date, interval and float formats its script restores with.
+func setDumpSettings(ctx context.Context, tx pgx.Tx, encoding string) error {
+	if _, err := tx.Exec(ctx, "SELECT set_config('client_encoding', $1, true)", encoding); err != nil {
+		return err
+	}
+
+	for _, setting := range []string{
+		"SET LOCAL DateStyle = ISO",
+		"SET LOCAL IntervalStyle = postgres",
+		"SET LOCAL extra_float_digits = 3",
+	} {
+		if _, err := tx.Exec(ctx, setting); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// syncWriter serializes the writes of concurrent pg_dump processes.
+type syncWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (s *syncWriter) Write(b []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.Write(b)
+}
+
+// sharedProgressWriter is progressWriter with the total kept across the
+// writers of several processes.
+type sharedProgressWriter struct {
+	w        io.Writer
+	total    *atomic.Int64
+	progress func(int64)
+}
+
+func (p *sharedProgressWriter) Write(b []byte) (int, error) {
+	n, err := p.w.Write(b)
+	total := p.total.Add(int64(n))
+	if p.progress != nil {
+		p.progress(total)
+	}
+	return n, err
+}
@@ -0,0 +1,39 @@
+package pgcontainer
+
+import (
+	"context"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// analyzePartitionsFile is the file of the build context holding
+// analyzePartitions, run between the data and the post-data sections of a
+// custom format restore.
+const analyzePartitionsFile = "analyze-partitions.sql"
+
+// analyzePartitions analyzes every partitioned table, which recurses into its
+// partitions. It runs after the data is loaded and before the post-data
+// section: without statistics, and autovacuum never analyzes a partitioned
+// table, the queries validating the foreign keys that reference partitioned
+// tables are planned as if every partition were empty, which on large ones
+// turns into nested loops taking hours. It does nothing when there are no
+// partitioned tables.
+const analyzePartitions = `SELECT format('ANALYZE %s;', c.oid::regclass)
+FROM pg_class c
+WHERE c.relkind = 'p' AND NOT c.relispartition
+\gexec
+`
+
+// countPartitioned returns the number of partitioned tables in schemas, or in
+// all schemas when there are none.
+func countPartitioned(ctx context.Context, tx pgx.Tx, schemas []string) (int, error) {
+	var count int
+	err := tx.QueryRow(ctx, `
+		SELECT count(*)
+		FROM pg_class c
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE c.relkind = 'p'
+		  AND (coalesce(cardinality($1::text[]), 0) = 0 OR n.nspname = ANY($1))`, schemas).Scan(&count)
+
+	return count, err
+}
@@ -0,0 +1,41 @@
+// Package pgcontainer turns a live Postgres database into a Docker image with
+// the data already restored, and runs containers from such images. It is
+// what the pg_container command is built on:
+//
+//	archive, err := pgcontainer.Dump(ctx, "postgres://user:password@db:5432/app", pgcontainer.DumpOptions{})
+//	defer archive.Close()
+//	image, err := pgcontainer.BuildImage(ctx, apiClient, archive, pgcontainer.BuildOptions{Database: "app"})
+//	name, err := pgcontainer.CreateContainer(ctx, apiClient, image, pgcontainer.ContainerOptions{Name: "app", HostPort: "5432"})
+//
+// pg_dump is embedded, so nothing but a Docker daemon is needed; on containerd
+// hosts Nerdctl builds and runs the same images through nerdctl instead. The
+// package does not log; output streams can be captured through the options
+// instead.
+package pgcontainer
+
+import "time"
+
+// Dump formats. A plain dump is restored with psql, a custom one with a
+// parallel pg_restore.
+const (
+	FormatPlain  = "plain"
+	FormatCustom = "custom"
+)
+
+// DefaultContainerPort is the port Postgres listens on inside the container.
+const DefaultContainerPort = "5432"
+
+// DumpFileName is the name of a dump of the given format in the build
+// context, and in the image when the dump is kept.
+func DumpFileName(format string) string {
+	if format == FormatCustom {
+		return "dump.pgdump"
+	}
+
+	return "dump.sql"
+}
+
+// ImageName is the tag of an image for name built at the given time.
+func ImageName(name string, t time.Time) string {
+	return name + "-" + t.Format("2006-01-02-1504") + ":latest"
+}
@@ -0,0 +1,77 @@
+set -e
+{{- if .Timescale}}
+
+# The Alpine based Timescale images may only have su-exec.
+command -v gosu >/dev/null || gosu() { su-exec "$@"; }
+{{- end}}
+
+mkdir -p ${PGDATA}
+chown postgres:postgres ${PGDATA}
+chmod 700 ${PGDATA}
+
+{{- if .Compressed}}
+zstd -d -q --rm /tmp/{{.DumpFile}}.zst -o /tmp/{{.DumpFile}}
+{{- end}}
+gosu postgres initdb --pgdata=${PGDATA}
+{{- if .Timescale}}
+echo "shared_preload_libraries = 'timescaledb'" >> ${PGDATA}/postgresql.conf
+echo "timescaledb.telemetry_level = off" >> ${PGDATA}/postgresql.conf
+{{- end}}
+gosu postgres pg_ctl -D ${PGDATA} -o "-c listen_addresses=''{{if .FastRestore}} -c fsync=off -c full_page_writes=off -c synchronous_commit=off -c max_wal_size=4GB -c maintenance_work_mem={{.MaintenanceWorkMem}}{{end}}" -w -t 86400 start
+gosu postgres psql -U postgres -c "CREATE DATABASE ${DB_NAME};"
+{{- if .Timescale}}
+gosu postgres psql -U postgres -d ${DB_NAME} -v ON_ERROR_STOP=1 -c "CREATE EXTENSION IF NOT EXISTS timescaledb VERSION '{{.Timescale}}';" -c "SELECT timescaledb_pre_restore();"
+{{- end}}
+{{- if .CustomFormat}}
+gosu postgres pg_restore -U postgres -d ${DB_NAME}{{if .StopOnError}} --exit-on-error{{end}} \
+    -j "$([ "${RESTORE_JOBS}" -gt 0 ] && echo "${RESTORE_JOBS}" || nproc)" \
+    --section=pre-data --section=data /tmp/{{.DumpFile}}
+gosu postgres psql -U postgres -d ${DB_NAME} -q -v ON_ERROR_STOP=1 -f /tmp/{{.AnalyzePartitionsFile}}
+gosu postgres pg_restore -U postgres -d ${DB_NAME}{{if .StopOnError}} --exit-on-error{{end}} \
+    -j "$([ "${RESTORE_JOBS}" -gt 0 ] && echo "${RESTORE_JOBS}" || nproc)" \
+    --section=post-data /tmp/{{.DumpFile}}
+{{- else}}
+gosu postgres psql -U postgres -d ${DB_NAME}{{if .StopOnError}} -v ON_ERROR_STOP=1{{end}} -f /tmp/{{.DumpFile}}
+{{- end}}
+{{- if .Timescale}}
+gosu postgres psql -U postgres -d ${DB_NAME} -v ON_ERROR_STOP=1 -c "SELECT timescaledb_post_restore();"
+{{- end}}
+{{- if .SequencesFile}}
+gosu postgres psql -U postgres -d ${DB_NAME} -v ON_ERROR_STOP=1 -f /tmp/{{.SequencesFile}}
+{{- end}}
+{{- if .Vacuum}}
+gosu postgres psql -U postgres -d ${DB_NAME} -c "VACUUM (ANALYZE);"
+{{- else if .Analyze}}
+gosu postgres psql -U postgres -d ${DB_NAME} -c "ANALYZE;"
+{{- end}}
+{{- if .InitScripts}}
+for script in /tmp/init/*.sql; do
+    gosu postgres psql -U postgres -d ${DB_NAME} -v ON_ERROR_STOP=1 -f "${script}"
+done
+{{- end}}
+{{- if .Template}}
+gosu postgres psql -U postgres -c "ALTER DATABASE ${DB_NAME} WITH IS_TEMPLATE true;"
+{{- end}}
+gosu postgres psql -U postgres -c "ALTER USER postgres WITH PASSWORD 'postgres';"
+gosu postgres pg_ctl -D ${PGDATA} -m fast -w -t 86400 stop
+
+echo "listen_addresses = '*'" >> ${PGDATA}/postgresql.conf
+echo "host all all 0.0.0.0/0 md5" >> ${PGDATA}/pg_hba.conf
+{{- if .Timezone}}
+echo "timezone = '{{.Timezone}}'" >> ${PGDATA}/postgresql.conf
+echo "log_timezone = '{{.Timezone}}'" >> ${PGDATA}/postgresql.conf
+{{- end}}
+
+mkdir -p /pgdata
+chown postgres:postgres /pgdata
+{{- if .Template}}
+install -m 755 /tmp/pg_container-clone /usr/local/bin/pg_container-clone
+{{- end}}
+{{- if .RefreshMatviewsFile}}
+install -D -m 644 /tmp/{{.RefreshMatviewsFile}} /usr/local/share/pg_container/{{.RefreshMatviewsFile}}
+install -m 755 /tmp/pg_container-refresh-matviews /usr/local/bin/pg_container-refresh-matviews
+{{- end}}
+{{- if .IncludeDump}}
+mv /tmp/{{.DumpFile}} /{{.DumpFile}}
+{{- end}}
+rm -rf /tmp/*
@@ -0,0 +1,237 @@
+package pgcontainer
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"slices"
+	"strings"
+)
+
+// Change is an object of the dump that was left out or altered on its way
+// into the image, reported so nobody is surprised by its absence.
+type Change struct {
+	// Kind is the option that made the change, e.g. "fdw".
+	Kind string `json:"kind"`
+
+	// Object is the object as pg_dump names it, e.g. "SERVER remote".
+	Object string `json:"object"`
+
+	// Action is what happened to it, e.g. "stripped" or "stubbed".
+	Action string `json:"action"`
+}
+
+// tocEntry is an object of a plain dump: the comment pg_dump heads it with,
+// which names it, and its statements or rows up to the next one.
+type tocEntry struct {
+	Name   string
+	Type   string
+	Schema string
+
+	// Text is the whole entry, the heading comment included, or a piece of
+	// it: an entry with COPY blocks is passed on up to and including each
+	// COPY line, then a row at a time with Rows set, so the data of a table
+	// is never held in memory, and then from the end of the block on.
+	Text []byte
+	Rows bool
+}
+
+// object is the entry named as in a Change, e.g. "TABLE public.users".
+func (e tocEntry) object() string {
+	if strings.HasPrefix(e.Name, e.Type+" ") {
+		// USER MAPPING and the like are named with their type already.
+		return e.Name
+	}
+
+	if e.Schema != "" && e.Schema != "-" {
+		return e.Type + " " + e.Schema + "." + e.Name
+	}
+
+	return e.Type + " " + e.Name
+}
+
+// rewriteDump splits the plain dump read from r into the entries of its TOC
+// and writes what rewrite returns for each to w; nil leaves the entry out.
+// The settings before the first entry and the footer after the last are kept
+// as they are. Rows of COPY blocks are never mistaken for headings.
+func rewriteDump(r io.Reader, w io.Writer, rewrite func(entry tocEntry) []byte) error {
+	in := bufio.NewReaderSize(r, 1<<20)
+
+	var entry *tocEntry
+	var pending bytes.Buffer
+
+	write := func(piece tocEntry) error {
+		text := piece.Text
+		if entry != nil {
+			piece.Name, piece.Type, piece.Schema = entry.Name, entry.Type, entry.Schema
+			text = rewrite(piece)
+		}
+		_, err := w.Write(text)
+		return err
+	}
+
+	// flush passes on the piece of the entry read so far. The capacity is
+	// cut so appending to the text copies it rather than overwriting the
+	// buffer.
+	flush := func() error {
+		err := write(tocEntry{Text: pending.Bytes()[:pending.Len():pending.Len()]})
+		pending.Reset()
+		return err
+	}
+
+	copying := false
+	previous := []byte(nil)
+
+	for {
+		line, err := in.ReadBytes('\n')
+		if len(line) > 0 {
+			trimmed := bytes.TrimSuffix(line, []byte("\n"))
+
+			switch {
+			case copying && string(trimmed) == `\.`:
+				copying = false
+				pending.Write(line)
+
+			case copying:
+				if err := write(tocEntry{Text: line, Rows: true}); err != nil {
+					return err
+				}
+
+			case bytes.HasPrefix(trimmed, []byte("COPY ")) && bytes.HasSuffix(trimmed, []byte(" FROM stdin;")):
+				copying = true
+				pending.Write(line)
+				if err := flush(); err != nil {
+					return err
+				}
+
+			case string(previous) == "--" && (bytes.HasPrefix(trimmed, []byte("-- Name: ")) || bytes.HasPrefix(trimmed, []byte("-- Data for Name: "))):
+				pending.Truncate(pending.Len() - len("--\n"))
+				if err := flush(); err != nil {
+					return err
+				}
+				entry = parseTocHeading(string(trimmed))
+				pending.WriteString("--\n")
+				pending.Write(line)
+
+			case string(previous) == "--" && string(trimmed) == "-- PostgreSQL database dump complete":
+				pending.Truncate(pending.Len() - len("--\n"))
+				if err := flush(); err != nil {
+					return err
+				}
+				entry = nil
+				pending.WriteString("--\n")
+				pending.Write(line)
+
+			default:
+				pending.Write(line)
+			}
+
+			previous = trimmed
+		}
+
+		if err == io.EOF {
+			return flush()
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// parseTocHeading reads the name, type and schema out of a heading such as
+// "-- Name: users; Type: TABLE; Schema: public; Owner: postgres".
+func parseTocHeading(line string) *tocEntry {
+	line = strings.TrimPrefix(line, "-- ")
+	line = strings.TrimPrefix(line, "Data for ")
+
+	fields := map[string]string{}
+	for _, part := range strings.Split(line, "; ") {
+		if key, value, ok := strings.Cut(part, ": "); ok {
+			fields[key] = value
+		}
+	}
+
+	return &tocEntry{Name: fields["Name"], Type: fields["Type"], Schema: fields["Schema"]}
+}
+
+// rewriteArchive applies the rewrites options ask for to a plain dump, all in
+// one pass from one file to the next: each piece of an entry goes through
+// the rewrites in turn, and one leaving it out ends its way.
+func rewriteArchive(archive *Archive, options DumpOptions) error {
+	if archive.Format != FormatPlain {
+		return nil
+	}
+
+	var header []byte
+	var rewrites []func(entry tocEntry) []byte
+
+	if slices.ContainsFunc(archive.Changes, func(change Change) bool { return change.Kind == "tablespace-map" }) {
+		header = createTablespaces(options.TablespaceMap)
+		rewrites = append(rewrites, tablespaceRewrite(options.TablespaceMap))
+	}
+
+	var encoding *encodingRewrite
+	if options.ConvertEncoding == EncodingUTF8 {
+		encoding = newEncodingRewrite()
+		rewrites = append(rewrites, encoding.rewrite)
+	}
+
+	if len(archive.excludedColumns) > 0 {
+		rewrites = append(rewrites, newColumnRewrite(archive.excludedColumns).rewrite)
+	}
+
+	var matviews *matviewRewrite
+	if options.RefreshMatviews == RefreshMatviewsNone || options.RefreshMatviews == RefreshMatviewsConcurrently {
+		matviews = &matviewRewrite{mode: options.RefreshMatviews}
+		rewrites = append(rewrites, matviews.rewrite)
+	}
+
+	var fdw *foreignDataRewrite
+	if options.ForeignData == ForeignDataStrip || options.ForeignData == ForeignDataStub {
+		fdw = newForeignDataRewrite(options.ForeignData)
+		rewrites = append(rewrites, fdw.rewrite)
+	}
+
+	var triggers *eventTriggerRewrite
+	if options.EventTriggers == EventTriggersSkip || options.EventTriggers == EventTriggersDefer {
+		triggers = &eventTriggerRewrite{mode: options.EventTriggers}
+		rewrites = append(rewrites, triggers.rewrite)
+	}
+
+	if len(rewrites) == 0 {
+		return nil
+	}
+
+	err := archive.transform(func(r io.Reader, w io.Writer) error {
+		if _, err := w.Write(header); err != nil {
+			return err
+		}
+		return rewriteDump(r, w, func(entry tocEntry) []byte {
+			for _, rewrite := range rewrites {
+				if entry.Text = rewrite(entry); entry.Text == nil {
+					return nil
+				}
+			}
+			return entry.Text
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	if encoding != nil {
+		archive.Changes = append(archive.Changes, encoding.changes()...)
+	}
+	if matviews != nil {
+		archive.RefreshMatviews = matviews.refreshes.Bytes()
+		archive.Changes = append(archive.Changes, matviews.changes...)
+	}
+	if fdw != nil {
+		archive.Changes = append(archive.Changes, fdw.changes...)
+	}
+	if triggers != nil {
+		archive.Changes = append(archive.Changes, triggers.changes...)
+	}
+
+	return nil
+}
@@ -0,0 +1,48 @@
+package pgcontainer
+
+import "fmt"
+
+// What the restore does with the values of sequences, see
+// BuildOptions.Sequences.
+const (
+	SequencesPreserve = "preserve"
+	SequencesReset    = "reset"
+	SequencesBump     = "bump"
+)
+
+// sequencesFile is the file of the build context holding the statements of
+// sequencesSQL, run once the dump is restored.
+const sequencesFile = "sequences.sql"
+
+// userSequences are the sequences of the restored database but those of
+// extensions, whose catalogs, e.g. the hypertables of TimescaleDB, rely on
+// the values they were dumped with.
+const userSequences = `FROM pg_catalog.pg_sequences s
+WHERE NOT EXISTS (
+    SELECT FROM pg_catalog.pg_depend d
+    WHERE d.classid = 'pg_catalog.pg_class'::regclass
+      AND d.objid = format('%I.%I', s.schemaname, s.sequencename)::regclass
+      AND d.deptype = 'e'
+);
+`
+
+// sequencesSQL returns the statements setting the sequences after the
+// restore: back to their start value, or offset values past the dumped ones,
+// further from zero for a descending sequence. A sequence that was never used
+// is bumped to its start value plus offset. It returns nil when the dumped
+// values are preserved.
+func sequencesSQL(mode string, offset int64) []byte {
+	switch mode {
+	case SequencesReset:
+		return []byte(`SELECT count(pg_catalog.setval(format('%I.%I', s.schemaname, s.sequencename)::regclass, s.start_value, false)) AS reset_sequences
+` + userSequences)
+
+	case SequencesBump:
+		return []byte(fmt.Sprintf(`SELECT count(pg_catalog.setval(format('%%I.%%I', s.schemaname, s.sequencename)::regclass,
+    coalesce(s.last_value, s.start_value) + CASE WHEN s.increment_by > 0 THEN %d ELSE -%d END,
+    s.last_value IS NOT NULL)) AS bumped_sequences
+`, offset, offset) + userSequences)
+	}
+
+	return nil
+}
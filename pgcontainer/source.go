@@ -0,0 +1,69 @@
+package pgcontainer
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// inspectSource records on archive what the restore needs to know about the
+// source beyond the dump: whether it has TimescaleDB, the tablespaces its
+// objects are moved out of, the columns whose data is left out, and the
+// publications and subscriptions options.NoReplication left out.
+func inspectSource(ctx context.Context, connectionURL string, archive *Archive, options DumpOptions) error {
+	conn, err := pgx.Connect(ctx, connectionURL)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(context.WithoutCancel(ctx))
+
+	archive.Timescale, archive.ServerVersion, err = SourceTimescale(ctx, conn)
+	if err != nil {
+		return fmt.Errorf("Failed to look for TimescaleDB in the source database: %w", err)
+	}
+
+	tablespaces, err := listTablespaces(ctx, conn, options.Schemas)
+	if err != nil {
+		return fmt.Errorf("Failed to list the tablespaces of the source database: %w", err)
+	}
+	archive.Changes = append(archive.Changes, tablespaceChanges(tablespaces, options.TablespaceMap)...)
+
+	if len(options.ExcludeColumnData) > 0 && archive.Format == FormatPlain {
+		archive.excludedColumns, err = listExcludedColumns(ctx, conn, options.ExcludeColumnData, options.Schemas, archive.ServerVersion)
+		if err != nil {
+			return fmt.Errorf("Failed to list the columns whose data is left out: %w", err)
+		}
+
+		for _, column := range archive.excludedColumns {
+			archive.Changes = append(archive.Changes, Change{
+				Kind:   "exclude-column-data",
+				Object: "COLUMN " + column.Schema + "." + column.Table + "." + column.Column,
+				Action: column.action(),
+			})
+		}
+	}
+
+	if options.NoReplication {
+		rows, err := conn.Query(ctx, `
+			SELECT 'PUBLICATION ' || quote_ident(pubname) FROM pg_publication
+			UNION ALL
+			SELECT 'SUBSCRIPTION ' || quote_ident(subname) FROM pg_subscription
+			WHERE subdbid = (SELECT oid FROM pg_database WHERE datname = current_database())
+			ORDER BY 1`)
+		if err != nil {
+			return fmt.Errorf("Failed to list the publications and subscriptions of the source database: %w", err)
+		}
+
+		objects, err := pgx.CollectRows(rows, pgx.RowTo[string])
+		if err != nil {
+			return fmt.Errorf("Failed to list the publications and subscriptions of the source database: %w", err)
+		}
+
+		for _, object := range objects {
+			archive.Changes = append(archive.Changes, Change{Kind: "replication", Object: object, Action: "skipped"})
+		}
+	}
+
+	return nil
+}
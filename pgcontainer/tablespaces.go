@@ -0,0 +1,120 @@
+package pgcontainer
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// TablespaceDefaulted is the Action of the Change recorded for a tablespace
+// of the source missing from DumpOptions.TablespaceMap, whose objects are
+// restored into pg_default since the container has no such tablespace.
+const TablespaceDefaulted = "remapped to pg_default"
+
+// tablespaceDirectory holds the tablespaces a plain dump maps objects to.
+// It is inside PGDATA, which postgres warns about, so the tablespaces are
+// copied into the image with the rest of the data.
+const tablespaceDirectory = "/data/pg_container_tablespaces"
+
+// listTablespaces returns the tablespaces other than pg_default that hold
+// relations in schemas, or in all schemas when there are none.
+func listTablespaces(ctx context.Context, conn *pgx.Conn, schemas []string) ([]string, error) {
+	rows, err := conn.Query(ctx, `
+		SELECT DISTINCT t.spcname
+		FROM pg_class c
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		JOIN pg_tablespace t ON t.oid = c.reltablespace
+		WHERE t.spcname NOT IN ('pg_default', 'pg_global')
+		  AND (coalesce(cardinality($1::text[]), 0) = 0 OR n.nspname = ANY($1))
+		ORDER BY 1`, schemas)
+	if err != nil {
+		return nil, err
+	}
+
+	return pgx.CollectRows(rows, pgx.RowTo[string])
+}
+
+// tablespaceChanges records where the objects of each tablespace of the
+// source go.
+func tablespaceChanges(tablespaces []string, mapping map[string]string) []Change {
+	var changes []Change
+	for _, tablespace := range tablespaces {
+		change := Change{Kind: "tablespace-map", Object: "TABLESPACE " + tablespace, Action: TablespaceDefaulted}
+		if target := mapping[tablespace]; target != "" {
+			change.Action = "mapped to " + target
+		}
+		changes = append(changes, change)
+	}
+
+	return changes
+}
+
+// tablespaceRewrite points the default_tablespace a plain dump sets before
+// each object at the tablespace it maps to, or at pg_default. Rows of data
+// are never touched.
+func tablespaceRewrite(mapping map[string]string) func(entry tocEntry) []byte {
+	return func(entry tocEntry) []byte {
+		if entry.Rows || entry.Type == "TABLE DATA" || !bytes.Contains(entry.Text, []byte("SET default_tablespace = ")) {
+			return entry.Text
+		}
+
+		var out bytes.Buffer
+		for _, line := range strings.SplitAfter(string(entry.Text), "\n") {
+			name, ok := strings.CutPrefix(strings.TrimRight(line, "\n"), "SET default_tablespace = ")
+			if !ok {
+				out.WriteString(line)
+				continue
+			}
+
+			name = unquoteIdent(strings.TrimSuffix(name, ";"))
+			if name == "''" || name == "pg_default" {
+				out.WriteString(line)
+				continue
+			}
+
+			fmt.Fprintf(&out, "SET default_tablespace = '%s';\n", mapping[name])
+		}
+
+		return out.Bytes()
+	}
+}
+
+// createTablespaces creates the tablespaces objects are mapped to, each in a
+// directory of tablespaceDirectory that psql makes first.
+func createTablespaces(mapping map[string]string) []byte {
+	targets := map[string]bool{}
+	for _, target := range mapping {
+		if target != "pg_default" {
+			targets[target] = true
+		}
+	}
+
+	names := make([]string, 0, len(targets))
+	for target := range targets {
+		names = append(names, target)
+	}
+	sort.Strings(names)
+
+	var out bytes.Buffer
+	for _, name := range names {
+		fmt.Fprintf(&out, "\\! mkdir -p %[1]s/%[2]s\nCREATE TABLESPACE %[2]s LOCATION '%[1]s/%[2]s';\n", tablespaceDirectory, name)
+	}
+	if out.Len() > 0 {
+		out.WriteString("\n")
+	}
+
+	return out.Bytes()
+}
+
+// unquoteIdent undoes the quoting pg_dump gives an identifier that needs it.
+func unquoteIdent(name string) string {
+	if len(name) < 2 || name[0] != '"' || name[len(name)-1] != '"' {
+		return name
+	}
+
+	return strings.ReplaceAll(name[1:len(name)-1], `""`, `"`)
+}
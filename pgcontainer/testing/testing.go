@@ -0,0 +1,141 @@
+// Package testing starts pg_container snapshot images with testcontainers-go,
+// so a test suite can run against a preloaded database in two lines:
+//
+//	snapshot := pgtesting.Start(t, "mydb-2025-01-18-1200:latest")
+//	rows, err := snapshot.DB(t).Query("SELECT ...")
+//
+// It is meant to be imported under a name such as pgtesting, since its own
+// name clashes with the standard library's testing package.
+package testing
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net"
+	gotesting "testing"
+	"time"
+
+	_ "github.com/jackc/pgx/v5/stdlib"
+	"github.com/testcontainers/testcontainers-go"
+	"github.com/testcontainers/testcontainers-go/wait"
+)
+
+// databaseLabel is the label pg_container records the database name in.
+const databaseLabel = "pg_container.database"
+
+const port = "5432/tcp"
+
+// Container is a running snapshot.
+type Container struct {
+	testcontainers.Container
+
+	// Database is the name of the restored database.
+	Database string
+
+	url string
+}
+
+// Run starts image and waits until Postgres accepts connections. The caller
+// terminates the container when done with it.
+func Run(ctx context.Context, image string) (*Container, error) {
+	container, err := testcontainers.GenericContainer(ctx, testcontainers.GenericContainerRequest{
+		ContainerRequest: testcontainers.ContainerRequest{
+			Image:        image,
+			ExposedPorts: []string{port},
+			WaitingFor: wait.ForAll(
+				wait.ForListeningPort(port),
+				wait.ForExec([]string{"pg_isready", "-U", "postgres", "-h", "127.0.0.1"}),
+			).WithDeadline(2 * time.Minute),
+		},
+		Started: true,
+	})
+	if err != nil {
+		if container != nil {
+			container.Terminate(context.Background())
+		}
+		return nil, fmt.Errorf("Failed to start %s: %w", image, err)
+	}
+
+	c, err := newContainer(ctx, container)
+	if err != nil {
+		container.Terminate(context.Background())
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func newContainer(ctx context.Context, container testcontainers.Container) (*Container, error) {
+	inspect, err := container.Inspect(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	database := inspect.Config.Labels[databaseLabel]
+	if database == "" {
+		return nil, fmt.Errorf("%s is not a pg_container snapshot: the %s label is missing", inspect.Config.Image, databaseLabel)
+	}
+
+	host, err := container.Host(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	mapped, err := container.MappedPort(ctx, port)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Container{
+		Container: container,
+		Database:  database,
+		url:       fmt.Sprintf("postgres://postgres:postgres@%s/%s", net.JoinHostPort(host, mapped.Port()), database),
+	}, nil
+}
+
+// Start is Run for tests: it fails tb if the snapshot does not come up and
+// removes the container once the test is over.
+func Start(tb gotesting.TB, image string) *Container {
+	tb.Helper()
+
+	c, err := Run(context.Background(), image)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	tb.Cleanup(func() {
+		if err := c.Terminate(context.Background()); err != nil {
+			tb.Errorf("Failed to remove the container of %s: %s", image, err)
+		}
+	})
+
+	return c
+}
+
+// ConnectionString is the URL of the database from the host.
+func (c *Container) ConnectionString() string {
+	return c.url
+}
+
+// OpenDB opens a pool of connections to the database through pgx.
+func (c *Container) OpenDB() (*sql.DB, error) {
+	return sql.Open("pgx", c.url)
+}
+
+// DB is OpenDB for tests: it fails tb on error and closes the pool once the
+// test is over.
+func (c *Container) DB(tb gotesting.TB) *sql.DB {
+	tb.Helper()
+
+	db, err := c.OpenDB()
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	tb.Cleanup(func() {
+		db.Close()
+	})
+
+	return db
+}
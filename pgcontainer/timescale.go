@@ -0,0 +1,55 @@
+package pgcontainer
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// DefaultBaseImage is the image a dump is restored on.
+const DefaultBaseImage = "postgres"
+
+// timescaleVersion matches the extension versions there are images of, and
+// keeps whatever the source reports from being pasted into the restore
+// script otherwise.
+var timescaleVersion = regexp.MustCompile(`^[0-9]+(\.[0-9]+)*$`)
+
+// TimescaleImage is the Timescale image with the extension version of the
+// source and its major version of PostgreSQL, which the catalog of the
+// hypertables only restores into.
+func TimescaleImage(extensionVersion string, serverVersionNum int) string {
+	return fmt.Sprintf("timescale/timescaledb:%s-pg%d", extensionVersion, serverVersionNum/10000)
+}
+
+// SourceTimescale returns the version of the timescaledb extension in the
+// database conn is connected to, empty when it is not installed, and
+// server_version_num.
+func SourceTimescale(ctx context.Context, conn *pgx.Conn) (string, int, error) {
+	var version string
+	var serverVersionNum int
+	err := conn.QueryRow(ctx, `
+		SELECT coalesce((SELECT extversion FROM pg_extension WHERE extname = 'timescaledb'), ''),
+		       current_setting('server_version_num')::int`).Scan(&version, &serverVersionNum)
+	if err != nil {
+		return "", 0, err
+	}
+
+	if version != "" && !timescaleVersion.MatchString(version) {
+		return "", 0, fmt.Errorf("Unsupported timescaledb version %q", version)
+	}
+
+	return version, serverVersionNum, nil
+}
+
+// baseImage is the image archive is restored on: a Timescale one for a dump
+// of a database with the extension, since restoring hypertables needs the
+// same version of it loaded, or else postgres.
+func baseImage(archive *Archive) string {
+	if archive.Timescale != "" {
+		return TimescaleImage(archive.Timescale, archive.ServerVersion)
+	}
+
+	return DefaultBaseImage
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/jsonmessage"
+	"github.com/docker/go-connections/nat"
+	"github.com/jackc/pgx/v5"
+	cli "github.com/urfave/cli/v3"
+)
+
+// physicalConflicts are the flags about the logical dump and its restore,
+// which mean nothing for a copy of the data directory.
+var physicalConflicts = []string{
+	"format", "restore-jobs", "ignore-restore-errors", "no-fast-restore", "restore-maintenance-work-mem",
+	"no-analyze", "vacuum", "readonly-user", "init-sql", "commit-strategy", "template", "schema", "dump-jobs", "split-table-size", "base",
+	"fdw", "event-triggers", "replication", "citus", "convert-encoding", "exclude-column-data", "refresh-matviews", "tablespace-map", "sequences", "sequence-offset",
+}
+
+// basebackupScript runs in the helper container. It reads the connection URL
+// from stdin, so it ends up neither in the container's environment nor in the
+// committed image, and takes the base backup into /data.
+const basebackupScript = `set -e
+read -r source
+mkdir -p /data
+chown postgres:postgres /data
+chmod 700 /data
+gosu postgres pg_basebackup --dbname="$source" --pgdata=/data --wal-method=stream --checkpoint=fast ${MAX_RATE:+--max-rate="$MAX_RATE"} --progress --verbose
+` + standaloneScript
+
+// standaloneScript makes the copy of a cluster in /data a standalone cluster:
+// configuration files living outside the data directory, as on Debian, are
+// replaced by the image's defaults, pg_hba.conf by the same rules the logical
+// images have, WAL archiving, which would fail without the archiver of the
+// source, is turned off and a first start completes the recovery of the copy,
+// promoting it, so containers start right away.
+const standaloneScript = `cd /data
+[ -f postgresql.conf ] || cp /usr/share/postgresql/postgresql.conf.sample postgresql.conf
+[ -f pg_ident.conf ] || touch pg_ident.conf
+printf 'local all all trust\nhost all all 0.0.0.0/0 md5\nhost all all ::/0 md5\n' > pg_hba.conf
+echo "listen_addresses = '*'" >> postgresql.conf
+echo "archive_mode = off" >> postgresql.conf
+if [ -n "$TIMEZONE" ]; then
+	echo "timezone = '$TIMEZONE'" >> postgresql.conf
+	echo "log_timezone = '$TIMEZONE'" >> postgresql.conf
+fi
+chown postgres:postgres postgresql.conf pg_ident.conf pg_hba.conf
+gosu postgres pg_ctl -D /data -o "-c listen_addresses=''" -w -t 86400 start
+until gosu postgres pg_controldata /data | grep -q "in production"; do sleep 1; done
+gosu postgres psql -d postgres -v ON_ERROR_STOP=1 -c "ALTER ROLE postgres PASSWORD 'postgres'" ||
+	echo "pg_container: the copy has no superuser named postgres, connect with the roles of the source"
+gosu postgres pg_ctl -D /data -m fast -w stop
+`
+
+// validatePhysical rejects the flags --physical cannot honour.
+func validatePhysical(cmd *cli.Command) error {
+	if !cmd.Bool("physical") {
+		return nil
+	}
+
+	for _, name := range physicalConflicts {
+		if cmd.IsSet(name) {
+			return fmt.Errorf("--%s cannot be used with --physical, which copies the data directory instead of restoring a dump", name)
+		}
+	}
+
+	if cmd.String("runtime") != runtimeDocker {
+		return fmt.Errorf("--physical needs --runtime %s", runtimeDocker)
+	}
+
+	return nil
+}
+
+// basebackupImage is the official image matching the major version of the
+// source server, which a data directory can only be run by.
+func basebackupImage(serverVersionNum int) string {
+	if serverVersionNum >= 100000 {
+		return "postgres:" + strconv.Itoa(serverVersionNum/10000)
+	}
+
+	return fmt.Sprintf("postgres:%d.%d", serverVersionNum/10000, serverVersionNum/100%100)
+}
+
+// sourceServerVersion returns server_version_num of the source server.
+func sourceServerVersion(ctx context.Context, connectionURL string) (int, error) {
+	conn, err := pgx.Connect(ctx, connectionURL)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close(ctx)
+
+	var version string
+	if err := conn.QueryRow(ctx, "SELECT current_setting('server_version_num')").Scan(&version); err != nil {
+		return 0, err
+	}
+
+	return strconv.Atoi(version)
+}
+
+// basebackup is a stopped helper container whose /data holds the copy of the
+// source cluster, waiting to be committed as the image.
+type basebackup struct {
+	ID    string
+	Image string
+	Size  int64
+
+	// Tool names what made the copy, in logs, errors and the image history.
+	Tool string
+
+	apiClient *client.Client
+}
+
+// Remove removes the helper container along with the anonymous volume of the
+// postgres image.
+func (b *basebackup) Remove() {
+	if err := b.apiClient.ContainerRemove(context.Background(), b.ID, container.RemoveOptions{Force: true, RemoveVolumes: true}); err != nil {
+		logger.Warn("Failed to remove the "+b.Tool+" container", "container", b.ID[:12], "error", err)
+	}
+}
+
+// copyCluster copies the whole cluster into a helper container, with
+// pg_basebackup from the source or from the backup repository.
+func copyCluster(ctx context.Context, apiClient *client.Client, connectionURL string, options backupOptions) (*basebackup, error) {
+	if options.FromBackup != nil {
+		return restoreBackup(ctx, apiClient, options.FromBackup, options)
+	}
+
+	return takeBasebackup(ctx, apiClient, connectionURL, options)
+}
+
+// takeBasebackup copies the whole source cluster with pg_basebackup, run in a
+// container of the matching postgres image on the host network so the
+// connection URL means the same as it does here. The source must allow a
+// replication connection of the user, in pg_hba.conf and through the
+// REPLICATION attribute.
+func takeBasebackup(ctx context.Context, apiClient *client.Client, connectionURL string, options backupOptions) (*basebackup, error) {
+	version, err := sourceServerVersion(ctx, connectionURL)
+	if err != nil {
+		return nil, connectionError(fmt.Errorf("Failed to connect to the source database: %w", err))
+	}
+
+	baseImage := basebackupImage(version)
+	if err := pullImage(ctx, apiClient, baseImage); err != nil {
+		return nil, err
+	}
+
+	logger.Info("📸 Copying the cluster with pg_basebackup", "image", baseImage)
+
+	return runClusterHelper(ctx, apiClient, baseImage, "pg_basebackup", basebackupScript, connectionURL+"\n", options)
+}
+
+// runClusterHelper runs script in a helper container of baseImage, on the
+// host network, with stdin on its standard input, and keeps the container
+// once the script succeeded.
+func runClusterHelper(ctx context.Context, apiClient *client.Client, baseImage string, tool string, script string, stdin string, options backupOptions) (*basebackup, error) {
+	// TIMEZONE and MAX_RATE are set in the script rather than the environment,
+	// which the commit would carry over into the image.
+	variables := "TIMEZONE=" + shellQuote(options.Timezone) + "\nMAX_RATE=" + basebackupMaxRate(options.MaxRate) + "\n"
+	created, err := apiClient.ContainerCreate(ctx, &container.Config{
+		Image:      baseImage,
+		Entrypoint: []string{"sh", "-c", variables + script},
+		Labels: map[string]string{
+			managedLabel:   "true",
+			temporaryLabel: "true",
+		},
+		OpenStdin: true,
+		StdinOnce: true,
+	}, &container.HostConfig{
+		NetworkMode: "host",
+	}, nil, nil, "")
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create the %s container: %w", tool, err)
+	}
+
+	b := &basebackup{ID: created.ID, Image: baseImage, Tool: tool, apiClient: apiClient}
+
+	if err := b.run(ctx, stdin, options.HeartbeatInterval); err != nil {
+		b.Remove()
+		return nil, err
+	}
+
+	if inspect, _, err := apiClient.ContainerInspectWithRaw(ctx, b.ID, true); err == nil && inspect.SizeRw != nil {
+		b.Size = *inspect.SizeRw
+	}
+
+	return b, nil
+}
+
+func (b *basebackup) run(ctx context.Context, stdin string, heartbeat time.Duration) error {
+	attach, err := b.apiClient.ContainerAttach(ctx, b.ID, container.AttachOptions{Stream: true, Stdin: true})
+	if err != nil {
+		return fmt.Errorf("Failed to attach to the %s container: %w", b.Tool, err)
+	}
+	defer attach.Close()
+
+	waitCh, errCh := b.apiClient.ContainerWait(ctx, b.ID, container.WaitConditionNextExit)
+
+	if err := b.apiClient.ContainerStart(ctx, b.ID, container.StartOptions{}); err != nil {
+		return fmt.Errorf("Failed to start the %s container: %w", b.Tool, err)
+	}
+
+	if _, err := io.WriteString(attach.Conn, stdin); err != nil {
+		return fmt.Errorf("Failed to pass the input of %s: %w", b.Tool, err)
+	}
+	attach.CloseWrite()
+
+	backupLog := newLogWriter(slog.LevelDebug, b.Tool)
+	defer backupLog.Flush()
+
+	logCtx, stopLogs := context.WithCancel(ctx)
+	defer stopLogs()
+	go streamContainerLogs(logCtx, b.apiClient, b.ID, backupLog)
+
+	stopHeartbeat := startHeartbeat(heartbeat, b.Tool, nil)
+	defer stopHeartbeat()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case err := <-errCh:
+		return fmt.Errorf("Failed to wait for %s: %w", b.Tool, err)
+	case status := <-waitCh:
+		if status.StatusCode == 0 {
+			return nil
+		}
+
+		output := containerLogTail(ctx, b.apiClient, b.ID, 30)
+		return &phaseError{
+			code: exitDump,
+			err:  fmt.Errorf("%s failed with exit code %d:\n%s", b.Tool, status.StatusCode, output),
+		}
+	}
+}
+
+// commit turns the helper container into the image, set up like the images
+// built from a logical dump: PGDATA in /data, run as postgres.
+func (b *basebackup) commit(ctx context.Context, name string, labels map[string]string, options backupOptions) (string, error) {
+	logger.Info("> Step 2: 🖼️  Committing the copy as an image")
+
+	env := []string{"PGDATA=/data"}
+	if options.Timezone != "" {
+		env = append(env, "TZ="+options.Timezone)
+	}
+
+	// The daemon adds the labels of the container to those of the image;
+	// containers of the image must not inherit the temporary one.
+	labels = mergeLabels(map[string]string{temporaryLabel: "false"}, labels)
+
+	response, err := b.apiClient.ContainerCommit(ctx, b.ID, container.CommitOptions{
+		Reference: name,
+		Comment:   b.Tool + " of " + labels[sourceLabel],
+		Config: &container.Config{
+			User:         "postgres",
+			Env:          env,
+			Labels:       labels,
+			Entrypoint:   []string{"docker-entrypoint.sh"},
+			Cmd:          []string{"postgres", "-c", "config_file=/data/postgresql.conf"},
+			ExposedPorts: nat.PortSet{"5432/tcp": struct{}{}},
+		},
+	})
+	if err != nil {
+		return "", fmt.Errorf("Failed to commit the image: %w", err)
+	}
+
+	logger.Info("✅ Image committed successfully", "image", name, "id", response.ID)
+
+	return name, nil
+}
+
+// pullImage pulls ref unless it is present already.
+func pullImage(ctx context.Context, apiClient *client.Client, ref string) error {
+	if _, _, err := apiClient.ImageInspectWithRaw(ctx, ref); err == nil {
+		return nil
+	}
+
+	logger.Info("⬇️  Pulling " + ref)
+
+	reader, err := apiClient.ImagePull(ctx, ref, image.PullOptions{})
+	if err != nil {
+		return fmt.Errorf("Failed to pull %s: %w", ref, err)
+	}
+	defer reader.Close()
+
+	pullLog := newLogWriter(slog.LevelDebug, "docker pull")
+	defer pullLog.Flush()
+
+	if err := jsonmessage.DisplayJSONMessagesStream(reader, pullLog, 0, false, nil); err != nil {
+		return fmt.Errorf("Failed to pull %s: %w", ref, err)
+	}
+
+	return nil
+}
+
+// containerLogTail returns the last lines a container printed.
+func containerLogTail(ctx context.Context, apiClient *client.Client, containerID string, lines int) string {
+	var output strings.Builder
+
+	logCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 10*time.Second)
+	defer cancel()
+
+	streamContainerLogs(logCtx, apiClient, containerID, &output)
+
+	return lastLines(output.String(), lines)
+}
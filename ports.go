@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+)
+
+// autoPort is the --port value that asks for any free host port.
+const autoPort = "auto"
+
+// resolveHostPort turns the --port value into a concrete port number.
+func resolveHostPort(bindAddress string, port string) (string, error) {
+	if port == autoPort {
+		return freePort(bindAddress)
+	}
+
+	n, err := strconv.Atoi(port)
+	if err != nil || n < 1 || n > 65535 {
+		return "", fmt.Errorf("Invalid port %q: expected a number between 1 and 65535 or %q", port, autoPort)
+	}
+
+	return port, nil
+}
+
+// freePort asks the kernel for an unused port. It is released again before
+// returning, so there is a small window in which something else can take it.
+func freePort(bindAddress string) (string, error) {
+	listener, err := net.Listen("tcp", net.JoinHostPort(bindAddress, "0"))
+	if err != nil {
+		return "", fmt.Errorf("Failed to find a free port: %w", err)
+	}
+	defer listener.Close()
+
+	return strconv.Itoa(listener.Addr().(*net.TCPAddr).Port), nil
+}
+
+func validateBindAddress(bindAddress string) error {
+	if net.ParseIP(bindAddress) == nil {
+		return fmt.Errorf("Invalid bind address %q: expected an IP address such as 127.0.0.1 or 0.0.0.0", bindAddress)
+	}
+
+	return nil
+}
+
+// connectHost is the address a client on this machine should use to reach a
+// port published on bindAddress.
+func connectHost(bindAddress string) string {
+	if ip := net.ParseIP(bindAddress); ip == nil || ip.IsUnspecified() {
+		return "127.0.0.1"
+	}
+
+	return bindAddress
+}
+
+// reserveHostPort resolves the requested port and makes sure nothing is
+// already listening on it. With fallback a taken port is swapped for a free
+// one instead of failing. A port held by the container named replacing is
+// treated as free, since that container is about to be removed.
+func reserveHostPort(ctx context.Context, apiClient *client.Client, bindAddress string, port string, fallback bool, replacing string) (string, error) {
+	resolved, err := resolveHostPort(bindAddress, port)
+	if err != nil {
+		return "", err
+	}
+
+	conflict := checkPortAvailable(ctx, apiClient, bindAddress, resolved, replacing)
+	if conflict == nil {
+		return resolved, nil
+	}
+
+	if !fallback {
+		return "", fmt.Errorf("%w; choose another --port, use --port auto or pass --port-fallback", conflict)
+	}
+
+	resolved, err = freePort(bindAddress)
+	if err != nil {
+		return "", err
+	}
+
+	logger.Warn(fmt.Sprintf("%s, using port %s instead", conflict, resolved))
+
+	return resolved, nil
+}
+
+// checkPortAvailable reports who holds a host port, checking containers first
+// so the message can name the culprit. Without a Docker client, as with
+// --runtime nerdctl, only the port itself is checked.
+func checkPortAvailable(ctx context.Context, apiClient *client.Client, bindAddress string, port string, replacing string) error {
+	var containers []types.Container
+	if apiClient != nil {
+		containers, _ = apiClient.ContainerList(ctx, container.ListOptions{})
+	}
+
+	for _, c := range containers {
+		for _, p := range c.Ports {
+			if strconv.Itoa(int(p.PublicPort)) != port || !addressesOverlap(p.IP, bindAddress) {
+				continue
+			}
+
+			name := c.ID[:12]
+			if len(c.Names) > 0 {
+				name = strings.TrimPrefix(c.Names[0], "/")
+			}
+
+			if name == replacing {
+				return nil
+			}
+
+			return fmt.Errorf("Port %s is already published by container %s", port, name)
+		}
+	}
+
+	listener, err := net.Listen("tcp", net.JoinHostPort(bindAddress, port))
+	if err != nil {
+		return fmt.Errorf("Port %s on %s is already in use on this machine", port, bindAddress)
+	}
+	listener.Close()
+
+	return nil
+}
+
+func addressesOverlap(a string, b string) bool {
+	ipA, ipB := net.ParseIP(a), net.ParseIP(b)
+	if ipA == nil || ipB == nil || ipA.IsUnspecified() || ipB.IsUnspecified() {
+		return true
+	}
+
+	return ipA.Equal(ipB)
+}
+
+// publishedPort reports where a running container's Postgres port is
+// reachable from this machine.
+func publishedPort(ctx context.Context, apiClient *client.Client, containerID string) (string, string, bool) {
+	inspect, err := apiClient.ContainerInspect(ctx, containerID)
+	if err != nil || inspect.NetworkSettings == nil {
+		return "", "", false
+	}
+
+	for _, bindings := range inspect.NetworkSettings.Ports {
+		for _, binding := range bindings {
+			if binding.HostPort != "" {
+				return connectHost(binding.HostIP), binding.HostPort, true
+			}
+		}
+	}
+
+	return "", "", false
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/api/types/registry"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/jsonmessage"
+	cli "github.com/urfave/cli/v3"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var timestampSuffix = regexp.MustCompile(`-\d{4}-\d{2}-\d{2}-\d{4}$`)
+
+var promoteCommand = &cli.Command{
+	Name:          "promote",
+	Usage:         "Retag an existing snapshot image under a new alias without rebuilding",
+	ShellComplete: completeImages(1),
+	UsageText: `pg_container promote [image] --as [alias]
+
+With --push --attach-dump the dump kept in the image is also pushed as an OCI
+artifact referring to the pushed image, which registries supporting OCI
+referrers list with it. Images made from the same dump share the artifact's
+blob, and the dump can be fetched without pulling the image with
+extract --from-registry.
+
+Example:
+	pg_container promote db-2025-01-18-1200:latest --as staging
+	pg_container promote db-2025-01-18-1200:latest --as registry.example.com/db:staging --push --attach-dump`,
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:     "as",
+			Usage:    "Alias to promote the image to, either a tag (staging) or a full image reference",
+			Required: true,
+		},
+		&cli.BoolFlag{
+			Name:  "push",
+			Usage: "Push the promoted reference to its registry",
+		},
+		&cli.BoolFlag{
+			Name:  "attach-dump",
+			Usage: "With --push, also push the dump of the image as an OCI artifact referring to it",
+		},
+		&cli.StringFlag{
+			Name:    "registry-username",
+			Usage:   "Username used to authenticate the push",
+			Sources: cli.EnvVars("PG_CONTAINER_REGISTRY_USERNAME"),
+		},
+		&cli.StringFlag{
+			Name:    "registry-password",
+			Usage:   "Password used to authenticate the push",
+			Sources: cli.EnvVars("PG_CONTAINER_REGISTRY_PASSWORD"),
+		},
+	},
+	Action: func(ctx context.Context, cmd *cli.Command) error {
+		source := cmd.Args().Get(0)
+		if source == "" {
+			return cli.ShowSubcommandHelp(cmd)
+		}
+
+		if cmd.Bool("attach-dump") && !cmd.Bool("push") {
+			return fmt.Errorf("--attach-dump requires --push")
+		}
+
+		apiClient, err := newDockerClient(ctx)
+		if err != nil {
+			return err
+		}
+		defer apiClient.Close()
+
+		target, err := promoteImage(ctx, apiClient, source, cmd.String("as"))
+		if err != nil {
+			return err
+		}
+
+		logger.Info("✅ Image promoted", "source", source, "image", target)
+
+		if cmd.Bool("push") {
+			auth := registry.AuthConfig{
+				Username: cmd.String("registry-username"),
+				Password: cmd.String("registry-password"),
+			}
+
+			if err := pushImage(ctx, apiClient, target, auth); err != nil {
+				return err
+			}
+
+			logger.Info("✅ Image pushed", "image", target)
+
+			if cmd.Bool("attach-dump") {
+				if err := attachDump(ctx, apiClient, source, target, auth); err != nil {
+					return err
+				}
+			}
+		}
+
+		if quiet() {
+			fmt.Println(target)
+		}
+
+		return nil
+	},
+}
+
+// promoteImage tags source under alias and returns the resulting reference.
+// A bare alias becomes a tag on the snapshot's repository, its name without
+// the build time, so "registry/team/db-2025-01-18-1200:latest" promoted as
+// "staging" becomes "registry/team/db:staging". The database label is only
+// used for an image without a timestamped name.
+func promoteImage(ctx context.Context, apiClient *client.Client, source string, alias string) (string, error) {
+	inspect, _, err := apiClient.ImageInspectWithRaw(ctx, source)
+	if err != nil {
+		return "", fmt.Errorf("Image %s not found: %w", source, err)
+	}
+
+	target := alias
+
+	if !strings.ContainsAny(alias, ":/") {
+		repository := ""
+
+		// source may be an ID or another alias; the image's own tags then
+		// carry the name it was built with.
+		for _, ref := range append([]string{source}, inspect.RepoTags...) {
+			if name := imageRepository(ref); timestampSuffix.MatchString(name) {
+				repository = timestampSuffix.ReplaceAllString(name, "")
+				break
+			}
+		}
+
+		if repository == "" && inspect.Config != nil {
+			repository = inspect.Config.Labels[databaseLabel]
+		}
+
+		if repository == "" {
+			repository = imageRepository(source)
+		}
+
+		target = repository + ":" + alias
+	}
+
+	if err := apiClient.ImageTag(ctx, inspect.ID, target); err != nil {
+		return "", fmt.Errorf("Failed to tag %s as %s: %w", source, target, err)
+	}
+
+	return target, nil
+}
+
+func pushImage(ctx context.Context, apiClient *client.Client, ref string, auth registry.AuthConfig) (err error) {
+	ctx, span := tracer.Start(ctx, "push", trace.WithAttributes(attribute.String("pg_container.image", ref)))
+	defer func() { endSpan(span, err) }()
+
+	encodedAuth, err := registry.EncodeAuthConfig(auth)
+	if err != nil {
+		return err
+	}
+
+	pushResponse, err := apiClient.ImagePush(ctx, ref, image.PushOptions{RegistryAuth: encodedAuth})
+	if err != nil {
+		return fmt.Errorf("Failed to push %s: %w", ref, err)
+	}
+	defer pushResponse.Close()
+
+	return jsonmessage.DisplayJSONMessagesStream(pushResponse, io.Discard, 0, false, nil)
+}
+
+// attachDump pushes the dump kept in source as an artifact referring to
+// target, the pushed image.
+func attachDump(ctx context.Context, apiClient *client.Client, source string, target string, auth registry.AuthConfig) error {
+	dump, err := openImageDump(ctx, apiClient, source)
+	if err != nil {
+		return err
+	}
+	defer dump.Close()
+
+	artifact, existed, err := pushDumpArtifact(ctx, target, auth, dump)
+	if err != nil {
+		return fmt.Errorf("Failed to attach the dump to %s: %w", target, err)
+	}
+
+	if existed {
+		logger.Info("✅ Dump attached, sharing a copy already in the registry", "image", target, "artifact", artifact.Digest.String())
+	} else {
+		logger.Info("✅ Dump attached", "image", target, "artifact", artifact.Digest.String())
+	}
+
+	return nil
+}
+
+// imageRepository strips the tag from an image reference, taking care not to
+// mistake a registry port for one.
+func imageRepository(ref string) string {
+	if i := strings.LastIndex(ref, ":"); i > strings.LastIndex(ref, "/") {
+		return ref[:i]
+	}
+
+	return ref
+}
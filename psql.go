@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/moby/term"
+	cli "github.com/urfave/cli/v3"
+)
+
+var psqlCommand = &cli.Command{
+	Name:          "psql",
+	Usage:         "Open psql inside a snapshot container",
+	ShellComplete: completeContainers(1),
+	UsageText: `pg_container psql [container] [-- psql arguments]
+
+Without a container name the most recently created running snapshot container is used.
+
+Example:
+	pg_container psql -- -c "SELECT count(*) FROM users"`,
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "database",
+			Usage: "Database to connect to (default: the database the snapshot was taken from)",
+		},
+	},
+	Action: func(ctx context.Context, cmd *cli.Command) error {
+		apiClient, err := newDockerClient(ctx)
+		if err != nil {
+			return err
+		}
+		defer apiClient.Close()
+
+		args := cmd.Args().Slice()
+		name := ""
+		if len(args) > 0 && args[0] != "--" {
+			name, args = args[0], args[1:]
+		}
+		if len(args) > 0 && args[0] == "--" {
+			args = args[1:]
+		}
+
+		target, err := findManagedContainer(ctx, apiClient, name)
+		if err != nil {
+			return err
+		}
+
+		if target.State != "running" {
+			return fmt.Errorf("Container %s is %s; start it first with pg_container start %s", containerName(target), target.State, containerName(target))
+		}
+
+		database := cmd.String("database")
+		if database == "" {
+			database = target.Labels[databaseLabel]
+		}
+		if database == "" {
+			database = "postgres"
+		}
+
+		psql := append([]string{"psql", "-U", "postgres", "-d", database}, args...)
+
+		exitCode, err := execInteractive(ctx, apiClient, target.ID, psql)
+		if err != nil {
+			return err
+		}
+
+		if exitCode != 0 {
+			return cli.Exit("", exitCode)
+		}
+
+		return nil
+	},
+}
+
+// execInteractive runs a command in a container wired to the local terminal,
+// like docker exec -it does.
+func execInteractive(ctx context.Context, apiClient *client.Client, containerID string, command []string) (int, error) {
+	inFd, isTerminal := term.GetFdInfo(os.Stdin)
+
+	exec, err := apiClient.ContainerExecCreate(ctx, containerID, container.ExecOptions{
+		Cmd:          command,
+		Tty:          isTerminal,
+		AttachStdin:  true,
+		AttachStdout: true,
+		AttachStderr: true,
+	})
+	if err != nil {
+		return -1, err
+	}
+
+	attach, err := apiClient.ContainerExecAttach(ctx, exec.ID, container.ExecAttachOptions{Tty: isTerminal})
+	if err != nil {
+		return -1, err
+	}
+	defer attach.Close()
+
+	if isTerminal {
+		state, err := term.SetRawTerminal(inFd)
+		if err != nil {
+			return -1, err
+		}
+		defer term.RestoreTerminal(inFd, state)
+
+		if size, err := term.GetWinsize(inFd); err == nil {
+			apiClient.ContainerExecResize(ctx, exec.ID, container.ResizeOptions{
+				Height: uint(size.Height),
+				Width:  uint(size.Width),
+			})
+		}
+	}
+
+	go func() {
+		io.Copy(attach.Conn, os.Stdin)
+		attach.CloseWrite()
+	}()
+
+	if isTerminal {
+		io.Copy(os.Stdout, attach.Reader)
+	} else {
+		stdcopy.StdCopy(os.Stdout, os.Stderr, attach.Reader)
+	}
+
+	inspect, err := apiClient.ContainerExecInspect(ctx, exec.ID)
+	if err != nil {
+		return -1, err
+	}
+
+	return inspect.ExitCode, nil
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"strconv"
+	"strings"
+
+	"github.com/bgrcs/pg_container/pgcontainer"
+	"github.com/docker/docker/api/types"
+	cli "github.com/urfave/cli/v3"
+)
+
+var refreshCommand = &cli.Command{
+	Name:          "refresh",
+	Usage:         "Re-dump the source of a snapshot container and recreate it from a fresh image",
+	ShellComplete: completeContainers(1),
+	UsageText: `pg_container refresh [container] [connection_url]
+
+The new container keeps the name, published port, network, restart policy,
+resource limits and labels of the old one, which is only removed once the new
+image has been built. The image is built with the flags given before
+"refresh", and the --citus, --timezone and --readonly-user of the old image
+unless they are given; the read-only user gets a new password unless one is
+passed. Without a connection URL the source recorded on the
+container is used; its password is not stored, so supply it through
+PGPASSWORD or ~/.pgpass. Volumes are not carried over, since their existing
+data would shadow the refreshed snapshot.
+
+Example:
+	pg_container refresh postgres-db-staging`,
+	Action: func(ctx context.Context, cmd *cli.Command) error {
+		if cmd.NArg() < 1 {
+			return cli.ShowSubcommandHelp(cmd)
+		}
+
+		apiClient, err := newDockerClient(ctx)
+		if err != nil {
+			return err
+		}
+		defer apiClient.Close()
+
+		target, err := findManagedContainer(ctx, apiClient, cmd.Args().Get(0))
+		if err != nil {
+			return err
+		}
+
+		inspect, err := apiClient.ContainerInspect(ctx, target.ID)
+		if err != nil {
+			return err
+		}
+
+		connectionURL := cmd.Args().Get(1)
+		if connectionURL == "" {
+			connectionURL = inspect.Config.Labels[sourceLabel]
+		}
+		if connectionURL == "" {
+			return fmt.Errorf("Container %s does not record its source; pass the connection URL explicitly", containerName(target))
+		}
+
+		connectionURL, err = normalizeConnectionURL(connectionURL)
+		if err != nil {
+			return err
+		}
+
+		var imageEnv []string
+		if image, _, err := apiClient.ImageInspectWithRaw(ctx, inspect.Image); err == nil && image.Config != nil {
+			imageEnv = image.Config.Env
+		}
+
+		defaults, err := parseBackupOptions(cmd)
+		if err != nil {
+			return err
+		}
+
+		options, err := refreshOptions(defaults, cmd.IsSet, inspect, imageEnv)
+		if err != nil {
+			return err
+		}
+
+		_, err = processBackup(ctx, connectionURL, options)
+		return err
+	},
+}
+
+// refreshOptions rebuilds the options a container was created with from what
+// docker reports about it, on top of defaults, the options of the command
+// line. The options recorded in the labels of the snapshot apply unless
+// isSet reports their flag as given. Variables inherited from the image are
+// dropped from the environment so the new image's own values apply.
+func refreshOptions(defaults backupOptions, isSet func(name string) bool, inspect types.ContainerJSON, imageEnv []string) (backupOptions, error) {
+	options := defaults
+	options.CreateContainer = true
+	options.StartContainer = inspect.State != nil && inspect.State.Running
+	options.ContainerName = inspect.Name[1:]
+	options.Replace = true
+	options.ConfirmReplace = false
+	options.AutoSuffix = false
+	options.HostPort = autoPort
+	options.Labels = maps.Clone(defaults.Labels)
+	if options.Labels == nil {
+		options.Labels = map[string]string{}
+	}
+
+	if citus := inspect.Config.Labels[citusLabel]; citus != "" && !isSet("citus") {
+		options.Citus = citus
+	}
+	if timezone := inspect.Config.Labels[timezoneLabel]; timezone != "" && !isSet("timezone") {
+		options.Timezone = timezone
+	}
+	if user := inspect.Config.Labels[readonlyUserLabel]; user != "" && !isSet("readonly-user") {
+		var err error
+		options.ReadonlyUser, options.ReadonlyPassword, err = parseReadonlyUser(user)
+		if err != nil {
+			return backupOptions{}, err
+		}
+	}
+
+	inherited := map[string]bool{}
+	for _, value := range imageEnv {
+		inherited[value] = true
+	}
+
+	for _, value := range inspect.Config.Env {
+		if !inherited[value] && !strings.HasPrefix(value, "PGDATA=") && !strings.HasPrefix(value, "PGPORT=") {
+			options.Env = append(options.Env, value)
+		}
+	}
+
+	for key, value := range inspect.Config.Labels {
+		if !isToolLabel(key) {
+			options.Labels[key] = value
+		}
+	}
+
+	if health := inspect.Config.Healthcheck; health != nil && len(health.Test) > 0 && health.Test[0] != "NONE" {
+		options.HealthInterval = health.Interval
+		options.HealthRetries = health.Retries
+	}
+
+	hostConfig := inspect.HostConfig
+	if hostConfig == nil {
+		return options, nil
+	}
+
+	for containerPort, bindings := range hostConfig.PortBindings {
+		for _, binding := range bindings {
+			options.ContainerPort = containerPort.Port()
+			options.HostPort = binding.HostPort
+			if binding.HostIP != "" {
+				options.BindAddress = binding.HostIP
+			}
+		}
+	}
+
+	if hostConfig.NetworkMode.IsUserDefined() {
+		options.Network = string(hostConfig.NetworkMode)
+	}
+
+	if hostConfig.RestartPolicy.Name != "" {
+		options.Restart = string(hostConfig.RestartPolicy.Name)
+		if hostConfig.RestartPolicy.MaximumRetryCount > 0 {
+			options.Restart += ":" + strconv.Itoa(hostConfig.RestartPolicy.MaximumRetryCount)
+		}
+	}
+
+	options.AutoRemove = hostConfig.AutoRemove
+	_, options.TmpfsPGData = hostConfig.Tmpfs[pgcontainer.TmpfsMountPoint]
+
+	if hostConfig.Memory > 0 {
+		options.Memory = strconv.FormatInt(hostConfig.Memory, 10)
+	}
+	if hostConfig.NanoCPUs > 0 {
+		options.CPUs = strconv.FormatFloat(float64(hostConfig.NanoCPUs)/1e9, 'f', -1, 64)
+	}
+	if hostConfig.ShmSize > 0 {
+		options.ShmSize = strconv.FormatInt(hostConfig.ShmSize, 10)
+	}
+
+	return options, nil
+}
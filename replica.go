@@ -0,0 +1,475 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/bgrcs/pg_container/pgcontainer"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/errdefs"
+	"github.com/jackc/pgx/v5"
+	cli "github.com/urfave/cli/v3"
+)
+
+// replicaPublication is the publication created on the source for the
+// replicas of its database.
+const replicaPublication = "pg_container"
+
+var replicaCommand = &cli.Command{
+	Name:  "replica",
+	Usage: "Keep a local logical replica of a database and snapshot the replica instead of the source",
+	UsageText: `pg_container replica [--every duration] [--once] connection_url
+pg_container replica --drop connection_url
+
+The first run creates a publication of all tables on the source and a replica
+container, with the schema of the database, subscribed to it, and waits for
+the initial copy. From then on the source only streams its changes, and every
+snapshot dumps the replica: once with --once, otherwise right away and then
+every --every. Snapshots take the flags given before "replica", as with serve,
+and record the source rather than the replica, so refresh still goes to the
+source.
+
+The source needs wal_level = logical and a user that may create a publication
+for all tables and connect for replication, which takes a superuser. Logical
+replication carries neither schema changes nor sequences: sequences are copied
+from the source right before each snapshot, while a schema change needs the
+replica dropped and created again. The replica runs on the host network, so
+the connection URL means the same to it as it does here, and keeps its
+subscription, password included, in its data volume.
+
+The subscription holds a replication slot on the source, which keeps WAL
+there while the replica is down. --drop removes the slot, the publication, the
+replica container and its volume.
+
+Examples:
+	pg_container replica --once postgres://admin:password@db/app
+	pg_container --container --replace --name app replica --every 24h postgres://admin:password@db/app
+	pg_container replica --drop postgres://admin:password@db/app`,
+	Flags: []cli.Flag{
+		&cli.DurationFlag{
+			Name:  "every",
+			Usage: "Snapshot the replica at this interval",
+			Value: 24 * time.Hour,
+		},
+		&cli.BoolFlag{
+			Name:  "once",
+			Usage: "Take a single snapshot and exit, e.g. from cron",
+		},
+		&cli.BoolFlag{
+			Name:  "drop",
+			Usage: "Remove the replica, its subscription and the publication on the source",
+		},
+		&cli.DurationFlag{
+			Name:  "sync-timeout",
+			Usage: "How long a new replica may take to copy the tables of the source",
+			Value: 24 * time.Hour,
+		},
+	},
+	Action: func(ctx context.Context, cmd *cli.Command) error {
+		if cmd.NArg() != 1 {
+			return cli.ShowSubcommandHelp(cmd)
+		}
+
+		connectionURL, err := normalizeConnectionURL(cmd.Args().First())
+		if err != nil {
+			return err
+		}
+
+		databaseName, err := extractDatabaseName(connectionURL)
+		if err != nil {
+			return err
+		}
+
+		apiClient, err := newDockerClient(ctx)
+		if err != nil {
+			return err
+		}
+		defer apiClient.Close()
+
+		if cmd.Bool("drop") {
+			name, _ := replicaNames(databaseName)
+			if err := confirmRemoval("the replica "+name+", its volume and the publication on the source", cmd.Bool("yes")); err != nil {
+				return err
+			}
+
+			return dropReplica(ctx, apiClient, connectionURL, databaseName)
+		}
+
+		options, err := parseBackupOptions(cmd)
+		if err != nil {
+			return err
+		}
+		options.SourceURL = connectionURL
+
+		if options.Physical || options.Runtime != runtimeDocker {
+			return fmt.Errorf("The replica is snapshotted with pg_dump and Docker; --physical and --runtime do not apply")
+		}
+
+		r, err := ensureReplica(ctx, apiClient, connectionURL, databaseName, cmd.Duration("sync-timeout"))
+		if err != nil {
+			return err
+		}
+
+		snapshot := func() error {
+			if err := copySequences(ctx, connectionURL, r.url()); err != nil {
+				return err
+			}
+
+			_, err := processBackup(ctx, r.url(), options)
+			return err
+		}
+
+		if cmd.Bool("once") {
+			return snapshot()
+		}
+
+		ticker := time.NewTicker(cmd.Duration("every"))
+		defer ticker.Stop()
+
+		for {
+			if err := snapshot(); err != nil {
+				if ctx.Err() != nil {
+					return err
+				}
+				logger.Error(err.Error(), "database", databaseName)
+			}
+
+			logger.Info("⏰ Next snapshot of the replica at " + time.Now().Add(cmd.Duration("every")).Format(time.DateTime))
+
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-ticker.C:
+			}
+		}
+	},
+}
+
+// replica is the container subscribed to a source database.
+type replica struct {
+	name     string
+	port     string
+	database string
+}
+
+func (r *replica) url() string {
+	return connectionString(r.database, "127.0.0.1", r.port)
+}
+
+var unsafeNameChars = regexp.MustCompile(`[^a-z0-9_]+`)
+
+// replicaNames returns the names of the container and volume of the replica
+// of databaseName, and of its subscription, which is also the name of the
+// replication slot on the source.
+func replicaNames(databaseName string) (containerName string, subscription string) {
+	return "pg_container-replica-" + databaseName,
+		"pg_container_" + unsafeNameChars.ReplaceAllString(strings.ToLower(databaseName), "_")
+}
+
+// ensureReplica returns the replica of the source database, started, or sets
+// one up.
+func ensureReplica(ctx context.Context, apiClient *client.Client, connectionURL string, databaseName string, syncTimeout time.Duration) (*replica, error) {
+	name, subscription := replicaNames(databaseName)
+
+	inspect, err := apiClient.ContainerInspect(ctx, name)
+	if err == nil {
+		r := &replica{name: name, database: databaseName}
+		for _, env := range inspect.Config.Env {
+			if port, ok := strings.CutPrefix(env, "PGPORT="); ok {
+				r.port = port
+			}
+		}
+
+		if inspect.State == nil || !inspect.State.Running {
+			logger.Info("🚀 Starting the replica", "container", name)
+			if err := startContainer(ctx, apiClient, name, defaultStartTimeout, nil); err != nil {
+				return nil, containerError(err)
+			}
+		}
+
+		return r, nil
+	} else if !errdefs.IsNotFound(err) {
+		return nil, err
+	}
+
+	version, err := sourceServerVersion(ctx, connectionURL)
+	if err != nil {
+		return nil, connectionError(fmt.Errorf("Failed to connect to the source database: %w", err))
+	}
+	if version < 100000 {
+		return nil, fmt.Errorf("Logical replication needs PostgreSQL 10 or later on the source")
+	}
+
+	if err := createPublication(ctx, connectionURL); err != nil {
+		return nil, err
+	}
+
+	baseImage := basebackupImage(version)
+	if err := pullImage(ctx, apiClient, baseImage); err != nil {
+		return nil, err
+	}
+
+	port, err := freePort("127.0.0.1")
+	if err != nil {
+		return nil, err
+	}
+
+	// The image keeps its data in /var/lib/postgresql from version 18 on.
+	dataDir := "/var/lib/postgresql/data"
+	if version >= 180000 {
+		dataDir = "/var/lib/postgresql"
+	}
+
+	logger.Info("🛰️  Creating the replica", "container", name, "image", baseImage, "port", port)
+
+	_, err = apiClient.ContainerCreate(ctx, &container.Config{
+		Image: baseImage,
+		Env:   []string{"POSTGRES_PASSWORD=postgres", "PGPORT=" + port},
+		Cmd:   []string{"postgres", "-c", "listen_addresses=127.0.0.1"},
+		Labels: map[string]string{
+			replicaLabel: databaseName,
+			sourceLabel:  redactURL(connectionURL),
+		},
+	}, &container.HostConfig{
+		NetworkMode:   "host",
+		RestartPolicy: container.RestartPolicy{Name: container.RestartPolicyUnlessStopped},
+		Mounts: []mount.Mount{
+			{Type: mount.TypeVolume, Source: name, Target: dataDir},
+		},
+	}, nil, nil, name)
+	if err != nil {
+		return nil, containerError(fmt.Errorf("Failed to create the replica: %w", err))
+	}
+
+	r := &replica{name: name, port: port, database: databaseName}
+
+	if err := setUpReplica(ctx, apiClient, r, connectionURL, subscription, syncTimeout); err != nil {
+		// A half set up replica would be taken as ready by the next run.
+		apiClient.ContainerRemove(context.WithoutCancel(ctx), name, container.RemoveOptions{Force: true, RemoveVolumes: true})
+		apiClient.VolumeRemove(context.WithoutCancel(ctx), name, true)
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// setUpReplica loads the schema of the source into the new replica and
+// subscribes it to the publication.
+func setUpReplica(ctx context.Context, apiClient *client.Client, r *replica, connectionURL string, subscription string, syncTimeout time.Duration) error {
+	if err := startContainer(ctx, apiClient, r.name, defaultStartTimeout, newLogWriter(slog.LevelDebug, "replica")); err != nil {
+		return containerError(err)
+	}
+
+	exitCode, output, err := execInContainer(ctx, apiClient, r.name, []string{"psql", "-U", "postgres", "-c", "CREATE DATABASE " + quoteIdent(r.database)})
+	if err != nil {
+		return err
+	}
+	if exitCode != 0 {
+		return fmt.Errorf("Failed to create the database in the replica: %s", strings.TrimSpace(output))
+	}
+
+	logger.Info("📐 Copying the schema to the replica")
+
+	schema, err := pgcontainer.Dump(ctx, connectionURL, pgcontainer.DumpOptions{
+		SchemaOnly:    true,
+		NoOwnership:   true,
+		NoReplication: true,
+	})
+	if err != nil {
+		return &phaseError{code: exitDump, err: err}
+	}
+	defer schema.Close()
+
+	schemaSQL, err := schema.ReadAll()
+	if err != nil {
+		return err
+	}
+
+	exitCode, output, err = psqlInContainer(ctx, apiClient, r.name, r.database, "schema.sql", schemaSQL)
+	if err != nil {
+		return err
+	}
+	if exitCode != 0 {
+		return fmt.Errorf("Failed to load the schema into the replica:\n%s", lastLines(output, 10))
+	}
+
+	conn, err := pgx.Connect(ctx, r.url())
+	if err != nil {
+		return fmt.Errorf("Failed to connect to the replica: %w", err)
+	}
+	defer conn.Close(ctx)
+
+	// The subscription connects with the full URL, password included.
+	if _, err := conn.Exec(ctx, fmt.Sprintf("CREATE SUBSCRIPTION %s CONNECTION %s PUBLICATION %s",
+		quoteIdent(subscription), quoteLiteral(connectionURL), quoteIdent(replicaPublication))); err != nil {
+		return fmt.Errorf("Failed to subscribe the replica to the source: %w", err)
+	}
+
+	logger.Info("⏳ Waiting for the replica to copy the tables")
+
+	deadline := time.Now().Add(syncTimeout)
+	for {
+		var pending, total int
+		err := conn.QueryRow(ctx, "SELECT count(*) FILTER (WHERE srsubstate NOT IN ('r', 's')), count(*) FROM pg_subscription_rel").Scan(&pending, &total)
+		if err != nil {
+			return fmt.Errorf("Failed to check the replica: %w", err)
+		}
+
+		if pending == 0 {
+			logger.Info("✅ Replica in sync", "container", r.name, "tables", total)
+			return nil
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("The replica still copies %d of %d tables after %s; raise --sync-timeout", pending, total, syncTimeout)
+		}
+
+		logger.Debug("Replica copying tables", "pending", pending, "tables", total)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
+
+// createPublication publishes every table of the source database, after
+// checking that the server can do logical replication at all.
+func createPublication(ctx context.Context, connectionURL string) error {
+	conn, err := pgx.Connect(ctx, connectionURL)
+	if err != nil {
+		return connectionError(fmt.Errorf("Failed to connect to the source database: %w", err))
+	}
+	defer conn.Close(ctx)
+
+	var walLevel string
+	if err := conn.QueryRow(ctx, "SHOW wal_level").Scan(&walLevel); err != nil {
+		return fmt.Errorf("Failed to query the source database: %w", err)
+	}
+	if walLevel != "logical" {
+		return fmt.Errorf("The source has wal_level = %s; set it to logical and restart the server to replicate from it", walLevel)
+	}
+
+	var exists bool
+	if err := conn.QueryRow(ctx, "SELECT EXISTS (SELECT FROM pg_publication WHERE pubname = $1)", replicaPublication).Scan(&exists); err != nil {
+		return fmt.Errorf("Failed to query the source database: %w", err)
+	}
+	if exists {
+		return nil
+	}
+
+	if _, err := conn.Exec(ctx, "CREATE PUBLICATION "+quoteIdent(replicaPublication)+" FOR ALL TABLES"); err != nil {
+		return fmt.Errorf("Failed to create the publication on the source, which takes a superuser: %w", err)
+	}
+
+	return nil
+}
+
+// copySequences sets the sequences of the replica to their values on the
+// source, since logical replication leaves them alone.
+func copySequences(ctx context.Context, sourceURL string, replicaURL string) error {
+	source, err := pgx.Connect(ctx, sourceURL)
+	if err != nil {
+		return connectionError(fmt.Errorf("Failed to connect to the source database: %w", err))
+	}
+	defer source.Close(ctx)
+
+	rows, err := source.Query(ctx, "SELECT format('%I.%I', schemaname, sequencename), last_value FROM pg_sequences WHERE last_value IS NOT NULL")
+	if err != nil {
+		return fmt.Errorf("Failed to read the sequences of the source: %w", err)
+	}
+
+	values := map[string]int64{}
+	for rows.Next() {
+		var name string
+		var value int64
+		if err := rows.Scan(&name, &value); err != nil {
+			return err
+		}
+		values[name] = value
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("Failed to read the sequences of the source: %w", err)
+	}
+
+	if len(values) == 0 {
+		return nil
+	}
+
+	target, err := pgx.Connect(ctx, replicaURL)
+	if err != nil {
+		return fmt.Errorf("Failed to connect to the replica: %w", err)
+	}
+	defer target.Close(ctx)
+
+	for name, value := range values {
+		if _, err := target.Exec(ctx, "SELECT setval($1::regclass, $2)", name, value); err != nil {
+			return fmt.Errorf("Failed to copy sequence %s to the replica: %w", name, err)
+		}
+	}
+
+	logger.Debug("Copied the sequences to the replica", "sequences", len(values))
+
+	return nil
+}
+
+// dropReplica undoes ensureReplica. Dropping the subscription drops its slot
+// on the source; without a replica to do so, a slot left behind is dropped
+// directly.
+func dropReplica(ctx context.Context, apiClient *client.Client, connectionURL string, databaseName string) error {
+	name, subscription := replicaNames(databaseName)
+	r := &replica{name: name, database: databaseName}
+
+	if inspect, err := apiClient.ContainerInspect(ctx, name); err == nil {
+		for _, env := range inspect.Config.Env {
+			if port, ok := strings.CutPrefix(env, "PGPORT="); ok {
+				r.port = port
+			}
+		}
+
+		if inspect.State != nil && inspect.State.Running {
+			if conn, err := pgx.Connect(ctx, r.url()); err == nil {
+				if _, err := conn.Exec(ctx, "DROP SUBSCRIPTION IF EXISTS "+quoteIdent(subscription)); err != nil {
+					logger.Warn("Failed to drop the subscription", "error", err)
+				}
+				conn.Close(ctx)
+			}
+		}
+
+		if err := apiClient.ContainerRemove(ctx, name, container.RemoveOptions{Force: true}); err != nil {
+			return fmt.Errorf("Failed to remove the replica: %w", err)
+		}
+		logger.Info("🗑️  Removed the replica", "container", name)
+	} else if !errdefs.IsNotFound(err) {
+		return err
+	}
+
+	if err := apiClient.VolumeRemove(ctx, name, true); err != nil && !errdefs.IsNotFound(err) {
+		return fmt.Errorf("Failed to remove the replica volume: %w", err)
+	}
+
+	conn, err := pgx.Connect(ctx, connectionURL)
+	if err != nil {
+		return connectionError(fmt.Errorf("Failed to connect to the source database: %w", err))
+	}
+	defer conn.Close(ctx)
+
+	if _, err := conn.Exec(ctx, "SELECT pg_drop_replication_slot(slot_name) FROM pg_replication_slots WHERE slot_name = $1 AND NOT active", subscription); err != nil {
+		return fmt.Errorf("Failed to drop the replication slot %s on the source: %w", subscription, err)
+	}
+
+	if _, err := conn.Exec(ctx, "DROP PUBLICATION IF EXISTS "+quoteIdent(replicaPublication)); err != nil {
+		return fmt.Errorf("Failed to drop the publication on the source: %w", err)
+	}
+
+	logger.Info("✅ Dropped the replication slot and the publication on the source")
+
+	return nil
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/bgrcs/pg_container/pgcontainer"
+	cli "github.com/urfave/cli/v3"
+)
+
+// Values of --runtime.
+const (
+	runtimeDocker  = "docker"
+	runtimeNerdctl = "nerdctl"
+)
+
+// validateRuntime checks --runtime and the flags it rules out. Only the
+// snapshot itself runs on nerdctl; the subcommands managing snapshots all
+// talk to the Docker API.
+func validateRuntime(cmd *cli.Command) error {
+	switch runtime := cmd.String("runtime"); runtime {
+	case runtimeDocker:
+		if cmd.IsSet("namespace") {
+			return fmt.Errorf("--namespace needs --runtime %s", runtimeNerdctl)
+		}
+	case runtimeNerdctl:
+		if cmd.String("smoke-test") != "" {
+			return fmt.Errorf("--smoke-test is not supported with --runtime %s", runtimeNerdctl)
+		}
+		if cmd.Bool("commit-strategy") {
+			return fmt.Errorf("--commit-strategy is not supported with --runtime %s", runtimeNerdctl)
+		}
+	default:
+		return fmt.Errorf("Invalid --runtime %q: expected %s or %s", runtime, runtimeDocker, runtimeNerdctl)
+	}
+
+	return nil
+}
+
+// processNerdctlBackup is the part of processBackup that talks to the
+// container runtime, done through nerdctl. The disk space check is skipped,
+// since it asks dockerd where its data lives.
+func processNerdctlBackup(ctx context.Context, run *runRecord, resources *runResources, connectionURL string, options backupOptions) error {
+	databaseName := run.Database
+
+	nerdctl := &pgcontainer.Nerdctl{Namespace: options.Namespace}
+	if _, err := nerdctl.Version(ctx); err != nil {
+		return connectionError(fmt.Errorf("Cannot run nerdctl: %w", err))
+	}
+
+	resources.nerdctl = nerdctl
+
+	if options.CreateContainer {
+		if options.ContainerName == "" {
+			options.ContainerName = defaultContainerName(databaseName)
+		}
+
+		// Catch a taken name now rather than after a long dump and build. The
+		// port is checked right before creating the container instead, as an
+		// old container being replaced still holds it until then.
+		var err error
+		options.ContainerName, err = resolveNerdctlContainerName(ctx, nerdctl, options.ContainerName, options.Replace, options.AutoSuffix)
+		if err != nil {
+			return containerError(err)
+		}
+
+		if options.ConfirmReplace {
+			exists, err := nerdctl.Exists(ctx, options.ContainerName)
+			if err != nil {
+				return containerError(err)
+			}
+			if exists {
+				if err := confirmRemoval("the existing container "+options.ContainerName, false); err != nil {
+					return containerError(err)
+				}
+			}
+		}
+
+		if _, err := resolveHostPort(options.BindAddress, options.HostPort); err != nil {
+			return containerError(err)
+		}
+	}
+
+	if err := options.Hooks.run(ctx, hookPreDump, run); err != nil {
+		return err
+	}
+
+	stopPhase := run.track("dump")
+	archive, err := dumpDatabase(ctx, connectionURL, options)
+	if err != nil {
+		return err
+	}
+	defer archive.Close()
+	stopPhase()
+
+	run.DumpSize = archive.Size()
+	run.Warnings = archive.Warnings
+	run.Changes = archive.Changes
+
+	if err := options.Hooks.run(ctx, hookPostDump, run); err != nil {
+		return err
+	}
+
+	if err := options.Hooks.run(ctx, hookPreBuild, run); err != nil {
+		return err
+	}
+
+	labels := mergeLabels(snapshotLabels(run.RunID, databaseName, cmp.Or(options.SourceURL, connectionURL), options), options.Labels)
+
+	stopPhase = run.track("build")
+	imageName, err := createDockerImage(ctx, nerdctl.BuildImage, archive, databaseName, labels, options)
+	if err != nil {
+		return buildError(err)
+	}
+	stopPhase()
+
+	run.Image = imageName
+	resources.addImage(imageName)
+
+	if err := options.Hooks.run(ctx, hookPostBuild, run); err != nil {
+		return err
+	}
+
+	if err := writeArtifacts(databaseName, imageName, connectionURL, options); err != nil {
+		return err
+	}
+
+	if !options.CreateContainer {
+		return nil
+	}
+
+	if options.Replace {
+		if err := nerdctl.RemoveContainer(ctx, options.ContainerName); err != nil {
+			return containerError(err)
+		}
+	}
+
+	options.HostPort, err = reserveHostPort(ctx, nil, options.BindAddress, options.HostPort, options.PortFallback, "")
+	if err != nil {
+		return containerError(err)
+	}
+
+	stopPhase = run.track("container")
+	run.Container, err = createContainer(ctx, nerdctl.CreateContainer, databaseName, imageName, labels, options)
+	if err != nil {
+		return containerError(err)
+	}
+	resources.addContainer(run.Container)
+	stopPhase()
+
+	run.Port = options.HostPort
+	run.ConnectionURL = connectionString(databaseName, connectHost(options.BindAddress), options.HostPort)
+
+	if options.StartContainer {
+		logger.Info("> Step 4: 🚀 Starting the container")
+
+		stopPhase = run.track("start")
+		if err := nerdctl.StartContainer(ctx, run.Container); err != nil {
+			return containerError(err)
+		}
+		if err := waitForNerdctlReady(ctx, nerdctl, run.Container, options.StartTimeout); err != nil {
+			return containerError(err)
+		}
+		stopPhase()
+
+		if options.PostStartSQL != "" || len(options.Hooks[hookPostStart]) > 0 {
+			logger.Info("> Step 5: 🪝 Running post-start hooks")
+
+			stopPhase = run.track("post-start")
+
+			if options.PostStartSQL != "" {
+				if err := runNerdctlPostStartSQL(ctx, nerdctl, run.Container, databaseName, options.PostStartSQL); err != nil {
+					return containerError(err)
+				}
+			}
+
+			if err := options.Hooks.run(ctx, hookPostStart, run); err != nil {
+				return containerError(err)
+			}
+
+			stopPhase()
+		}
+
+		printReady(databaseName, connectHost(options.BindAddress), options.HostPort)
+	} else {
+		logger.Info("🔌 Connect once started with: " + run.ConnectionURL)
+	}
+
+	if options.Dotenv != "" {
+		if err := writeDotenv(options.Dotenv, options.DotenvKey, run.ConnectionURL); err != nil {
+			return err
+		}
+
+		logger.Info("📝 Wrote "+options.DotenvKey, "file", options.Dotenv)
+	}
+
+	if len(run.Warnings) > 0 {
+		logger.Warn(fmt.Sprintf("pg_dump reported %d warnings; the snapshot may be incomplete", len(run.Warnings)))
+		for _, warning := range run.Warnings {
+			logger.Warn(warning.Message, "kind", warning.Kind)
+		}
+	}
+
+	return nil
+}
+
+// resolveNerdctlContainerName is resolveContainerName for nerdctl.
+func resolveNerdctlContainerName(ctx context.Context, nerdctl *pgcontainer.Nerdctl, name string, replace bool, autoSuffix bool) (string, error) {
+	if replace && autoSuffix {
+		return "", fmt.Errorf("--replace and --auto-suffix cannot be used together")
+	}
+
+	candidate := name
+	for i := 2; ; i++ {
+		exists, err := nerdctl.Exists(ctx, candidate)
+		if err != nil {
+			return "", err
+		}
+
+		if !exists || (replace && candidate == name) {
+			return candidate, nil
+		}
+
+		if !autoSuffix {
+			return "", fmt.Errorf("A container named %s already exists; pass --replace to remove it or --auto-suffix to pick another name", name)
+		}
+
+		candidate = name + "-" + strconv.Itoa(i)
+	}
+}
+
+// waitForNerdctlReady is waitForReady for nerdctl.
+func waitForNerdctlReady(ctx context.Context, nerdctl *pgcontainer.Nerdctl, containerName string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+
+	for {
+		running, exitCode, err := nerdctl.Running(ctx, containerName)
+		if err != nil {
+			return err
+		}
+
+		if !running {
+			return fmt.Errorf("Container %s exited with code %d before accepting connections", containerName, exitCode)
+		}
+
+		exitCode, _, err = nerdctl.Exec(ctx, containerName, []string{"pg_isready", "-U", "postgres", "-h", "127.0.0.1"}, nil)
+		if err == nil && exitCode == 0 {
+			return nil
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("Container %s did not accept connections within %s", containerName, timeout)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(500 * time.Millisecond):
+		}
+	}
+}
+
+// runNerdctlPostStartSQL is runPostStartSQL for nerdctl, which feeds the file
+// to psql on its standard input rather than copying it in.
+func runNerdctlPostStartSQL(ctx context.Context, nerdctl *pgcontainer.Nerdctl, containerName string, databaseName string, sqlPath string) error {
+	sql, err := os.ReadFile(sqlPath)
+	if err != nil {
+		return err
+	}
+
+	exitCode, output, err := nerdctl.Exec(ctx, containerName, []string{
+		"psql", "-U", "postgres", "-d", databaseName, "-v", "ON_ERROR_STOP=1", "-f", "-",
+	}, bytes.NewReader(sql))
+	if err != nil {
+		return err
+	}
+
+	postStartLog := newLogWriter(slog.LevelInfo, "psql")
+	postStartLog.Write([]byte(output))
+	postStartLog.Flush()
+
+	if exitCode != 0 {
+		return fmt.Errorf("%s failed with exit code %d", filepath.Base(sqlPath), exitCode)
+	}
+
+	return nil
+}
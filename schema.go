@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"strings"
+)
+
+// customDumpMagic starts every pg_dump -Fc archive.
+const customDumpMagic = "PGDMP"
+
+type column struct {
+	Name       string
+	Definition string
+}
+
+type tableSummary struct {
+	Columns []column
+	Rows    int64
+}
+
+// dumpSummary is what we can learn about a database from its plain SQL dump
+// without restoring it: the objects pg_dump lists in its TOC comments, the
+// column layout of every table and how many rows each table's COPY carries.
+type dumpSummary struct {
+	Objects map[string]struct{}
+	Tables  map[string]*tableSummary
+}
+
+func (s *dumpSummary) table(name string) *tableSummary {
+	t, ok := s.Tables[name]
+	if !ok {
+		t = &tableSummary{}
+		s.Tables[name] = t
+	}
+
+	return t
+}
+
+func parseDump(r io.Reader) (*dumpSummary, error) {
+	summary := &dumpSummary{
+		Objects: map[string]struct{}{},
+		Tables:  map[string]*tableSummary{},
+	}
+
+	buffered := bufio.NewReader(r)
+	if magic, _ := buffered.Peek(len(customDumpMagic)); string(magic) == customDumpMagic {
+		return nil, errors.New("custom format dumps cannot be inspected, build the image with --format plain")
+	}
+
+	scanner := bufio.NewScanner(buffered)
+	scanner.Buffer(make([]byte, 0, 64*1024), 256*1024*1024)
+
+	var copying *tableSummary
+	var creating *tableSummary
+
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		switch {
+		case copying != nil:
+			if line == `\.` {
+				copying = nil
+			} else {
+				copying.Rows++
+			}
+
+		case creating != nil:
+			if strings.HasPrefix(line, ")") {
+				creating = nil
+				continue
+			}
+
+			definition := strings.TrimSuffix(strings.TrimSpace(line), ",")
+			if definition == "" || strings.HasPrefix(definition, "CONSTRAINT ") {
+				continue
+			}
+
+			name, rest := splitIdentifier(definition)
+			creating.Columns = append(creating.Columns, column{Name: name, Definition: rest})
+
+		case strings.HasPrefix(line, "-- Name: "):
+			if key, ok := tocObject(line); ok {
+				summary.Objects[key] = struct{}{}
+			}
+
+		case strings.HasPrefix(line, "CREATE TABLE ") && strings.HasSuffix(line, " ("):
+			name := strings.TrimSuffix(strings.TrimPrefix(line, "CREATE TABLE "), " (")
+			creating = summary.table(name)
+			creating.Columns = nil
+
+		case strings.HasPrefix(line, "COPY ") && strings.HasSuffix(line, " FROM stdin;"):
+			name, _ := splitIdentifier(strings.TrimPrefix(line, "COPY "))
+			copying = summary.table(name)
+		}
+	}
+
+	return summary, scanner.Err()
+}
+
+// tocObject turns a pg_dump TOC comment such as
+// "-- Name: users; Type: TABLE; Schema: public; Owner: postgres" into
+// "TABLE public.users". Data entries are skipped since they are not schema.
+func tocObject(line string) (string, bool) {
+	fields := map[string]string{}
+
+	for _, part := range strings.Split(strings.TrimPrefix(line, "-- "), "; ") {
+		if key, value, ok := strings.Cut(part, ": "); ok {
+			fields[key] = value
+		}
+	}
+
+	objectType := fields["Type"]
+	if objectType == "" || objectType == "TABLE DATA" || objectType == "SEQUENCE SET" {
+		return "", false
+	}
+
+	name := fields["Name"]
+	if schema := fields["Schema"]; schema != "" && schema != "-" {
+		name = schema + "." + name
+	}
+
+	return objectType + " " + name, true
+}
+
+// splitIdentifier splits a possibly double-quoted leading identifier from the
+// rest of the statement.
+func splitIdentifier(s string) (string, string) {
+	inQuotes := false
+
+	for i, r := range s {
+		switch {
+		case r == '"':
+			inQuotes = !inQuotes
+		case r == ' ' && !inQuotes:
+			return s[:i], strings.TrimSpace(s[i+1:])
+		}
+	}
+
+	return s, ""
+}
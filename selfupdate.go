@@ -0,0 +1,434 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/docker/go-units"
+	cli "github.com/urfave/cli/v3"
+	"golang.org/x/crypto/blake2b"
+)
+
+// releasesAPI is where self-update looks for releases. Each release carries
+// one binary per platform, named as in releaseAssetName, a checksums.txt in
+// the format of sha256sum listing them and, for each binary, a minisign
+// signature named after it with signatureSuffix.
+const (
+	releasesAPI      = "https://api.github.com/repos/bgrcs/pg_container/releases"
+	checksumsAsset   = "checksums.txt"
+	signatureSuffix  = ".minisig"
+	maxReleaseBinary = 512 << 20
+)
+
+// updatePublicKey is the minisign public key, the base64 line of its .pub
+// file, that release binaries are signed with, set at build time with
+//
+//	go build -ldflags "-X main.updatePublicKey=RWQ..."
+//
+// A checksums.txt comes from the same release as the binary, so it catches a
+// corrupted download but not a tampered release; the signature does. Builds
+// without a key only verify the checksum.
+var updatePublicKey = ""
+
+var selfUpdateCommand = &cli.Command{
+	Name:  "self-update",
+	Usage: "Replace the binary with the latest release from GitHub",
+	UsageText: `pg_container self-update [--check] [--version tag] [--force]
+
+The binary for this platform is downloaded from the GitHub release, checked
+against the release's checksums.txt and then swapped in place of the running
+one, so the directory holding it must be writable. GITHUB_TOKEN, if set, is
+sent to avoid the API rate limit.
+
+Release builds embed the minisign key the releases are signed with and refuse
+a binary without a valid signature from it. A build without the key, such as
+one from source, only verifies the checksum, which comes from the same
+release as the binary: it catches a corrupted download, not a tampered
+release, and a warning says so.
+
+Examples:
+	pg_container self-update --check
+	pg_container self-update --version v1.4.0`,
+	Flags: []cli.Flag{
+		&cli.BoolFlag{
+			Name:  "check",
+			Usage: "Only report whether a newer release exists; exits 1 if one does",
+		},
+		&cli.StringFlag{
+			Name:  "version",
+			Usage: "Install this release tag instead of the latest, also to downgrade",
+		},
+		&cli.BoolFlag{
+			Name:  "force",
+			Usage: "Install even over a development build or the same version",
+		},
+	},
+	Action: func(ctx context.Context, cmd *cli.Command) error {
+		release, err := fetchRelease(ctx, cmd.String("version"))
+		if err != nil {
+			return err
+		}
+
+		newer := compareVersions(release.TagName, version) > 0
+
+		if cmd.Bool("check") {
+			if !newer {
+				logger.Info("✅ " + version + " is the latest release")
+				return nil
+			}
+			fmt.Println(release.TagName)
+			return cli.Exit("", 1)
+		}
+
+		if !cmd.Bool("force") {
+			if version == "dev" {
+				return fmt.Errorf("This is a development build; pass --force to replace it with %s", release.TagName)
+			}
+			if release.TagName == version {
+				logger.Info("✅ Already at " + version)
+				return nil
+			}
+			if !newer && !cmd.IsSet("version") {
+				logger.Info("✅ " + version + " is newer than the latest release " + release.TagName)
+				return nil
+			}
+		}
+
+		binary, checksums, signature, err := release.assets(releaseAssetName())
+		if err != nil {
+			return err
+		}
+
+		logger.Info("⬇️  Downloading " + release.TagName)
+
+		sums, err := download(ctx, checksums.URL, 1<<20)
+		if err != nil {
+			return err
+		}
+
+		expected, err := findChecksum(sums, binary.Name)
+		if err != nil {
+			return err
+		}
+
+		data, err := download(ctx, binary.URL, maxReleaseBinary)
+		if err != nil {
+			return err
+		}
+
+		sum := sha256.Sum256(data)
+		if hex.EncodeToString(sum[:]) != expected {
+			return fmt.Errorf("Checksum mismatch for %s, refusing to install it", binary.Name)
+		}
+
+		if updatePublicKey == "" {
+			logger.Warn("⚠️  This build has no release signing key, only the checksum of " + binary.Name + " is verified")
+		} else {
+			sig, err := download(ctx, signature.URL, 1<<20)
+			if err != nil {
+				return err
+			}
+			if err := verifyMinisign(updatePublicKey, data, sig); err != nil {
+				return fmt.Errorf("Signature of %s does not verify, refusing to install it: %w", binary.Name, err)
+			}
+		}
+
+		path, err := replaceExecutable(data)
+		if err != nil {
+			return err
+		}
+
+		logger.Info("✅ Updated "+path+" to "+release.TagName, "size", units.HumanSize(float64(len(data))))
+
+		return nil
+	},
+}
+
+type githubRelease struct {
+	TagName string        `json:"tag_name"`
+	Assets  []githubAsset `json:"assets"`
+}
+
+type githubAsset struct {
+	Name string `json:"name"`
+	URL  string `json:"browser_download_url"`
+}
+
+// releaseAssetName is the name of the release binary for this platform.
+func releaseAssetName() string {
+	name := "pg_container_" + runtime.GOOS + "_" + runtime.GOARCH
+	if runtime.GOOS == "windows" {
+		name += ".exe"
+	}
+	return name
+}
+
+// assets picks the binary name, checksums.txt and, when this build has a
+// key to check it with, the binary's signature out of the release.
+func (r *githubRelease) assets(name string) (binary, checksums, signature githubAsset, err error) {
+	for _, asset := range r.Assets {
+		switch asset.Name {
+		case name:
+			binary = asset
+		case checksumsAsset:
+			checksums = asset
+		case name + signatureSuffix:
+			signature = asset
+		}
+	}
+
+	if binary.URL == "" {
+		return binary, checksums, signature, fmt.Errorf("Release %s has no binary for %s/%s", r.TagName, runtime.GOOS, runtime.GOARCH)
+	}
+	if checksums.URL == "" {
+		return binary, checksums, signature, fmt.Errorf("Release %s has no %s, refusing to install an unverified binary", r.TagName, checksumsAsset)
+	}
+	if updatePublicKey != "" && signature.URL == "" {
+		return binary, checksums, signature, fmt.Errorf("Release %s has no %s, refusing to install an unsigned binary", r.TagName, name+signatureSuffix)
+	}
+
+	return binary, checksums, signature, nil
+}
+
+// fetchRelease looks up a release by tag, or the latest one.
+func fetchRelease(ctx context.Context, tag string) (*githubRelease, error) {
+	endpoint := releasesAPI + "/latest"
+	if tag != "" {
+		endpoint = releasesAPI + "/tags/" + tag
+	}
+
+	body, err := download(ctx, endpoint, 1<<20)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to look up the release: %w", err)
+	}
+
+	var release githubRelease
+	if err := json.Unmarshal(body, &release); err != nil {
+		return nil, fmt.Errorf("Failed to parse the release: %w", err)
+	}
+
+	return &release, nil
+}
+
+// download fetches url, failing if it is larger than limit.
+func download(ctx context.Context, url string, limit int64) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasPrefix(url, releasesAPI) {
+		req.Header.Set("Accept", "application/vnd.github+json")
+		if token := os.Getenv("GITHUB_TOKEN"); token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Unexpected response %s from %s", resp.Status, url)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		return nil, fmt.Errorf("%s is larger than %s", url, units.HumanSize(float64(limit)))
+	}
+
+	return data, nil
+}
+
+// findChecksum picks the SHA-256 of name out of a sha256sum listing.
+func findChecksum(sums []byte, name string) (string, error) {
+	scanner := bufio.NewScanner(bytes.NewReader(sums))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && strings.TrimPrefix(fields[1], "*") == name {
+			return strings.ToLower(fields[0]), nil
+		}
+	}
+
+	return "", fmt.Errorf("%s does not list %s, refusing to install an unverified binary", checksumsAsset, name)
+}
+
+// verifyMinisign checks sig, a minisign signature file, over data against
+// publicKey, the base64 line of a minisign public key. Both the legacy and
+// the default prehashed signatures are accepted, and the trusted comment must
+// carry the global signature of the key.
+func verifyMinisign(publicKey string, data, sig []byte) error {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(publicKey))
+	if err != nil || len(key) != 2+8+ed25519.PublicKeySize || string(key[:2]) != "Ed" {
+		return fmt.Errorf("Malformed minisign public key")
+	}
+	keyID, pub := key[2:10], ed25519.PublicKey(key[10:])
+
+	lines := strings.Split(strings.ReplaceAll(string(sig), "\r\n", "\n"), "\n")
+	if len(lines) < 4 || !strings.HasPrefix(lines[0], "untrusted comment:") {
+		return fmt.Errorf("Malformed minisign signature")
+	}
+	signature, err := base64.StdEncoding.DecodeString(lines[1])
+	if err != nil || len(signature) != 2+8+ed25519.SignatureSize {
+		return fmt.Errorf("Malformed minisign signature")
+	}
+	comment, ok := strings.CutPrefix(lines[2], "trusted comment: ")
+	if !ok {
+		return fmt.Errorf("Malformed minisign trusted comment")
+	}
+	global, err := base64.StdEncoding.DecodeString(lines[3])
+	if err != nil || len(global) != ed25519.SignatureSize {
+		return fmt.Errorf("Malformed minisign global signature")
+	}
+
+	if !bytes.Equal(signature[2:10], keyID) {
+		return fmt.Errorf("Signed with key %X, not %X", signature[2:10], keyID)
+	}
+
+	message := data
+	switch string(signature[:2]) {
+	case "Ed":
+	case "ED":
+		sum := blake2b.Sum512(data)
+		message = sum[:]
+	default:
+		return fmt.Errorf("Unsupported minisign algorithm %q", signature[:2])
+	}
+
+	if !ed25519.Verify(pub, message, signature[10:]) {
+		return fmt.Errorf("Invalid signature")
+	}
+	if !ed25519.Verify(pub, append(signature[10:], comment...), global) {
+		return fmt.Errorf("Invalid trusted comment signature")
+	}
+
+	return nil
+}
+
+// replaceExecutable writes data next to the running binary and renames it
+// over the binary, so the swap is atomic and a failed download never leaves
+// a broken binary behind.
+func replaceExecutable(data []byte) (string, error) {
+	path, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	path, err = filepath.EvalSymlinks(path)
+	if err != nil {
+		return "", err
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+
+	temp, err := os.CreateTemp(filepath.Dir(path), ".pg_container-update-")
+	if err != nil {
+		return "", fmt.Errorf("Failed to write next to %s: %w", path, err)
+	}
+	defer os.Remove(temp.Name())
+
+	if _, err := temp.Write(data); err != nil {
+		temp.Close()
+		return "", err
+	}
+	if err := temp.Close(); err != nil {
+		return "", err
+	}
+	if err := os.Chmod(temp.Name(), info.Mode().Perm()|0111); err != nil {
+		return "", err
+	}
+
+	if runtime.GOOS == "windows" {
+		// A running executable cannot be replaced on Windows, only renamed.
+		old := path + ".old"
+		os.Remove(old)
+		if err := os.Rename(path, old); err != nil {
+			return "", err
+		}
+	}
+
+	if err := os.Rename(temp.Name(), path); err != nil {
+		return "", fmt.Errorf("Failed to replace %s: %w", path, err)
+	}
+
+	return path, nil
+}
+
+// compareVersions orders vMAJOR.MINOR.PATCH tags; anything after a hyphen is a
+// pre-release, which sorts before the release itself. Versions that do not
+// parse, such as dev, sort before every release.
+func compareVersions(a, b string) int {
+	pa, oka := parseVersion(a)
+	pb, okb := parseVersion(b)
+
+	switch {
+	case !oka && !okb:
+		return 0
+	case !oka:
+		return -1
+	case !okb:
+		return 1
+	}
+
+	for i := range pa {
+		if pa[i] != pb[i] {
+			if pa[i] < pb[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+
+	return 0
+}
+
+// parseVersion returns major, minor, patch and 1 for a release or 0 for a
+// pre-release.
+func parseVersion(v string) ([4]int, bool) {
+	var parts [4]int
+
+	v, ok := strings.CutPrefix(v, "v")
+	if !ok {
+		return parts, false
+	}
+
+	v, pre, _ := strings.Cut(v, "-")
+	if pre == "" {
+		parts[3] = 1
+	}
+
+	numbers := strings.Split(v, ".")
+	if len(numbers) != 3 {
+		return parts, false
+	}
+
+	for i, number := range numbers {
+		n, err := strconv.Atoi(number)
+		if err != nil || n < 0 {
+			return parts, false
+		}
+		parts[i] = n
+	}
+
+	return parts, true
+}
@@ -0,0 +1,522 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	apiv1 "github.com/bgrcs/pg_container/api/v1"
+	"github.com/docker/docker/client"
+	cli "github.com/urfave/cli/v3"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	// maxQueuedJobs is how many builds can wait behind the one running
+	// before TriggerBuild turns new ones away.
+	maxQueuedJobs = 32
+
+	// maxRetainedJobs is how many jobs the server remembers; the oldest
+	// finished ones are forgotten first. Their runs stay in the history file.
+	maxRetainedJobs = 200
+)
+
+var serveCommand = &cli.Command{
+	Name:  "serve",
+	Usage: "Run a server that takes snapshot requests over gRPC and from a web dashboard",
+	UsageText: `pg_container serve [--grpc address] [--http address] [--source connection_url...] [--refresh-every duration]
+
+Platform services call the pg_container.v1.SnapshotService defined in
+api/v1/pg_container.proto to trigger builds, poll their status, list the
+snapshot images and stream the progress of a build as it runs. Builds are
+queued and run one at a time, with the flags given before "serve" as their
+defaults; a request can only ask for a container and pick its name and port.
+The HTTP listener serves a dashboard listing the jobs, the last run of every
+--source with a button to refresh it, and the snapshot images, as well as
+/metrics as the metrics command does. The dashboard has no authentication;
+put it behind an authenticating proxy before listening beyond localhost.
+
+Examples:
+	pg_container --format custom --restore-jobs 4 serve --grpc 0.0.0.0:50051
+	pg_container --container --replace --name staging serve --source postgres://user:password@db/staging --refresh-every 24h`,
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "grpc",
+			Usage: "Address to serve the gRPC API on",
+			Value: "127.0.0.1:50051",
+		},
+		&cli.StringFlag{
+			Name:  "http",
+			Usage: "Address to serve the dashboard and /metrics on, empty to disable",
+			Value: "127.0.0.1:9187",
+		},
+		&cli.StringSliceFlag{
+			Name:  "source",
+			Usage: "Database the dashboard can refresh, and --refresh-every snapshots (can be repeated)",
+		},
+		&cli.DurationFlag{
+			Name:  "refresh-every",
+			Usage: "Snapshot every --source at this interval",
+		},
+	},
+	Action: func(ctx context.Context, cmd *cli.Command) error {
+		defaults, err := parseBackupOptions(cmd)
+		if err != nil {
+			return err
+		}
+		// The result of a job is reported through the API, not on stdout, and
+		// a long-running server has nobody to confirm --replace.
+		defaults.JSONOutput = false
+		defaults.ConfirmReplace = false
+
+		schedule, err := newSchedule(cmd.StringSlice("source"), cmd.Duration("refresh-every"))
+		if err != nil {
+			return err
+		}
+
+		apiClient, err := newDockerClient(ctx)
+		if err != nil {
+			return err
+		}
+		defer apiClient.Close()
+
+		grpcListener, err := net.Listen("tcp", cmd.String("grpc"))
+		if err != nil {
+			return fmt.Errorf("Failed to listen on %s: %w", cmd.String("grpc"), err)
+		}
+
+		var httpListener net.Listener
+		if address := cmd.String("http"); address != "" {
+			httpListener, err = net.Listen("tcp", address)
+			if err != nil {
+				grpcListener.Close()
+				return fmt.Errorf("Failed to listen on %s: %w", address, err)
+			}
+		}
+
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		server := newJobServer(defaults, apiClient)
+		logger = slog.New(&jobLogHandler{next: logger.Handler(), server: server})
+
+		workerDone := make(chan struct{})
+		go func() {
+			defer close(workerDone)
+			server.work(ctx)
+		}()
+		go schedule.run(ctx, server)
+
+		grpcServer := grpc.NewServer()
+		apiv1.RegisterSnapshotServiceServer(grpcServer, server)
+
+		errs := make(chan error, 2)
+		go func() {
+			errs <- grpcServer.Serve(grpcListener)
+		}()
+		logger.Info("🛰️  Serving the gRPC API on " + grpcListener.Addr().String())
+
+		if httpListener != nil {
+			mux := http.NewServeMux()
+			mux.HandleFunc("/metrics", handleMetrics)
+			(&dashboard{server: server, schedule: schedule}).routes(mux)
+
+			go func() {
+				errs <- serveHTTP(ctx, httpListener, mux)
+			}()
+			logger.Info("🖥️  Serving the dashboard on http://" + httpListener.Addr().String() + "/")
+		}
+
+		select {
+		case <-ctx.Done():
+		case err = <-errs:
+		}
+
+		// Stopping also ends the log streams a graceful stop would wait for.
+		grpcServer.Stop()
+		cancel()
+		<-workerDone
+
+		return err
+	},
+}
+
+// job is a build requested over the API. Everything below the first block is
+// guarded by jobServer.mu.
+type job struct {
+	id            string
+	connectionURL string
+	database      string
+	options       backupOptions
+	createdAt     time.Time
+
+	state      apiv1.JobState
+	run        *runRecord
+	err        error
+	startedAt  time.Time
+	finishedAt time.Time
+	logs       []*apiv1.LogLine
+
+	// changed is closed and replaced whenever the job logs a line or changes
+	// state, waking the streams following it.
+	changed chan struct{}
+}
+
+func (j *job) finished() bool {
+	return j.state == apiv1.JobState_JOB_STATE_SUCCEEDED || j.state == apiv1.JobState_JOB_STATE_FAILED
+}
+
+func (j *job) notify() {
+	close(j.changed)
+	j.changed = make(chan struct{})
+}
+
+// jobServer implements the SnapshotService. Jobs run one at a time from the
+// queue, since concurrent runs would compete for the same ports, disk and
+// Docker daemon anyway.
+type jobServer struct {
+	apiv1.UnimplementedSnapshotServiceServer
+
+	defaults  backupOptions
+	apiClient *client.Client
+	queue     chan *job
+
+	mu      sync.Mutex
+	jobs    map[string]*job
+	order   []string
+	current *job
+}
+
+func newJobServer(defaults backupOptions, apiClient *client.Client) *jobServer {
+	return &jobServer{
+		defaults:  defaults,
+		apiClient: apiClient,
+		queue:     make(chan *job, maxQueuedJobs),
+		jobs:      map[string]*job{},
+	}
+}
+
+// work runs queued jobs until ctx is done. A job running at that point is
+// interrupted and rolls back like a cancelled command line run.
+func (s *jobServer) work(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case j := <-s.queue:
+			s.runJob(ctx, j)
+		}
+	}
+}
+
+func (s *jobServer) runJob(ctx context.Context, j *job) {
+	s.mu.Lock()
+	j.state = apiv1.JobState_JOB_STATE_RUNNING
+	j.startedAt = time.Now()
+	j.notify()
+	s.current = j
+	s.mu.Unlock()
+
+	run, err := processBackup(ctx, j.connectionURL, j.options)
+	if err != nil {
+		// Logged while the job is still current, so its stream ends with it.
+		logger.Error(err.Error(), "job", j.id)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.current = nil
+	j.run = run
+	j.err = err
+	j.finishedAt = time.Now()
+	j.state = apiv1.JobState_JOB_STATE_SUCCEEDED
+	if err != nil {
+		j.state = apiv1.JobState_JOB_STATE_FAILED
+	}
+	j.notify()
+}
+
+// enqueue registers j and queues it, forgetting the oldest finished jobs
+// once more than maxRetainedJobs are known.
+func (s *jobServer) enqueue(j *job) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	select {
+	case s.queue <- j:
+	default:
+		return status.Errorf(codes.ResourceExhausted, "%d builds are already queued", maxQueuedJobs)
+	}
+
+	s.jobs[j.id] = j
+	s.order = append(s.order, j.id)
+
+	for i := 0; len(s.jobs) > maxRetainedJobs && i < len(s.order); {
+		if old := s.jobs[s.order[i]]; old.finished() {
+			delete(s.jobs, old.id)
+			s.order = append(s.order[:i], s.order[i+1:]...)
+		} else {
+			i++
+		}
+	}
+
+	return nil
+}
+
+func (s *jobServer) lookup(id string) (*job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	j, ok := s.jobs[id]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "No job %q", id)
+	}
+
+	return j, nil
+}
+
+// submit queues a build of connectionURL with options.
+func (s *jobServer) submit(connectionURL string, options backupOptions) (*job, error) {
+	connectionURL, err := normalizeConnectionURL(connectionURL)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	database, err := extractDatabaseName(connectionURL)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	j := &job{
+		id:            newRunID(),
+		connectionURL: connectionURL,
+		database:      database,
+		options:       options,
+		createdAt:     time.Now(),
+		state:         apiv1.JobState_JOB_STATE_QUEUED,
+		changed:       make(chan struct{}),
+	}
+
+	if err := s.enqueue(j); err != nil {
+		return nil, err
+	}
+
+	logger.Info("📥 Queued a build", "job", j.id, "database", database)
+
+	return j, nil
+}
+
+// pending reports whether a build of connectionURL is queued or running.
+func (s *jobServer) pending(connectionURL string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, j := range s.jobs {
+		if j.connectionURL == connectionURL && !j.finished() {
+			return true
+		}
+	}
+
+	return false
+}
+
+// list returns the status of every known job, newest first.
+func (s *jobServer) list() []*apiv1.Job {
+	s.mu.Lock()
+	jobs := make([]*job, 0, len(s.order))
+	for i := len(s.order) - 1; i >= 0; i-- {
+		jobs = append(jobs, s.jobs[s.order[i]])
+	}
+	s.mu.Unlock()
+
+	statuses := make([]*apiv1.Job, len(jobs))
+	for i, j := range jobs {
+		statuses[i] = s.status(j)
+	}
+
+	return statuses
+}
+
+func (s *jobServer) TriggerBuild(ctx context.Context, req *apiv1.TriggerBuildRequest) (*apiv1.Job, error) {
+	options := s.defaults
+	if req.GetCreateContainer() || req.GetStartContainer() {
+		options.CreateContainer = true
+	}
+	if req.GetStartContainer() {
+		options.StartContainer = true
+	}
+	if req.GetContainerName() != "" {
+		options.ContainerName = req.GetContainerName()
+	}
+	if req.GetReplace() {
+		options.Replace = true
+		options.ConfirmReplace = false
+	}
+	if req.GetHostPort() != "" {
+		options.HostPort = req.GetHostPort()
+	}
+
+	j, err := s.submit(req.GetConnectionUrl(), options)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.status(j), nil
+}
+
+func (s *jobServer) GetStatus(ctx context.Context, req *apiv1.GetStatusRequest) (*apiv1.Job, error) {
+	j, err := s.lookup(req.GetJobId())
+	if err != nil {
+		return nil, err
+	}
+
+	return s.status(j), nil
+}
+
+func (s *jobServer) status(j *job) *apiv1.Job {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	response := &apiv1.Job{
+		Id:        j.id,
+		Database:  j.database,
+		State:     j.state,
+		CreatedAt: timestamppb.New(j.createdAt),
+	}
+
+	if !j.startedAt.IsZero() {
+		response.StartedAt = timestamppb.New(j.startedAt)
+	}
+	if !j.finishedAt.IsZero() {
+		response.FinishedAt = timestamppb.New(j.finishedAt)
+	}
+	if j.run != nil {
+		response.RunId = j.run.RunID
+		response.Image = j.run.Image
+		response.Container = j.run.Container
+		response.ConnectionUrl = j.run.ConnectionURL
+	}
+	if j.err != nil {
+		response.Error = j.err.Error()
+	}
+
+	return response
+}
+
+func (s *jobServer) ListImages(ctx context.Context, req *apiv1.ListImagesRequest) (*apiv1.ListImagesResponse, error) {
+	images, err := listManagedImages(ctx, s.apiClient, req.GetDatabase())
+	if err != nil {
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+
+	response := &apiv1.ListImagesResponse{}
+	for _, image := range images {
+		for _, reference := range image.RepoTags {
+			response.Images = append(response.Images, &apiv1.Image{
+				Reference: reference,
+				Id:        image.ID,
+				Database:  image.Labels[databaseLabel],
+				Size:      image.Size,
+				CreatedAt: timestamppb.New(time.Unix(image.Created, 0)),
+			})
+		}
+	}
+
+	return response, nil
+}
+
+func (s *jobServer) StreamLogs(req *apiv1.StreamLogsRequest, stream grpc.ServerStreamingServer[apiv1.LogLine]) error {
+	j, err := s.lookup(req.GetJobId())
+	if err != nil {
+		return err
+	}
+
+	for sent := 0; ; {
+		s.mu.Lock()
+		lines := j.logs[sent:]
+		finished := j.finished()
+		changed := j.changed
+		s.mu.Unlock()
+
+		for _, line := range lines {
+			if err := stream.Send(line); err != nil {
+				return err
+			}
+		}
+		sent += len(lines)
+
+		if !req.GetFollow() || finished {
+			return nil
+		}
+
+		select {
+		case <-changed:
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		}
+	}
+}
+
+// record appends a log line to the running job, if there is one.
+func (s *jobServer) record(record slog.Record) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.current == nil {
+		return
+	}
+
+	var message strings.Builder
+	var source string
+	record.Attrs(func(attr slog.Attr) bool {
+		if attr.Key == sourceKey {
+			source = attr.Value.String()
+		} else {
+			fmt.Fprintf(&message, " %s=%s", attr.Key, attr.Value.Resolve())
+		}
+		return true
+	})
+	if source != "" {
+		source += ": "
+	}
+
+	s.current.logs = append(s.current.logs, &apiv1.LogLine{
+		Time:    timestamppb.New(record.Time),
+		Level:   record.Level.String(),
+		Message: source + record.Message + message.String(),
+	})
+	s.current.notify()
+}
+
+// jobLogHandler copies every record logged while a job runs into the job's
+// log, for StreamLogs, and passes it on to the server's own log.
+type jobLogHandler struct {
+	next   slog.Handler
+	server *jobServer
+}
+
+func (h *jobLogHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level)
+}
+
+func (h *jobLogHandler) Handle(ctx context.Context, record slog.Record) error {
+	h.server.record(record)
+	return h.next.Handle(ctx, record)
+}
+
+func (h *jobLogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &jobLogHandler{next: h.next.WithAttrs(attrs), server: h.server}
+}
+
+func (h *jobLogHandler) WithGroup(name string) slog.Handler {
+	return &jobLogHandler{next: h.next.WithGroup(name), server: h.server}
+}
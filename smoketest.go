@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/docker/docker/client"
+	"github.com/jackc/pgx/v5"
+)
+
+// smokeTest is one statement of a --smoke-test file. A preceding
+// "-- expect: value" comment makes the first column of the first row part of
+// the check, compared as text.
+type smokeTest struct {
+	SQL    string
+	Expect *string
+}
+
+// parseSmokeTests splits a SQL file into statements ending with a semicolon
+// at the end of a line.
+func parseSmokeTests(path string) ([]smokeTest, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var tests []smokeTest
+	var current strings.Builder
+	var expect *string
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		trimmed := strings.TrimSpace(line)
+
+		if value, ok := strings.CutPrefix(trimmed, "-- expect:"); ok && current.Len() == 0 {
+			value = strings.TrimSpace(value)
+			expect = &value
+			continue
+		}
+
+		if trimmed == "" || (strings.HasPrefix(trimmed, "--") && current.Len() == 0) {
+			continue
+		}
+
+		current.WriteString(line)
+		current.WriteString("\n")
+
+		if strings.HasSuffix(trimmed, ";") {
+			tests = append(tests, smokeTest{SQL: strings.TrimSpace(current.String()), Expect: expect})
+			current.Reset()
+			expect = nil
+		}
+	}
+
+	if current.Len() > 0 {
+		tests = append(tests, smokeTest{SQL: strings.TrimSpace(current.String()), Expect: expect})
+	}
+
+	return tests, scanner.Err()
+}
+
+func runSmokeTests(ctx context.Context, databaseURL string, tests []smokeTest) error {
+	conn, err := pgx.Connect(ctx, databaseURL)
+	if err != nil {
+		return fmt.Errorf("Failed to connect for smoke tests: %w", err)
+	}
+	defer conn.Close(ctx)
+
+	for i, test := range tests {
+		rows, err := conn.Query(ctx, test.SQL, pgx.QueryExecModeSimpleProtocol)
+		if err != nil {
+			return fmt.Errorf("Smoke test %d failed: %w\n%s", i+1, err, test.SQL)
+		}
+
+		var first *string
+		if rows.Next() {
+			values, err := rows.Values()
+			if err == nil && len(values) > 0 {
+				value := fmt.Sprint(values[0])
+				first = &value
+			}
+		}
+		rows.Close()
+
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("Smoke test %d failed: %w\n%s", i+1, err, test.SQL)
+		}
+
+		if test.Expect != nil && (first == nil || *first != *test.Expect) {
+			got := "no rows"
+			if first != nil {
+				got = *first
+			}
+
+			return fmt.Errorf("Smoke test %d returned %s, expected %s\n%s", i+1, got, *test.Expect, test.SQL)
+		}
+	}
+
+	logger.Info(fmt.Sprintf("✅ %d smoke tests passed", len(tests)))
+
+	return nil
+}
+
+// smokeTestImage runs the smoke tests in a throwaway container, so the image
+// is checked the same way whether or not a container is created for it.
+func smokeTestImage(ctx context.Context, apiClient *client.Client, imageName string, options backupOptions) error {
+	e, err := startEphemeralContainer(ctx, apiClient, imageName, options.StartTimeout)
+	if err != nil {
+		return err
+	}
+	defer e.Remove()
+
+	return runSmokeTests(ctx, e.URL(), options.SmokeTests)
+}
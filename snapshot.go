@@ -0,0 +1,74 @@
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/bgrcs/pg_container/pgcontainer"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+)
+
+// imageDumpPaths are where the Dockerfile leaves the original dump in the
+// final image, for plain and custom format dumps respectively.
+var imageDumpPaths = []string{"/" + pgcontainer.DumpFileName(pgcontainer.FormatPlain), "/" + pgcontainer.DumpFileName(pgcontainer.FormatCustom)}
+
+type imageDump struct {
+	io.Reader
+	close func() error
+}
+
+func (d *imageDump) Close() error {
+	return d.close()
+}
+
+// openImageDump streams the dump out of a snapshot image. The image is never
+// started; a throwaway container is created only so its filesystem can be
+// read, and it is removed when the returned reader is closed.
+func openImageDump(ctx context.Context, apiClient *client.Client, imageName string) (io.ReadCloser, error) {
+	containerConfig := &container.Config{
+		Image: imageName,
+		Labels: map[string]string{
+			managedLabel:   "true",
+			temporaryLabel: "true",
+		},
+	}
+
+	created, err := apiClient.ContainerCreate(ctx, containerConfig, nil, nil, nil, "")
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open image %s: %w", imageName, err)
+	}
+
+	remove := func() error {
+		return apiClient.ContainerRemove(context.Background(), created.ID, container.RemoveOptions{Force: true})
+	}
+
+	var content io.ReadCloser
+	for _, path := range imageDumpPaths {
+		content, _, err = apiClient.CopyFromContainer(ctx, created.ID, path)
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		remove()
+		return nil, fmt.Errorf("Image %s does not contain a dump: %w", imageName, err)
+	}
+
+	tr := tar.NewReader(content)
+	if _, err := tr.Next(); err != nil {
+		content.Close()
+		remove()
+		return nil, fmt.Errorf("Failed to read dump from image %s: %w", imageName, err)
+	}
+
+	return &imageDump{
+		Reader: tr,
+		close: func() error {
+			content.Close()
+			return remove()
+		},
+	}, nil
+}
@@ -0,0 +1,14 @@
+package main
+
+import "strings"
+
+// quoteIdent quotes a Postgres identifier the way quote_ident() does.
+func quoteIdent(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+// quoteLiteral quotes a Postgres string literal the way quote_literal() does
+// with standard_conforming_strings on.
+func quoteLiteral(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", "''") + "'"
+}
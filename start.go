@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/stdcopy"
+)
+
+// startContainer starts a created container, streams its logs until Postgres
+// accepts connections and fails if it exits or does not become ready in time.
+func startContainer(ctx context.Context, apiClient *client.Client, containerName string, timeout time.Duration, logs io.Writer) error {
+	if err := apiClient.ContainerStart(ctx, containerName, container.StartOptions{}); err != nil {
+		return fmt.Errorf("Failed to start container %s: %w", containerName, err)
+	}
+
+	logCtx, stopLogs := context.WithCancel(ctx)
+	defer stopLogs()
+
+	if logs != nil {
+		go streamContainerLogs(logCtx, apiClient, containerName, logs)
+	}
+
+	return waitForReady(ctx, apiClient, containerName, timeout)
+}
+
+func streamContainerLogs(ctx context.Context, apiClient *client.Client, containerName string, w io.Writer) {
+	reader, err := apiClient.ContainerLogs(ctx, containerName, container.LogsOptions{
+		ShowStdout: true,
+		ShowStderr: true,
+		Follow:     true,
+	})
+	if err != nil {
+		return
+	}
+	defer reader.Close()
+
+	stdcopy.StdCopy(w, w, reader)
+}
+
+// waitForReady polls pg_isready inside the container, every 50ms at first and
+// backing off to every 500ms, so a quick start is noticed right away.
+func waitForReady(ctx context.Context, apiClient *client.Client, containerName string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	interval := 50 * time.Millisecond
+
+	for {
+		inspect, err := apiClient.ContainerInspect(ctx, containerName)
+		if err != nil {
+			return err
+		}
+
+		if inspect.State != nil && !inspect.State.Running {
+			return fmt.Errorf("Container %s exited with code %d before accepting connections", containerName, inspect.State.ExitCode)
+		}
+
+		exitCode, _, err := execInContainer(ctx, apiClient, containerName, []string{"pg_isready", "-U", "postgres", "-h", "127.0.0.1"})
+		if err == nil && exitCode == 0 {
+			return nil
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("Container %s did not accept connections within %s", containerName, timeout)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(interval):
+		}
+
+		interval = min(2*interval, 500*time.Millisecond)
+	}
+}
+
+// execInContainer runs a command inside a running container and returns its
+// exit code and combined output.
+func execInContainer(ctx context.Context, apiClient *client.Client, containerName string, command []string) (int, string, error) {
+	exec, err := apiClient.ContainerExecCreate(ctx, containerName, container.ExecOptions{
+		Cmd:          command,
+		AttachStdout: true,
+		AttachStderr: true,
+	})
+	if err != nil {
+		return -1, "", err
+	}
+
+	attach, err := apiClient.ContainerExecAttach(ctx, exec.ID, container.ExecAttachOptions{})
+	if err != nil {
+		return -1, "", err
+	}
+	defer attach.Close()
+
+	var output bytes.Buffer
+	if _, err := stdcopy.StdCopy(&output, &output, attach.Reader); err != nil {
+		return -1, "", err
+	}
+
+	inspect, err := apiClient.ContainerExecInspect(ctx, exec.ID)
+	if err != nil {
+		return -1, "", err
+	}
+
+	return inspect.ExitCode, output.String(), nil
+}
+
+func connectionString(databaseName string, host string, port string) string {
+	return fmt.Sprintf("postgres://postgres:postgres@%s/%s", net.JoinHostPort(host, port), databaseName)
+}
+
+func printReady(databaseName string, host string, port string) {
+	logger.Info("✅ Database ready: " + connectionString(databaseName, host, port))
+}
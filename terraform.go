@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"text/template"
+
+	"github.com/docker/go-units"
+)
+
+// terraformModule describes the snapshot as resources of the
+// kreuzwerker/docker provider, which OpenTofu uses as well.
+type terraformModule struct {
+	Name          string
+	Image         string
+	ContainerPort string
+	HostPort      string
+	BindAddress   string
+	Env           []string
+	Labels        map[string]string
+	Restart       string
+	MaxRetries    string
+	MemoryMB      int64
+	ShmSizeMB     int64
+}
+
+var terraformTemplate = template.Must(template.New("terraform").Funcs(template.FuncMap{
+	"hcl": hclString,
+}).Parse(`# {{.Name}} snapshot made by pg_container. The file is rewritten on every
+# run, so keep changes in other files.
+terraform {
+  required_providers {
+    docker = {
+      source = "kreuzwerker/docker"
+    }
+  }
+}
+
+resource "docker_image" "{{.Name}}" {
+  name         = {{hcl .Image}}
+  keep_locally = true
+}
+
+resource "docker_container" "{{.Name}}" {
+  name  = {{hcl .Name}}
+  image = docker_image.{{.Name}}.image_id
+{{- if .Restart}}
+  restart = {{hcl .Restart}}
+{{- if .MaxRetries}}
+  max_retry_count = {{.MaxRetries}}
+{{- end}}
+{{- end}}
+{{- if .MemoryMB}}
+  memory = {{.MemoryMB}}
+{{- end}}
+{{- if .ShmSizeMB}}
+  shm_size = {{.ShmSizeMB}}
+{{- end}}
+{{- if .Env}}
+
+  env = [
+{{- range .Env}}
+    {{hcl .}},
+{{- end}}
+  ]
+{{- end}}
+
+  ports {
+    internal = {{.ContainerPort}}
+{{- if .HostPort}}
+    external = {{.HostPort}}
+{{- end}}
+    ip       = {{hcl .BindAddress}}
+  }
+{{- range $label, $value := .Labels}}
+
+  labels {
+    label = {{hcl $label}}
+    value = {{hcl $value}}
+  }
+{{- end}}
+}
+`))
+
+func newTerraformModule(name string, imageName string, options backupOptions) (terraformModule, error) {
+	module := terraformModule{
+		Name:          name,
+		Image:         imageName,
+		ContainerPort: options.ContainerPort,
+		BindAddress:   options.BindAddress,
+		Labels:        options.Labels,
+	}
+
+	// Without an external port Docker picks a free one, like --port auto.
+	if options.HostPort != autoPort {
+		module.HostPort = options.HostPort
+	}
+
+	module.Env = append(module.Env, options.Env...)
+	if options.ContainerPort != defaultContainerPort {
+		module.Env = append(module.Env, "PGPORT="+options.ContainerPort)
+	}
+
+	if options.Restart != "" && options.Restart != "no" {
+		module.Restart, module.MaxRetries, _ = strings.Cut(options.Restart, ":")
+	}
+
+	// The provider takes both sizes in megabytes.
+	for _, size := range []struct {
+		value  string
+		target *int64
+	}{
+		{options.Memory, &module.MemoryMB},
+		{options.ShmSize, &module.ShmSizeMB},
+	} {
+		if size.value == "" {
+			continue
+		}
+
+		n, err := units.RAMInBytes(size.value)
+		if err != nil {
+			return module, fmt.Errorf("Invalid size %q: %w", size.value, err)
+		}
+		*size.target = n / units.MiB
+	}
+
+	return module, nil
+}
+
+var terraformNameInvalid = regexp.MustCompile(`[^a-zA-Z0-9_-]+`)
+
+// terraformName is the resource name for a database. It has to start with a
+// letter or underscore and may only contain letters, digits, dashes and
+// underscores.
+func terraformName(databaseName string) string {
+	name := strings.Trim(terraformNameInvalid.ReplaceAllString(databaseName, "_"), "_")
+	if name == "" {
+		return "postgres"
+	}
+	if name[0] >= '0' && name[0] <= '9' || name[0] == '-' {
+		name = "_" + name
+	}
+
+	return name
+}
+
+// writeTerraform writes the snapshot for Terraform or OpenTofu. A .tfvars
+// file only gets a <name>_image variable with the image reference, for
+// configurations that define the resources themselves; any other file is
+// replaced with docker_image and docker_container resources.
+func writeTerraform(path string, module terraformModule) error {
+	if strings.HasSuffix(path, ".tfvars") {
+		return writeTerraformVariable(path, module.Name+"_image", module.Image)
+	}
+
+	var content bytes.Buffer
+	if err := terraformTemplate.Execute(&content, module); err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(path, content.Bytes(), 0644); err != nil {
+		return fmt.Errorf("Failed to write %s: %w", path, err)
+	}
+
+	return nil
+}
+
+// writeTerraformVariable sets a variable in a .tfvars file, replacing an
+// existing assignment and keeping the rest of the file as it is.
+func writeTerraformVariable(path string, name string, value string) error {
+	content, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	assignment := name + " = " + hclString(value)
+	replaced := false
+
+	var lines []string
+	if len(content) > 0 {
+		lines = strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")
+	}
+
+	for i, line := range lines {
+		key, _, found := strings.Cut(line, "=")
+		if found && strings.TrimSpace(key) == name {
+			lines[i] = assignment
+			replaced = true
+		}
+	}
+
+	if !replaced {
+		lines = append(lines, assignment)
+	}
+
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		return fmt.Errorf("Failed to write %s: %w", path, err)
+	}
+
+	return nil
+}
+
+// hclString quotes a value as an HCL string literal. The escapes match JSON,
+// except that template sequences have to be escaped as well.
+func hclString(s string) string {
+	quoted, _ := json.Marshal(s)
+	return strings.NewReplacer("${", "$${", "%{", "%%{").Replace(string(quoted))
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	cli "github.com/urfave/cli/v3"
+)
+
+var upCommand = &cli.Command{
+	Name:          "up",
+	Usage:         "Start one or more isolated containers from an existing snapshot image",
+	ShellComplete: completeImages(1),
+	UsageText: `pg_container up [image] [--replicas n]
+
+Every replica gets its own free host port.
+
+Example:
+	pg_container up db-2025-01-18-1200:latest --replicas 3`,
+	Flags: []cli.Flag{
+		&cli.IntFlag{
+			Name:  "replicas",
+			Usage: "Number of containers to start",
+			Value: 1,
+		},
+		&cli.StringFlag{
+			Name:  "name",
+			Usage: "Name prefix of the containers, suffixed with -1, -2, ... (default: postgres-<database>-<timestamp>)",
+		},
+		&cli.StringFlag{
+			Name:  "bind",
+			Usage: "Host address to publish the ports on",
+			Value: "127.0.0.1",
+		},
+		&cli.StringFlag{
+			Name:  "network",
+			Usage: "Docker network to attach the containers to, created if it does not exist",
+		},
+		&cli.StringSliceFlag{
+			Name:  "label",
+			Usage: "Label to set on the containers as KEY=VALUE; repeatable",
+		},
+		&cli.DurationFlag{
+			Name:  "start-timeout",
+			Usage: "How long to wait for each container to accept connections",
+			Value: defaultStartTimeout,
+		},
+	},
+	Action: func(ctx context.Context, cmd *cli.Command) error {
+		imageName := cmd.Args().Get(0)
+		if imageName == "" {
+			return cli.ShowSubcommandHelp(cmd)
+		}
+
+		replicas := int(cmd.Int("replicas"))
+		if replicas < 1 {
+			return fmt.Errorf("--replicas must be at least 1")
+		}
+
+		customLabels, err := parseKeyValues("label", cmd.StringSlice("label"))
+		if err != nil {
+			return err
+		}
+
+		bindAddress := cmd.String("bind")
+		if err := validateBindAddress(bindAddress); err != nil {
+			return err
+		}
+
+		apiClient, err := newDockerClient(ctx)
+		if err != nil {
+			return err
+		}
+		defer apiClient.Close()
+
+		inspect, _, err := apiClient.ImageInspectWithRaw(ctx, imageName)
+		if err != nil {
+			return fmt.Errorf("Image %s not found: %w", imageName, err)
+		}
+
+		databaseName := ""
+		source := ""
+		if inspect.Config != nil {
+			databaseName = inspect.Config.Labels[databaseLabel]
+			source = inspect.Config.Labels[sourceLabel]
+		}
+		if databaseName == "" {
+			databaseName = "postgres"
+		}
+
+		runID := newRunID()
+		labels := mergeLabels(managedLabels(runID, databaseName, source), customLabels)
+
+		resources := &runResources{runID: runID, apiClient: apiClient}
+		succeeded := false
+		defer func() {
+			if !succeeded {
+				resources.rollback()
+			}
+		}()
+
+		if network := cmd.String("network"); network != "" {
+			created, err := ensureNetwork(ctx, apiClient, network)
+			if err != nil {
+				return err
+			}
+			if created {
+				resources.addNetwork(network)
+			}
+		}
+
+		prefix := cmd.String("name")
+		if prefix == "" {
+			prefix = defaultContainerName(databaseName)
+		}
+
+		type replica struct{ name, port string }
+		var started []replica
+
+		for i := 1; i <= replicas; i++ {
+			options := backupOptions{
+				ContainerName:  prefix + "-" + strconv.Itoa(i),
+				BindAddress:    bindAddress,
+				ContainerPort:  defaultContainerPort,
+				Network:        cmd.String("network"),
+				Restart:        "no",
+				HealthInterval: defaultHealthInterval,
+				HealthRetries:  defaultHealthRetries,
+			}
+
+			options.ContainerName, err = resolveContainerName(ctx, apiClient, options.ContainerName, false, false)
+			if err != nil {
+				return err
+			}
+
+			options.HostPort, err = reserveHostPort(ctx, apiClient, bindAddress, autoPort, false, "")
+			if err != nil {
+				return err
+			}
+
+			name, err := createContainer(ctx, dockerContainerCreator(apiClient), databaseName, imageName, labels, options)
+			if err != nil {
+				return containerError(err)
+			}
+			resources.addContainer(name)
+
+			// Start each replica before picking the next port, so the free
+			// port lookup cannot hand out the same port twice.
+			if err := startContainer(ctx, apiClient, name, cmd.Duration("start-timeout"), nil); err != nil {
+				return containerError(err)
+			}
+
+			started = append(started, replica{name: name, port: options.HostPort})
+		}
+
+		succeeded = true
+
+		for _, r := range started {
+			fmt.Println(display(fmt.Sprintf("✅ %s: %s", r.name, connectionString(databaseName, connectHost(bindAddress), r.port))))
+		}
+
+		return nil
+	},
+}
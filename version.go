@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/bgrcs/pg_container/pgcontainer"
+	"github.com/docker/docker/client"
+	cli "github.com/urfave/cli/v3"
+)
+
+// version is the release of the binary, set at build time with
+//
+//	go build -ldflags "-X main.version=v1.2.3"
+//
+// Builds without it are development builds, which self-update refuses to
+// replace unless forced.
+var version = "dev"
+
+var versionCommand = &cli.Command{
+	Name:  "version",
+	Usage: "Show the versions of the tool, the embedded pg_dump and the Docker daemon",
+	UsageText: `pg_container version
+
+Worth including in bug reports: which source servers the embedded pg_dump can
+dump depends on its version, and which Docker features are available on the
+API version negotiated with the daemon. With --output json the same is printed
+as a JSON document.`,
+	Action: func(ctx context.Context, cmd *cli.Command) error {
+		info := collectVersions(ctx)
+
+		if cmd.String("output") == "json" {
+			encoder := json.NewEncoder(os.Stdout)
+			encoder.SetIndent("", "  ")
+			return encoder.Encode(info)
+		}
+
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+
+		fmt.Fprintf(tw, "pg_container:\t%s\n", info.Version)
+		if info.Commit != "" {
+			fmt.Fprintf(tw, "Commit:\t%s\n", info.Commit)
+		}
+		fmt.Fprintf(tw, "Go:\t%s %s/%s\n", info.Go, runtime.GOOS, runtime.GOARCH)
+		fmt.Fprintf(tw, "pg_dump:\t%s\n", info.PgDump)
+		if info.SupportedServers != "" {
+			fmt.Fprintf(tw, "Source servers:\t%s\n", info.SupportedServers)
+		}
+		fmt.Fprintf(tw, "Docker client API:\t%s\n", info.DockerClientAPI)
+		if info.DockerError != "" {
+			fmt.Fprintf(tw, "Docker daemon:\t%s\n", info.DockerError)
+		} else {
+			fmt.Fprintf(tw, "Docker daemon:\t%s (API %s, %s)\n", info.DockerServer, info.DockerServerAPI, info.DockerPlatform)
+		}
+		for _, module := range versionModules {
+			if v, ok := info.Libraries[module]; ok {
+				fmt.Fprintf(tw, "%s:\t%s\n", module, v)
+			}
+		}
+
+		return tw.Flush()
+	},
+}
+
+// minSourceServer is the oldest server release pg_dump still supports
+// dumping from; the newest is the release of pg_dump itself.
+const minSourceServer = "9.2"
+
+// versionModules are the libraries whose versions matter for compatibility
+// with the source database and the Docker daemon.
+var versionModules = []string{"github.com/jackc/pgx/v5", "github.com/docker/docker"}
+
+type versionInfo struct {
+	Version          string            `json:"version"`
+	Commit           string            `json:"commit,omitempty"`
+	Go               string            `json:"go"`
+	PgDump           string            `json:"pg_dump"`
+	SupportedServers string            `json:"supported_servers,omitempty"`
+	DockerClientAPI  string            `json:"docker_client_api"`
+	DockerServer     string            `json:"docker_server,omitempty"`
+	DockerServerAPI  string            `json:"docker_server_api,omitempty"`
+	DockerPlatform   string            `json:"docker_platform,omitempty"`
+	DockerError      string            `json:"docker_error,omitempty"`
+	Libraries        map[string]string `json:"libraries"`
+}
+
+// collectVersions never fails: what cannot be determined is reported as such,
+// since the command is most needed when something does not work.
+func collectVersions(ctx context.Context) versionInfo {
+	info := versionInfo{Version: version, Go: runtime.Version(), Libraries: map[string]string{}}
+
+	if build, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range build.Settings {
+			if setting.Key == "vcs.revision" {
+				info.Commit = setting.Value
+			}
+		}
+		for _, dep := range build.Deps {
+			if slices.Contains(versionModules, dep.Path) {
+				info.Libraries[dep.Path] = dep.Version
+			}
+		}
+	}
+
+	if pgDumpVersion, err := pgcontainer.PgDumpVersion(ctx); err == nil {
+		info.PgDump = pgDumpVersion
+		if major := pgDumpMajor(pgDumpVersion); major != "" {
+			info.SupportedServers = "PostgreSQL " + minSourceServer + " to " + major
+		}
+	} else {
+		info.PgDump = "cannot run on this machine: " + err.Error()
+	}
+
+	apiClient, err := client.NewClientWithOpts(client.FromEnv)
+	if err != nil {
+		info.DockerError = err.Error()
+		return info
+	}
+	defer apiClient.Close()
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	apiClient.NegotiateAPIVersion(ctx)
+	info.DockerClientAPI = apiClient.ClientVersion()
+
+	server, err := apiClient.ServerVersion(ctx)
+	if err != nil {
+		info.DockerError = err.Error()
+		return info
+	}
+
+	info.DockerServer = server.Version
+	info.DockerServerAPI = server.APIVersion
+	info.DockerPlatform = server.Os + "/" + server.Arch
+
+	return info
+}
+
+// pgDumpMajor returns the major release of a "pg_dump (PostgreSQL) 17.2"
+// version string.
+func pgDumpMajor(pgDumpVersion string) string {
+	fields := strings.Fields(pgDumpVersion)
+	if len(fields) == 0 {
+		return ""
+	}
+
+	major, _, _ := strings.Cut(fields[len(fields)-1], ".")
+	if _, err := strconv.Atoi(major); err != nil {
+		return ""
+	}
+
+	return major
+}
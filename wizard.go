@@ -0,0 +1,456 @@
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/moby/term"
+	cli "github.com/urfave/cli/v3"
+)
+
+var wizardCommand = &cli.Command{
+	Name:  "wizard",
+	Usage: "Build the command line for a snapshot by answering a few questions",
+	UsageText: `pg_container wizard
+
+Asks for the connection details, the image options and whether to create a
+container, prints the equivalent pg_container command and offers to run it.
+Servers found on this machine, from the PG* environment, running postgres
+containers and the usual ports of localhost, are offered as the source. The
+password is never printed; the command relies on PGPASSWORD or ~/.pgpass for
+it instead. Also started by running pg_container without arguments in a
+terminal.`,
+	Action: func(ctx context.Context, cmd *cli.Command) error {
+		return runWizard(ctx)
+	},
+}
+
+// stdinIsTerminal reports whether the wizard can prompt for answers.
+func stdinIsTerminal() bool {
+	_, isTerminal := term.GetFdInfo(os.Stdin)
+	return isTerminal
+}
+
+// stderrIsTerminal reports whether stderr is read by a person rather than
+// collected into a log.
+func stderrIsTerminal() bool {
+	_, isTerminal := term.GetFdInfo(os.Stderr)
+	return isTerminal
+}
+
+// prompter asks questions on stderr, so the printed command is all that goes
+// to stdout, and reads the answers from stdin.
+type prompter struct {
+	in  *bufio.Reader
+	out io.Writer
+}
+
+func newPrompter() *prompter {
+	return &prompter{in: bufio.NewReader(os.Stdin), out: os.Stderr}
+}
+
+func (p *prompter) readLine() (string, error) {
+	line, err := p.in.ReadString('\n')
+	if err != nil && !(errors.Is(err, io.EOF) && line != "") {
+		return "", err
+	}
+	return strings.TrimSpace(line), nil
+}
+
+// ask returns the answer to question, or fallback for an empty answer.
+func (p *prompter) ask(question, fallback string) (string, error) {
+	if fallback != "" {
+		fmt.Fprintf(p.out, "%s [%s]: ", question, fallback)
+	} else {
+		fmt.Fprintf(p.out, "%s: ", question)
+	}
+
+	answer, err := p.readLine()
+	if err != nil {
+		return "", err
+	}
+	if answer == "" {
+		return fallback, nil
+	}
+	return answer, nil
+}
+
+// secret reads an answer without echoing it.
+func (p *prompter) secret(question string) (string, error) {
+	fmt.Fprintf(p.out, "%s: ", question)
+
+	if fd, isTerminal := term.GetFdInfo(os.Stdin); isTerminal {
+		state, err := term.SaveState(fd)
+		if err != nil {
+			return "", err
+		}
+		if err := term.DisableEcho(fd, state); err != nil {
+			return "", err
+		}
+		defer func() {
+			term.RestoreTerminal(fd, state)
+			fmt.Fprintln(p.out)
+		}()
+	}
+
+	return p.readLine()
+}
+
+func (p *prompter) confirm(question string, fallback bool) (bool, error) {
+	hint := "y/N"
+	if fallback {
+		hint = "Y/n"
+	}
+
+	for {
+		answer, err := p.ask(question+" ("+hint+")", "")
+		if err != nil {
+			return false, err
+		}
+
+		switch strings.ToLower(answer) {
+		case "":
+			return fallback, nil
+		case "y", "yes":
+			return true, nil
+		case "n", "no":
+			return false, nil
+		}
+	}
+}
+
+// choose asks until the answer is one of choices.
+func (p *prompter) choose(question string, choices []string, fallback string) (string, error) {
+	for {
+		answer, err := p.ask(question+" ("+strings.Join(choices, "/")+")", fallback)
+		if err != nil {
+			return "", err
+		}
+
+		for _, choice := range choices {
+			if strings.EqualFold(answer, choice) {
+				return choice, nil
+			}
+		}
+	}
+}
+
+// wizardAnswers are the answers that differ from the defaults of the flags,
+// turned into command line arguments by args.
+type wizardAnswers struct {
+	connectionURL string
+	password      string
+
+	format      string
+	restoreJobs string
+	noDump      bool
+	vacuum      bool
+	noAnalyze   bool
+	timezone    string
+
+	container bool
+	start     bool
+	name      string
+	port      string
+	replace   bool
+}
+
+func (a wizardAnswers) args() []string {
+	var args []string
+
+	if a.format != "" && a.format != "plain" {
+		args = append(args, "--format", a.format)
+	}
+	if a.restoreJobs != "" {
+		args = append(args, "--restore-jobs", a.restoreJobs)
+	}
+	if a.noDump {
+		args = append(args, "--no-dump")
+	}
+	if a.vacuum {
+		args = append(args, "--vacuum")
+	}
+	if a.noAnalyze {
+		args = append(args, "--no-analyze")
+	}
+	if a.timezone != "" {
+		args = append(args, "--timezone", a.timezone)
+	}
+
+	switch {
+	case a.start:
+		args = append(args, "--start")
+	case a.container:
+		args = append(args, "--container")
+	}
+	if a.name != "" {
+		args = append(args, "--name", a.name)
+	}
+	if a.port != "" {
+		args = append(args, "--port", a.port)
+	}
+	if a.replace {
+		args = append(args, "--replace")
+	}
+
+	return append(args, a.connectionURL)
+}
+
+func runWizard(ctx context.Context) error {
+	if !stdinIsTerminal() {
+		return fmt.Errorf("The wizard needs a terminal; pass the connection URL and flags instead")
+	}
+
+	p := newPrompter()
+	fmt.Fprintln(p.out, "This walks through a snapshot and prints the command doing the same. Run pg_container --help for every option.")
+
+	answers, err := askConnection(ctx, p)
+	if err != nil {
+		return err
+	}
+
+	if err := askImage(p, &answers); err != nil {
+		return err
+	}
+
+	if err := askContainer(p, &answers); err != nil {
+		return err
+	}
+
+	args := answers.args()
+
+	fmt.Fprintln(p.out)
+	fmt.Fprintln(p.out, "The equivalent command is:")
+	fmt.Println(shellCommand(append([]string{"pg_container"}, args...)))
+	if answers.password != "" {
+		fmt.Fprintln(p.out, "It takes the password from PGPASSWORD or ~/.pgpass.")
+	}
+	fmt.Fprintln(p.out)
+
+	run, err := p.confirm("Run it now?", true)
+	if err != nil || !run {
+		return err
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	command := exec.CommandContext(ctx, executable, args...)
+	command.Stdin, command.Stdout, command.Stderr = os.Stdin, os.Stdout, os.Stderr
+	command.Env = os.Environ()
+	if answers.password != "" {
+		command.Env = append(command.Env, "PGPASSWORD="+answers.password)
+	}
+
+	if err := command.Run(); err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			// The run has reported its own error already.
+			return cli.Exit("", exitErr.ExitCode())
+		}
+		return err
+	}
+
+	return nil
+}
+
+// askConnection asks for the connection details, defaulting to those of a
+// server found on this machine or else to the PG* environment variables libpq
+// would use, until a connection succeeds or the user goes on without one.
+func askConnection(ctx context.Context, p *prompter) (wizardAnswers, error) {
+	user := os.Getenv("PGUSER")
+	if user == "" {
+		user = os.Getenv("USER")
+	}
+
+	fallbacks := map[string]string{
+		"host":     cmp.Or(os.Getenv("PGHOST"), "localhost"),
+		"port":     cmp.Or(os.Getenv("PGPORT"), "5432"),
+		"user":     user,
+		"database": cmp.Or(os.Getenv("PGDATABASE"), user),
+	}
+	password := os.Getenv("PGPASSWORD")
+
+	if found := detectLocalPostgres(ctx); len(found) > 0 {
+		server, err := chooseLocalPostgres(p, found)
+		if err != nil {
+			return wizardAnswers{}, err
+		}
+
+		if server != nil {
+			fallbacks["host"], fallbacks["port"] = server.Host, server.Port
+			if server.User != "" {
+				fallbacks["user"] = server.User
+				fallbacks["database"] = cmp.Or(server.Database, server.User)
+			}
+			password = cmp.Or(server.Password, password)
+		}
+	}
+
+	for {
+		var answers wizardAnswers
+
+		host, err := p.ask("Host", fallbacks["host"])
+		if err != nil {
+			return answers, err
+		}
+		port, err := p.ask("Port", fallbacks["port"])
+		if err != nil {
+			return answers, err
+		}
+		user, err := p.ask("User", fallbacks["user"])
+		if err != nil {
+			return answers, err
+		}
+		answers.password = password
+		if answers.password == "" {
+			answers.password, err = p.secret("Password (empty for none or ~/.pgpass)")
+			if err != nil {
+				return answers, err
+			}
+		}
+		database, err := p.ask("Database", cmp.Or(fallbacks["database"], user))
+		if err != nil {
+			return answers, err
+		}
+
+		fallbacks = map[string]string{"host": host, "port": port, "user": user, "database": database}
+
+		u := url.URL{Scheme: "postgres", User: url.User(user), Host: net.JoinHostPort(host, port), Path: "/" + database}
+		answers.connectionURL = u.String()
+
+		if _, err := normalizeConnectionURL(answers.connectionURL); err != nil {
+			fmt.Fprintln(p.out, display("❌ "+err.Error()))
+			continue
+		}
+
+		// The connection is tried with the password, which the printed URL
+		// leaves out.
+		if answers.password != "" {
+			u.User = url.UserPassword(user, answers.password)
+		}
+
+		connectCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		conn, err := pgx.Connect(connectCtx, u.String())
+		cancel()
+		if err == nil {
+			conn.Close(ctx)
+			fmt.Fprintln(p.out, display("✅ Connected"))
+			return answers, nil
+		}
+
+		fmt.Fprintln(p.out, display("❌ Failed to connect: "+err.Error()))
+		retry, err := p.confirm("Change the connection details?", true)
+		if err != nil {
+			return answers, err
+		}
+		if !retry {
+			return answers, nil
+		}
+	}
+}
+
+func askImage(p *prompter, answers *wizardAnswers) error {
+	var err error
+
+	answers.format, err = p.choose("Dump format; custom restores in parallel", []string{"plain", "custom"}, "plain")
+	if err != nil {
+		return err
+	}
+
+	if answers.format == "custom" {
+		answers.restoreJobs, err = p.ask("Parallel restore jobs (empty for one per CPU)", "")
+		if err != nil {
+			return err
+		}
+	}
+
+	keepDump, err := p.confirm("Keep the dump in the image, for extract and diff?", true)
+	if err != nil {
+		return err
+	}
+	answers.noDump = !keepDump
+
+	answers.vacuum, err = p.confirm("VACUUM the restored database? (slower build, faster first queries)", false)
+	if err != nil {
+		return err
+	}
+
+	if !answers.vacuum {
+		analyze, err := p.confirm("ANALYZE the restored database?", true)
+		if err != nil {
+			return err
+		}
+		answers.noAnalyze = !analyze
+	}
+
+	for {
+		answers.timezone, err = p.ask("Time zone of the image, e.g. Europe/Berlin (empty to keep the default)", "")
+		if err != nil {
+			return err
+		}
+		if err := validateTimezone(answers.timezone); err != nil {
+			fmt.Fprintln(p.out, display("❌ "+err.Error()))
+			continue
+		}
+		return nil
+	}
+}
+
+func askContainer(p *prompter, answers *wizardAnswers) error {
+	var err error
+
+	answers.container, err = p.confirm("Create a container from the image?", true)
+	if err != nil || !answers.container {
+		return err
+	}
+
+	answers.start, err = p.confirm("Start it?", true)
+	if err != nil {
+		return err
+	}
+
+	answers.name, err = p.ask("Container name (empty for postgres-<database>-<timestamp>)", "")
+	if err != nil {
+		return err
+	}
+
+	if answers.name != "" {
+		answers.replace, err = p.confirm("Replace a container with the same name?", false)
+		if err != nil {
+			return err
+		}
+	}
+
+	answers.port, err = p.ask("Host port (empty for a free one)", "")
+	return err
+}
+
+// shellCommand renders args as a POSIX shell command line.
+func shellCommand(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = shellQuote(arg)
+	}
+	return strings.Join(quoted, " ")
+}
+
+func shellQuote(value string) string {
+	if value != "" && strings.Trim(value, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_./:=@,+") == "" {
+		return value
+	}
+	return "'" + strings.ReplaceAll(value, "'", `'\''`) + "'"
+}